@@ -13,6 +13,11 @@ type Connection interface {
 	Unsubscribe(channel string)
 	SubCount() int
 	GetChannels() []string
+	// sharded pub/sub
+	SSubscribe(channel string)
+	SUnsubscribe(channel string)
+	SSubCount() int
+	GetShardChannels() []string
 
 	// transaction
 
@@ -27,4 +32,14 @@ type Connection interface {
 
 	AddTxError(err error)
 	GetTxErrors() []error
+
+	// cluster
+	SetAsking(bool)
+	IsAsking() bool
+	SetReadOnly(bool)
+	IsReadOnly() bool
+	SetClusterPeer(bool)
+	IsClusterPeer() bool
+	SetClusterChallenge(string)
+	GetClusterChallenge() string
 }
@@ -10,5 +10,12 @@ import (
 type Engine interface {
 	Exec(c Connection, redisCommand [][]byte) (result protocol.Reply)
 	ForEach(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool)
+	// 客户端连接关闭（清理连接相关的状态，例如：从节点）
+	AfterClientClose(c Connection)
 	Close()
 }
+
+// 加载快照数据（数据直接保存到数据库中，不经过命令执行）
+type EntityLoader interface {
+	LoadEntity(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error
+}
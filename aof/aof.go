@@ -1,8 +1,10 @@
 package aof
 
 import (
-	"io"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -10,10 +12,12 @@ import (
 	"time"
 
 	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/engine/payload"
 	"github.com/gofish2020/easyredis/redis/connection"
-	"github.com/gofish2020/easyredis/redis/parser"
 	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
 	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
 )
 
 /*
@@ -41,19 +45,34 @@ type aofRecord struct {
 }
 
 type AOF struct {
-	// aof 文件句柄
+	// aof 文件句柄（当前的增量文件）
 	aofFile *os.File
-	// aof 文件路径
+	// aof 文件路径（当前的增量文件）
 	aofFileName string
+	// aof 目录
+	aofDir string
+	// aof 文件名前缀，例如：appendonly.aof
+	baseFileName string
+	// 清单（记录目录中有效的aof文件）
+	manifest *aofManifest
 	// 刷盘间隔
 	aofFsync string
 	// 最后写入aof日志的数据库索引
 	lastDBIndex int
+	// 最后写入的时间戳注释（秒）
+	lastTimestamp int64
 	// 保存aof记录通道
 	aofChan chan aofRecord
 	// 互斥锁
 	mu sync.Mutex
 
+	// 保存的命令个数 / 写入文件的命令个数（mu保护）/ 刷盘的命令个数（WAITAOF）
+	offset        atomic.Int64
+	writtenOffset int64
+	fsyncedOffset atomic.Int64
+	// 刷盘后关闭，通知等待刷盘的客户端（mu保护）
+	fsyncNotify chan struct{}
+
 	// aofChan读取完毕
 	aofFinished chan struct{}
 	// 关闭定时刷盘
@@ -62,12 +81,33 @@ type AOF struct {
 	atomicClose atomic.Bool
 	// 引擎 *Engine
 	engine abstract.Engine
+
+	// 创建临时内存对象（重写时使用）
+	newTmpEngine func() abstract.Engine
+	// 重写中（同一时间只允许一个重写）
+	rewriting atomic.Bool
+	// aof文件大小（基础文件 + 增量文件）
+	currentSize atomic.Int64
+	// 上次重写（or 启动）后的aof文件大小
+	baseSize atomic.Int64
+	// 自动重写的条件（auto-aof-rewrite-percentage / auto-aof-rewrite-min-size）
+	rewritePercentage atomic.Int64
+	rewriteMinSize    atomic.Int64
+
+	// 重写统计信息
+	statsMu             sync.Mutex
+	rewriteStartTime    time.Time
+	lastRewriteDuration time.Duration
+	lastRewriteErr      error
+	rewriteCount        int64
 }
 
-// 构建AOF对象
-func NewAOF(aofFileName string, engine abstract.Engine, load bool, fsync string) (*AOF, error) {
+// 构建AOF对象 aofDir：aof目录 fileName：aof文件名前缀 tmpEngine：创建重写时使用的临时内存对象
+func NewAOF(aofDir string, fileName string, engine abstract.Engine, load bool, fsync string, tmpEngine func() abstract.Engine) (*AOF, error) {
 	aof := &AOF{}
-	aof.aofFileName = aofFileName
+	aof.newTmpEngine = tmpEngine
+	aof.aofDir = aofDir
+	aof.baseFileName = fileName
 	aof.aofFsync = strings.ToLower(fsync)
 	aof.lastDBIndex = 0
 	aof.aofChan = make(chan aofRecord, aofChanSize)
@@ -75,28 +115,122 @@ func NewAOF(aofFileName string, engine abstract.Engine, load bool, fsync string)
 	aof.aofFinished = make(chan struct{})
 	aof.engine = engine
 	aof.atomicClose.Store(false)
+	aof.rewritePercentage.Store(int64(conf.GlobalConfig.AutoAofRewritePercentage))
+	if minSize, err := conf.ParseSize(conf.GlobalConfig.AutoAofRewriteMinSize); err == nil {
+		aof.rewriteMinSize.Store(minSize)
+	}
+
+	if err := utils.MakeDir(aof.aofDir); err != nil {
+		return nil, err
+	}
+
+	// 读取清单文件
+	manifest, err := aof.loadOrUpgradeManifest()
+	if err != nil {
+		return nil, err
+	}
+	aof.manifest = manifest
+	// 清理上次重写遗留的文件
+	aof.cleanTempFiles()
+	aof.cleanHistory()
 
 	// 启动加载aof文件
 	if load {
-		aof.LoadAof(0)
+		if err := aof.LoadAof(); err != nil {
+			return nil, err
+		}
 	}
 
-	// 打开文件(追加写/创建/读写)
-	aofFile, err := os.OpenFile(aof.aofFileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
+	// 没有增量文件，创建一个新的
+	if len(aof.manifest.incrAofList) == 0 {
+		aof.manifest.currIncrFileSeq++
+		aof.manifest.incrAofList = append(aof.manifest.incrAofList, &aofInfo{
+			fileName: incrName(aof.baseFileName, aof.manifest.currIncrFileSeq),
+			fileSeq:  aof.manifest.currIncrFileSeq,
+			fileType: incrFileType,
+		})
+		if err := persistManifest(aof.aofDir, aof.baseFileName, aof.manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	// 打开最后一个增量文件(追加写/创建/读写)
+	lastIncr := aof.manifest.incrAofList[len(aof.manifest.incrAofList)-1]
+	if err := aof.openIncrFile(lastIncr.fileName); err != nil {
 		return nil, err
 	}
-	aof.aofFile = aofFile
+
+	// 记录文件大小（自动重写的基准）
+	aof.currentSize.Store(aof.filesSize())
+	aof.baseSize.Store(aof.currentSize.Load())
 
 	// 启动协程：每秒刷盘
 	if aof.aofFsync == FsyncEverySec {
 		aof.fsyncEverySec()
 	}
+	// 启动协程：检测是否需要自动重写
+	aof.autoRewriteCron()
 	// 启动协程：检测aofChan
 	go aof.watchChan()
 	return aof, nil
 }
 
+// 读取清单文件；如果清单不存在，但是存在老版本的单个aof文件，将其作为基础文件迁移到aof目录中
+func (aof *AOF) loadOrUpgradeManifest() (*aofManifest, error) {
+	manifest, err := loadManifest(filepath.Join(aof.aofDir, manifestName(aof.baseFileName)))
+	if err == nil {
+		return manifest, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	manifest = &aofManifest{}
+	oldFileName := filepath.Join(filepath.Dir(aof.aofDir), aof.baseFileName)
+	if utils.FileExists(oldFileName) {
+		logger.Infof("upgrade aof file %s to aof dir %s", oldFileName, aof.aofDir)
+		if err := os.Rename(oldFileName, filepath.Join(aof.aofDir, aof.baseFileName)); err != nil {
+			return nil, err
+		}
+		manifest.baseAof = &aofInfo{
+			fileName: aof.baseFileName,
+			fileSeq:  1,
+			fileType: baseFileType,
+		}
+		manifest.currBaseFileSeq = 1
+		if err := persistManifest(aof.aofDir, aof.baseFileName, manifest); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// 删除重写失败遗留的临时文件
+func (aof *AOF) cleanTempFiles() {
+	tempFiles, err := filepath.Glob(filepath.Join(aof.aofDir, tempFilePrefix+"rewriteaof-*"))
+	if err != nil {
+		return
+	}
+	for _, name := range tempFiles {
+		os.Remove(name)
+	}
+}
+
+// 打开增量文件，作为当前的写入文件
+func (aof *AOF) openIncrFile(fileName string) error {
+	aofFileName := filepath.Join(aof.aofDir, fileName)
+	aofFile, err := os.OpenFile(aofFileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	aof.aofFile = aofFile
+	aof.aofFileName = aofFileName
+	// 每个文件都是独立加载的（从0号数据库开始），新文件的第一条命令前，需要写入select
+	aof.lastDBIndex = -1
+	aof.lastTimestamp = 0
+	return nil
+}
+
 func (aof *AOF) watchChan() {
 
 	for record := range aof.aofChan {
@@ -111,6 +245,7 @@ func (aof *AOF) SaveRedisCommand(dbIndex int, command Command) {
 	if aof.atomicClose.Load() {
 		return
 	}
+	aof.offset.Add(1)
 	// 写入文件 & 刷盘
 	if aof.aofFsync == FsyncAlways {
 		record := aofRecord{
@@ -131,6 +266,21 @@ func (aof *AOF) writeAofRecord(record aofRecord) {
 
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
+	// 持有锁期间不会刷盘，无论写入是否成功，都表示该命令已经处理
+	aof.writtenOffset++
+
+	// 时间戳注释（每秒最多一条），用于按时间点恢复
+	if conf.GlobalConfig.AofTimestampEnabled {
+		if now := time.Now().Unix(); now > aof.lastTimestamp {
+			n, err := aof.aofFile.Write(timestampAnnotation(now))
+			aof.currentSize.Add(int64(n))
+			if err != nil {
+				logger.Warn(err)
+				return
+			}
+			aof.lastTimestamp = now
+		}
+	}
 
 	// 因为aof对象是所有数据库对象【复用】写入文件方法，每个数据库的索引不同
 	// 所以，每个命令的执行，有个前提就是操作的不同的数据库
@@ -138,7 +288,8 @@ func (aof *AOF) writeAofRecord(record aofRecord) {
 		// 构建select index 命令 & 写入文件
 		selectCommand := [][]byte{[]byte("select"), []byte(strconv.Itoa(record.dbIndex))}
 		data := protocol.NewMultiBulkReply(selectCommand).ToBytes()
-		_, err := aof.aofFile.Write(data)
+		n, err := aof.aofFile.Write(data)
+		aof.currentSize.Add(int64(n))
 		if err != nil {
 			logger.Warn(err)
 			return
@@ -148,21 +299,22 @@ func (aof *AOF) writeAofRecord(record aofRecord) {
 
 	// redis命令
 	data := protocol.NewMultiBulkReply(record.command).ToBytes()
-	_, err := aof.aofFile.Write(data)
+	n, err := aof.aofFile.Write(data)
+	aof.currentSize.Add(int64(n))
 	if err != nil {
 		logger.Warn(err)
 	}
 	logger.Debugf("write aof command:%q", data)
 	// 每次写入刷盘
 	if aof.aofFsync == FsyncAlways {
-		aof.aofFile.Sync()
+		aof.syncLocked()
 	}
 }
 
 func (aof *AOF) Fsync() {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
-	if err := aof.aofFile.Sync(); err != nil {
+	if err := aof.syncLocked(); err != nil {
 		logger.Errorf("aof sync err:%+v", err)
 	}
 }
@@ -182,8 +334,48 @@ func (aof *AOF) fsyncEverySec() {
 	}()
 }
 
-// 加载aof文件,maxBytes限定读取的字节数
-func (aof *AOF) LoadAof(maxBytes int) {
+// 计算aof文件的总大小（基础文件 + 增量文件）
+func (aof *AOF) filesSize() int64 {
+	var size int64
+	for _, info := range aof.manifest.loadList() {
+		fileInfo, err := os.Stat(filepath.Join(aof.aofDir, info.fileName))
+		if err == nil {
+			size += fileInfo.Size()
+		}
+	}
+	return size
+}
+
+// 按照清单，依次加载基础文件和增量文件
+func (aof *AOF) LoadAof() error {
+	loadList := aof.manifest.loadList()
+	for i, info := range loadList {
+		result, err := aof.loadFile(filepath.Join(aof.aofDir, info.fileName))
+		if err != nil {
+			// 清单中的文件不存在 or 无法读取，继续启动会丢失数据
+			return fmt.Errorf("load aof file %s err: %w", info.fileName, err)
+		}
+		if result.Err == nil {
+			continue
+		}
+
+		// 最后一个文件的尾部不完整（一般是写入过程中进程崩溃），丢弃不完整的命令，继续启动
+		if i == len(loadList)-1 && result.Truncated() && conf.GlobalConfig.AofLoadTruncated {
+			logger.Warnf("!!! Warning: short read while loading the AOF file %s !!!, AOF loaded anyway because aof-load-truncated is enabled, truncate %d bytes to %d",
+				result.FileName, result.FileSize, result.ValidSize)
+			if err := TruncateFile(result); err != nil {
+				return err
+			}
+			continue
+		}
+		return fmt.Errorf("load aof file %s err: %w, first bad command at offset %d, use 'easyredis check-aof --fix %s' to repair",
+			result.FileName, result.Err, result.ValidSize, result.FileName)
+	}
+	return nil
+}
+
+// 加载单个aof文件
+func (aof *AOF) loadFile(fileName string) (*CheckResult, error) {
 
 	// 目的：当加载aof文件的时候，因为需要复用engine对象，内部重放命令的时候会自动写aof日志，加载aof 禁用 SaveRedisCommand的写入
 	aof.atomicClose.Store(true)
@@ -191,62 +383,41 @@ func (aof *AOF) LoadAof(maxBytes int) {
 		aof.atomicClose.Store(false)
 	}()
 
-	// 只读打开文件
-	file, err := os.Open(aof.aofFileName)
-	if err != nil {
-		logger.Error(err.Error())
-		return
-	}
-	defer file.Close()
-	file.Seek(0, io.SeekStart)
-
-	var reader io.Reader
-	if maxBytes > 0 { // 限定读取的字节大小
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else { // 不限定，直接读取到文件结尾（为止）
-		reader = file
-	}
-
-	// 文件中保存的格式和网络传输的格式一致
-	ch := parser.ParseStream(reader)
+	// 每个文件都是从0号数据库开始
+	aof.lastDBIndex = 0
 	virtualConn := connection.NewVirtualConn()
 
-	for payload := range ch {
-		if payload.Err != nil {
-			// 文件已经读取到“完成“
-			if payload.Err == io.EOF {
-				break
-			}
-			// 读取到非法的格式
-			logger.Errorf("LoadAof parser error %+v:", payload.Err)
-			continue
-		}
-
-		if payload.Reply == nil {
-			logger.Error("empty payload data")
-			continue
-		}
-		// 从文件中读取到命令
-		reply, ok := payload.Reply.(*protocol.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk protocol")
-			continue
-		}
-
+	// 文件中保存的格式和网络传输的格式一致
+	return scanFile(fileName, func(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error {
+		return aof.loadEntity(dbIndex, key, entity, expiration)
+	}, func(cmd Command) {
 		// 利用数据库引擎，将命令数据保存到内存中（命令重放）
-		ret := aof.engine.Exec(virtualConn, reply.RedisCommand)
+		ret := aof.engine.Exec(virtualConn, cmd)
 		// 判断是否执行失败
 		if protocol.IsErrReply(ret) {
 			logger.Error("exec err ", string(ret.ToBytes()))
 		}
 		// 判断命令是否是"select"
-		if strings.ToLower(string(reply.RedisCommand[0])) == "select" {
-			dbIndex, err := strconv.Atoi(string(reply.RedisCommand[1]))
+		if strings.ToLower(string(cmd[0])) == "select" && len(cmd) > 1 {
+			dbIndex, err := strconv.Atoi(string(cmd[1]))
 			if err == nil {
 				aof.lastDBIndex = dbIndex // 记录下数据恢复过程中，选中的数据库索引
 			}
 		}
+	}, nil)
+}
+
+// 将快照中的一条数据，直接保存到内存中
+func (aof *AOF) loadEntity(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error {
+	// 已过期的数据，不用加载
+	if expiration != nil && expiration.Before(time.Now()) {
+		return nil
+	}
+	loader, ok := aof.engine.(abstract.EntityLoader)
+	if !ok {
+		return errors.New("engine can't load rdb preamble")
 	}
+	return loader.LoadEntity(dbIndex, key, entity, expiration)
 }
 
 func (aof *AOF) Close() {
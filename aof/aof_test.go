@@ -0,0 +1,339 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+)
+
+// 只支持字符串的内存对象（select / set / get）
+type memEngine struct {
+	mu   sync.Mutex
+	dbs  map[int]map[string][]byte
+	sets int // 执行set命令的次数
+}
+
+func newMemEngine() *memEngine {
+	return &memEngine{dbs: make(map[int]map[string][]byte)}
+}
+
+func (e *memEngine) Exec(c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch strings.ToLower(string(redisCommand[0])) {
+	case "select":
+		index, _ := strconv.Atoi(string(redisCommand[1]))
+		c.SetDBIndex(index)
+	case "set":
+		e.sets++
+		e.put(c.GetDBIndex(), string(redisCommand[1]), redisCommand[2])
+	case "get":
+		if val, ok := e.dbs[c.GetDBIndex()][string(redisCommand[1])]; ok {
+			return protocol.NewBulkReply(val)
+		}
+		return protocol.NewNullBulkReply()
+	}
+	return protocol.NewOkReply()
+}
+
+func (e *memEngine) put(dbIndex int, key string, val []byte) {
+	db := e.dbs[dbIndex]
+	if db == nil {
+		db = make(map[string][]byte)
+		e.dbs[dbIndex] = db
+	}
+	db[key] = val
+}
+
+func (e *memEngine) LoadEntity(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.put(dbIndex, key, entity.RedisObject.([]byte))
+	return nil
+}
+
+func (e *memEngine) ForEach(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool) {
+	e.mu.Lock()
+	db := e.dbs[dbIndex]
+	keys := make([]string, 0, len(db))
+	for key := range db {
+		keys = append(keys, key)
+	}
+	e.mu.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		e.mu.Lock()
+		val := db[key]
+		e.mu.Unlock()
+		if !cb(key, &payload.DataEntity{RedisObject: val}, nil) {
+			return
+		}
+	}
+}
+
+func (e *memEngine) AfterClientClose(c abstract.Connection) {}
+
+func (e *memEngine) Close() {}
+
+func (e *memEngine) get(dbIndex int, key string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return string(e.dbs[dbIndex][key])
+}
+
+func setCommand(key, value string) Command {
+	return [][]byte{[]byte("set"), []byte(key), []byte(value)}
+}
+
+// 目录中的文件（不包括子目录）
+func dirFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	m := &aofManifest{
+		baseAof:         &aofInfo{fileName: baseName("appendonly.aof", 2, true), fileSeq: 2, fileType: baseFileType},
+		historyAofList:  []*aofInfo{{fileName: incrName("appendonly.aof", 1), fileSeq: 1, fileType: historyFileType}},
+		incrAofList:     []*aofInfo{{fileName: incrName("appendonly.aof", 2), fileSeq: 2, fileType: incrFileType}, {fileName: incrName("appendonly.aof", 3), fileSeq: 3, fileType: incrFileType}},
+		currBaseFileSeq: 2,
+		currIncrFileSeq: 3,
+	}
+	if err := persistManifest(dir, "appendonly.aof", m); err != nil {
+		t.Fatal(err)
+	}
+	// 临时文件已经重命名
+	if files := dirFiles(t, dir); len(files) != 1 || files[0] != "appendonly.aof.manifest" {
+		t.Fatalf("unexpected files %v", files)
+	}
+	loaded, err := loadManifest(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.String() != m.String() || loaded.currBaseFileSeq != 2 || loaded.currIncrFileSeq != 3 {
+		t.Fatalf("unexpected manifest %q", loaded.String())
+	}
+	expected := "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type h\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n" +
+		"file appendonly.aof.3.incr.aof seq 3 type i\n"
+	if m.String() != expected {
+		t.Fatalf("unexpected manifest %q", m.String())
+	}
+	if list := loaded.loadList(); len(list) != 3 || list[0].fileName != "appendonly.aof.2.base.rdb" || list[2].fileName != "appendonly.aof.3.incr.aof" {
+		t.Fatalf("unexpected load list %v", list)
+	}
+
+	// 注释和空行忽略
+	path := filepath.Join(dir, "test.manifest")
+	os.WriteFile(path, []byte("# comment\n\nfile appendonly.aof.1.incr.aof seq 1 type i\n"), 0600)
+	if loaded, err := loadManifest(path); err != nil || len(loaded.incrAofList) != 1 || loaded.baseAof != nil {
+		t.Fatalf("unexpected manifest %v %v", loaded, err)
+	}
+
+	// 格式错误
+	for _, content := range []string{
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq 2 type i\nfile b seq 1 type i\n",
+		"file a seq 1 type x\n",
+		"file a seq 1 type\n",
+		"seq 1 type i\n",
+		"file a seq x type i\n",
+	} {
+		os.WriteFile(path, []byte(content), 0600)
+		if _, err := loadManifest(path); err == nil {
+			t.Fatalf("manifest %q should be invalid", content)
+		}
+	}
+	if _, err := loadManifest(filepath.Join(dir, "missing.manifest")); !os.IsNotExist(err) {
+		t.Fatalf("expect not exist, got %v", err)
+	}
+}
+
+func TestUpgradeManifest(t *testing.T) {
+	// 老版本：单个aof文件
+	parent := t.TempDir()
+	var data []byte
+	data = append(data, protocol.NewMultiBulkReply(setCommand("a", "1")).ToBytes()...)
+	data = append(data, protocol.NewMultiBulkReply(SelectCmd([]byte("1"))).ToBytes()...)
+	data = append(data, protocol.NewMultiBulkReply(setCommand("b", "2")).ToBytes()...)
+	os.WriteFile(filepath.Join(parent, "appendonly.aof"), data, 0600)
+
+	dir := filepath.Join(parent, "appendonlydir")
+	engine := newMemEngine()
+	aof, err := NewAOF(dir, "appendonly.aof", engine, true, FsyncAlways, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.SaveRedisCommand(0, setCommand("c", "3"))
+	aof.Close()
+
+	// 老文件迁移到aof目录中作为基础文件，新命令写入增量文件
+	if _, err := os.Stat(filepath.Join(parent, "appendonly.aof")); !os.IsNotExist(err) {
+		t.Fatal("old aof file should be moved")
+	}
+	if engine.get(0, "a") != "1" || engine.get(1, "b") != "2" {
+		t.Fatal("old aof file should be loaded")
+	}
+	manifest, err := loadManifest(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "file appendonly.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n"; manifest.String() != expected {
+		t.Fatalf("unexpected manifest %q", manifest.String())
+	}
+
+	// 重新启动，从aof目录中加载
+	engine = newMemEngine()
+	aof, err = NewAOF(dir, "appendonly.aof", engine, true, FsyncAlways, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.Close()
+	if engine.get(0, "a") != "1" || engine.get(1, "b") != "2" || engine.get(0, "c") != "3" {
+		t.Fatal("aof dir should be loaded")
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	defer func(preamble bool) { conf.GlobalConfig.AofUseRdbPreamble = preamble }(conf.GlobalConfig.AofUseRdbPreamble)
+	for _, preamble := range []bool{false, true} {
+		conf.GlobalConfig.AofUseRdbPreamble = preamble
+		dir := t.TempDir()
+		aof, err := NewAOF(dir, "appendonly.aof", newMemEngine(), false, FsyncAlways, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			aof.SaveRedisCommand(i%2, setCommand("key"+strconv.Itoa(i), "old"))
+		}
+		aof.SaveRedisCommand(0, setCommand("key0", "new"))
+
+		// 重写：旧的增量文件生成新的基础文件，重写开始后的命令写入新的增量文件
+		if err := aof.rewrite(newMemEngine()); err != nil {
+			t.Fatal(err)
+		}
+		aof.SaveRedisCommand(1, setCommand("key1", "new"))
+		stats := aof.Stats()
+		aof.Close()
+
+		base := baseName("appendonly.aof", 1, preamble)
+		expected := "file " + base + " seq 1 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n"
+		if aof.manifest.String() != expected {
+			t.Fatalf("preamble %v: unexpected manifest %q", preamble, aof.manifest.String())
+		}
+		if stats.CurrentBaseFileSeq != 1 || stats.CurrentIncrFileSeq != 2 {
+			t.Fatalf("preamble %v: unexpected stats %+v", preamble, stats)
+		}
+		// 被重写的增量文件、临时文件已经删除
+		files := dirFiles(t, dir)
+		sort.Strings(files)
+		expectedFiles := []string{base, "appendonly.aof.2.incr.aof", "appendonly.aof.manifest"}
+		sort.Strings(expectedFiles)
+		if strings.Join(files, " ") != strings.Join(expectedFiles, " ") {
+			t.Fatalf("preamble %v: unexpected files %v", preamble, files)
+		}
+
+		// 从基础文件 + 增量文件加载
+		engine := newMemEngine()
+		aof, err = NewAOF(dir, "appendonly.aof", engine, true, FsyncAlways, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aof.Close()
+		// 混合持久化：快照中的数据直接保存到内存中，只有增量文件中的命令需要执行
+		if sets := engine.sets; (preamble && sets != 1) || (!preamble && sets != 11) {
+			t.Fatalf("preamble %v: unexpected set commands %d", preamble, sets)
+		}
+		for i := 0; i < 10; i++ {
+			value := "old"
+			if i < 2 {
+				value = "new"
+			}
+			if got := engine.get(i%2, "key"+strconv.Itoa(i)); got != value {
+				t.Fatalf("preamble %v: key%d expect %s, got %q", preamble, i, value, got)
+			}
+		}
+	}
+}
+
+// 重写遗留的临时文件、历史文件在启动时删除
+func TestCleanRewriteLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAOF(dir, "appendonly.aof", newMemEngine(), false, FsyncAlways, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.SaveRedisCommand(0, setCommand("a", "1"))
+	aof.Close()
+
+	os.WriteFile(filepath.Join(dir, tempFilePrefix+"rewriteaof-1.aof"), []byte("garbage"), 0600)
+	os.WriteFile(filepath.Join(dir, "appendonly.aof.0.incr.aof"), []byte("garbage"), 0600)
+	manifest := aof.manifest.copy()
+	manifest.historyAofList = []*aofInfo{{fileName: "appendonly.aof.0.incr.aof", fileSeq: 0, fileType: historyFileType}}
+	if err := persistManifest(dir, "appendonly.aof", manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := newMemEngine()
+	aof, err = NewAOF(dir, "appendonly.aof", engine, true, FsyncAlways, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.Close()
+	files := dirFiles(t, dir)
+	sort.Strings(files)
+	if strings.Join(files, " ") != "appendonly.aof.1.incr.aof appendonly.aof.manifest" {
+		t.Fatalf("unexpected files %v", files)
+	}
+	if engine.get(0, "a") != "1" {
+		t.Fatal("aof should be loaded")
+	}
+}
+
+// 清单中的文件不存在 or 无法读取，启动失败
+func TestLoadMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAOF(dir, "appendonly.aof", newMemEngine(), false, FsyncAlways, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.SaveRedisCommand(0, setCommand("a", "1"))
+	aof.Close()
+
+	manifest := aof.manifest.copy()
+	manifest.baseAof = &aofInfo{fileName: baseName("appendonly.aof", 1, false), fileSeq: 1, fileType: baseFileType}
+	if err := persistManifest(dir, "appendonly.aof", manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAOF(dir, "appendonly.aof", newMemEngine(), true, FsyncAlways, nil); err == nil || !strings.Contains(err.Error(), "appendonly.aof.1.base.aof") {
+		t.Fatalf("missing base file should fail loading, got %v", err)
+	}
+
+	// 文件无法读取（目录）
+	os.Mkdir(filepath.Join(dir, baseName("appendonly.aof", 1, false)), 0700)
+	if _, err := NewAOF(dir, "appendonly.aof", newMemEngine(), true, FsyncAlways, nil); err == nil {
+		t.Fatal("unreadable base file should fail loading")
+	}
+}
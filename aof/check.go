@@ -0,0 +1,150 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/rdb"
+)
+
+/*
+aof文件检测：
+1. 文件完整：所有命令都能正常解析
+2. 尾部不完整（ErrAofTruncated）：可以截断到最后一条完整的命令
+3. 格式错误（*FormatError）：同样可以截断，但是错误位置之后的命令都会丢失
+4. 二进制快照错误：无法修复
+*/
+
+// 检测结果
+type CheckResult struct {
+	FileName string
+	// 文件大小
+	FileSize int64
+	// 最后一条完整命令的结尾位置（也就是第一条错误命令的开始位置）
+	ValidSize int64
+	// 文件头部为二进制快照
+	Preamble bool
+	// 完整命令的个数
+	Commands int
+	// 遇到注释后停止读取（按时间戳截断）
+	Stopped bool
+	// nil 表示文件完整
+	Err error
+}
+
+// 尾部的命令不完整
+func (r *CheckResult) Truncated() bool {
+	return errors.Is(r.Err, ErrAofTruncated)
+}
+
+// 能否通过截断文件修复（快照部分的错误无法修复）
+func (r *CheckResult) Fixable() bool {
+	var formatErr *FormatError
+	return r.Truncated() || errors.As(r.Err, &formatErr)
+}
+
+// 解析aof文件，快照中的每条数据调用onEntity，每条完整的命令调用onCommand，每行注释调用onAnnotation（返回false停止读取）
+func scanFile(fileName string, onEntity rdb.EntryFunc, onCommand func(cmd Command), onAnnotation func(annotation string) bool) (*CheckResult, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result := &CheckResult{
+		FileName: fileName,
+		FileSize: stat.Size(),
+	}
+
+	counter := &countReader{r: file}
+	bufReader := bufio.NewReader(counter)
+
+	// 混合持久化：文件头部为二进制快照，后面紧跟增量的aof命令
+	if rdb.HasPreamble(bufReader) {
+		result.Preamble = true
+		if err := rdb.NewDecoder(bufReader).Load(onEntity); err != nil {
+			result.Err = fmt.Errorf("rdb preamble: %w", err)
+			return result, nil
+		}
+		// 快照的长度 = 底层读取的字节数 - 缓冲中未使用的字节数
+		result.ValidSize = counter.n - int64(bufReader.Buffered())
+	}
+
+	reader := newCmdReader(bufReader, result.ValidSize)
+	for {
+		cmd, annotation, err := reader.ReadRecord()
+		if err != nil {
+			if err != io.EOF {
+				result.Err = err
+			}
+			break
+		}
+		if cmd == nil {
+			// 停止读取时，ValidSize 为注释的开始位置
+			if onAnnotation != nil && !onAnnotation(annotation) {
+				result.Stopped = true
+				break
+			}
+			result.ValidSize = reader.offset
+			continue
+		}
+		result.ValidSize = reader.offset
+		result.Commands++
+		if onCommand != nil {
+			onCommand(cmd)
+		}
+	}
+	return result, nil
+}
+
+// 检测单个aof文件
+func CheckFile(fileName string) (*CheckResult, error) {
+	return scanFile(fileName, skipEntity, nil, nil)
+}
+
+// 忽略快照中的数据
+func skipEntity(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error {
+	return nil
+}
+
+// 按照清单文件，依次检测基础文件和增量文件
+func CheckManifest(manifestFile string) ([]*CheckResult, error) {
+	manifest, err := loadManifest(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(manifestFile)
+	var results []*CheckResult
+	for _, info := range manifest.loadList() {
+		result, err := CheckFile(filepath.Join(dir, info.fileName))
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// 是否为清单文件
+func IsManifest(fileName string) bool {
+	return strings.HasSuffix(fileName, manifestNameSuffix)
+}
+
+// 将文件截断到最后一条完整的命令
+func TruncateFile(result *CheckResult) error {
+	if !result.Fixable() {
+		return fmt.Errorf("can't fix %s: %v", result.FileName, result.Err)
+	}
+	return os.Truncate(result.FileName, result.ValidSize)
+}
@@ -0,0 +1,87 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/protocol"
+)
+
+func TestCheckFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	valid := protocol.NewMultiBulkReply(SelectCmd([]byte("0"))).ToBytes()
+	valid = append(valid, protocol.NewMultiBulkReply([][]byte{[]byte("set"), []byte("a"), []byte("1")}).ToBytes()...)
+
+	// 完整的文件
+	os.WriteFile(fileName, valid, 0600)
+	result, err := CheckFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Err != nil || result.Commands != 2 || result.ValidSize != int64(len(valid)) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// 尾部不完整
+	os.WriteFile(fileName, append(append([]byte{}, valid...), "*3\r\n$3\r\nset\r\n$1"...), 0600)
+	result, _ = CheckFile(fileName)
+	if !result.Truncated() || result.ValidSize != int64(len(valid)) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if err := TruncateFile(result); err != nil {
+		t.Fatal(err)
+	}
+	result, _ = CheckFile(fileName)
+	if result.Err != nil || result.FileSize != int64(len(valid)) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// 格式错误
+	os.WriteFile(fileName, append(append([]byte{}, valid...), "garbage\r\n"...), 0600)
+	result, _ = CheckFile(fileName)
+	if result.Truncated() || !result.Fixable() || result.ValidSize != int64(len(valid)) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestTruncateToTimestamp(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	var data []byte
+	data = append(data, timestampAnnotation(100)...)
+	data = append(data, protocol.NewMultiBulkReply([][]byte{[]byte("set"), []byte("a"), []byte("1")}).ToBytes()...)
+	validSize := len(data)
+	data = append(data, timestampAnnotation(200)...)
+	data = append(data, protocol.NewMultiBulkReply([][]byte{[]byte("set"), []byte("a"), []byte("2")}).ToBytes()...)
+	os.WriteFile(fileName, data, 0600)
+
+	// 注释不影响检测
+	result, _ := CheckFile(fileName)
+	if result.Err != nil || result.Commands != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	output := filepath.Join(t.TempDir(), "output.aof")
+	tsResult, err := TruncateToTimestamp(fileName, 150, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsResult.CheckResult == nil || tsResult.Timestamp != 200 || tsResult.ValidSize != int64(validSize) {
+		t.Fatalf("unexpected result %+v", tsResult)
+	}
+	outData, _ := os.ReadFile(output)
+	if string(outData) != string(data[:validSize]) {
+		t.Fatalf("unexpected output %q", outData)
+	}
+
+	// 原地截断
+	if _, err := TruncateToTimestamp(fileName, 150, ""); err != nil {
+		t.Fatal(err)
+	}
+	result, _ = CheckFile(fileName)
+	if result.Err != nil || result.Commands != 1 || result.FileSize != int64(validSize) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
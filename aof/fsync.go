@@ -0,0 +1,85 @@
+package aof
+
+import (
+	"time"
+)
+
+/*
+刷盘位置（WAITAOF）：
+
+aof偏移量 = 保存到aof的命令个数
+1. SaveRedisCommand 时 offset + 1
+2. 命令写入文件后 writtenOffset + 1（和保存的顺序一致）
+3. 刷盘成功后 fsyncedOffset = writtenOffset
+
+客户端的写命令执行完成后，读取 Offset()，等待 FsyncedOffset() >= 该位置，即可确认写命令已经刷盘
+*/
+
+// 已经保存到aof的命令个数
+func (aof *AOF) Offset() int64 {
+	return aof.offset.Load()
+}
+
+// 已经刷盘的命令个数
+func (aof *AOF) FsyncedOffset() int64 {
+	return aof.fsyncedOffset.Load()
+}
+
+// 刷盘，并更新刷盘位置（调用方持有aof.mu）
+func (aof *AOF) syncLocked() error {
+	if err := aof.aofFile.Sync(); err != nil {
+		return err
+	}
+	if aof.writtenOffset > aof.fsyncedOffset.Load() {
+		aof.fsyncedOffset.Store(aof.writtenOffset)
+		// 通知等待刷盘的客户端
+		if aof.fsyncNotify != nil {
+			close(aof.fsyncNotify)
+			aof.fsyncNotify = nil
+		}
+	}
+	return nil
+}
+
+// 等待 offset 之前的命令刷盘，超时返回false（deadline为零值表示一直等待）
+func (aof *AOF) WaitFsync(offset int64, deadline time.Time) bool {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		aof.mu.Lock()
+		if aof.fsyncedOffset.Load() >= offset {
+			aof.mu.Unlock()
+			return true
+		}
+		// 不主动刷盘的策略，命令写入文件后，由等待的客户端触发刷盘
+		if aof.aofFsync == FsyncNo && aof.writtenOffset >= offset {
+			err := aof.syncLocked()
+			aof.mu.Unlock()
+			return err == nil
+		}
+		if aof.fsyncNotify == nil {
+			aof.fsyncNotify = make(chan struct{})
+		}
+		notify := aof.fsyncNotify
+		aof.mu.Unlock()
+
+		// FsyncNo：定时检测命令是否已经写入文件
+		var poll <-chan time.Time
+		if aof.aofFsync == FsyncNo {
+			poll = time.After(10 * time.Millisecond)
+		}
+		select {
+		case <-notify:
+		case <-poll:
+		case <-timeout:
+			return aof.fsyncedOffset.Load() >= offset
+		case <-aof.closed:
+			return aof.fsyncedOffset.Load() >= offset
+		}
+	}
+}
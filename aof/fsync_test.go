@@ -0,0 +1,32 @@
+package aof
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitFsync(t *testing.T) {
+	for _, fsync := range []string{FsyncAlways, FsyncEverySec, FsyncNo} {
+		aof, err := NewAOF(t.TempDir(), "appendonly.aof", nil, false, fsync, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer aof.Close()
+		for i := 0; i < 3; i++ {
+			aof.SaveRedisCommand(0, [][]byte{[]byte("set"), []byte("a"), []byte("1")})
+		}
+		if aof.Offset() != 3 {
+			t.Fatalf("%s: expect offset 3, got %d", fsync, aof.Offset())
+		}
+		if !aof.WaitFsync(3, time.Now().Add(3*time.Second)) {
+			t.Fatalf("%s: wait fsync timeout", fsync)
+		}
+		if aof.FsyncedOffset() < 3 {
+			t.Fatalf("%s: expect fsynced offset 3, got %d", fsync, aof.FsyncedOffset())
+		}
+		// 超过当前位置，等待超时
+		if aof.WaitFsync(4, time.Now().Add(50*time.Millisecond)) {
+			t.Fatalf("%s: expect timeout", fsync)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+多文件aof（参考 Redis 7 的 appendonlydir）：
+
+appendonlydir/
+	appendonly.aof.1.base.rdb    基础文件（重写生成，快照 or 命令）
+	appendonly.aof.1.incr.aof    增量文件（重写开始后的新命令）
+	appendonly.aof.2.incr.aof
+	appendonly.aof.manifest      清单文件，记录当前有效的文件
+
+清单文件每行格式：file appendonly.aof.1.incr.aof seq 1 type i
+*/
+
+type aofFileType string
+
+const (
+	baseFileType    aofFileType = "b" // 基础文件
+	historyFileType aofFileType = "h" // 历史文件（重写完成后等待删除）
+	incrFileType    aofFileType = "i" // 增量文件
+)
+
+const (
+	manifestNameSuffix = ".manifest"
+	baseNameSuffix     = ".base"
+	incrNameSuffix     = ".incr"
+	rdbFormatSuffix    = ".rdb"
+	aofFormatSuffix    = ".aof"
+	tempFilePrefix     = "temp-"
+)
+
+type aofInfo struct {
+	fileName string
+	fileSeq  int64
+	fileType aofFileType
+}
+
+func (info *aofInfo) String() string {
+	return fmt.Sprintf("file %s seq %d type %s\n", info.fileName, info.fileSeq, info.fileType)
+}
+
+type aofManifest struct {
+	baseAof         *aofInfo   // 基础文件（可能不存在）
+	incrAofList     []*aofInfo // 增量文件，按照seq从小到大
+	historyAofList  []*aofInfo // 历史文件
+	currBaseFileSeq int64      // 当前基础文件的seq
+	currIncrFileSeq int64      // 当前增量文件的seq
+}
+
+func (m *aofManifest) String() string {
+	var builder strings.Builder
+	if m.baseAof != nil {
+		builder.WriteString(m.baseAof.String())
+	}
+	for _, info := range m.historyAofList {
+		builder.WriteString(info.String())
+	}
+	for _, info := range m.incrAofList {
+		builder.WriteString(info.String())
+	}
+	return builder.String()
+}
+
+// 按照加载顺序，返回所有有效的文件（基础文件 + 增量文件）
+func (m *aofManifest) loadList() []*aofInfo {
+	var result []*aofInfo
+	if m.baseAof != nil {
+		result = append(result, m.baseAof)
+	}
+	return append(result, m.incrAofList...)
+}
+
+func (m *aofManifest) copy() *aofManifest {
+	result := &aofManifest{
+		currBaseFileSeq: m.currBaseFileSeq,
+		currIncrFileSeq: m.currIncrFileSeq,
+	}
+	if m.baseAof != nil {
+		base := *m.baseAof
+		result.baseAof = &base
+	}
+	for _, info := range m.incrAofList {
+		incr := *info
+		result.incrAofList = append(result.incrAofList, &incr)
+	}
+	for _, info := range m.historyAofList {
+		history := *info
+		result.historyAofList = append(result.historyAofList, &history)
+	}
+	return result
+}
+
+func manifestName(fileName string) string {
+	return fileName + manifestNameSuffix
+}
+
+// appendonly.aof.1.base.rdb / appendonly.aof.1.base.aof
+func baseName(fileName string, seq int64, rdbFormat bool) string {
+	suffix := aofFormatSuffix
+	if rdbFormat {
+		suffix = rdbFormatSuffix
+	}
+	return fileName + "." + strconv.FormatInt(seq, 10) + baseNameSuffix + suffix
+}
+
+// appendonly.aof.1.incr.aof
+func incrName(fileName string, seq int64) string {
+	return fileName + "." + strconv.FormatInt(seq, 10) + incrNameSuffix + aofFormatSuffix
+}
+
+// 读取清单文件（文件不存在，返回 os.ErrNotExist）
+func loadManifest(path string) (*aofManifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m := &aofManifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// file xxx seq 1 type b
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid aof manifest line: %s", line)
+		}
+		info := &aofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.fileName = fields[i+1]
+			case "seq":
+				info.fileSeq, err = strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid aof manifest line: %s", line)
+				}
+			case "type":
+				info.fileType = aofFileType(fields[i+1])
+			}
+		}
+		if info.fileName == "" {
+			return nil, fmt.Errorf("invalid aof manifest line: %s", line)
+		}
+
+		switch info.fileType {
+		case baseFileType:
+			if m.baseAof != nil {
+				return nil, errors.New("found duplicate base file information in aof manifest")
+			}
+			m.baseAof = info
+			m.currBaseFileSeq = info.fileSeq
+		case historyFileType:
+			m.historyAofList = append(m.historyAofList, info)
+		case incrFileType:
+			if info.fileSeq <= m.currIncrFileSeq {
+				return nil, errors.New("found a non-monotonic sequence number in aof manifest")
+			}
+			m.incrAofList = append(m.incrAofList, info)
+			m.currIncrFileSeq = info.fileSeq
+		default:
+			return nil, fmt.Errorf("unknown aof file type %s", info.fileType)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 原子的更新清单文件：先写临时文件，刷盘后再重命名
+func persistManifest(dir string, fileName string, m *aofManifest) error {
+	tmpPath := filepath.Join(dir, tempFilePrefix+manifestName(fileName))
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(m.String()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+
+	if err := os.Rename(tmpPath, filepath.Join(dir, manifestName(fileName))); err != nil {
+		return err
+	}
+	return fsyncDir(dir)
+}
+
+// 目录刷盘，保证重命名操作持久化
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,130 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/*
+按照RESP协议，从aof文件中逐条读取命令，同时记录读取的位置（字节偏移）
+
+	*2\r\n$6\r\nselect\r\n$1\r\n0\r\n
+
+以 # 开头的行为注释（例如时间戳注释 #TS:1700000000），命令重放时忽略
+
+和 parser.ParseStream 不同：这里只允许数组格式，并且能够区分【文件尾部不完整】和【格式错误】
+*/
+
+// 文件尾部的命令不完整（一般是进程在写入过程中崩溃）
+var ErrAofTruncated = errors.New("unexpected end of aof file")
+
+const annotationPrefix = '#'
+
+// 格式错误
+type FormatError struct {
+	msg string
+}
+
+func (e *FormatError) Error() string {
+	return "bad aof format: " + e.msg
+}
+
+type cmdReader struct {
+	r *bufio.Reader
+	// 已经读取的字节数
+	offset int64
+}
+
+func newCmdReader(r *bufio.Reader, offset int64) *cmdReader {
+	return &cmdReader{r: r, offset: offset}
+}
+
+// 读取一行（包括 \r\n）；start表示是否为一条命令的开头
+func (cr *cmdReader) readLine(start bool) ([]byte, error) {
+	line, err := cr.r.ReadBytes('\n')
+	cr.offset += int64(len(line))
+	if err != nil {
+		if err == io.EOF {
+			// 命令的开头读取到文件尾，说明文件正常结束
+			if start && len(line) == 0 {
+				return nil, io.EOF
+			}
+			return nil, ErrAofTruncated
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, &FormatError{msg: fmt.Sprintf("line %q missing \\r\\n", line)}
+	}
+	return line[:len(line)-2], nil
+}
+
+// 读取一条完整的命令 or 一行注释（二者只会返回一个），文件正常结束返回 io.EOF
+func (cr *cmdReader) ReadRecord() (Command, string, error) {
+	header, err := cr.readLine(true)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(header) > 0 && header[0] == annotationPrefix {
+		return nil, string(header[1:]), nil
+	}
+	cmd, err := cr.readArray(header)
+	return cmd, "", err
+}
+
+// 解析数组的剩余部分
+func (cr *cmdReader) readArray(header []byte) (Command, error) {
+	if len(header) == 0 || header[0] != '*' {
+		return nil, &FormatError{msg: fmt.Sprintf("expected '*', got %q", header)}
+	}
+	argNum, err := strconv.ParseInt(string(header[1:]), 10, 64)
+	if err != nil || argNum <= 0 {
+		return nil, &FormatError{msg: fmt.Sprintf("illegal array header %q", header)}
+	}
+
+	cmd := make(Command, 0, argNum)
+	for i := int64(0); i < argNum; i++ {
+		line, err := cr.readLine(false)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, &FormatError{msg: fmt.Sprintf("expected '$', got %q", line)}
+		}
+		size, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || size < 0 {
+			return nil, &FormatError{msg: fmt.Sprintf("illegal bulk string header %q", line)}
+		}
+
+		body := make([]byte, size+2)
+		n, err := io.ReadFull(cr.r, body)
+		cr.offset += int64(n)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, ErrAofTruncated
+			}
+			return nil, err
+		}
+		if !bytes.HasSuffix(body, []byte{'\r', '\n'}) {
+			return nil, &FormatError{msg: "bulk string missing \\r\\n"}
+		}
+		cmd = append(cmd, body[:size])
+	}
+	return cmd, nil
+}
+
+// 统计底层reader读取的字节数（用于计算二进制快照的长度）
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
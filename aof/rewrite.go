@@ -1,44 +1,125 @@
 package aof
 
 import (
-	"io"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/gofish2020/easyredis/abstract"
 	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/rdb"
 	"github.com/gofish2020/easyredis/redis/protocol"
 	"github.com/gofish2020/easyredis/tool/conf"
 	"github.com/gofish2020/easyredis/tool/logger"
 )
 
+/*
+重写流程（多文件aof）：
+1. 加锁，打开一个新的增量文件，后续的写命令都写入新文件中（不再需要复制旧文件的尾部数据）
+2. 将旧的文件（基础文件 + 增量文件）加载到临时内存中，生成新的基础文件
+3. 加锁，原子的更新清单文件：新的基础文件 + 重写开始后的增量文件，旧文件标记为历史文件，然后删除
+*/
+
 type snapshotAOF struct {
-	fileSize int64 // 文件大小
-	dbIndex  int   // 数据库索引
-	tempFile *os.File
+	manifest *aofManifest // 重写开始时的清单（需要被重写的文件）
+	tempFile *os.File     // 临时的基础文件
+}
+
+const autoRewriteInterval = 1 * time.Second
+
+var ErrRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+
+// 后台重写aof（如果已经在重写中，返回 ErrRewriteInProgress）
+func (aof *AOF) BackgroundRewrite() error {
+	if !aof.rewriting.CompareAndSwap(false, true) {
+		return ErrRewriteInProgress
+	}
+
+	aof.statsMu.Lock()
+	aof.rewriteStartTime = time.Now()
+	aof.statsMu.Unlock()
+
+	go func() {
+		err := aof.rewrite(aof.newTmpEngine())
+
+		aof.statsMu.Lock()
+		aof.lastRewriteDuration = time.Since(aof.rewriteStartTime)
+		aof.lastRewriteErr = err
+		aof.rewriteCount++
+		aof.statsMu.Unlock()
+
+		aof.rewriting.Store(false)
+	}()
+	return nil
+}
+
+// 定时检测是否需要自动重写
+func (aof *AOF) autoRewriteCron() {
+	ticker := time.NewTicker(autoRewriteInterval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				aof.checkAutoRewrite()
+			case <-aof.closed:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// 文件大小 > auto-aof-rewrite-min-size，并且相比上次重写后的大小增长了 auto-aof-rewrite-percentage，触发重写
+func (aof *AOF) checkAutoRewrite() {
+	percentage := aof.rewritePercentage.Load()
+	if percentage <= 0 || aof.rewriting.Load() {
+		return
+	}
+
+	currentSize := aof.currentSize.Load()
+	if currentSize < aof.rewriteMinSize.Load() {
+		return
+	}
+
+	baseSize := aof.baseSize.Load()
+	if baseSize == 0 {
+		baseSize = 1
+	}
+	growth := (currentSize - baseSize) * 100 / baseSize
+	if growth >= percentage {
+		logger.Infof("starting automatic rewriting of AOF on %d%% growth", growth)
+		if err := aof.BackgroundRewrite(); err != nil {
+			logger.Warn(err)
+		}
+	}
 }
 
-func (aof *AOF) Rewrite(engine abstract.Engine) {
-	//1.对现有的aof文件做一次快照
+func (aof *AOF) rewrite(engine abstract.Engine) error {
+	//1.切换新的增量文件，并记录需要重写的文件
 	snapShot, err := aof.startRewrite()
 	if err != nil {
 		logger.Errorf("StartRewrite err: %+v", err)
-		return
+		return err
 	}
 
-	//2. 将现在的aof文件数据，加在到新（内存）对象中,并重写入新aof文件中
+	//2. 将需要重写的文件数据，加载到新（内存）对象中,并写入新的基础文件中
 	err = aof.doRewrite(snapShot, engine)
 	if err != nil {
+		snapShot.tempFile.Close()
+		os.Remove(snapShot.tempFile.Name())
 		logger.Errorf("doRewrite err: %+v", err)
-		return
+		return err
 	}
 
-	//3. 将重写过程中的增量命令写入到新文件中
+	//3. 更新清单文件，并删除历史文件
 	err = aof.finishRewrite(snapShot)
 	if err != nil {
 		logger.Errorf("finishRewrite err: %+v", err)
 	}
+	return err
 }
 
 func (aof *AOF) startRewrite() (*snapshotAOF, error) {
@@ -48,42 +129,79 @@ func (aof *AOF) startRewrite() (*snapshotAOF, error) {
 	defer aof.mu.Unlock()
 
 	// 文件刷盘
-	err := aof.aofFile.Sync()
+	err := aof.syncLocked()
 	if err != nil {
 		return nil, err
 	}
 
-	// 获取当前文件信息
-	fileInfo, err := aof.aofFile.Stat()
+	// 创建临时的基础文件
+	file, err := os.CreateTemp(aof.aofDir, tempFilePrefix+"rewriteaof-*"+aofFormatSuffix)
 	if err != nil {
 		return nil, err
 	}
 
-	// 创建新的aof文件
-	file, err := os.CreateTemp(conf.TmpDir(), "*.aof")
-	if err != nil {
+	// 需要重写的文件
+	snapShot := &snapshotAOF{
+		manifest: aof.manifest.copy(),
+		tempFile: file,
+	}
+
+	// 新的增量文件
+	newManifest := aof.manifest.copy()
+	newManifest.currIncrFileSeq++
+	newIncr := &aofInfo{
+		fileName: incrName(aof.baseFileName, newManifest.currIncrFileSeq),
+		fileSeq:  newManifest.currIncrFileSeq,
+		fileType: incrFileType,
+	}
+	newManifest.incrAofList = append(newManifest.incrAofList, newIncr)
+	// 先更新清单，再切换文件（即使进程崩溃，新文件也在清单中）
+	if err := persistManifest(aof.aofDir, aof.baseFileName, newManifest); err != nil {
+		file.Close()
+		os.Remove(file.Name())
 		return nil, err
 	}
 
-	// 当前aof重写前的信息
-	snapShot := &snapshotAOF{}
-	// 大小
-	snapShot.fileSize = fileInfo.Size()
-	// 选中的数据库
-	snapShot.dbIndex = aof.lastDBIndex
-	snapShot.tempFile = file
+	oldFile := aof.aofFile
+	if err := aof.openIncrFile(newIncr.fileName); err != nil {
+		// 打开失败，继续使用旧文件（清单中多出一个空的增量文件，不影响加载）
+		aof.aofFile = oldFile
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	oldFile.Close()
+	aof.manifest = newManifest
 	return snapShot, nil
 }
 
 func (aof *AOF) doRewrite(snapShot *snapshotAOF, engine abstract.Engine) error {
 	// 临时aof对象
 	tmpAof := &AOF{}
-	tmpAof.aofFileName = aof.aofFileName
 	tmpAof.engine = engine
-	// 临时aof，加载aof文件，并将数据保存到临时内存中（engine）
-	tmpAof.LoadAof(int(snapShot.fileSize))
-	// 扫描临时内存，将结果保存到新的aof文件中
+	// 临时aof，加载需要重写的文件，并将数据保存到临时内存中（engine）
+	for _, info := range snapShot.manifest.loadList() {
+		result, err := tmpAof.loadFile(filepath.Join(aof.aofDir, info.fileName))
+		if err != nil {
+			return err
+		}
+		// 文件不完整，继续重写会丢失数据
+		if result.Err != nil {
+			return fmt.Errorf("aof file %s err: %w", info.fileName, result.Err)
+		}
+	}
+
+	// 扫描临时内存，将结果保存到新的基础文件中
 	tmpFile := snapShot.tempFile
+
+	// 混合持久化：以二进制快照的格式保存
+	if conf.GlobalConfig.AofUseRdbPreamble {
+		if err := rdb.Dump(tmpFile, conf.GlobalConfig.Databases, tmpAof.engine.ForEach); err != nil {
+			return err
+		}
+		return tmpFile.Sync()
+	}
+
 	for i := 0; i < conf.GlobalConfig.Databases; i++ {
 		// 写入 select index
 		data := protocol.NewMultiBulkReply(SelectCmd([]byte(strconv.Itoa(i))))
@@ -96,16 +214,22 @@ func (aof *AOF) doRewrite(snapShot *snapshotAOF, engine abstract.Engine) error {
 		tmpAof.engine.ForEach(i, func(key string, data *payload.DataEntity, expiration *time.Time) bool {
 			// 写入 redis命令
 			cmd := EntityToCmd(key, data)
-			tmpFile.Write(cmd.ToBytes())
+			_, err = tmpFile.Write(cmd.ToBytes())
+			if err != nil {
+				return false
+			}
 			// 写入过期时间（如果存在的话）
 			if expiration != nil {
 				cmd := protocol.NewMultiBulkReply(PExpireAtCmd(key, *expiration))
-				tmpFile.Write(cmd.ToBytes())
+				_, err = tmpFile.Write(cmd.ToBytes())
 			}
-			return true
+			return err == nil
 		})
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	return tmpFile.Sync()
 
 }
 
@@ -113,71 +237,71 @@ func (aof *AOF) finishRewrite(snapshot *snapshotAOF) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	err := aof.aofFile.Sync()
-	if err != nil {
-		return err
-	}
-
 	tmpFile := snapshot.tempFile
+	tmpFile.Close()
 
-	lastCopy := func() error {
-		// 打开现有aof
-		src, err := os.Open(aof.aofFileName)
-		if err != nil {
-			return err
-		}
-
-		defer func() {
-			src.Close()
-			tmpFile.Close()
-		}()
-		// 将游标移动到上次的快照位置
-		_, err = src.Seek(snapshot.fileSize, io.SeekStart)
-		if err != nil {
-			return err
-		}
-
-		// 将快照的dbindex保存到tmpFile中（因为增量的命令是在当时快照的时候数据库下生成的）
-		data := protocol.NewMultiBulkReply(SelectCmd([]byte(strconv.Itoa(snapshot.dbIndex))))
-		_, err = tmpFile.Write(data.ToBytes())
-		if err != nil {
-			return err
-		}
+	// 新的基础文件
+	newManifest := aof.manifest.copy()
+	newManifest.currBaseFileSeq++
+	newBase := &aofInfo{
+		fileName: baseName(aof.baseFileName, newManifest.currBaseFileSeq, conf.GlobalConfig.AofUseRdbPreamble),
+		fileSeq:  newManifest.currBaseFileSeq,
+		fileType: baseFileType,
+	}
+	if err := os.Rename(tmpFile.Name(), filepath.Join(aof.aofDir, newBase.fileName)); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
 
-		// 将增量的数据保存到tmpFile中
-		_, err = io.Copy(tmpFile, src)
-		if err != nil {
-			return err
+	// 已经被重写的文件，标记为历史文件
+	rewritten := make(map[string]struct{})
+	for _, info := range snapshot.manifest.loadList() {
+		rewritten[info.fileName] = struct{}{}
+		newManifest.historyAofList = append(newManifest.historyAofList, &aofInfo{
+			fileName: info.fileName,
+			fileSeq:  info.fileSeq,
+			fileType: historyFileType,
+		})
+	}
+	newManifest.baseAof = newBase
+	incrAofList := make([]*aofInfo, 0, len(newManifest.incrAofList))
+	for _, info := range newManifest.incrAofList {
+		if _, ok := rewritten[info.fileName]; !ok {
+			incrAofList = append(incrAofList, info)
 		}
-		return nil
 	}
+	newManifest.incrAofList = incrAofList
 
-	if err := lastCopy(); err != nil {
+	if err := persistManifest(aof.aofDir, aof.baseFileName, newManifest); err != nil {
+		os.Remove(filepath.Join(aof.aofDir, newBase.fileName))
 		return err
 	}
-	// 执行到这里说明数据复制完毕
+	aof.manifest = newManifest
 
-	// 关闭当前的aof
-	aof.aofFile.Close()
+	// 删除历史文件
+	aof.cleanHistory()
 
-	// 将临时文件移动到aof文件
-	if err := os.Rename(tmpFile.Name(), aof.aofFileName); err != nil {
-		logger.Warn(err)
-	}
+	// 重写后的文件大小，作为下次自动重写的基准
+	aof.currentSize.Store(aof.filesSize())
+	aof.baseSize.Store(aof.currentSize.Load())
+	return nil
+}
 
-	// 重新打开
-	aofFile, err := os.OpenFile(aof.aofFileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
+// 删除历史文件，并更新清单
+func (aof *AOF) cleanHistory() {
+	if len(aof.manifest.historyAofList) == 0 {
+		return
 	}
-	aof.aofFile = aofFile
-
-	// 将当前的数据库索引写入
-	data := protocol.NewMultiBulkReply(SelectCmd([]byte(strconv.Itoa(aof.lastDBIndex))))
-	_, err = aof.aofFile.Write(data.ToBytes())
-	if err != nil {
-		panic(err)
+	for _, info := range aof.manifest.historyAofList {
+		if err := os.Remove(filepath.Join(aof.aofDir, info.fileName)); err != nil && !os.IsNotExist(err) {
+			logger.Warn(err)
+		}
 	}
-
-	return nil
+	newManifest := aof.manifest.copy()
+	newManifest.historyAofList = nil
+	if err := persistManifest(aof.aofDir, aof.baseFileName, newManifest); err != nil {
+		logger.Warn(err)
+		return
+	}
+	aof.manifest = newManifest
 }
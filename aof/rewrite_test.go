@@ -0,0 +1,85 @@
+package aof
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofish2020/easyredis/abstract"
+)
+
+func TestAutoRewrite(t *testing.T) {
+	dir := t.TempDir()
+	tmpEngine := func() abstract.Engine { return newMemEngine() }
+	aof, err := NewAOF(dir, "appendonly.aof", newMemEngine(), false, FsyncAlways, tmpEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		aof.SaveRedisCommand(0, setCommand("key", strconv.Itoa(i)))
+	}
+	aof.Close()
+
+	// 重新启动：启动时的文件大小作为基准
+	aof, err = NewAOF(dir, "appendonly.aof", newMemEngine(), true, FsyncAlways, tmpEngine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	aof.rewritePercentage.Store(100)
+	aof.rewriteMinSize.Store(1 << 30)
+	stats := aof.Stats()
+	if stats.BaseSize == 0 || stats.BaseSize != stats.CurrentSize || stats.RewriteCount != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	baseSize := stats.BaseSize
+
+	// 增长没有达到 auto-aof-rewrite-percentage
+	for i := 0; i < 50; i++ {
+		aof.SaveRedisCommand(0, setCommand("key", strconv.Itoa(i)))
+	}
+	aof.rewriteMinSize.Store(1)
+	aof.checkAutoRewrite()
+	if stats := aof.Stats(); stats.RewriteInProgress || stats.RewriteCount != 0 || stats.CurrentSize >= 2*baseSize {
+		t.Fatalf("rewrite should not start before 100%% growth: %+v", stats)
+	}
+
+	// 增长达到 auto-aof-rewrite-percentage，但是小于 auto-aof-rewrite-min-size
+	for i := 0; i < 100; i++ {
+		aof.SaveRedisCommand(0, setCommand("key", strconv.Itoa(i)))
+	}
+	aof.rewriteMinSize.Store(1 << 30)
+	aof.checkAutoRewrite()
+	if stats := aof.Stats(); stats.RewriteInProgress || stats.RewriteCount != 0 || stats.CurrentSize < 2*baseSize {
+		t.Fatalf("rewrite should not start below min size: %+v", stats)
+	}
+	// auto-aof-rewrite-percentage 为0，禁用自动重写
+	aof.rewriteMinSize.Store(1)
+	aof.rewritePercentage.Store(0)
+	aof.checkAutoRewrite()
+	if stats := aof.Stats(); stats.RewriteInProgress || stats.RewriteCount != 0 {
+		t.Fatalf("auto rewrite should be disabled: %+v", stats)
+	}
+
+	// 两个条件都满足，开始重写；完成后更新统计信息，重写后的大小作为新的基准
+	aof.rewritePercentage.Store(100)
+	aof.checkAutoRewrite()
+	deadline := time.Now().Add(5 * time.Second)
+	for stats = aof.Stats(); stats.RewriteInProgress || stats.RewriteCount == 0; stats = aof.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("rewrite not finished: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.RewriteCount != 1 || !stats.LastRewriteOK || stats.CurrentBaseFileSeq != 1 || stats.CurrentIncrFileSeq != 2 {
+		t.Fatalf("unexpected stats after rewrite %+v", stats)
+	}
+	if stats.CurrentSize >= baseSize || stats.BaseSize != stats.CurrentSize {
+		t.Fatalf("rewritten size should be the new base: %+v", stats)
+	}
+	// 刚重写完，不再触发
+	aof.checkAutoRewrite()
+	if stats := aof.Stats(); stats.RewriteInProgress || stats.RewriteCount != 1 {
+		t.Fatalf("rewrite should not start again: %+v", stats)
+	}
+}
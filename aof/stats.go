@@ -0,0 +1,38 @@
+package aof
+
+import "time"
+
+// aof运行状态（INFO persistence）
+type Stats struct {
+	RewriteInProgress  bool          // 是否正在重写
+	CurrentRewriteTime time.Duration // 当前重写已经执行的时间
+	LastRewriteTime    time.Duration // 上次重写耗时
+	LastRewriteOK      bool          // 上次重写是否成功
+	RewriteCount       int64         // 重写次数
+	CurrentSize        int64         // aof文件大小
+	BaseSize           int64         // 上次重写（or 启动）后的aof文件大小
+	CurrentIncrFileSeq int64         // 当前增量文件的seq
+	CurrentBaseFileSeq int64         // 当前基础文件的seq
+}
+
+func (aof *AOF) Stats() Stats {
+	aof.statsMu.Lock()
+	stats := Stats{
+		RewriteInProgress: aof.rewriting.Load(),
+		LastRewriteTime:   aof.lastRewriteDuration,
+		LastRewriteOK:     aof.lastRewriteErr == nil,
+		RewriteCount:      aof.rewriteCount,
+		CurrentSize:       aof.currentSize.Load(),
+		BaseSize:          aof.baseSize.Load(),
+	}
+	if stats.RewriteInProgress {
+		stats.CurrentRewriteTime = time.Since(aof.rewriteStartTime)
+	}
+	aof.statsMu.Unlock()
+
+	aof.mu.Lock()
+	stats.CurrentIncrFileSeq = aof.manifest.currIncrFileSeq
+	stats.CurrentBaseFileSeq = aof.manifest.currBaseFileSeq
+	aof.mu.Unlock()
+	return stats
+}
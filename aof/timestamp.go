@@ -0,0 +1,156 @@
+package aof
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+时间戳注释（aof-timestamp-enabled yes）：
+
+	#TS:1700000000\r\n
+	*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n
+
+每秒最多写入一条，命令重放时忽略；按时间点恢复时，截断到第一个大于指定时间戳的注释位置
+*/
+
+const timestampAnnotationPrefix = "TS:"
+
+func timestampAnnotation(timestamp int64) []byte {
+	return []byte(string(annotationPrefix) + timestampAnnotationPrefix + strconv.FormatInt(timestamp, 10) + "\r\n")
+}
+
+// 解析时间戳注释（不是时间戳注释，返回false）
+func parseTimestampAnnotation(annotation string) (int64, bool) {
+	if !strings.HasPrefix(annotation, timestampAnnotationPrefix) {
+		return 0, false
+	}
+	timestamp, err := strconv.ParseInt(annotation[len(timestampAnnotationPrefix):], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return timestamp, true
+}
+
+// 按时间戳截断的结果
+type TimestampResult struct {
+	// 被截断的文件（nil 表示所有命令都不晚于指定的时间戳）
+	*CheckResult
+	// 截断位置的时间戳注释
+	Timestamp int64
+	// 截断位置之后的文件（整个丢弃）
+	Dropped []string
+}
+
+// 将aof（单个文件 or 清单文件）截断到指定的时间戳（包含该时间戳）
+// output为空：原地截断（清单中截断位置之后的增量文件，标记为历史文件）；否则将截断后的数据合并写入到新的aof文件中，原文件不变
+func TruncateToTimestamp(fileName string, timestamp int64, output string) (*TimestampResult, error) {
+
+	fileNames := []string{fileName}
+	var manifest *aofManifest
+	if IsManifest(fileName) {
+		var err error
+		manifest, err = loadManifest(fileName)
+		if err != nil {
+			return nil, err
+		}
+		fileNames = fileNames[:0]
+		for _, info := range manifest.loadList() {
+			fileNames = append(fileNames, filepath.Join(filepath.Dir(fileName), info.fileName))
+		}
+	}
+
+	// 找到第一个大于timestamp的注释
+	tsResult := &TimestampResult{}
+	cutIndex := len(fileNames)
+	for i, name := range fileNames {
+		result, err := scanFile(name, skipEntity, nil, func(annotation string) bool {
+			ts, ok := parseTimestampAnnotation(annotation)
+			if ok && ts > timestamp {
+				tsResult.Timestamp = ts
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.Err != nil {
+			return nil, fmt.Errorf("%s: %w, run 'easyredis check-aof --fix' first", name, result.Err)
+		}
+		if result.Stopped {
+			tsResult.CheckResult = result
+			tsResult.Dropped = fileNames[i+1:]
+			cutIndex = i
+			break
+		}
+	}
+
+	if output != "" {
+		return tsResult, writeTruncated(output, fileNames, cutIndex, tsResult.CheckResult)
+	}
+
+	// 原地截断
+	if tsResult.CheckResult == nil {
+		return tsResult, nil
+	}
+	if err := os.Truncate(tsResult.FileName, tsResult.ValidSize); err != nil {
+		return nil, err
+	}
+	if manifest != nil && len(tsResult.Dropped) > 0 {
+		// 丢弃的增量文件标记为历史文件（下次启动时删除）
+		dropped := manifest.incrAofList[len(manifest.incrAofList)-len(tsResult.Dropped):]
+		manifest.incrAofList = manifest.incrAofList[:len(manifest.incrAofList)-len(tsResult.Dropped)]
+		for _, info := range dropped {
+			manifest.historyAofList = append(manifest.historyAofList, &aofInfo{
+				fileName: info.fileName,
+				fileSeq:  info.fileSeq,
+				fileType: historyFileType,
+			})
+		}
+		baseFileName := strings.TrimSuffix(filepath.Base(fileName), manifestNameSuffix)
+		if err := persistManifest(filepath.Dir(fileName), baseFileName, manifest); err != nil {
+			return nil, err
+		}
+	}
+	return tsResult, nil
+}
+
+// 将 fileNames[:cutIndex] 和 截断文件的有效部分，依次写入到output中
+func writeTruncated(output string, fileNames []string, cutIndex int, cut *CheckResult) error {
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	copyFile := func(name string, size int64) error {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if size < 0 {
+			_, err = io.Copy(out, file)
+		} else {
+			_, err = io.CopyN(out, file, size)
+		}
+		return err
+	}
+
+	for _, name := range fileNames[:cutIndex] {
+		if err := copyFile(name, -1); err != nil {
+			return err
+		}
+	}
+	if cut != nil {
+		if err := copyFile(cut.FileName, cut.ValidSize); err != nil {
+			return err
+		}
+	}
+	return out.Sync()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gofish2020/easyredis/aof"
+)
+
+/*
+检测 & 修复aof文件：
+
+	easyredis check-aof [--fix] <file.aof | file.manifest>
+
+按时间点恢复（需要开启 aof-timestamp-enabled，服务停止后执行）：
+
+	easyredis check-aof --truncate-to-timestamp <unix> [--output new.aof] <file.aof | file.manifest>
+*/
+
+func checkAof(args []string) int {
+	flagSet := flag.NewFlagSet("check-aof", flag.ExitOnError)
+	fix := flagSet.Bool("fix", false, "truncate the file to the last valid command")
+	timestamp := flagSet.Int64("truncate-to-timestamp", 0, "truncate the aof to the given unix timestamp")
+	output := flagSet.String("output", "", "write the truncated aof to a new file instead of truncating in place")
+	flagSet.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: easyredis check-aof [--fix] [--truncate-to-timestamp <unix> [--output <file>]] <file.aof | file.manifest>")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return 1
+	}
+	fileName := flagSet.Arg(0)
+
+	if *timestamp > 0 {
+		return truncateToTimestamp(fileName, *timestamp, *output)
+	}
+
+	var results []*aof.CheckResult
+	if aof.IsManifest(fileName) {
+		var err error
+		results, err = aof.CheckManifest(fileName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else {
+		result, err := aof.CheckFile(fileName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		results = append(results, result)
+	}
+
+	exitCode := 0
+	for i, result := range results {
+		if result.Err == nil {
+			fmt.Printf("%s: ok, %d bytes, %d commands, rdb preamble: %t\n", result.FileName, result.FileSize, result.Commands, result.Preamble)
+			continue
+		}
+
+		fmt.Printf("%s: %v\n", result.FileName, result.Err)
+		fmt.Printf("  first bad command at offset %d, file size %d, %d bytes after it\n", result.ValidSize, result.FileSize, result.FileSize-result.ValidSize)
+
+		if !*fix {
+			exitCode = 1
+			continue
+		}
+		// 只有最后一个文件可以修复（前面的文件截断后，后面的文件命令不再连续）
+		if i != len(results)-1 {
+			fmt.Println("  can't fix: only the last file in the manifest can be truncated")
+			exitCode = 1
+			continue
+		}
+		if err := aof.TruncateFile(result); err != nil {
+			fmt.Printf("  %v\n", err)
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("  successfully truncated to %d bytes\n", result.ValidSize)
+	}
+	return exitCode
+}
+
+func truncateToTimestamp(fileName string, timestamp int64, output string) int {
+	result, err := aof.TruncateToTimestamp(fileName, timestamp, output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if result.CheckResult == nil {
+		fmt.Printf("no commands after timestamp %d\n", timestamp)
+	} else {
+		fmt.Printf("%s: truncated at offset %d (annotation #TS:%d), %d commands kept\n", result.FileName, result.ValidSize, result.Timestamp, result.Commands)
+		for _, name := range result.Dropped {
+			fmt.Printf("%s: dropped\n", name)
+		}
+	}
+	if output != "" {
+		fmt.Printf("truncated aof written to %s\n", output)
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+节点认证（集群总线使用单独的密钥 cluster-secret，不再使用客户端的 requirepass）：
+
+1. 连接方发送 CLUSTERAUTH <addr> <cnonce>
+2. 被连接方生成 snonce，回复 [snonce, HMAC(secret, "server:"+cnonce+":"+snonce)]
+3. 连接方校验被连接方的proof（双方的密钥一致），再发送 CLUSTERAUTH HMAC(secret, "client:"+snonce+":"+cnonce)
+4. 被连接方校验通过后，将连接标记为节点连接（不再需要 AUTH）
+
+没有配置 cluster-secret 时使用 requirepass 作为密钥；都没有配置时拒绝节点认证（空的密钥任何人都可以计算HMAC）
+
+只有节点连接（以及内部的虚拟连接）可以执行集群内部命令
+*/
+
+const nonceSize = 16
+
+// 集群内部命令：只能由其他节点发送
+var internalCommands = map[string]bool{
+	"direct":         true,
+	"owner":          true,
+	"importing":      true,
+	"rehome":         true,
+	"prepare":        true,
+	"commit":         true,
+	"rollback":       true,
+	"txstatus":       true,
+	"watchversion":   true,
+	"restore-asking": true,
+	"withdb":         true,
+}
+
+// 集群内部的 CLUSTER 子命令
+var internalClusterCommands = map[string]bool{
+	"gossip":   true,
+	"setpeers": true,
+	"rehome":   true,
+	"rehomed":  true,
+}
+
+// 不需要密码就可以执行的命令
+var noAuthCommands = map[string]bool{
+	"ping":        true,
+	"auth":        true,
+	"clusterauth": true,
+}
+
+// 是否是集群内部命令，返回命令名称（CLUSTER 子命令包含子命令名称）
+func internalCommand(name string, redisCommand [][]byte) (string, bool) {
+	if internalCommands[name] {
+		return name, true
+	}
+	if name == "cluster" && len(redisCommand) >= 2 {
+		subCommand := strings.ToLower(string(redisCommand[1]))
+		return name + " " + subCommand, internalClusterCommands[subCommand]
+	}
+	return name, false
+}
+
+// 校验客户端密码（节点连接不需要）
+func checkPasswd(c abstract.Connection) bool {
+	if conf.GlobalConfig.RequirePass == "" || c.IsClusterPeer() {
+		return true
+	}
+	return c.GetPassword() == conf.GlobalConfig.RequirePass
+}
+
+func newNonce() string {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return utils.RandString(nonceSize * 2)
+	}
+	return hex.EncodeToString(b)
+}
+
+var errNoClusterSecret = errors.New("cluster authentication is disabled, cluster-secret is not configured")
+
+// 节点认证的密钥
+func clusterSecret() string {
+	if conf.GlobalConfig.ClusterSecret != "" {
+		return conf.GlobalConfig.ClusterSecret
+	}
+	return conf.GlobalConfig.RequirePass
+}
+
+func clusterProof(role, nonce1, nonce2 string) string {
+	mac := hmac.New(sha256.New, []byte(clusterSecret()))
+	mac.Write([]byte(role + ":" + nonce1 + ":" + nonce2))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CLUSTERAUTH <addr> <cnonce> / CLUSTERAUTH <proof>
+func clusterAuthFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	args := redisCommand[1:]
+	if clusterSecret() == "" {
+		c.SetClusterPeer(false)
+		c.SetClusterChallenge("")
+		return protocol.NewGenericErrReply(errNoClusterSecret.Error())
+	}
+	switch len(args) {
+	case 2:
+		addr, cnonce := string(args[0]), string(args[1])
+		snonce := newNonce()
+		c.SetClusterPeer(false)
+		c.SetClusterChallenge(cnonce + " " + snonce + " " + addr)
+		return protocol.NewMultiBulkReply(utils.ToCmdLine(snonce, clusterProof("server", cnonce, snonce)))
+	case 1:
+		challenge := strings.SplitN(c.GetClusterChallenge(), " ", 3)
+		c.SetClusterChallenge("")
+		if len(challenge) != 3 {
+			return protocol.NewGenericErrReply("cluster authentication not started")
+		}
+		cnonce, snonce, addr := challenge[0], challenge[1], challenge[2]
+		if !hmac.Equal(args[0], []byte(clusterProof("client", snonce, cnonce))) {
+			logger.Warnf("cluster authentication failed from %s", addr)
+			return protocol.NewGenericErrReply("cluster authentication failed")
+		}
+		c.SetClusterPeer(true)
+		return protocol.NewOkReply()
+	}
+	return protocol.NewArgNumErrReply("clusterauth")
+}
+
+// 连接方：与被连接的节点相互认证
+func clusterHandshake(cli Client, self string) error {
+	if clusterSecret() == "" {
+		return errNoClusterSecret
+	}
+	cnonce := newNonce()
+	reply, err := cli.Send(utils.ToCmdLine("ClusterAuth", self, cnonce))
+	if err != nil {
+		return err
+	}
+	challenge, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(challenge.RedisCommand) != 2 {
+		return errors.New("cluster auth failed:" + string(reply.ToBytes()))
+	}
+	snonce, proof := string(challenge.RedisCommand[0]), challenge.RedisCommand[1]
+	if !hmac.Equal(proof, []byte(clusterProof("server", cnonce, snonce))) {
+		return errors.New("cluster auth failed: peer has a different cluster-secret")
+	}
+	reply, err = cli.Send(utils.ToCmdLine("ClusterAuth", clusterProof("client", snonce, cnonce)))
+	if err != nil {
+		return err
+	}
+	if !protocol.IsOKReply(reply) {
+		return errors.New("cluster auth failed:" + string(reply.ToBytes()))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+// 在同一个连接上执行命令（模拟节点之间的连接），被连接方使用自己的 cluster-secret
+type connClient struct {
+	cluster *Cluster
+	conn    abstract.Connection
+	secret  string
+}
+
+func (c *connClient) Send(command [][]byte) (protocol.Reply, error) {
+	secret := conf.GlobalConfig.ClusterSecret
+	conf.GlobalConfig.ClusterSecret = c.secret
+	defer func() { conf.GlobalConfig.ClusterSecret = secret }()
+	return c.cluster.Exec(c.conn, command), nil
+}
+
+func TestClusterAuth(t *testing.T) {
+	conf.GlobalConfig.Peers = []string{"127.0.0.1:61379"}
+	conf.GlobalConfig.Self = "127.0.0.1:61379"
+	node := newCluster(&mockFactory{})
+	addCluster(conf.GlobalConfig.Self, node)
+	defer node.Close()
+
+	exec := func(conn abstract.Connection, cmdLine ...string) string {
+		return string(node.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+
+	// 普通客户端不能执行集群内部命令
+	client := connection.NewKeepConnection(nil)
+	for _, cmdLine := range [][]string{
+		{"Prepare", "1", "set", "k", "v"},
+		{"Rehome", "get", "k"},
+		{"cluster", "setpeers", "1", conf.GlobalConfig.Self},
+	} {
+		if got := exec(client, cmdLine...); !strings.HasSuffix(got, "is only allowed from cluster peers\r\n") {
+			t.Fatalf("%v: %q", cmdLine, got)
+		}
+	}
+	if got := exec(client, "Direct", "set", "k", "v"); got != "-ERR command 'direct' is only allowed from cluster peers\r\n" {
+		t.Fatalf("direct: %q", got)
+	}
+	if got := exec(client, "cluster", "gossip"); got != "-ERR command 'cluster gossip' is only allowed from cluster peers\r\n" {
+		t.Fatalf("cluster gossip: %q", got)
+	}
+	if got := exec(client, "set", "k", "v"); got != "+OK\r\n" {
+		t.Fatalf("set: %q", got)
+	}
+
+	// 密钥不一致：连接方校验被连接方的proof失败
+	wrong := connection.NewKeepConnection(nil)
+	conf.GlobalConfig.ClusterSecret = "other"
+	err := clusterHandshake(&connClient{cluster: node, conn: wrong, secret: "secret"}, "127.0.0.1:62379")
+	conf.GlobalConfig.ClusterSecret = "secret"
+	if err == nil || wrong.IsClusterPeer() {
+		t.Fatal("handshake with a different secret should fail")
+	}
+	// 伪造的proof
+	exec(wrong, "ClusterAuth", "127.0.0.1:62379", "nonce")
+	if got := exec(wrong, "ClusterAuth", "forged"); got != "-ERR cluster authentication failed\r\n" || wrong.IsClusterPeer() {
+		t.Fatalf("forged proof: %q", got)
+	}
+	if got := exec(wrong, "ClusterAuth", "forged"); got != "-ERR cluster authentication not started\r\n" {
+		t.Fatalf("replayed proof: %q", got)
+	}
+
+	// 认证通过的节点连接可以执行内部命令，且不需要 requirepass
+	conf.GlobalConfig.RequirePass = "pass"
+	defer func() { conf.GlobalConfig.RequirePass = "" }()
+	if got := exec(client, "get", "k"); got != "-ERR Authentication required\r\n" {
+		t.Fatalf("get without auth: %q", got)
+	}
+	if got := exec(client, "Direct", "get", "k"); got != "-ERR Authentication required\r\n" {
+		t.Fatalf("direct without auth: %q", got)
+	}
+	peer := connection.NewKeepConnection(nil)
+	if err := clusterHandshake(&connClient{cluster: node, conn: peer, secret: "secret"}, "127.0.0.1:62379"); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.IsClusterPeer() {
+		t.Fatal("connection should be marked as a cluster peer")
+	}
+	if got := exec(peer, "Direct", "get", "k"); got != "$1\r\nv\r\n" {
+		t.Fatalf("direct from peer: %q", got)
+	}
+}
+
+// 没有配置 cluster-secret：使用 requirepass 认证，都没有配置时拒绝节点认证
+func TestClusterAuthWithoutSecret(t *testing.T) {
+	conf.GlobalConfig.Peers = []string{"127.0.0.1:61380"}
+	conf.GlobalConfig.Self = "127.0.0.1:61380"
+	conf.GlobalConfig.ClusterSecret = ""
+	defer func() { conf.GlobalConfig.ClusterSecret = "secret" }()
+	node := newCluster(&mockFactory{})
+	defer node.Close()
+	exec := func(conn abstract.Connection, cmdLine ...string) string {
+		return string(node.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+
+	// 使用空的密钥计算proof，不能成为节点连接
+	client := connection.NewKeepConnection(nil)
+	if err := clusterHandshake(&connClient{cluster: node, conn: client}, "127.0.0.1:62380"); err != errNoClusterSecret {
+		t.Fatalf("expect handshake to be rejected, got %v", err)
+	}
+	if got := exec(client, "ClusterAuth", "127.0.0.1:62380", "nonce"); got != "-ERR "+errNoClusterSecret.Error()+"\r\n" {
+		t.Fatalf("clusterauth: %q", got)
+	}
+	if got := exec(client, "ClusterAuth", clusterProof("client", "snonce", "nonce")); !strings.HasPrefix(got, "-ERR") || client.IsClusterPeer() {
+		t.Fatalf("client should not become a cluster peer: %q", got)
+	}
+	if got := exec(client, "Direct", "set", "k", "v"); got != "-ERR command 'direct' is only allowed from cluster peers\r\n" {
+		t.Fatalf("direct: %q", got)
+	}
+
+	// 使用 requirepass 作为密钥：不知道密码的客户端不能成为节点连接
+	conf.GlobalConfig.RequirePass = "pass"
+	defer func() { conf.GlobalConfig.RequirePass = "" }()
+	exec(client, "ClusterAuth", "127.0.0.1:62380", "nonce")
+	conf.GlobalConfig.RequirePass = ""
+	forged := clusterProof("client", "snonce", "nonce")
+	conf.GlobalConfig.RequirePass = "pass"
+	if got := exec(client, "ClusterAuth", forged); got != "-ERR cluster authentication failed\r\n" || client.IsClusterPeer() {
+		t.Fatalf("forged proof: %q", got)
+	}
+	if got := exec(client, "Direct", "get", "k"); got != "-ERR Authentication required\r\n" {
+		t.Fatalf("direct without auth: %q", got)
+	}
+	peer := connection.NewKeepConnection(nil)
+	if err := clusterHandshake(&connClient{cluster: node, conn: peer}, "127.0.0.1:62380"); err != nil {
+		t.Fatal(err)
+	}
+	if got := exec(peer, "Direct", "set", "k", "v"); got != "+OK\r\n" || !peer.IsClusterPeer() {
+		t.Fatalf("direct from peer: %q", got)
+	}
+}
@@ -3,8 +3,10 @@ package cluster
 import (
 	"fmt"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofish2020/easyredis/abstract"
@@ -13,6 +15,7 @@ import (
 	"github.com/gofish2020/easyredis/redis/protocol"
 	"github.com/gofish2020/easyredis/tool/conf"
 	"github.com/gofish2020/easyredis/tool/consistenthash"
+	"github.com/gofish2020/easyredis/tool/hashslot"
 	"github.com/gofish2020/easyredis/tool/idgenerator"
 	"github.com/gofish2020/easyredis/tool/logger"
 	"github.com/gofish2020/easyredis/tool/timewheel"
@@ -28,6 +31,12 @@ const (
 	replicas = 100 // 副本数量
 )
 
+// key的分配方式
+const (
+	modeConsistentHash = "consistent-hash"
+	modeSlot           = "slot"
+)
+
 type Cluster struct {
 	// 当前的ip地址
 	self string
@@ -36,8 +45,30 @@ type Cluster struct {
 	// Redis存储引擎
 	engine *engine.Engine
 
-	// 一致性hash
+	// key的分配方式
+	mode string
+	// 一致性hash（节点变更见 rehome.go）
+	ringMu      sync.RWMutex
 	consistHash *consistenthash.Map
+	ringEpoch   int64               // 节点列表的纪元
+	oldHash     *consistenthash.Map // 节点变更前的一致性hash，key迁移完成前使用
+	rehoming    map[string]bool     // 还没有完成key迁移的节点
+	rehomeEpoch int64               // 已经开始迁移key的纪元
+	probeMu     sync.RWMutex
+	probes      map[string]peerProbe // 最近一次探测的节点连通性
+	// 哈希槽
+	slots *slotTable
+	// 哈希槽模式下，回复 -MOVED/-ASK 而不是转发
+	redirect bool
+
+	// 集群总线（哈希槽模式）
+	nodeTimeout      time.Duration
+	configFile       string
+	saveMu           sync.Mutex
+	messagesSent     atomic.Int64
+	messagesReceived atomic.Int64
+	closed           chan struct{}
+	closeOnce        sync.Once
 
 	// 雪花算法，生成唯一guid
 	snowflake *idgenerator.IDGenerator
@@ -45,19 +76,38 @@ type Cluster struct {
 	// 分布式事务
 	transactionLock sync.RWMutex
 	transactions    map[string]*Transaction
+	txLog           *txLog
 
 	delay *timewheel.Delay
 }
 
 func NewCluster() *Cluster {
+	return newCluster(NewPeerLinks())
+}
+
+// factory：节点之间的连接（测试中使用模拟的连接），必须在启动定时任务之前设置
+func newCluster(factory Factory) *Cluster {
 	cluster := Cluster{
-		clientFactory: NewRedisConnPool(),
+		clientFactory: factory,
 		engine:        engine.NewEngine(),
-		consistHash:   consistenthash.New(replicas, nil),
+		mode:          conf.GlobalConfig.ClusterMode,
+		redirect:      conf.GlobalConfig.ClusterRedirect,
+		consistHash:   newConsistentHash(),
 		self:          conf.GlobalConfig.Self,
 		snowflake:     idgenerator.MakeGenerator(conf.GlobalConfig.Self),
 		delay:         timewheel.NewDelay(),
 		transactions:  make(map[string]*Transaction),
+		nodeTimeout:   time.Duration(conf.GlobalConfig.ClusterNodeTimeout) * time.Millisecond,
+		configFile:    nodesConfPath(),
+		closed:        make(chan struct{}),
+	}
+
+	if conf.GlobalConfig.ClusterSecret == "" {
+		if conf.GlobalConfig.RequirePass == "" {
+			logger.Error("cluster-secret and requirepass are empty, nodes can't authenticate each other")
+		} else {
+			logger.Warn("cluster-secret is empty, using requirepass to authenticate cluster peers")
+		}
 	}
 
 	// 一致性hash初始化
@@ -68,18 +118,108 @@ func NewCluster() *Cluster {
 		if _, ok := contains[peer]; ok {
 			continue
 		}
+		contains[peer] = struct{}{}
 		peers = append(peers, peer)
 	}
 
 	if _, ok := contains[cluster.self]; !ok {
 		peers = append(peers, cluster.self)
 	}
+	// 加载分布式事务日志
+	txLog, prepared, decided, err := openTxLog(dataFilePath(conf.GlobalConfig.ClusterTxLogFile))
+	if err != nil {
+		panic(fmt.Sprintf("cluster: open transaction log failed: %v", err))
+	}
+	cluster.txLog = txLog
+
 	// 添加到集群
-	cluster.consistHash.Add(peers...)
+	if cluster.mode == modeSlot {
+		cluster.slots = cluster.initSlotTable(peers)
+		if master := cluster.slots.myself.master; master != nil {
+			cluster.replicate(master)
+		}
+		go cluster.cron()
+	} else {
+		if cluster.redirect {
+			logger.Warn("cluster-redirect only works when cluster-mode is slot, ignored")
+		}
+		cluster.mode = modeConsistentHash
+		weights := peerWeights(conf.GlobalConfig.ClusterPeerWeights)
+		for _, peer := range peers {
+			cluster.consistHash.AddWithWeight(peer, weights[peer])
+		}
+		go cluster.probeCron()
+	}
+	cluster.recoverTransactions(prepared, decided)
 	return &cluster
 }
 
-func (cluster *Cluster) Exec(c abstract.Connection, redisCommand [][]byte) (result protocol.Reply) {
+// 一致性hash（所有节点必须使用相同的hash函数和分配方式）
+func newConsistentHash() *consistenthash.Map {
+	fn, ok := consistenthash.HashFuncByName(conf.GlobalConfig.ClusterHashFunc)
+	if !ok {
+		logger.Warn(fmt.Sprintf("unknown cluster-hash-func %q (supported: %s), use crc32", conf.GlobalConfig.ClusterHashFunc, strings.Join(consistenthash.HashFuncNames(), " ")))
+	}
+	if conf.GlobalConfig.ClusterHashStrategy == "jump" {
+		return consistenthash.NewJump(fn)
+	}
+	return consistenthash.New(replicas, fn)
+}
+
+// 解析节点的权重：ip:port=weight
+func peerWeights(items []string) map[string]int {
+	weights := make(map[string]int, len(items))
+	for _, item := range items {
+		peer, weight, err := parsePeerWeight(item)
+		if err != nil {
+			logger.Warn("cluster: " + err.Error())
+			continue
+		}
+		weights[peer] = weight
+	}
+	return weights
+}
+
+// ip:port[=weight]（没有权重时返回0）
+func parsePeerWeight(item string) (string, int, error) {
+	index := strings.LastIndex(item, "=")
+	if index == -1 {
+		return item, 0, nil
+	}
+	weight, err := strconv.Atoi(item[index+1:])
+	if err != nil || weight <= 0 {
+		return "", 0, fmt.Errorf("invalid peer weight %q", item)
+	}
+	return item[:index], weight, nil
+}
+
+// 计算key所属的节点
+func (cluster *Cluster) pickPeer(key string) string {
+	if cluster.mode == modeSlot {
+		if node := cluster.slots.nodeOf(hashslot.Slot(key)); node != nil {
+			return node.addr
+		}
+		return ""
+	}
+	cluster.ringMu.RLock()
+	defer cluster.ringMu.RUnlock()
+	return cluster.consistHash.Get(key)
+}
+
+func (cluster *Cluster) Exec(c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	name := strings.ToLower(string(redisCommand[0]))
+	if !noAuthCommands[name] && !checkPasswd(c) {
+		return protocol.NewGenericErrReply("Authentication required")
+	}
+	// 集群内部命令只能由通过认证的节点发送
+	if internal, ok := internalCommand(name, redisCommand); ok && !c.IsClusterPeer() {
+		return protocol.NewGenericErrReply("command '" + internal + "' is only allowed from cluster peers")
+	}
+	return cluster.exec(c, redisCommand)
+}
+
+// 执行命令（转发到当前节点的命令不再校验）
+func (cluster *Cluster) exec(c abstract.Connection, redisCommand [][]byte) (result protocol.Reply) {
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
@@ -88,17 +228,39 @@ func (cluster *Cluster) Exec(c abstract.Connection, redisCommand [][]byte) (resu
 	}()
 
 	name := strings.ToLower(string(redisCommand[0]))
+	// 事务模式：命令入队，EXEC 时执行
+	if c.IsTransaction() && !multiCommands[name] {
+		return cluster.enqueueCmd(c, redisCommand)
+	}
 	routerFunc, ok := clusterRouter[name]
 	if !ok {
 		return protocol.NewGenericErrReply("unknown command '" + name + "' or not support command in cluster mode")
 	}
+	if name != "asking" {
+		// ASKING 只对下一条命令有效
+		defer c.SetAsking(false)
+	}
 	return routerFunc(cluster, c, redisCommand)
 }
 
 func (cluster *Cluster) Close() {
+	cluster.closeOnce.Do(func() {
+		close(cluster.closed)
+	})
+	if cluster.mode == modeSlot {
+		cluster.saveNodesConf()
+	}
+	if links, ok := cluster.clientFactory.(*PeerLinks); ok {
+		links.Close()
+	}
+	cluster.txLog.close()
 	cluster.engine.Close()
 }
 
+func (cluster *Cluster) AfterClientClose(c abstract.Connection) {
+	cluster.engine.AfterClientClose(c)
+}
+
 func (cluster *Cluster) ForEach(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool) {
 	cluster.engine.ForEach(dbIndex, cb)
 }
@@ -0,0 +1,349 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+)
+
+/*
+CLUSTER 子命令：
+
+keyslot <key>：key所属的槽
+countkeysinslot <slot>：当前节点中，槽内key的数量
+getkeysinslot <slot> <count>：当前节点中，槽内的key
+slots / shards / nodes：槽的分配情况（哈希槽模式）
+setslot / setslotrange / addnode / rebalance：槽迁移（哈希槽模式，见 migrate.go）
+meet / forget / gossip：集群总线（哈希槽模式，见 gossip.go）
+replicate / replicas：从节点（哈希槽模式，见 failover.go）
+info：集群状态
+links：与其他节点之间的连接的统计（见 peer_link.go）
+addpeer / delpeer / setweight / setpeers / rehome / rehomed：动态增删节点、修改权重（一致性hash模式，见 rehome.go）
+distribution：每个节点预期分配到的key的比例（一致性hash模式）
+myid：当前节点的id
+whereis <key>：key所属的节点（一致性hash模式下原来的节点还没有完成迁移时：<新节点> rehoming from <原来的节点>）
+transactions：当前节点参与的TCC事务（见 ring.go）
+nodes：一致性hash模式下为每个节点的权重、虚拟节点数量、连通性（见 ring.go）
+*/
+
+func execCluster(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) < 2 {
+		return protocol.NewArgNumErrReply("cluster")
+	}
+	subCommand := strings.ToLower(string(redisCommand[1]))
+	args := redisCommand[2:]
+
+	switch subCommand {
+	case "keyslot":
+		if len(args) != 1 {
+			return protocol.NewArgNumErrReply("cluster " + subCommand)
+		}
+		return protocol.NewIntegerReply(int64(hashslot.Slot(string(args[0]))))
+	case "countkeysinslot":
+		if len(args) != 1 {
+			return protocol.NewArgNumErrReply("cluster " + subCommand)
+		}
+		slot, errReply := parseSlot(args[0])
+		if errReply != nil {
+			return errReply
+		}
+		return protocol.NewIntegerReply(int64(cluster.engine.CountKeysInSlot(c.GetDBIndex(), slot)))
+	case "getkeysinslot":
+		if len(args) != 2 {
+			return protocol.NewArgNumErrReply("cluster " + subCommand)
+		}
+		slot, errReply := parseSlot(args[0])
+		if errReply != nil {
+			return errReply
+		}
+		count, err := strconv.Atoi(string(args[1]))
+		if err != nil || count < 0 {
+			return protocol.NewGenericErrReply("Invalid number of keys")
+		}
+		keys := cluster.engine.KeysInSlot(c.GetDBIndex(), slot, count)
+		if len(keys) == 0 {
+			return protocol.NewEmptyMultiBulkReply()
+		}
+		result := make([][]byte, len(keys))
+		for i, key := range keys {
+			result[i] = []byte(key)
+		}
+		return protocol.NewMultiBulkReply(result)
+	case "myid":
+		return protocol.NewBulkReply([]byte(nodeID(cluster.self)))
+	case "info":
+		return cluster.clusterInfo()
+	case "whereis":
+		if len(args) != 1 {
+			return protocol.NewArgNumErrReply("cluster whereis")
+		}
+		peer := cluster.whereis(string(args[0]))
+		if peer == "" {
+			return protocol.NewNullBulkReply()
+		}
+		return protocol.NewBulkReply([]byte(peer))
+	case "transactions":
+		return cluster.clusterTransactions()
+	case "links":
+		return cluster.clusterLinks()
+	case "addpeer", "delpeer", "setweight", "setpeers", "rehome", "rehomed", "distribution":
+		if cluster.mode != modeConsistentHash {
+			return protocol.NewGenericErrReply("cluster " + subCommand + " is only supported when cluster-mode is consistent-hash")
+		}
+		switch subCommand {
+		case "addpeer", "delpeer", "setweight":
+			return cluster.clusterChangePeer(subCommand, args)
+		case "distribution":
+			return cluster.clusterDistribution()
+		case "setpeers":
+			return cluster.clusterSetPeers(args)
+		case "rehome":
+			return cluster.clusterRehome(args)
+		}
+		return cluster.clusterRehomed(args)
+	case "slots", "shards", "nodes":
+		if cluster.mode == modeConsistentHash && subCommand == "nodes" {
+			return cluster.clusterRingNodes()
+		}
+		if cluster.mode != modeSlot {
+			return protocol.NewGenericErrReply("cluster " + subCommand + " is only supported when cluster-mode is slot")
+		}
+		switch subCommand {
+		case "slots":
+			return cluster.clusterSlots()
+		case "shards":
+			return cluster.clusterShards()
+		}
+		return cluster.clusterNodes()
+	case "meet", "forget", "gossip":
+		if cluster.mode != modeSlot {
+			return protocol.NewGenericErrReply("cluster " + subCommand + " is only supported when cluster-mode is slot")
+		}
+		switch subCommand {
+		case "meet":
+			return cluster.clusterMeet(args)
+		case "forget":
+			return cluster.clusterForget(args)
+		}
+		return cluster.clusterGossip(args)
+	case "replicate", "replicas", "slaves":
+		if cluster.mode != modeSlot {
+			return protocol.NewGenericErrReply("cluster " + subCommand + " is only supported when cluster-mode is slot")
+		}
+		if subCommand == "replicate" {
+			return cluster.clusterReplicate(args)
+		}
+		return cluster.clusterReplicas(args)
+	case "setslot", "setslotrange", "addnode", "rebalance":
+		if cluster.mode != modeSlot {
+			return protocol.NewGenericErrReply("cluster " + subCommand + " is only supported when cluster-mode is slot")
+		}
+		switch subCommand {
+		case "setslot":
+			return cluster.clusterSetSlot(c, args)
+		case "setslotrange":
+			return cluster.clusterSetSlotRange(args)
+		}
+		if len(args) != 1 {
+			return protocol.NewArgNumErrReply("cluster " + subCommand)
+		}
+		if subCommand == "addnode" {
+			if _, _, err := net.SplitHostPort(string(args[0])); err != nil {
+				return protocol.NewGenericErrReply("invalid address " + string(args[0]))
+			}
+			cluster.slots.addNode(string(args[0]))
+			return protocol.NewOkReply()
+		}
+		return cluster.clusterRebalance(string(args[0]))
+	}
+	return protocol.NewGenericErrReply("unknown subcommand '" + subCommand + "'. Try CLUSTER HELP.")
+}
+
+func parseSlot(arg []byte) (int, protocol.Reply) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= hashslot.SlotCount {
+		return 0, protocol.NewGenericErrReply("Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+func (cluster *Cluster) clusterInfo() protocol.Reply {
+	var knownNodes, size, assigned, pfail, fail int
+	var currentEpoch, myEpoch int64
+	state := "ok"
+	if cluster.mode == modeSlot {
+		t := cluster.slots
+		t.mu.RLock()
+		for _, node := range t.nodes {
+			if !node.hasFlag(nodeHandshake) {
+				knownNodes++
+			}
+		}
+		size = t.sizeLocked()
+		for _, node := range t.slots {
+			switch {
+			case node == nil:
+				continue
+			case node.hasFlag(nodeFail):
+				fail++
+			case node.hasFlag(nodePFail):
+				pfail++
+			}
+			assigned++
+		}
+		currentEpoch, myEpoch = t.currentEpoch, t.myself.configEpoch
+		t.mu.RUnlock()
+		if assigned < hashslot.SlotCount || fail > 0 {
+			state = "fail"
+		}
+	}
+	var unreachable, rehoming int
+	if cluster.mode == modeConsistentHash {
+		knownNodes, unreachable, currentEpoch, rehoming = cluster.ringInfo()
+		size, myEpoch = knownNodes, currentEpoch
+		if unreachable > 0 {
+			state = "fail"
+		}
+	}
+	lines := []string{
+		"cluster_enabled:1",
+		"cluster_mode:" + cluster.mode,
+		"cluster_state:" + state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", knownNodes),
+		fmt.Sprintf("cluster_size:%d", size),
+		fmt.Sprintf("cluster_current_epoch:%d", currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", myEpoch),
+		fmt.Sprintf("cluster_stats_messages_sent:%d", cluster.messagesSent.Load()),
+		fmt.Sprintf("cluster_stats_messages_received:%d", cluster.messagesReceived.Load()),
+		fmt.Sprintf("cluster_transactions_in_flight:%d", cluster.inFlightTransactions()),
+	}
+	if cluster.mode == modeConsistentHash {
+		lines = append(lines,
+			"cluster_hash_func:"+conf.GlobalConfig.ClusterHashFunc,
+			"cluster_hash_strategy:"+conf.GlobalConfig.ClusterHashStrategy,
+			fmt.Sprintf("cluster_peers_unreachable:%d", unreachable),
+			fmt.Sprintf("cluster_peers_rehoming:%d", rehoming),
+		)
+	}
+	return protocol.NewBulkReply([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
+
+// [start end [ip port id] [ip port id]...] ...（主节点在前，之后是从节点）
+func (cluster *Cluster) clusterSlots() protocol.Reply {
+	result := protocol.NewMixReply()
+	for _, node := range cluster.slots.sortedNodes() {
+		ranges := cluster.slots.rangesOf(node)
+		if len(ranges) == 0 {
+			continue
+		}
+		replicas := cluster.slots.replicasOf(node)
+		for _, r := range ranges {
+			item := protocol.NewMixReply()
+			item.Append(protocol.NewIntegerReply(int64(r.start)), protocol.NewIntegerReply(int64(r.end)))
+			for _, n := range append([]*clusterNode{node}, replicas...) {
+				host, port := splitAddr(n.addr)
+				nodeReply := protocol.NewMixReply()
+				nodeReply.Append(protocol.NewBulkReply([]byte(host)), protocol.NewIntegerReply(int64(port)), protocol.NewBulkReply([]byte(n.id)))
+				item.Append(nodeReply)
+			}
+			result.Append(item)
+		}
+	}
+	return result
+}
+
+// [slots [start end ...] nodes [[id .. port .. ip .. endpoint .. role .. replication-offset .. health ..]]] ...
+func (cluster *Cluster) clusterShards() protocol.Reply {
+	result := protocol.NewMixReply()
+	for _, node := range cluster.slots.sortedNodes() {
+		if cluster.slots.masterOf(node) != nil {
+			continue
+		}
+		slots := protocol.NewMixReply()
+		for _, r := range cluster.slots.rangesOf(node) {
+			slots.Append(protocol.NewIntegerReply(int64(r.start)), protocol.NewIntegerReply(int64(r.end)))
+		}
+		nodes := protocol.NewMixReply()
+		nodes.Append(cluster.shardNode(node, "master"))
+		for _, replica := range cluster.slots.replicasOf(node) {
+			nodes.Append(cluster.shardNode(replica, "replica"))
+		}
+
+		shard := protocol.NewMixReply()
+		shard.Append(protocol.NewBulkReply([]byte("slots")), slots, protocol.NewBulkReply([]byte("nodes")), nodes)
+		result.Append(shard)
+	}
+	return result
+}
+
+func (cluster *Cluster) shardNode(node *clusterNode, role string) protocol.Reply {
+	host, port := splitAddr(node.addr)
+	cluster.slots.mu.RLock()
+	offset := node.replOffset
+	cluster.slots.mu.RUnlock()
+	health := "online"
+	if cluster.slots.isFailed(node) {
+		health = "fail"
+	}
+	nodeReply := protocol.NewMixReply()
+	nodeReply.Append(
+		protocol.NewBulkReply([]byte("id")), protocol.NewBulkReply([]byte(node.id)),
+		protocol.NewBulkReply([]byte("port")), protocol.NewIntegerReply(int64(port)),
+		protocol.NewBulkReply([]byte("ip")), protocol.NewBulkReply([]byte(host)),
+		protocol.NewBulkReply([]byte("endpoint")), protocol.NewBulkReply([]byte(host)),
+		protocol.NewBulkReply([]byte("role")), protocol.NewBulkReply([]byte(role)),
+		protocol.NewBulkReply([]byte("replication-offset")), protocol.NewIntegerReply(offset),
+		protocol.NewBulkReply([]byte("health")), protocol.NewBulkReply([]byte(health)),
+	)
+	return nodeReply
+}
+
+// CLUSTER REPLICAS <node-id>：主节点的从节点（格式与 CLUSTER NODES 相同）
+func (cluster *Cluster) clusterReplicas(args [][]byte) protocol.Reply {
+	if len(args) != 1 {
+		return protocol.NewArgNumErrReply("cluster replicas")
+	}
+	t := cluster.slots
+	master := t.nodeByID(string(args[0]))
+	if master == nil {
+		return protocol.NewGenericErrReply("Unknown node " + string(args[0]))
+	}
+	if t.masterOf(master) != nil {
+		return protocol.NewGenericErrReply("The specified node is not a master")
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var result [][]byte
+	for _, line := range strings.Split(t.describeNodes(true), "\n") {
+		if fields := strings.Fields(line); len(fields) > 3 && fields[3] == master.id {
+			result = append(result, []byte(line))
+		}
+	}
+	if len(result) == 0 {
+		return protocol.NewEmptyMultiBulkReply()
+	}
+	return protocol.NewMultiBulkReply(result)
+}
+
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> <slot> ... <slot>
+func (cluster *Cluster) clusterNodes() protocol.Reply {
+	cluster.slots.mu.RLock()
+	defer cluster.slots.mu.RUnlock()
+	return protocol.NewBulkReply([]byte(cluster.slots.describeNodes(true)))
+}
+
+func splitAddr(addr string) (string, int) {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
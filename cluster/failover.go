@@ -0,0 +1,249 @@
+package cluster
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/engine"
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/tool/logger"
+)
+
+/*
+从节点以及故障转移（哈希槽模式）：
+
+1. CLUSTER REPLICATE <master-id>：当前节点（没有负责的槽，并且没有数据）成为主节点的从节点，通过 REPLICAOF 同步主节点的数据
+2. 主节点被标记为下线（FAIL）后，从节点等待 500ms + 随机0~500ms + 排名*1s（复制偏移量越大，排名越靠前）后发起选举：
+   当前纪元+1，向所有主节点发送投票请求（auth-request），请求中包含主节点负责的槽以及主节点的配置纪元
+3. 负责槽的主节点投票：每个纪元只投票一次；只为下线主节点的从节点投票，同一个主节点的从节点 cluster-node-timeout*2 内只投票一次；
+   请求中的槽，当前负责节点的配置纪元不能大于请求中的配置纪元
+4. 获得多数主节点（负责槽的主节点数量/2+1）的投票后，从节点提升为主节点（REPLICAOF NO ONE），使用选举的纪元作为配置纪元，接管原主节点的槽；
+   其他节点通过 gossip 接受新的槽分配（配置纪元较大），原主节点恢复后 or 原主节点的其他从节点，发现槽被接管，成为新主节点的从节点
+5. 选举超时（cluster-node-timeout*2，最少2秒）后，重新选举
+
+客户端执行 READONLY 后，可以在从节点上读取主节点负责的槽
+*/
+
+const (
+	failoverMinTimeout  = 2 * time.Second
+	failoverFixedDelay  = 500 * time.Millisecond
+	failoverRandomDelay = 500 // 毫秒
+	failoverRankDelay   = 1 * time.Second
+)
+
+// 从节点的故障转移状态
+type failoverState struct {
+	// 开始选举的时间
+	authTime time.Time
+	// 是否已经发送投票请求，选举的纪元，获得的投票数
+	authSent  bool
+	authEpoch int64
+	authCount int
+}
+
+// 从节点的故障转移（调用者持有锁）：返回需要发送的投票请求；获得多数投票后提升为主节点
+func (t *slotTable) replicaFailover(now time.Time, nodeTimeout time.Duration) (request *gossipMessage, voters []string, promoted bool) {
+	master := t.myself.master
+	state := &t.failover
+	if master == nil || !master.hasFlag(nodeFail) || len(t.rangesOfLocked(master)) == 0 {
+		*state = failoverState{}
+		return nil, nil, false
+	}
+	authTimeout := nodeTimeout * 2
+	if authTimeout < failoverMinTimeout {
+		authTimeout = failoverMinTimeout
+	}
+
+	// 第一次选举 or 上一次选举超时，重新选举
+	if state.authTime.IsZero() || now.Sub(state.authTime) > authTimeout*2 {
+		rank := t.replicaRank()
+		delay := failoverFixedDelay + time.Duration(rand.Intn(failoverRandomDelay))*time.Millisecond + time.Duration(rank)*failoverRankDelay
+		*state = failoverState{authTime: now.Add(delay)}
+		logger.Infof("cluster: start of election delayed for %d milliseconds (rank #%d, offset %d)", delay.Milliseconds(), rank, t.myself.replOffset)
+		return nil, nil, false
+	}
+	if now.Before(state.authTime) || now.Sub(state.authTime) > authTimeout {
+		return nil, nil, false
+	}
+
+	if !state.authSent {
+		t.currentEpoch++
+		state.authSent = true
+		state.authEpoch = t.currentEpoch
+		t.dirty = true
+		logger.Infof("cluster: starting a failover election for epoch %d", state.authEpoch)
+
+		request = t.buildMessage(gossipAuthRequest, nil)
+		request.ConfigEpoch = master.configEpoch
+		request.Slots = t.slotBitmap(master)
+		for _, node := range t.nodes {
+			if node.master == nil && node != t.myself && node != master && !node.hasFlag(nodeHandshake) {
+				voters = append(voters, node.addr)
+			}
+		}
+		return request, voters, false
+	}
+
+	if state.authCount < t.sizeLocked()/2+1 {
+		return nil, nil, false
+	}
+	t.promote(master, state.authEpoch)
+	*state = failoverState{}
+	return nil, nil, true
+}
+
+// 排名：复制偏移量比自己大的其他从节点的数量
+func (t *slotTable) replicaRank() int {
+	rank := 0
+	for _, node := range t.nodes {
+		if node != t.myself && node.master == t.myself.master && node.replOffset > t.myself.replOffset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// 提升为主节点，接管原主节点的槽（调用者持有锁）
+func (t *slotTable) promote(oldMaster *clusterNode, epoch int64) {
+	t.myself.master = nil
+	t.myself.configEpoch = epoch
+	count := 0
+	for slot, owner := range t.slots {
+		if owner == oldMaster {
+			t.slots[slot] = t.myself
+			count++
+		}
+	}
+	// 立即通知其他节点
+	for _, node := range t.nodes {
+		node.lastPing = time.Time{}
+	}
+	t.dirty = true
+	logger.Warnf("cluster: failover election won, I'm the new master of %d slots (config epoch %d)", count, epoch)
+}
+
+// 向主节点发送投票请求
+func (cluster *Cluster) requestFailoverAuth(addr string, request *gossipMessage) {
+	reply, err := cluster.sendGossip(addr, request)
+	if err != nil {
+		logger.Debugf("cluster: send failover auth request to %s err: %v", addr, err)
+		return
+	}
+	if reply.Type != gossipAuthAck {
+		return
+	}
+	t := cluster.slots
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failover.authSent && t.failover.authEpoch == request.CurrentEpoch {
+		t.failover.authCount++
+		logger.Infof("cluster: failover auth granted to me by %s for epoch %d", addr, request.CurrentEpoch)
+	}
+}
+
+// 主节点：是否同意从节点的投票请求（调用者持有锁）
+func (t *slotTable) voteForFailover(sender *clusterNode, request *gossipMessage, now time.Time, nodeTimeout time.Duration) bool {
+	master := sender.master
+	switch {
+	case t.myself.master != nil || len(t.rangesOfLocked(t.myself)) == 0:
+		// 只有负责槽的主节点可以投票
+		return false
+	case request.CurrentEpoch < t.currentEpoch:
+		logger.Warnf("cluster: failover auth denied to %s: request epoch %d < current epoch %d", sender.addr, request.CurrentEpoch, t.currentEpoch)
+		return false
+	case t.lastVoteEpoch == t.currentEpoch:
+		logger.Warnf("cluster: failover auth denied to %s: already voted for epoch %d", sender.addr, t.currentEpoch)
+		return false
+	case master == nil || !master.hasFlag(nodeFail):
+		logger.Warnf("cluster: failover auth denied to %s: its master is up", sender.addr)
+		return false
+	case now.Sub(master.votedTime) < nodeTimeout*2:
+		logger.Warnf("cluster: failover auth denied to %s: can't vote for the replicas of %s now", sender.addr, master.addr)
+		return false
+	}
+	if len(request.Slots) != hashslot.SlotCount/8 {
+		return false
+	}
+	for slot, owner := range t.slots {
+		if request.Slots[slot/8]&(1<<(slot%8)) == 0 || owner == nil {
+			continue
+		}
+		// 槽已经被配置纪元更大的节点接管
+		if owner.configEpoch > request.ConfigEpoch {
+			logger.Warnf("cluster: failover auth denied to %s: slot %d epoch (%d) > request epoch (%d)", sender.addr, slot, owner.configEpoch, request.ConfigEpoch)
+			return false
+		}
+	}
+	t.lastVoteEpoch = t.currentEpoch
+	master.votedTime = now
+	t.dirty = true
+	logger.Infof("cluster: failover auth granted to %s for epoch %d", sender.addr, t.currentEpoch)
+	return true
+}
+
+// 通过 REPLICAOF 同步主节点的数据
+func (cluster *Cluster) replicate(master *clusterNode) {
+	host, port := splitAddr(master.addr)
+	reply := cluster.engine.ReplicaOf(host, port)
+	if protocol.IsErrReply(reply) {
+		logger.Errorf("cluster: replicate %s failed: %s", master.addr, string(reply.ToBytes()))
+	}
+}
+
+// CLUSTER REPLICATE <node-id>
+func (cluster *Cluster) clusterReplicate(args [][]byte) protocol.Reply {
+	if len(args) != 1 {
+		return protocol.NewArgNumErrReply("cluster replicate")
+	}
+	t := cluster.slots
+	node := t.nodeByID(string(args[0]))
+	if node == nil {
+		return protocol.NewGenericErrReply("Unknown node " + string(args[0]))
+	}
+	if node == t.myself {
+		return protocol.NewGenericErrReply("Can't replicate myself")
+	}
+	if t.masterOf(node) != nil {
+		return protocol.NewGenericErrReply("I can only replicate a master, not a replica.")
+	}
+	if t.masterOf(t.myself) == nil && (len(t.rangesOf(t.myself)) > 0 || cluster.hasKeys()) {
+		return protocol.NewGenericErrReply("To set a master the node must be empty and without assigned slots.")
+	}
+
+	t.mu.Lock()
+	t.myself.master = node
+	t.failover = failoverState{}
+	t.dirty = true
+	t.mu.Unlock()
+	cluster.replicate(node)
+	return protocol.NewOkReply()
+}
+
+// 当前节点是否有数据（所有数据库）
+func (cluster *Cluster) hasKeys() bool {
+	found := false
+	for dbIndex := 0; dbIndex < conf.GlobalConfig.Databases && !found; dbIndex++ {
+		cluster.engine.ForEach(dbIndex, func(key string, data *payload.DataEntity, expiration *time.Time) bool {
+			found = true
+			return false
+		})
+	}
+	return found
+}
+
+// 从节点：执行了 READONLY 的客户端，可以读取主节点负责的槽
+func (cluster *Cluster) readFromReplica(c abstract.Connection, redisCommand [][]byte, keys []string) bool {
+	if !c.IsReadOnly() || len(keys) == 0 || !sameSlot(keys) {
+		return false
+	}
+	master := cluster.slots.masterOf(cluster.slots.myself)
+	if master == nil || cluster.slots.nodeOf(hashslot.Slot(keys[0])) != master {
+		return false
+	}
+	_, writeKeys := engine.GetRelatedKeys(redisCommand)
+	return len(writeKeys) == 0
+}
@@ -0,0 +1,81 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailoverElection(t *testing.T) {
+	masters := []string{"127.0.0.1:6379", "127.0.0.1:6380", "127.0.0.1:6381"}
+	replicaAddr := "127.0.0.1:6382"
+	failedID := newClusterNode(masters[0]).id
+	timeout := time.Second
+
+	// 从节点的视角：主节点 6379 已经下线
+	replica := newSlotTable(replicaAddr, masters)
+	failed := replica.nodes[failedID]
+	replica.myself.master = failed
+	failed.flags |= nodeFail
+	failedSlots := len(replica.rangesOfLocked(failed))
+
+	// 1.延迟一段时间后发起选举
+	now := time.Now()
+	if request, _, _ := replica.replicaFailover(now, timeout); request != nil {
+		t.Fatalf("election should be delayed")
+	}
+	if replica.failover.authTime.Sub(now) < failoverFixedDelay {
+		t.Fatalf("unexpected election delay")
+	}
+	now = replica.failover.authTime
+	request, voters, _ := replica.replicaFailover(now, timeout)
+	if request == nil || request.Type != gossipAuthRequest || request.CurrentEpoch != 1 || len(voters) != 2 {
+		t.Fatalf("unexpected auth request %+v, voters %v", request, voters)
+	}
+
+	// 2.其他主节点投票
+	newVoter := func(addr string, masterFailed bool) (*slotTable, *clusterNode) {
+		voter := newSlotTable(addr, masters)
+		sender := voter.addNode(replicaAddr)
+		sender.master = voter.nodes[failedID]
+		if masterFailed {
+			sender.master.flags |= nodeFail
+		}
+		return voter, sender
+	}
+	voter1, sender1 := newVoter(masters[1], true)
+	voter1.currentEpoch = request.CurrentEpoch
+	if !voter1.voteForFailover(sender1, request, now, timeout) {
+		t.Fatalf("expect vote granted")
+	}
+	if voter1.voteForFailover(sender1, request, now, timeout) {
+		t.Fatalf("should vote only once per epoch")
+	}
+	voter2, sender2 := newVoter(masters[2], false)
+	voter2.currentEpoch = request.CurrentEpoch
+	if voter2.voteForFailover(sender2, request, now, timeout) {
+		t.Fatalf("should not vote when the master is up")
+	}
+	sender2.master.flags |= nodeFail
+	if !voter2.voteForFailover(sender2, request, now, timeout) {
+		t.Fatalf("expect vote granted")
+	}
+
+	// 3.获得多数投票后提升为主节点，接管原主节点的槽
+	replica.failover.authCount = 2
+	if _, _, promoted := replica.replicaFailover(now, timeout); !promoted {
+		t.Fatalf("expect promoted")
+	}
+	if replica.myself.master != nil || replica.myself.configEpoch != request.CurrentEpoch ||
+		len(replica.rangesOfLocked(replica.myself)) != failedSlots || len(replica.rangesOfLocked(failed)) != 0 {
+		t.Fatalf("unexpected slot table after promotion")
+	}
+
+	// 4.原主节点恢复后，发现槽被接管，成为新主节点的从节点
+	old := newSlotTable(masters[0], masters)
+	newMaster := old.addNode(replicaAddr)
+	newMaster.configEpoch = request.CurrentEpoch
+	lost, master := old.updateSlots(newMaster, replica.slotBitmap(replica.myself))
+	if len(lost) != 0 || master != newMaster || old.myself.master != newMaster {
+		t.Fatalf("old master should become a replica of the new master")
+	}
+}
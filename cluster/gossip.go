@@ -0,0 +1,631 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+集群总线（哈希槽模式）：节点之间通过 CLUSTER GOSSIP <消息> 交换集群状态，消息格式为json
+
+1. 每秒向每个已知节点发送PING，对方回复PONG；消息中包含发送者的当前纪元、配置纪元、负责的槽（位图），以及发送者看到的其他节点的状态
+2. 超过 cluster-node-timeout 没有收到PONG，标记为疑似下线（PFAIL），并通过 gossip 告知其他节点
+3. 多数主节点（负责槽的节点数量/2+1，包括自己）报告疑似下线，标记为下线（FAIL），并向所有节点广播FAIL消息
+4. 槽冲突时，以配置纪元较大的节点为准；两个节点的配置纪元相同时，id较小的节点增加配置纪元
+5. CLUSTER MEET 向新节点发送MEET消息，新节点收到后认识发送者；其他节点通过 gossip 认识新节点（握手）
+6. CLUSTER FORGET 删除节点，60秒内不会通过 gossip 重新加入（需要在所有节点上执行）
+
+节点、槽分配表、纪元保存到 nodes.conf（见 nodesconf.go）
+*/
+
+// 消息类型
+const (
+	gossipPing = "ping"
+	gossipPong = "pong"
+	gossipMeet = "meet"
+	gossipFail = "fail"
+	// 故障转移：从节点请求投票，主节点同意后回复 auth-ack（见 failover.go）
+	gossipAuthRequest = "auth-request"
+	gossipAuthAck     = "auth-ack"
+)
+
+const (
+	clusterCronInterval = 100 * time.Millisecond
+	clusterPingPeriod   = 1 * time.Second
+	// 下线报告的有效期：cluster-node-timeout * 2
+	failReportValidityMult = 2
+	// 负责槽的节点恢复后，下线超过 cluster-node-timeout * 2 才清除FAIL标记
+	failUndoTimeMult   = 2
+	forgetBlacklistTTL = 60 * time.Second
+)
+
+type gossipMessage struct {
+	Type         string        `json:"type"`
+	Sender       string        `json:"sender"`
+	Addr         string        `json:"addr"`
+	CurrentEpoch int64         `json:"current_epoch"`
+	ConfigEpoch  int64         `json:"config_epoch"`
+	Slots        []byte        `json:"slots"` // 发送者负责的槽（位图）
+	Gossip       []gossipEntry `json:"gossip,omitempty"`
+	Fail         string        `json:"fail,omitempty"`   // FAIL消息：下线节点的id
+	Master       string        `json:"master,omitempty"` // 发送者是从节点时，复制的主节点id
+	ReplOffset   int64         `json:"repl_offset"`
+}
+
+// 发送者看到的其他节点的状态
+type gossipEntry struct {
+	ID    string `json:"id"`
+	Addr  string `json:"addr"`
+	PFail bool   `json:"pfail,omitempty"`
+	Fail  bool   `json:"fail,omitempty"`
+}
+
+func (cluster *Cluster) cron() {
+	ticker := time.NewTicker(clusterCronInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cluster.clusterCron()
+		case <-cluster.closed:
+			return
+		}
+	}
+}
+
+// 定时任务：发送PING，检测下线，从节点故障转移，保存nodes.conf
+func (cluster *Cluster) clusterCron() {
+	t := cluster.slots
+	now := time.Now()
+	var failed []*clusterNode
+	replOffset := cluster.engine.ReplOffset()
+
+	t.mu.Lock()
+	t.myself.replOffset = replOffset
+	for id, expire := range t.blacklist {
+		if now.After(expire) {
+			delete(t.blacklist, id)
+		}
+	}
+	for _, node := range t.nodes {
+		if node == t.myself {
+			continue
+		}
+		// 握手超时
+		if node.hasFlag(nodeHandshake) && now.Sub(node.createTime) > cluster.nodeTimeout {
+			logger.Infof("cluster: handshake with %s timeout", node.addr)
+			t.delNode(node)
+			continue
+		}
+		if !node.pingSent.IsZero() && now.Sub(node.pingSent) > cluster.nodeTimeout && !node.hasFlag(nodePFail|nodeFail) {
+			node.flags |= nodePFail
+			logger.Infof("cluster: node %s (%s) possibly failing", node.id, node.addr)
+		}
+		if t.markFailingIfNeeded(node, now, cluster.nodeTimeout) {
+			failed = append(failed, node)
+		}
+
+		if now.Sub(node.lastPing) >= clusterPingPeriod && node.pinging.CompareAndSwap(false, true) {
+			node.lastPing = now
+			if node.pingSent.IsZero() {
+				node.pingSent = now
+			}
+			// 握手中的节点可能还不认识自己，发送MEET
+			msgType := gossipPing
+			if node.hasFlag(nodeHandshake) {
+				msgType = gossipMeet
+			}
+			msg := t.buildMessage(msgType, node)
+			go func(node *clusterNode) {
+				defer node.pinging.Store(false)
+				cluster.ping(node, msg)
+			}(node)
+		}
+	}
+	authRequest, voters, promoted := t.replicaFailover(now, cluster.nodeTimeout)
+	dirty := t.dirty
+	t.dirty = false
+	t.mu.Unlock()
+
+	for _, node := range failed {
+		cluster.broadcastFail(node)
+	}
+	for _, addr := range voters {
+		go cluster.requestFailoverAuth(addr, authRequest)
+	}
+	if promoted {
+		cluster.engine.ReplicaOfNoOne()
+	}
+	if dirty {
+		cluster.saveNodesConf()
+	}
+}
+
+func (cluster *Cluster) ping(node *clusterNode, msg *gossipMessage) {
+	pong, err := cluster.sendGossip(node.addr, msg)
+	if err != nil {
+		logger.Debugf("cluster: ping %s err: %v", node.addr, err)
+		return
+	}
+	if pong.Sender != node.id {
+		logger.Warnf("cluster: node %s replied with unexpected id %s", node.addr, pong.Sender)
+		return
+	}
+	cluster.handleGossip(pong, true)
+}
+
+func (cluster *Cluster) sendGossip(addr string, msg *gossipMessage) (*gossipMessage, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := cluster.clientFactory.GetConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer cluster.clientFactory.ReturnConn(addr, client)
+
+	reply, err := client.Send(utils.ToCmdLine("cluster", "gossip", string(data)))
+	if err != nil {
+		return nil, err
+	}
+	cluster.messagesSent.Add(1)
+	bulkReply, ok := reply.(*protocol.BulkReply)
+	if !ok {
+		return nil, errors.New(strings.TrimSpace(string(reply.ToBytes())))
+	}
+	pong := &gossipMessage{}
+	if err := json.Unmarshal(bulkReply.Arg, pong); err != nil {
+		return nil, err
+	}
+	cluster.messagesReceived.Add(1)
+	return pong, nil
+}
+
+// 向所有节点广播FAIL消息
+func (cluster *Cluster) broadcastFail(failed *clusterNode) {
+	t := cluster.slots
+	t.mu.RLock()
+	msg := t.buildMessage(gossipFail, nil)
+	msg.Fail = failed.id
+	var addrs []string
+	for _, node := range t.nodes {
+		if node != t.myself && node != failed && !node.hasFlag(nodeHandshake) {
+			addrs = append(addrs, node.addr)
+		}
+	}
+	t.mu.RUnlock()
+
+	for _, addr := range addrs {
+		go func(addr string) {
+			if _, err := cluster.sendGossip(addr, msg); err != nil {
+				logger.Debugf("cluster: send fail message to %s err: %v", addr, err)
+			}
+		}(addr)
+	}
+}
+
+// CLUSTER GOSSIP <消息>：处理其他节点发送的消息，回复PONG
+func (cluster *Cluster) clusterGossip(args [][]byte) protocol.Reply {
+	if len(args) != 1 {
+		return protocol.NewArgNumErrReply("cluster gossip")
+	}
+	msg := &gossipMessage{}
+	if err := json.Unmarshal(args[0], msg); err != nil {
+		return protocol.NewGenericErrReply("invalid gossip message")
+	}
+	cluster.messagesReceived.Add(1)
+	voted := cluster.handleGossip(msg, false)
+
+	t := cluster.slots
+	t.mu.RLock()
+	pong := t.buildMessage(gossipPong, t.nodes[msg.Sender])
+	t.mu.RUnlock()
+	if voted {
+		pong.Type = gossipAuthAck
+	}
+	data, err := json.Marshal(pong)
+	if err != nil {
+		return protocol.NewGenericErrReply(err.Error())
+	}
+	cluster.messagesSent.Add(1)
+	return protocol.NewBulkReply(data)
+}
+
+// 处理消息（isPong：自己发送的PING的回复），返回是否同意发送者的投票请求
+func (cluster *Cluster) handleGossip(msg *gossipMessage, isPong bool) (voted bool) {
+	t := cluster.slots
+	now := time.Now()
+	var lostSlots []int
+	var failed []*clusterNode
+	var newMaster *clusterNode
+
+	t.mu.Lock()
+	sender := t.nodes[msg.Sender]
+	if sender == nil && msg.Type == gossipMeet && !t.blacklisted(msg.Sender, now) {
+		// 只接受MEET消息的未知发送者
+		if node := newClusterNode(msg.Addr); node.id == msg.Sender {
+			sender = node
+			t.nodes[node.id] = node
+			t.dirty = true
+			logger.Infof("cluster: meet node %s (%s)", node.id, node.addr)
+		}
+	}
+	if sender == nil || sender == t.myself {
+		t.mu.Unlock()
+		return false
+	}
+
+	if isPong {
+		sender.pongReceived = now
+		sender.pingSent = time.Time{}
+		sender.flags &^= nodePFail
+		if sender.hasFlag(nodeFail) && (len(t.rangesOfLocked(sender)) == 0 || now.Sub(sender.failTime) > cluster.nodeTimeout*failUndoTimeMult) {
+			sender.flags &^= nodeFail
+			t.dirty = true
+			logger.Infof("cluster: clear FAIL state for node %s (%s): is reachable again", sender.id, sender.addr)
+		}
+	}
+	if sender.hasFlag(nodeHandshake) {
+		sender.flags &^= nodeHandshake
+		t.dirty = true
+	}
+	if msg.CurrentEpoch > t.currentEpoch {
+		t.currentEpoch = msg.CurrentEpoch
+		t.dirty = true
+	}
+	t.updateRole(sender, msg.Master)
+	sender.replOffset = msg.ReplOffset
+
+	switch msg.Type {
+	case gossipFail:
+		if node := t.nodes[msg.Fail]; node != nil && node != t.myself && !node.hasFlag(nodeFail) {
+			node.flags = node.flags&^nodePFail | nodeFail
+			node.failTime = now
+			t.dirty = true
+			logger.Warnf("cluster: FAIL message received from %s about %s (%s)", sender.addr, node.id, node.addr)
+		}
+	case gossipAuthRequest:
+		voted = t.voteForFailover(sender, msg, now, cluster.nodeTimeout)
+	default:
+		if msg.ConfigEpoch != sender.configEpoch {
+			sender.configEpoch = msg.ConfigEpoch
+			t.dirty = true
+		}
+		// 从节点不负责槽
+		if sender.master == nil {
+			lostSlots, newMaster = t.updateSlots(sender, msg.Slots)
+			t.handleConfigEpochCollision(sender)
+		}
+		failed = t.processGossipSection(sender, msg.Gossip, now, cluster.nodeTimeout)
+	}
+	t.mu.Unlock()
+
+	for _, node := range failed {
+		cluster.broadcastFail(node)
+	}
+	if newMaster != nil {
+		cluster.replicate(newMaster)
+	} else if len(lostSlots) > 0 {
+		cluster.delKeysInSlots(lostSlots)
+	}
+	return voted
+}
+
+// 更新节点的角色（还不认识主节点时忽略）
+func (t *slotTable) updateRole(node *clusterNode, masterID string) {
+	var master *clusterNode
+	if masterID != "" {
+		if master = t.nodes[masterID]; master == nil || master == node {
+			return
+		}
+	}
+	if node.master != master {
+		node.master = master
+		t.dirty = true
+	}
+}
+
+// 构造消息（调用者持有锁），target：消息的接收者（不需要告知接收者自己的状态）
+func (t *slotTable) buildMessage(msgType string, target *clusterNode) *gossipMessage {
+	msg := &gossipMessage{
+		Type:         msgType,
+		Sender:       t.myself.id,
+		Addr:         t.myself.addr,
+		CurrentEpoch: t.currentEpoch,
+		ConfigEpoch:  t.myself.configEpoch,
+		Slots:        t.slotBitmap(t.myself),
+		ReplOffset:   t.myself.replOffset,
+	}
+	if t.myself.master != nil {
+		msg.Master = t.myself.master.id
+	}
+	for _, node := range t.nodes {
+		if node == t.myself || node == target || node.hasFlag(nodeHandshake) {
+			continue
+		}
+		msg.Gossip = append(msg.Gossip, gossipEntry{
+			ID:    node.id,
+			Addr:  node.addr,
+			PFail: node.hasFlag(nodePFail),
+			Fail:  node.hasFlag(nodeFail),
+		})
+	}
+	return msg
+}
+
+// 节点负责的槽（位图）
+func (t *slotTable) slotBitmap(node *clusterNode) []byte {
+	bitmap := make([]byte, hashslot.SlotCount/8)
+	for slot, owner := range t.slots {
+		if owner == node {
+			bitmap[slot/8] |= 1 << (slot % 8)
+		}
+	}
+	return bitmap
+}
+
+// 根据主节点负责的槽更新槽分配表（配置纪元较大的为准），返回自己失去的槽；
+// 自己（or 自己的主节点）的槽全部被发送者接管时（故障转移），返回新的主节点
+func (t *slotTable) updateSlots(sender *clusterNode, bitmap []byte) ([]int, *clusterNode) {
+	if len(bitmap) != hashslot.SlotCount/8 {
+		return nil, nil
+	}
+	current := t.myself
+	if t.myself.master != nil {
+		current = t.myself.master
+	}
+	var lost []int
+	taken := 0
+	for slot := 0; slot < hashslot.SlotCount; slot++ {
+		if bitmap[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		owner := t.slots[slot]
+		// 迁入中的槽由迁移流程（SETSLOT NODE）决定
+		if owner == sender || t.importing[slot] != nil {
+			continue
+		}
+		if owner != nil && owner.configEpoch >= sender.configEpoch {
+			continue
+		}
+		if owner == t.myself {
+			lost = append(lost, slot)
+		}
+		if owner == current {
+			taken++
+		}
+		t.slots[slot] = sender
+		delete(t.migrating, slot)
+		t.dirty = true
+	}
+	if len(lost) > 0 {
+		logger.Warnf("cluster: %d slots are now served by %s (config epoch %d)", len(lost), sender.addr, sender.configEpoch)
+	}
+	if taken > 0 && len(t.rangesOfLocked(current)) == 0 {
+		logger.Warnf("cluster: all slots of %s are served by %s now, reconfiguring myself as a replica of %s", current.addr, sender.addr, sender.addr)
+		t.myself.master = sender
+		t.failover = failoverState{}
+		t.dirty = true
+		// 通过全量同步替换数据，不需要删除
+		return nil, sender
+	}
+	return lost, nil
+}
+
+// 配置纪元冲突：id较小的节点增加配置纪元，保证每个主节点的配置纪元唯一
+func (t *slotTable) handleConfigEpochCollision(sender *clusterNode) {
+	if t.myself.master != nil || sender.configEpoch != t.myself.configEpoch || sender.id <= t.myself.id {
+		return
+	}
+	t.currentEpoch++
+	t.myself.configEpoch = t.currentEpoch
+	t.dirty = true
+	logger.Infof("cluster: config epoch collision with node %s, new config epoch %d", sender.id, t.myself.configEpoch)
+}
+
+// 处理消息中其他节点的状态：认识新节点，记录下线报告；返回标记为下线的节点
+func (t *slotTable) processGossipSection(sender *clusterNode, entries []gossipEntry, now time.Time, timeout time.Duration) []*clusterNode {
+	var failed []*clusterNode
+	for _, entry := range entries {
+		if entry.ID == t.myself.id {
+			continue
+		}
+		node := t.nodes[entry.ID]
+		if node == nil {
+			if t.blacklisted(entry.ID, now) {
+				continue
+			}
+			if node = newClusterNode(entry.Addr); node.id == entry.ID {
+				node.flags |= nodeHandshake
+				t.nodes[node.id] = node
+				t.dirty = true
+				logger.Infof("cluster: start handshake with %s (learned from %s)", node.addr, sender.addr)
+			}
+			continue
+		}
+
+		// 只记录主节点的下线报告
+		if sender.master == nil {
+			if entry.PFail || entry.Fail {
+				node.failReports[sender.id] = now
+			} else {
+				delete(node.failReports, sender.id)
+			}
+		}
+		if t.markFailingIfNeeded(node, now, timeout) {
+			failed = append(failed, node)
+		}
+	}
+	return failed
+}
+
+// 自己认为节点疑似下线，且多数主节点报告疑似下线时，标记为下线
+func (t *slotTable) markFailingIfNeeded(node *clusterNode, now time.Time, timeout time.Duration) bool {
+	if !node.hasFlag(nodePFail) || node.hasFlag(nodeFail) {
+		return false
+	}
+	size := t.sizeLocked()
+	if size == 0 {
+		return false
+	}
+	// 自己是主节点时，包括自己
+	failures := 0
+	if t.myself.master == nil {
+		failures = 1
+	}
+	for reporter, reportTime := range node.failReports {
+		if now.Sub(reportTime) > timeout*failReportValidityMult || t.nodes[reporter] == nil {
+			delete(node.failReports, reporter)
+			continue
+		}
+		failures++
+	}
+	if failures < size/2+1 {
+		return false
+	}
+	node.flags = node.flags&^nodePFail | nodeFail
+	node.failTime = now
+	t.dirty = true
+	logger.Warnf("cluster: marking node %s (%s) as failing (quorum reached)", node.id, node.addr)
+	return true
+}
+
+// 负责槽的主节点数量（下线报告、故障转移投票的法定人数为 size/2+1）
+func (t *slotTable) sizeLocked() int {
+	owners := make(map[*clusterNode]struct{})
+	for _, node := range t.slots {
+		if node != nil {
+			owners[node] = struct{}{}
+		}
+	}
+	return len(owners)
+}
+
+func (t *slotTable) blacklisted(id string, now time.Time) bool {
+	expire, ok := t.blacklist[id]
+	return ok && now.Before(expire)
+}
+
+// 删除节点（调用者持有锁）
+func (t *slotTable) delNode(node *clusterNode) {
+	delete(t.nodes, node.id)
+	for slot, owner := range t.slots {
+		if owner == node {
+			t.slots[slot] = nil
+		}
+	}
+	for slot, peer := range t.migrating {
+		if peer == node {
+			delete(t.migrating, slot)
+		}
+	}
+	for slot, peer := range t.importing {
+		if peer == node {
+			delete(t.importing, slot)
+		}
+	}
+	for _, other := range t.nodes {
+		delete(other.failReports, node.id)
+	}
+	t.dirty = true
+}
+
+// 没有经过选举，直接增加配置纪元（自己的配置纪元不是最大的时候）
+func (t *slotTable) bumpConfigEpoch() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	maxEpoch := int64(0)
+	for _, node := range t.nodes {
+		if node.configEpoch > maxEpoch {
+			maxEpoch = node.configEpoch
+		}
+	}
+	if t.myself.configEpoch != 0 && t.myself.configEpoch == maxEpoch {
+		return
+	}
+	t.currentEpoch++
+	t.myself.configEpoch = t.currentEpoch
+	t.dirty = true
+	logger.Infof("cluster: new config epoch %d", t.myself.configEpoch)
+}
+
+func (t *slotTable) isFailed(node *clusterNode) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return node.hasFlag(nodeFail)
+}
+
+// 槽已经由其他节点负责，删除当前节点中残留的key
+func (cluster *Cluster) delKeysInSlots(slots []int) {
+	conn := connection.NewVirtualConn()
+	for dbIndex := 0; dbIndex < conf.GlobalConfig.Databases; dbIndex++ {
+		conn.SetDBIndex(dbIndex)
+		for _, slot := range slots {
+			keys := cluster.engine.KeysInSlot(dbIndex, slot, -1)
+			if len(keys) == 0 {
+				continue
+			}
+			logger.Warnf("cluster: slot %d is served by another node, delete %d keys (db %d)", slot, len(keys), dbIndex)
+			cluster.engine.Exec(conn, utils.ToCmdLine("del", keys...))
+		}
+	}
+}
+
+// CLUSTER MEET <ip> <port>
+func (cluster *Cluster) clusterMeet(args [][]byte) protocol.Reply {
+	if len(args) != 2 {
+		return protocol.NewArgNumErrReply("cluster meet")
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 || net.ParseIP(string(args[0])) == nil {
+		return protocol.NewGenericErrReply("Invalid node address specified: " + string(args[0]) + ":" + string(args[1]))
+	}
+	addr := net.JoinHostPort(string(args[0]), string(args[1]))
+
+	t := cluster.slots
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node := newClusterNode(addr)
+	if _, ok := t.nodes[node.id]; ok {
+		return protocol.NewOkReply()
+	}
+	node.flags |= nodeHandshake
+	t.nodes[node.id] = node
+	delete(t.blacklist, node.id)
+	t.dirty = true
+	return protocol.NewOkReply()
+}
+
+// CLUSTER FORGET <node-id>
+func (cluster *Cluster) clusterForget(args [][]byte) protocol.Reply {
+	if len(args) != 1 {
+		return protocol.NewArgNumErrReply("cluster forget")
+	}
+	id := string(args[0])
+
+	t := cluster.slots
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node := t.nodes[id]
+	if node == nil {
+		return protocol.NewGenericErrReply("Unknown node " + id)
+	}
+	if node == t.myself {
+		return protocol.NewGenericErrReply("I tried hard but I can't forget myself...")
+	}
+	t.delNode(node)
+	t.blacklist[id] = time.Now().Add(forgetBlacklistTTL)
+	return protocol.NewOkReply()
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+// 可以模拟节点下线的连接池
+type downFactory struct {
+	self string
+}
+
+var (
+	downMu    sync.Mutex
+	downNodes = map[string]bool{}
+)
+
+func setDown(addr string, down bool) {
+	downMu.Lock()
+	defer downMu.Unlock()
+	downNodes[addr] = down
+}
+
+func (f *downFactory) GetConn(addr string) (Client, error) {
+	downMu.Lock()
+	defer downMu.Unlock()
+	if downNodes[addr] || downNodes[f.self] {
+		return nil, errors.New("connection refused")
+	}
+	return &fakeClient{cluster: getCluster(addr)}, nil
+}
+
+func (f *downFactory) ReturnConn(peer string, cli Client) error {
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func nodeFlags(c *Cluster, addr string) (known bool, flags int) {
+	c.slots.mu.RLock()
+	defer c.slots.mu.RUnlock()
+	node := c.slots.nodes[newClusterNode(addr).id]
+	if node == nil {
+		return false, 0
+	}
+	return true, node.flags
+}
+
+func TestGossip(t *testing.T) {
+	conf.GlobalConfig.ClusterMode = modeSlot
+	conf.GlobalConfig.ClusterConfigFile = ""
+	conf.GlobalConfig.ClusterNodeTimeout = 500
+	defer func() {
+		conf.GlobalConfig.ClusterMode = modeConsistentHash
+		conf.GlobalConfig.ClusterConfigFile = "nodes.conf"
+		conf.GlobalConfig.ClusterNodeTimeout = 15000
+	}()
+
+	peers := []string{"127.0.0.1:26379", "127.0.0.1:26380", "127.0.0.1:26381"}
+	newAddr := "127.0.0.1:26382"
+	addrs := append(append([]string{}, peers...), newAddr)
+	for _, addr := range addrs {
+		conf.GlobalConfig.Peers = peers
+		if addr == newAddr {
+			conf.GlobalConfig.Peers = nil
+		}
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&downFactory{self: addr})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+
+	// 1.MEET：新节点通过 gossip 被所有节点认识
+	if reply := first.Exec(conn, utils.ToCmdLine("cluster", "meet", "127.0.0.1", "26382")); string(reply.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("cluster meet: %q", reply.ToBytes())
+	}
+	waitFor(t, "meet", func() bool {
+		for _, addr := range addrs {
+			for _, other := range addrs {
+				if known, flags := nodeFlags(cluster[addr], other); !known || flags&nodeHandshake != 0 {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if cluster[newAddr].slots.assignedCount() != hashslot.SlotCount {
+		t.Fatalf("new node should learn the slot table")
+	}
+
+	// 2.节点下线：其他节点先标记为PFAIL，多数主节点同意后标记为FAIL
+	failedAddr := peers[2]
+	setDown(failedAddr, true)
+	waitFor(t, "fail", func() bool {
+		for _, addr := range addrs {
+			if addr == failedAddr {
+				continue
+			}
+			if _, flags := nodeFlags(cluster[addr], failedAddr); flags&nodeFail == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	key := "foo" // 12182，属于 127.0.0.1:26381
+	if reply := first.Exec(conn, utils.ToCmdLine("get", key)); string(reply.ToBytes()) != "-CLUSTERDOWN The cluster is down\r\n" {
+		t.Fatalf("expect CLUSTERDOWN, got %q", reply.ToBytes())
+	}
+
+	// 3.节点恢复后，清除FAIL标记
+	setDown(failedAddr, false)
+	waitFor(t, "recover", func() bool {
+		_, flags := nodeFlags(first, failedAddr)
+		return flags&(nodeFail|nodePFail) == 0
+	})
+
+	// 4.FORGET：其他节点的 gossip 不会让节点重新加入
+	newID := newClusterNode(newAddr).id
+	if reply := first.Exec(conn, utils.ToCmdLine("cluster", "forget", newID)); string(reply.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("cluster forget: %q", reply.ToBytes())
+	}
+	time.Sleep(2 * clusterPingPeriod)
+	if known, _ := nodeFlags(first, newAddr); known {
+		t.Fatalf("forgotten node should not be added back")
+	}
+}
+
+func TestNodesConf(t *testing.T) {
+	table := newSlotTable("127.0.0.1:7379", []string{"127.0.0.1:6379", "127.0.0.1:7379"})
+	other := table.nodes[newClusterNode("127.0.0.1:6379").id]
+	table.currentEpoch = 5
+	table.myself.configEpoch = 5
+	other.configEpoch = 3
+	table.migrating[10000] = other
+	table.importing[100] = other
+	table.slots[200] = nil
+	table.lastVoteEpoch = 4
+	replica := table.addNode("127.0.0.1:8379")
+	replica.master = other
+
+	filename := filepath.Join(t.TempDir(), "nodes.conf")
+	c := &Cluster{self: "127.0.0.1:7379", slots: table, configFile: filename}
+	c.saveNodesConf()
+
+	loaded, err := loadNodesConf(filename, "127.0.0.1:7379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.myself.id != table.myself.id || loaded.currentEpoch != 5 || loaded.myself.configEpoch != 5 ||
+		loaded.nodes[other.id].configEpoch != 3 {
+		t.Fatalf("unexpected nodes or epochs")
+	}
+	for slot := 0; slot < hashslot.SlotCount; slot++ {
+		if (table.slots[slot] == nil) != (loaded.slots[slot] == nil) ||
+			(table.slots[slot] != nil && table.slots[slot].id != loaded.slots[slot].id) {
+			t.Fatalf("slot %d owner mismatch", slot)
+		}
+	}
+	if loaded.lastVoteEpoch != 4 || loaded.nodes[replica.id].master != loaded.nodes[other.id] {
+		t.Fatalf("replica or lastVoteEpoch not loaded")
+	}
+	if loaded.migrating[10000].id != other.id || loaded.importing[100].id != other.id {
+		t.Fatalf("migration state not loaded")
+	}
+	if _, err := loadNodesConf(filename, "127.0.0.1:6379"); err == nil {
+		t.Fatalf("expect error when myself doesn't match")
+	}
+}
@@ -0,0 +1,410 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+槽迁移（将 slot 从 source 迁移到 target）：
+
+1. target: CLUSTER SETSLOT <slot> IMPORTING <source-id>
+2. source: CLUSTER SETSLOT <slot> MIGRATING <target-id>
+3. source: CLUSTER GETKEYSINSLOT <slot> <count> + MIGRATE <host> <port> "" 0 <timeout> KEYS <key> ...，直到槽内没有key
+4. 所有节点: CLUSTER SETSLOT <slot> NODE <target-id>
+
+迁移过程中，已经迁走的key由 -ASK 重定向到 target
+
+CLUSTER REBALANCE <ip:port>：将新节点加入集群，并从其他节点平均迁移槽到新节点
+（迁移所有数据库中属于该槽的key）
+*/
+
+const (
+	migrateBatch   = 100
+	migrateTimeout = 5000
+)
+
+// 添加节点（不负责任何槽）
+func (t *slotTable) addNode(addr string) *clusterNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node := newClusterNode(addr)
+	if exist, ok := t.nodes[node.id]; ok {
+		return exist
+	}
+	t.nodes[node.id] = node
+	delete(t.blacklist, node.id)
+	t.dirty = true
+	return node
+}
+
+func (t *slotTable) nodeByID(id string) *clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.nodes[id]
+}
+
+func (t *slotTable) setImporting(slot int, source *clusterNode) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.slots[slot] == t.myself {
+		return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	}
+	t.importing[slot] = source
+	t.dirty = true
+	return nil
+}
+
+func (t *slotTable) setMigrating(slot int, target *clusterNode) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.slots[slot] != t.myself {
+		return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	}
+	t.migrating[slot] = target
+	t.dirty = true
+	return nil
+}
+
+// 设置槽的负责节点，并结束迁移状态
+func (t *slotTable) setOwner(start int, end int, node *clusterNode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for slot := start; slot <= end; slot++ {
+		t.slots[slot] = node
+		delete(t.migrating, slot)
+		delete(t.importing, slot)
+	}
+	t.dirty = true
+}
+
+func (t *slotTable) setStable(slot int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.migrating, slot)
+	delete(t.importing, slot)
+	t.dirty = true
+}
+
+// CLUSTER SETSLOT <slot> IMPORTING <node-id> | MIGRATING <node-id> | NODE <node-id> | STABLE
+func (cluster *Cluster) clusterSetSlot(c abstract.Connection, args [][]byte) protocol.Reply {
+	if len(args) < 2 {
+		return protocol.NewArgNumErrReply("cluster setslot")
+	}
+	slot, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToLower(string(args[1]))
+	if action == "stable" {
+		if len(args) != 2 {
+			return protocol.NewSyntaxErrReply()
+		}
+		cluster.slots.setStable(slot)
+		return protocol.NewOkReply()
+	}
+	if len(args) != 3 {
+		return protocol.NewSyntaxErrReply()
+	}
+	node := cluster.slots.nodeByID(string(args[2]))
+	if node == nil {
+		return protocol.NewGenericErrReply("I don't know about node " + string(args[2]))
+	}
+
+	var err error
+	switch action {
+	case "importing":
+		if node == cluster.slots.myself {
+			return protocol.NewGenericErrReply("I'm the source node of hash slot " + strconv.Itoa(slot))
+		}
+		err = cluster.slots.setImporting(slot, node)
+	case "migrating":
+		if node == cluster.slots.myself {
+			return protocol.NewGenericErrReply("I'm the target node of hash slot " + strconv.Itoa(slot))
+		}
+		err = cluster.slots.setMigrating(slot, node)
+	case "node":
+		owner := cluster.slots.nodeOf(slot)
+		if owner == cluster.slots.myself && node != owner && cluster.hasKeysInSlot(slot) {
+			return protocol.NewGenericErrReply(fmt.Sprintf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		imported := node == cluster.slots.myself && cluster.slots.importingFrom(slot) != nil
+		cluster.slots.setOwner(slot, slot, node)
+		if imported {
+			// 迁入完成，增加配置纪元，其他节点通过 gossip 接受新的槽分配
+			cluster.slots.bumpConfigEpoch()
+		}
+	default:
+		return protocol.NewSyntaxErrReply()
+	}
+	if err != nil {
+		return protocol.NewGenericErrReply(err.Error())
+	}
+	return protocol.NewOkReply()
+}
+
+// CLUSTER SETSLOTRANGE <start> <end> NODE <node-id>：批量设置槽的负责节点（新节点加入时同步槽分配表）
+func (cluster *Cluster) clusterSetSlotRange(args [][]byte) protocol.Reply {
+	if len(args) != 4 || strings.ToLower(string(args[2])) != "node" {
+		return protocol.NewArgNumErrReply("cluster setslotrange")
+	}
+	start, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	end, errReply := parseSlot(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	if start > end {
+		return protocol.NewGenericErrReply("start slot number " + strconv.Itoa(start) + " is greater than end slot number " + strconv.Itoa(end))
+	}
+	node := cluster.slots.nodeByID(string(args[3]))
+	if node == nil {
+		return protocol.NewGenericErrReply("I don't know about node " + string(args[3]))
+	}
+	cluster.slots.setOwner(start, end, node)
+	return protocol.NewOkReply()
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [KEYS key [key ...]]
+func migrateFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) < 6 {
+		return protocol.NewArgNumErrReply("migrate")
+	}
+	addr := net.JoinHostPort(string(redisCommand[1]), string(redisCommand[2]))
+	destDB, err := strconv.Atoi(string(redisCommand[4]))
+	if err != nil || destDB < 0 || destDB >= conf.GlobalConfig.Databases {
+		return protocol.NewGenericErrReply("db index out of range")
+	}
+	if conf.GlobalConfig.ClusterSingleDB && destDB != 0 {
+		return protocol.NewGenericErrReply("destination-db must be 0 in cluster mode")
+	}
+	if timeout, err := strconv.ParseInt(string(redisCommand[5]), 10, 64); err != nil || timeout < 0 {
+		return protocol.NewGenericErrReply("value is not an integer or out of range")
+	}
+
+	copyKey, replace := false, false
+	var keys []string
+	if key := string(redisCommand[3]); key != "" {
+		keys = append(keys, key)
+	}
+	for i := 6; i < len(redisCommand); i++ {
+		switch strings.ToLower(string(redisCommand[i])) {
+		case "copy":
+			copyKey = true
+		case "replace":
+			replace = true
+		case "keys":
+			if len(keys) > 0 {
+				return protocol.NewGenericErrReply("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range redisCommand[i+1:] {
+				keys = append(keys, string(key))
+			}
+			i = len(redisCommand)
+		default:
+			return protocol.NewSyntaxErrReply()
+		}
+	}
+	if len(keys) == 0 {
+		return protocol.NewSimpleReply("NOKEY")
+	}
+	if addr == cluster.self {
+		return protocol.NewGenericErrReply("Target instance is the same as the source instance")
+	}
+	return cluster.migrateKeys(c.GetDBIndex(), destDB, addr, keys, copyKey, replace)
+}
+
+// 迁移keys：迁移过程中锁定keys，避免 DUMP 之后、DEL 之前的写入丢失
+func (cluster *Cluster) migrateKeys(dbIndex int, destDB int, addr string, keys []string, copyKey bool, replace bool) protocol.Reply {
+	cluster.engine.RWLocks(dbIndex, nil, keys)
+	defer cluster.engine.RWUnLocks(dbIndex, nil, keys)
+
+	client, err := cluster.clientFactory.GetConn(addr)
+	if err != nil {
+		return protocol.NewSimpleErrReply("IOERR error or timeout connecting to the client: " + err.Error())
+	}
+	defer cluster.clientFactory.ReturnConn(addr, client)
+
+	migrated := 0
+	for _, key := range keys {
+		dump, ok := cluster.engine.ExecWithLock(dbIndex, utils.ToCmdLine("dump", key)).(*protocol.BulkReply)
+		if !ok {
+			continue // key不存在
+		}
+		ttl := int64(0)
+		if pttl, ok := cluster.engine.ExecWithLock(dbIndex, utils.ToCmdLine("pttl", key)).(*protocol.IntegerReply); ok && pttl.Integer > 0 {
+			ttl = pttl.Integer
+		}
+
+		cmdLine := utils.ToCmdLine("restore-asking", key, strconv.FormatInt(ttl, 10), string(dump.Arg))
+		if replace {
+			cmdLine = append(cmdLine, []byte("replace"))
+		}
+		reply, err := client.Send(withDB(destDB, cmdLine))
+		if err != nil {
+			return protocol.NewSimpleErrReply("IOERR error or timeout writing to target instance: " + err.Error())
+		}
+		if protocol.IsErrReply(reply) {
+			return reply
+		}
+		if !copyKey {
+			cluster.engine.ExecWithLock(dbIndex, utils.ToCmdLine("del", key))
+		}
+		migrated++
+	}
+	if migrated == 0 {
+		return protocol.NewSimpleReply("NOKEY")
+	}
+	return protocol.NewOkReply()
+}
+
+// 当前节点的任意数据库中是否有属于该槽的key
+func (cluster *Cluster) hasKeysInSlot(slot int) bool {
+	for dbIndex := 0; dbIndex < conf.GlobalConfig.Databases; dbIndex++ {
+		if len(cluster.engine.KeysInSlot(dbIndex, slot, 1)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 向节点发送命令（当前节点直接执行），错误回复转换为error
+func (cluster *Cluster) callNode(addr string, args ...string) (protocol.Reply, error) {
+	return cluster.callNodeDB(addr, 0, args...)
+}
+
+// 在节点的指定数据库上执行命令
+func (cluster *Cluster) callNodeDB(addr string, dbIndex int, args ...string) (protocol.Reply, error) {
+	conn := connection.NewVirtualConn()
+	conn.SetDBIndex(dbIndex)
+	reply := cluster.Relay(addr, conn, utils.ToCmdLine(args[0], args[1:]...))
+	if protocol.IsErrReply(reply) {
+		return nil, errors.New(addr + ": " + strings.TrimSpace(string(reply.ToBytes())))
+	}
+	return reply, nil
+}
+
+// 将槽从source迁移到target，并通知所有节点
+func (cluster *Cluster) migrateSlot(slot int, source *clusterNode, target *clusterNode) error {
+	slotStr := strconv.Itoa(slot)
+	if _, err := cluster.callNode(target.addr, "cluster", "setslot", slotStr, "importing", source.id); err != nil {
+		return err
+	}
+	if _, err := cluster.callNode(source.addr, "cluster", "setslot", slotStr, "migrating", target.id); err != nil {
+		return err
+	}
+
+	// 迁移所有数据库中属于该槽的key
+	host, port := splitAddr(target.addr)
+	for dbIndex := 0; dbIndex < conf.GlobalConfig.Databases; dbIndex++ {
+		for {
+			reply, err := cluster.callNodeDB(source.addr, dbIndex, "cluster", "getkeysinslot", slotStr, strconv.Itoa(migrateBatch))
+			if err != nil {
+				return err
+			}
+			keys, ok := reply.(*protocol.MultiBulkReply)
+			if !ok || len(keys.RedisCommand) == 0 {
+				break
+			}
+			args := []string{"migrate", host, strconv.Itoa(port), "", strconv.Itoa(dbIndex), strconv.Itoa(migrateTimeout), "replace", "keys"}
+			for _, key := range keys.RedisCommand {
+				args = append(args, string(key))
+			}
+			if _, err := cluster.callNodeDB(source.addr, dbIndex, args...); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 先通知target和source，再通知其他节点
+	notified := map[string]bool{}
+	for _, node := range append([]*clusterNode{target, source}, cluster.slots.sortedNodes()...) {
+		if notified[node.addr] {
+			continue
+		}
+		notified[node.addr] = true
+		if _, err := cluster.callNode(node.addr, "cluster", "setslot", slotStr, "node", target.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CLUSTER REBALANCE <ip:port>：新节点加入集群，从其他节点平均迁移槽到新节点
+func (cluster *Cluster) clusterRebalance(addr string) protocol.Reply {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return protocol.NewGenericErrReply("invalid address " + addr)
+	}
+	existing := cluster.slots.sortedNodes()
+	for _, node := range existing {
+		if node.addr == addr && len(cluster.slots.rangesOf(node)) > 0 {
+			return protocol.NewGenericErrReply("node " + addr + " already serves hash slots")
+		}
+	}
+
+	// 1.所有节点添加新节点，新节点添加所有节点，并同步槽分配表
+	for _, node := range existing {
+		if node.addr == addr {
+			continue
+		}
+		if _, err := cluster.callNode(node.addr, "cluster", "addnode", addr); err != nil {
+			return protocol.NewGenericErrReply(err.Error())
+		}
+		if _, err := cluster.callNode(addr, "cluster", "addnode", node.addr); err != nil {
+			return protocol.NewGenericErrReply(err.Error())
+		}
+	}
+	newNode := cluster.slots.addNode(addr)
+	for _, node := range existing {
+		for _, r := range cluster.slots.rangesOf(node) {
+			_, err := cluster.callNode(addr, "cluster", "setslotrange", strconv.Itoa(r.start), strconv.Itoa(r.end), "node", node.id)
+			if err != nil {
+				return protocol.NewGenericErrReply(err.Error())
+			}
+		}
+	}
+
+	// 2.每个节点保留 SlotCount/n 个槽，多出的槽（从后往前）迁移到新节点
+	// 只有主节点负责槽
+	var owners []*clusterNode
+	for _, node := range cluster.slots.sortedNodes() {
+		if cluster.slots.masterOf(node) == nil {
+			owners = append(owners, node)
+		}
+	}
+	expected := hashslot.SlotCount / len(owners)
+	moved := 0
+	for _, node := range owners {
+		if node == newNode {
+			continue
+		}
+		var slots []int
+		for _, r := range cluster.slots.rangesOf(node) {
+			for slot := r.start; slot <= r.end; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		for i := len(slots) - 1; i >= expected; i-- {
+			if err := cluster.migrateSlot(slots[i], node, newNode); err != nil {
+				logger.Errorf("migrate slot %d from %s to %s failed: %v", slots[i], node.addr, addr, err)
+				return protocol.NewGenericErrReply(fmt.Sprintf("migrate slot %d failed: %v", slots[i], err))
+			}
+			moved++
+		}
+	}
+	logger.Infof("rebalance: %d slots moved to %s", moved, addr)
+	return protocol.NewIntegerReply(int64(moved))
+}
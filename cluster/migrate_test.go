@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+func TestRebalance(t *testing.T) {
+	conf.GlobalConfig.ClusterMode = modeSlot
+	conf.GlobalConfig.ClusterConfigFile = ""
+	defer func() {
+		conf.GlobalConfig.ClusterMode = modeConsistentHash
+		conf.GlobalConfig.ClusterConfigFile = "nodes.conf"
+	}()
+
+	// 两个节点组成集群，新节点只知道自己
+	peers := []string{"127.0.0.1:16379", "127.0.0.1:16380"}
+	newAddr := "127.0.0.1:16381"
+	for _, addr := range append(peers, newAddr) {
+		conf.GlobalConfig.Peers = peers
+		if addr == newAddr {
+			conf.GlobalConfig.Peers = nil
+		}
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&mockFactory{})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+	for i := 0; i < 200; i++ {
+		key := "key" + strconv.Itoa(i)
+		if reply := first.Exec(conn, utils.ToCmdLine("set", key, strconv.Itoa(i))); !protocol.IsOKReply(reply) {
+			t.Fatalf("set %s failed: %q", key, reply.ToBytes())
+		}
+	}
+
+	reply := first.Exec(conn, utils.ToCmdLine("cluster", "rebalance", newAddr))
+	moved, ok := reply.(*protocol.IntegerReply)
+	if !ok || moved.Integer != hashslot.SlotCount-2*(hashslot.SlotCount/3) {
+		t.Fatalf("unexpected rebalance result: %q", reply.ToBytes())
+	}
+
+	// 所有节点的槽分配表一致，且key都在负责的节点上
+	for _, addr := range append(peers, newAddr) {
+		node := cluster[addr]
+		for slot := 0; slot < hashslot.SlotCount; slot++ {
+			if node.slots.nodeOf(slot).addr != first.slots.nodeOf(slot).addr {
+				t.Fatalf("%s: slot %d owner mismatch", addr, slot)
+			}
+		}
+	}
+	for i := 0; i < 200; i++ {
+		key := "key" + strconv.Itoa(i)
+		owner := cluster[first.slots.nodeOf(hashslot.Slot(key)).addr]
+		if !owner.existsLocal(conn, key) {
+			t.Fatalf("%s not found on owner %s", key, owner.self)
+		}
+		reply := cluster[newAddr].Exec(conn, utils.ToCmdLine("get", key))
+		if string(reply.ToBytes()) != string(protocol.NewBulkReply([]byte(strconv.Itoa(i))).ToBytes()) {
+			t.Fatalf("get %s: %q", key, reply.ToBytes())
+		}
+	}
+}
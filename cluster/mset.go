@@ -27,6 +27,11 @@ func mset(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protoc
 		values[keys[i]] = string(redisCommand[2*i+2])
 	}
 
+	// 哈希槽模式：keys属于同一个槽（重定向模式下必须属于同一个槽），不需要走分布式事务
+	if cluster.mode == modeSlot && (cluster.redirect || sameSlot(keys)) {
+		return cluster.execSlotCommand(c, redisCommand, keys, true)
+	}
+
 	//2.计算key映射的ip地址;  ip -> []string
 	ipMap := cluster.groupByKeys(keys)
 
@@ -41,6 +46,7 @@ func mset(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protoc
 	var respReply protocol.Reply = protocol.NewOkReply()
 	// 事务id
 	txId := cluster.newTxId()
+	cluster.txLog.begin(txId)
 	rollback := false
 	for ip, keys := range ipMap {
 		// txid mset key value [key value...]
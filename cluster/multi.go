@@ -0,0 +1,284 @@
+package cluster
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/engine"
+	"github.com/gofish2020/easyredis/redis/protocol"
+)
+
+/*
+集群模式下的事务（MULTI/EXEC/WATCH）：
+
+1. MULTI 之后的命令在当前连接上入队；命令的key必须属于同一个节点，否则回复 -CROSSSLOT（EXEC 时回复 -EXECABORT）
+2. WATCH key [key...]：向key所属的节点查询版本号（WatchVersion key [key...]），保存在当前连接上
+3. EXEC：按节点对命令（没有key的命令在当前节点执行）和 WATCH key 分组，通过分布式事务（TCC）执行
+   - prepare txid multi <watch-count> [key version ...] <command-count> [<argc> arg ...] ...
+     参与者锁定key后检查 WATCH key的版本号，版本号有变化时 prepare 失败，协调者回滚事务并回复空数组
+   - commit txid：参与者依次执行命令，回复每条命令的结果；协调者按命令入队的顺序合并结果
+*/
+
+// 参与者 prepare 时发现 WATCH key有变化
+var errWatchChanged = errors.New("watched keys changed")
+
+// 不入队的命令
+var multiCommands = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+	"unwatch": true,
+}
+
+// 事务模式：命令入队，命令的key必须属于同一个节点
+func (cluster *Cluster) enqueueCmd(c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if keys := commandKeys(redisCommand); len(keys) > 1 && len(cluster.groupByKeys(keys)) > 1 {
+		c.AddTxError(errors.New("CROSSSLOT Keys in request don't hash to the same node"))
+		return protocol.NewSimpleErrReply("CROSSSLOT Keys in request don't hash to the same node")
+	}
+	return engine.EnqueueCmd(c, redisCommand)
+}
+
+// watch key [key...]
+func watchFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) < 2 {
+		return protocol.NewArgNumErrReply("watch")
+	}
+	if c.IsTransaction() {
+		return protocol.NewGenericErrReply("WATCH inside MULTI is not allowed")
+	}
+	keys := make([]string, 0, len(redisCommand)-1)
+	for _, key := range redisCommand[1:] {
+		keys = append(keys, string(key))
+	}
+
+	// 向key所属的节点查询版本号
+	versions := make(map[string]int64, len(keys))
+	for peer, keys := range cluster.groupByKeys(keys) {
+		if peer == "" {
+			return protocol.NewSimpleErrReply("CLUSTERDOWN Hash slot not served")
+		}
+		args := make([][]byte, 0, len(keys))
+		for _, key := range keys {
+			args = append(args, []byte(key))
+		}
+		reply := cluster.Relay(peer, c, pushCmd(args, "WatchVersion"))
+		if protocol.IsErrReply(reply) {
+			return reply
+		}
+		multiBulk, ok := reply.(*protocol.MultiBulkReply)
+		if !ok || len(multiBulk.RedisCommand) != len(keys) {
+			return protocol.NewGenericErrReply("unexpected reply of WatchVersion from " + peer)
+		}
+		for i, key := range keys {
+			version, err := strconv.ParseInt(string(multiBulk.RedisCommand[i]), 10, 64)
+			if err != nil {
+				return protocol.NewGenericErrReply("unexpected reply of WatchVersion from " + peer)
+			}
+			versions[key] = version
+		}
+	}
+
+	watching := c.GetWatchKey()
+	for key, version := range versions {
+		watching[key] = version
+	}
+	return protocol.NewOkReply()
+}
+
+// WatchVersion key [key...]：key的版本号
+func watchVersionFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) < 2 {
+		return protocol.NewArgNumErrReply("watchversion")
+	}
+	versions := make([][]byte, 0, len(redisCommand)-1)
+	for _, key := range redisCommand[1:] {
+		version := cluster.engine.GetVersion(c.GetDBIndex(), string(key))
+		versions = append(versions, []byte(strconv.FormatInt(version, 10)))
+	}
+	return protocol.NewMultiBulkReply(versions)
+}
+
+// 节点上执行的命令和 WATCH key
+type multiGroup struct {
+	indexes  []int // 命令入队的顺序
+	cmdLines []CmdLine
+	watching map[string]int64
+}
+
+// exec
+func execMultiFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) != 1 {
+		return protocol.NewArgNumErrReply("exec")
+	}
+	if !c.IsTransaction() {
+		return protocol.NewGenericErrReply("EXEC without MULTI")
+	}
+	cmdLines := c.GetQueuedCmdLine()
+	watching := make(map[string]int64)
+	for key, version := range c.GetWatchKey() {
+		watching[key] = version
+	}
+	aborted := len(c.GetTxErrors()) > 0
+	// 退出事务模式（之后在当前连接上执行的 Prepare/Commit 不能入队）
+	c.SetTransaction(false)
+	if aborted {
+		return protocol.NewGenericErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	// 1.按节点分组
+	groups := make(map[string]*multiGroup)
+	groupOf := func(peer string) *multiGroup {
+		group, ok := groups[peer]
+		if !ok {
+			group = &multiGroup{watching: make(map[string]int64)}
+			groups[peer] = group
+		}
+		return group
+	}
+	for i, cmdLine := range cmdLines {
+		peer := cluster.self
+		if keys := commandKeys(cmdLine); len(keys) > 0 {
+			peer = cluster.pickPeer(keys[0])
+		}
+		if peer == "" {
+			return protocol.NewSimpleErrReply("CLUSTERDOWN Hash slot not served")
+		}
+		group := groupOf(peer)
+		group.indexes = append(group.indexes, i)
+		group.cmdLines = append(group.cmdLines, cmdLine)
+	}
+	for key, version := range watching {
+		peer := cluster.pickPeer(key)
+		if peer == "" {
+			return protocol.NewSimpleErrReply("CLUSTERDOWN Hash slot not served")
+		}
+		groupOf(peer).watching[key] = version
+	}
+	if len(groups) == 0 {
+		return protocol.NewEmptyMultiBulkReply()
+	}
+
+	// 2.prepare阶段
+	txId := cluster.newTxId()
+	cluster.txLog.begin(txId)
+	ipMap := make(map[string][]string, len(groups))
+	for peer := range groups {
+		ipMap[peer] = nil
+	}
+	for peer, group := range groups {
+		args := encodeMultiPrepare(txId, group.watching, group.cmdLines)
+		reply := cluster.Relay(peer, c, pushCmd(args, "Prepare"))
+		if protocol.IsErrReply(reply) {
+			rollbackTransaction(cluster, c, txId, ipMap)
+			if strings.Contains(string(reply.ToBytes()), errWatchChanged.Error()) {
+				return protocol.NewEmptyMultiBulkReply()
+			}
+			return reply
+		}
+	}
+
+	// 3.commit阶段：按命令入队的顺序合并结果
+	replies, errReply := commitTransaction(cluster, c, txId, ipMap)
+	if errReply != nil {
+		return errReply
+	}
+	results := make([]protocol.Reply, len(cmdLines))
+	for peer, group := range groups {
+		peerResults := multiResults(replies[peer])
+		if len(peerResults) != len(group.indexes) {
+			return protocol.NewGenericErrReply("unexpected reply of Commit from " + peer)
+		}
+		for i, index := range group.indexes {
+			results[index] = peerResults[i]
+		}
+	}
+	mixReply := protocol.NewMixReply()
+	mixReply.Append(results...)
+	return mixReply
+}
+
+// 参与者回复的每条命令的结果（远程节点回复的数组，全部是字符串时解析为 MultiBulkReply）
+func multiResults(reply protocol.Reply) []protocol.Reply {
+	switch reply := reply.(type) {
+	case *protocol.MixReply:
+		return reply.Replies()
+	case *protocol.MultiBulkReply:
+		results := make([]protocol.Reply, 0, len(reply.RedisCommand))
+		for _, arg := range reply.RedisCommand {
+			if arg == nil {
+				results = append(results, protocol.NewNullBulkReply())
+			} else {
+				results = append(results, protocol.NewBulkReply(arg))
+			}
+		}
+		return results
+	}
+	return nil
+}
+
+// txid multi <watch-count> [key version ...] <command-count> [<argc> arg ...] ...
+func encodeMultiPrepare(txId string, watching map[string]int64, cmdLines []CmdLine) [][]byte {
+	args := [][]byte{[]byte(txId), []byte("multi"), []byte(strconv.Itoa(len(watching)))}
+	for key, version := range watching {
+		args = append(args, []byte(key), []byte(strconv.FormatInt(version, 10)))
+	}
+	args = append(args, []byte(strconv.Itoa(len(cmdLines))))
+	for _, cmdLine := range cmdLines {
+		args = append(args, []byte(strconv.Itoa(len(cmdLine))))
+		args = append(args, cmdLine...)
+	}
+	return args
+}
+
+// 解析 prepare 的命令：mset key value [key value...] / multi ...（encodeMultiPrepare）
+func parseTxCommand(redisCommand [][]byte) (cmdLines []CmdLine, watching map[string]int64, multi bool, err error) {
+	if strings.ToLower(string(redisCommand[0])) != "multi" {
+		return []CmdLine{redisCommand}, nil, false, nil
+	}
+	errSyntax := errors.New("invalid multi transaction")
+	args := redisCommand[1:]
+	// 读取一个数字
+	next := func() (int, bool) {
+		if len(args) == 0 {
+			return 0, false
+		}
+		n, err := strconv.Atoi(string(args[0]))
+		args = args[1:]
+		return n, err == nil && n >= 0
+	}
+
+	watchCount, ok := next()
+	if !ok || len(args) < watchCount*2 {
+		return nil, nil, false, errSyntax
+	}
+	watching = make(map[string]int64, watchCount)
+	for i := 0; i < watchCount; i++ {
+		version, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return nil, nil, false, errSyntax
+		}
+		watching[string(args[0])] = version
+		args = args[2:]
+	}
+
+	cmdCount, ok := next()
+	if !ok {
+		return nil, nil, false, errSyntax
+	}
+	for i := 0; i < cmdCount; i++ {
+		argc, ok := next()
+		if !ok || argc == 0 || len(args) < argc {
+			return nil, nil, false, errSyntax
+		}
+		cmdLines = append(cmdLines, args[:argc])
+		args = args[argc:]
+	}
+	if len(args) > 0 {
+		return nil, nil, false, errSyntax
+	}
+	return cmdLines, watching, true, nil
+}
@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+func TestMulti(t *testing.T) {
+	peers := []string{"127.0.0.1:46379", "127.0.0.1:47379", "127.0.0.1:48379"}
+	conf.GlobalConfig.Peers = peers
+	for _, addr := range peers {
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&mockFactory{})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+
+	// 找到属于其他节点的key
+	var key1, key2 string
+	for i := 0; key1 == "" || key2 == ""; i++ {
+		key := "key" + strconv.Itoa(i)
+		switch peer := first.pickPeer(key); {
+		case peer == peers[1] && key1 == "":
+			key1 = key
+		case peer == peers[2] && key2 == "":
+			key2 = key
+		}
+	}
+
+	exec := func(conn *connection.VirtualConnection, cmdLine ...string) string {
+		return string(first.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+	expect := func(conn *connection.VirtualConnection, want string, cmdLine ...string) {
+		t.Helper()
+		if got := exec(conn, cmdLine...); got != want {
+			t.Fatalf("%v: expect %q, got %q", cmdLine, want, got)
+		}
+	}
+
+	// 命令分布在多个节点上，按入队的顺序回复结果
+	conn := connection.NewVirtualConn()
+	expect(conn, "+OK\r\n", "set", key1, "1")
+	expect(conn, "+OK\r\n", "watch", key1, key2)
+	expect(conn, "+OK\r\n", "multi")
+	expect(conn, "+QUEUED\r\n", "set", key1, "2")
+	expect(conn, "+QUEUED\r\n", "zadd", key2, "1", "a", "2", "b")
+	expect(conn, "+QUEUED\r\n", "get", key1)
+	expect(conn, "+QUEUED\r\n", "zcard", key1)
+	expect(conn, "*4\r\n+OK\r\n:2\r\n$1\r\n2\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "exec")
+	expect(conn, ":2\r\n", "zcard", key2)
+
+	// WATCH key在其他节点上被修改，事务不执行
+	other := connection.NewVirtualConn()
+	expect(conn, "+OK\r\n", "watch", key2)
+	expect(conn, "+OK\r\n", "multi")
+	expect(conn, "+QUEUED\r\n", "set", key1, "100")
+	expect(other, ":1\r\n", "zadd", key2, "3", "c")
+	expect(conn, "*0\r\n", "exec")
+	expect(conn, "$1\r\n2\r\n", "get", key1)
+	expect(conn, "-ERR EXEC without MULTI\r\n", "exec")
+
+	// 入队时出错，EXEC 回复 -EXECABORT
+	expect(conn, "+OK\r\n", "multi")
+	expect(conn, "-CROSSSLOT Keys in request don't hash to the same node\r\n", "del", key1, key2)
+	expect(conn, "+QUEUED\r\n", "del", key1)
+	expect(conn, "-ERR EXECABORT Transaction discarded because of previous errors.\r\n", "exec")
+	expect(conn, "$1\r\n2\r\n", "get", key1)
+
+	// DISCARD 清空队列
+	expect(conn, "+OK\r\n", "multi")
+	expect(conn, "+QUEUED\r\n", "del", key1)
+	expect(conn, "+OK\r\n", "discard")
+	expect(conn, ":1\r\n", "exists", key1)
+}
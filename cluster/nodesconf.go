@@ -0,0 +1,268 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/tool/logger"
+)
+
+/*
+nodes.conf（cluster-config-file）：保存 gossip 学习到的集群状态，格式与 CLUSTER NODES 相同
+
+<id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ... [slot->-id] [slot-<-id]
+vars currentEpoch <epoch> lastVoteEpoch <epoch>
+
+节点启动时，nodes.conf 存在则加载（忽略 peers 配置），否则根据 peers 配置初始化
+*/
+
+func nodesConfPath() string {
+	return dataFilePath(conf.GlobalConfig.ClusterConfigFile)
+}
+
+// 初始化槽分配表：优先加载 nodes.conf
+func (cluster *Cluster) initSlotTable(peers []string) *slotTable {
+	if cluster.configFile != "" {
+		table, err := loadNodesConf(cluster.configFile, cluster.self)
+		if err == nil {
+			logger.Infof("cluster: %d nodes loaded from %s", len(table.nodes), cluster.configFile)
+			return table
+		}
+		if !os.IsNotExist(err) {
+			logger.Errorf("cluster: load %s failed: %v", cluster.configFile, err)
+		}
+	}
+	if len(conf.GlobalConfig.Peers) == 0 {
+		peers = nil
+	}
+	table := newSlotTable(cluster.self, peers)
+	table.dirty = true
+	return table
+}
+
+func (cluster *Cluster) saveNodesConf() {
+	if cluster.configFile == "" {
+		return
+	}
+	t := cluster.slots
+	t.mu.RLock()
+	content := t.describeNodes(false) + fmt.Sprintf("vars currentEpoch %d lastVoteEpoch %d\n", t.currentEpoch, t.lastVoteEpoch)
+	t.mu.RUnlock()
+
+	cluster.saveMu.Lock()
+	defer cluster.saveMu.Unlock()
+	// 先写临时文件再重命名，避免写入过程中宕机导致文件损坏
+	tmpFile := cluster.configFile + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		logger.Errorf("cluster: save %s failed: %v", cluster.configFile, err)
+		return
+	}
+	_, err = file.WriteString(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpFile, cluster.configFile)
+	}
+	if err != nil {
+		logger.Errorf("cluster: save %s failed: %v", cluster.configFile, err)
+	}
+}
+
+// 节点信息（调用者持有锁），forNodes：CLUSTER NODES 输出（包括握手中的节点）
+func (t *slotTable) describeNodes(forNodes bool) string {
+	var builder strings.Builder
+	for _, node := range t.sortedNodesLocked() {
+		if node.hasFlag(nodeHandshake) && !forNodes {
+			continue
+		}
+		_, port := splitAddr(node.addr)
+		linkState := "connected"
+		if node != t.myself && node.hasFlag(nodePFail|nodeFail|nodeHandshake) {
+			linkState = "disconnected"
+		}
+		master := "-"
+		if node.master != nil {
+			master = node.master.id
+		}
+		builder.WriteString(fmt.Sprintf("%s %s@%d %s %s %d %d %d %s", node.id, node.addr, port+10000, node.flagsString(), master,
+			unixMilli(node.pingSent), unixMilli(node.pongReceived), node.configEpoch, linkState))
+		for _, r := range t.rangesOfLocked(node) {
+			if r.start == r.end {
+				builder.WriteString(" " + strconv.Itoa(r.start))
+			} else {
+				builder.WriteString(fmt.Sprintf(" %d-%d", r.start, r.end))
+			}
+		}
+		if node == t.myself {
+			builder.WriteString(describeMigration(t.migrating, "->-"))
+			builder.WriteString(describeMigration(t.importing, "-<-"))
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// [slot->-id]（迁出） / [slot-<-id]（迁入）
+func describeMigration(migration map[int]*clusterNode, sep string) string {
+	slots := make([]int, 0, len(migration))
+	for slot := range migration {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	var builder strings.Builder
+	for _, slot := range slots {
+		builder.WriteString(fmt.Sprintf(" [%d%s%s]", slot, sep, migration[slot].id))
+	}
+	return builder.String()
+}
+
+func (node *clusterNode) flagsString() string {
+	var flags []string
+	if node.hasFlag(nodeMyself) {
+		flags = append(flags, "myself")
+	}
+	if node.master != nil {
+		flags = append(flags, "slave")
+	} else {
+		flags = append(flags, "master")
+	}
+	if node.hasFlag(nodePFail) {
+		flags = append(flags, "fail?")
+	}
+	if node.hasFlag(nodeFail) {
+		flags = append(flags, "fail")
+	}
+	if node.hasFlag(nodeHandshake) {
+		flags = append(flags, "handshake")
+	}
+	return strings.Join(flags, ",")
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func loadNodesConf(filename string, self string) (*slotTable, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	table := emptySlotTable()
+	var lines [][]string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				var epoch *int64
+				switch fields[i] {
+				case "currentEpoch":
+					epoch = &table.currentEpoch
+				case "lastVoteEpoch":
+					epoch = &table.lastVoteEpoch
+				default:
+					continue
+				}
+				if *epoch, err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid %s %s", fields[i], fields[i+1])
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("invalid line: %s", line)
+		}
+
+		addr := fields[1]
+		if i := strings.IndexByte(addr, '@'); i >= 0 {
+			addr = addr[:i]
+		}
+		node := newClusterNode(addr)
+		if node.id != fields[0] {
+			return nil, fmt.Errorf("node id %s doesn't match address %s", fields[0], addr)
+		}
+		for _, flag := range strings.Split(fields[2], ",") {
+			switch flag {
+			case "myself":
+				node.flags |= nodeMyself
+				table.myself = node
+			case "fail":
+				node.flags |= nodeFail
+				node.failTime = time.Now()
+			}
+		}
+		if node.configEpoch, err = strconv.ParseInt(fields[6], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid config epoch of node %s", node.id)
+		}
+		table.nodes[node.id] = node
+		lines = append(lines, fields)
+	}
+	if table.myself == nil || table.myself.addr != self {
+		return nil, fmt.Errorf("myself (%s) not found", self)
+	}
+
+	// 主从关系、槽分配
+	for _, fields := range lines {
+		node := table.nodes[fields[0]]
+		if fields[3] != "-" {
+			if node.master = table.nodes[fields[3]]; node.master == nil || node.master == node {
+				return nil, fmt.Errorf("unknown master %s of node %s", fields[3], node.id)
+			}
+		}
+		for _, arg := range fields[8:] {
+			if err := table.loadSlot(node, arg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return table, nil
+}
+
+// <slot> / <start>-<end> / [slot->-id] / [slot-<-id]
+func (t *slotTable) loadSlot(node *clusterNode, arg string) error {
+	if strings.HasPrefix(arg, "[") {
+		migration, sep := t.migrating, "->-"
+		if strings.Contains(arg, "-<-") {
+			migration, sep = t.importing, "-<-"
+		}
+		parts := strings.SplitN(strings.Trim(arg, "[]"), sep, 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid slot migration %s", arg)
+		}
+		slot, err := strconv.Atoi(parts[0])
+		peer := t.nodes[parts[1]]
+		if err != nil || slot < 0 || slot >= hashslot.SlotCount || peer == nil {
+			return fmt.Errorf("invalid slot migration %s", arg)
+		}
+		migration[slot] = peer
+		return nil
+	}
+
+	start, end := arg, arg
+	if i := strings.IndexByte(arg, '-'); i >= 0 {
+		start, end = arg[:i], arg[i+1:]
+	}
+	startSlot, err1 := strconv.Atoi(start)
+	endSlot, err2 := strconv.Atoi(end)
+	if err1 != nil || err2 != nil || startSlot < 0 || startSlot > endSlot || endSlot >= hashslot.SlotCount {
+		return fmt.Errorf("invalid slot range %s", arg)
+	}
+	for slot := startSlot; slot <= endSlot; slot++ {
+		t.slots[slot] = node
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/client"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+)
+
+/*
+节点之间的连接（peer link）：
+
+1. 与每个节点建立固定数量的连接（cluster-peer-conns），请求按轮询分配到连接上，不再独占连接
+2. 同一个连接上的请求并发地发送（pipeline），发送协程将缓冲区中的请求合并后一次写入，按发送的顺序匹配结果
+3. 每个请求等待结果的超时时间为 cluster-relay-timeout
+4. 统计每个节点进行中的请求数量、请求数量、失败/超时次数、延迟（CLUSTER LINKS）
+*/
+
+var errPeerLinkClosed = errors.New("peer link is closed")
+
+type Factory interface {
+	GetConn(addr string) (Client, error)
+	ReturnConn(peer string, cli Client) error
+}
+
+type Client interface {
+	Send(command [][]byte) (protocol.Reply, error)
+}
+
+type PeerLinks struct {
+	mu      sync.Mutex
+	links   map[string]*peerLink // addr -> *peerLink
+	size    int
+	timeout time.Duration
+}
+
+// 与一个节点之间的连接
+type peerLink struct {
+	addr    string
+	mu      sync.Mutex
+	clients []*client.RedisClient
+	next    atomic.Uint64
+	closed  bool
+
+	// 统计
+	inFlight     atomic.Int64
+	requests     atomic.Int64
+	failures     atomic.Int64
+	timeouts     atomic.Int64
+	totalLatency atomic.Int64 // 微秒
+	maxLatency   atomic.Int64 // 微秒
+}
+
+// 节点连接的统计
+type linkStats struct {
+	addr        string
+	connections int
+	inFlight    int64
+	requests    int64
+	failures    int64
+	timeouts    int64
+	avgLatency  int64 // 微秒
+	maxLatency  int64 // 微秒
+}
+
+func NewPeerLinks() *PeerLinks {
+	size := conf.GlobalConfig.ClusterPeerConns
+	if size <= 0 {
+		size = 1
+	}
+	timeout := time.Duration(conf.GlobalConfig.ClusterRelayTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	return &PeerLinks{
+		links:   make(map[string]*peerLink),
+		size:    size,
+		timeout: timeout,
+	}
+}
+
+func (p *PeerLinks) link(addr string) *peerLink {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.links[addr]
+	if !ok {
+		l = &peerLink{addr: addr, clients: make([]*client.RedisClient, p.size)}
+		p.links[addr] = l
+	}
+	return l
+}
+
+// 轮询选择一个连接（连接不存在 or 已关闭时重新建立连接）
+func (p *PeerLinks) GetConn(addr string) (Client, error) {
+	l := p.link(addr)
+	index := int(l.next.Add(1) % uint64(len(l.clients)))
+
+	l.mu.Lock()
+	old := l.clients[index]
+	l.mu.Unlock()
+	if old != nil && !old.IsClosed() {
+		return &linkClient{link: l, cli: old, timeout: p.timeout}, nil
+	}
+
+	// 建立连接（包括握手）时不持有锁，避免阻塞同一个节点的其他请求
+	cli, err := dialPeer(addr)
+	if err != nil {
+		l.failures.Add(1)
+		return nil, err
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		cli.Stop()
+		return nil, errPeerLinkClosed
+	}
+	// 其他协程已经建立了连接：使用已有的连接，关闭新建的连接
+	if cur := l.clients[index]; cur != old && cur != nil && !cur.IsClosed() {
+		l.mu.Unlock()
+		cli.Stop()
+		return &linkClient{link: l, cli: cur, timeout: p.timeout}, nil
+	}
+	l.clients[index] = cli
+	l.mu.Unlock()
+	return &linkClient{link: l, cli: cli, timeout: p.timeout}, nil
+}
+
+// 连接是共享的，不需要归还
+func (p *PeerLinks) ReturnConn(peer string, cli Client) error {
+	return nil
+}
+
+// 关闭所有连接
+func (p *PeerLinks) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range p.links {
+		l.mu.Lock()
+		l.closed = true
+		for i, cli := range l.clients {
+			if cli != nil {
+				cli.Stop()
+				l.clients[i] = nil
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// 所有节点连接的统计，按地址排序
+func (p *PeerLinks) stats() []linkStats {
+	p.mu.Lock()
+	links := make([]*peerLink, 0, len(p.links))
+	for _, l := range p.links {
+		links = append(links, l)
+	}
+	p.mu.Unlock()
+	sort.Slice(links, func(i, j int) bool { return links[i].addr < links[j].addr })
+
+	result := make([]linkStats, 0, len(links))
+	for _, l := range links {
+		s := linkStats{
+			addr:       l.addr,
+			inFlight:   l.inFlight.Load(),
+			requests:   l.requests.Load(),
+			failures:   l.failures.Load(),
+			timeouts:   l.timeouts.Load(),
+			maxLatency: l.maxLatency.Load(),
+		}
+		if s.requests > 0 {
+			s.avgLatency = l.totalLatency.Load() / s.requests
+		}
+		l.mu.Lock()
+		for _, cli := range l.clients {
+			if cli != nil && !cli.IsClosed() {
+				s.connections++
+			}
+		}
+		l.mu.Unlock()
+		result = append(result, s)
+	}
+	return result
+}
+
+// 建立连接
+func dialPeer(addr string) (*client.RedisClient, error) {
+	cli, err := client.NewRedisClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	// 使用 cluster-secret 与节点相互认证（不使用客户端的 requirepass），断线重连后重新认证
+	cli.SetOnConnect(func(s client.Sender) error {
+		return clusterHandshake(s, conf.GlobalConfig.Self)
+	})
+	if err := cli.Start(); err != nil {
+		cli.Stop()
+		return nil, err
+	}
+	return cli, nil
+}
+
+// 在共享的连接上发送请求，并记录统计
+type linkClient struct {
+	link    *peerLink
+	cli     *client.RedisClient
+	timeout time.Duration
+}
+
+func (c *linkClient) Send(command [][]byte) (protocol.Reply, error) {
+	l := c.link
+	l.inFlight.Add(1)
+	start := time.Now()
+	reply, err := c.cli.SendWithTimeout(command, c.timeout)
+	latency := time.Since(start).Microseconds()
+	l.inFlight.Add(-1)
+
+	l.requests.Add(1)
+	l.totalLatency.Add(latency)
+	for {
+		max := l.maxLatency.Load()
+		if latency <= max || l.maxLatency.CompareAndSwap(max, latency) {
+			break
+		}
+	}
+	if err == client.ErrTimeout {
+		l.timeouts.Add(1)
+	} else if err != nil {
+		l.failures.Add(1)
+	}
+	return reply, err
+}
+
+// cluster links：每个节点一项 [peer addr connections n in-flight n requests n failures n timeouts n avg-latency-us n max-latency-us n]
+func (cluster *Cluster) clusterLinks() protocol.Reply {
+	result := protocol.NewMixReply()
+	links, ok := cluster.clientFactory.(*PeerLinks)
+	if !ok {
+		return result
+	}
+	for _, s := range links.stats() {
+		item := protocol.NewMixReply()
+		field := func(name string, value int64) {
+			item.Append(protocol.NewBulkReply([]byte(name)), protocol.NewIntegerReply(value))
+		}
+		item.Append(protocol.NewBulkReply([]byte("peer")), protocol.NewBulkReply([]byte(s.addr)))
+		field("connections", int64(s.connections))
+		field("in-flight", s.inFlight)
+		field("requests", s.requests)
+		field("failures", s.failures)
+		field("timeouts", s.timeouts)
+		field("avg-latency-us", s.avgLatency)
+		field("max-latency-us", s.maxLatency)
+		result.Append(item)
+	}
+	return result
+}
@@ -0,0 +1,284 @@
+package cluster
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/client"
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/parser"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+// 回复最后一个参数的服务端（sleep命令等待200毫秒后回复，ClusterAuth 完成节点认证，认证前调用 beforeAuth(第几个连接)）
+func startEchoServer(t *testing.T, accepted *atomic.Int64, beforeAuth func(n int64)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n := accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				peer := connection.NewKeepConnection(conn)
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					args := payload.Reply.(*protocol.MultiBulkReply).RedisCommand
+					if string(args[0]) == "ClusterAuth" {
+						if beforeAuth != nil {
+							beforeAuth(n)
+						}
+						conn.Write(clusterAuthFunc(nil, peer, args).ToBytes())
+						continue
+					}
+					if string(args[0]) == "sleep" {
+						time.Sleep(200 * time.Millisecond)
+					}
+					conn.Write(protocol.NewBulkReply(args[len(args)-1]).ToBytes())
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestPeerLinks(t *testing.T) {
+	conf.GlobalConfig.ClusterPeerConns = 2
+	conf.GlobalConfig.ClusterRelayTimeout = 100
+	defer func() {
+		conf.GlobalConfig.ClusterPeerConns = 4
+		conf.GlobalConfig.ClusterRelayTimeout = 3000
+	}()
+	var accepted atomic.Int64
+	addr := startEchoServer(t, &accepted, nil)
+	links := NewPeerLinks()
+	defer links.Close()
+
+	// 并发请求复用2个连接，结果与请求一一对应
+	var wg sync.WaitGroup
+	var wrong atomic.Int64
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cli, err := links.GetConn(addr)
+			if err != nil {
+				wrong.Add(1)
+				return
+			}
+			defer links.ReturnConn(addr, cli)
+			value := strconv.Itoa(i)
+			reply, err := cli.Send(utils.ToCmdLine("echo", value))
+			if err != nil || string(reply.ToBytes()) != string(protocol.NewBulkReply([]byte(value)).ToBytes()) {
+				wrong.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if wrong.Load() != 0 {
+		t.Fatalf("%d requests got wrong reply", wrong.Load())
+	}
+	// 同时建立的多余连接已经关闭
+	if accepted.Load() < 2 {
+		t.Fatalf("expect at least 2 connections, got %d", accepted.Load())
+	}
+
+	// 超过 cluster-relay-timeout 没有结果
+	cli, _ := links.GetConn(addr)
+	if _, err := cli.Send(utils.ToCmdLine("sleep", "x")); err != client.ErrTimeout {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+
+	stats := links.stats()
+	if len(stats) != 1 {
+		t.Fatalf("expect 1 peer, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.addr != addr || s.connections != 2 || s.requests != 201 || s.timeouts != 1 || s.failures != 0 || s.inFlight != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s.maxLatency < 100000 || s.avgLatency > s.maxLatency {
+		t.Fatalf("unexpected latency %+v", s)
+	}
+}
+
+// 建立连接时不持有锁：一个连接的握手阻塞时，其他连接上的请求不受影响
+func TestPeerLinkDialWithoutLock(t *testing.T) {
+	conf.GlobalConfig.ClusterPeerConns = 2
+	defer func() { conf.GlobalConfig.ClusterPeerConns = 4 }()
+	release := make(chan struct{})
+	defer close(release)
+	var accepted atomic.Int64
+	addr := startEchoServer(t, &accepted, func(n int64) {
+		if n == 2 {
+			<-release // 第二个连接的握手一直阻塞
+		}
+	})
+	links := NewPeerLinks()
+	defer links.Close()
+
+	// 第一个连接
+	if _, err := links.GetConn(addr); err != nil {
+		t.Fatal(err)
+	}
+	// 第二个连接正在握手
+	go links.GetConn(addr)
+	for accepted.Load() != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 轮询到第一个连接，不需要等待
+	done := make(chan error, 1)
+	go func() {
+		_, err := links.GetConn(addr)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetConn blocked by another connection's handshake")
+	}
+}
+
+// 同时建立同一个连接：只保留一个，其他的关闭
+func TestPeerLinkDialRace(t *testing.T) {
+	conf.GlobalConfig.ClusterPeerConns = 1
+	defer func() { conf.GlobalConfig.ClusterPeerConns = 4 }()
+	var accepted atomic.Int64
+	start := make(chan struct{})
+	addr := startEchoServer(t, &accepted, func(n int64) {
+		<-start
+	})
+	links := NewPeerLinks()
+	defer links.Close()
+
+	const n = 8
+	clients := make(chan Client, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			cli, err := links.GetConn(addr)
+			if err != nil {
+				t.Error(err)
+			}
+			clients <- cli
+		}()
+	}
+	for accepted.Load() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(start)
+
+	var first *client.RedisClient
+	for i := 0; i < n; i++ {
+		cli := <-clients
+		if cli == nil {
+			t.FailNow()
+		}
+		if first == nil {
+			first = cli.(*linkClient).cli
+		}
+		if cli.(*linkClient).cli != first {
+			t.Fatal("all requests should share the installed connection")
+		}
+	}
+	if s := links.stats()[0]; s.connections != 1 {
+		t.Fatalf("expect 1 connection, got %d", s.connections)
+	}
+}
+
+// 断线重连后重新认证，内部命令仍然可以转发
+func TestPeerLinkReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+	conf.GlobalConfig.Peers = []string{addr}
+	conf.GlobalConfig.Self = addr
+	node := newCluster(&mockFactory{})
+	defer node.Close()
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				peer := connection.NewKeepConnection(conn)
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					args := payload.Reply.(*protocol.MultiBulkReply).RedisCommand
+					conn.Write(node.Exec(peer, args).ToBytes())
+				}
+			}()
+		}
+	}()
+
+	conf.GlobalConfig.ClusterPeerConns = 1
+	defer func() { conf.GlobalConfig.ClusterPeerConns = 4 }()
+	links := NewPeerLinks()
+	defer links.Close()
+	send := func(cmdLine ...string) (string, error) {
+		cli, err := links.GetConn(addr)
+		if err != nil {
+			return "", err
+		}
+		defer links.ReturnConn(addr, cli)
+		reply, err := cli.Send(utils.ToCmdLine(cmdLine[0], cmdLine[1:]...))
+		if err != nil {
+			return "", err
+		}
+		return string(reply.ToBytes()), nil
+	}
+	if got, err := send("Direct", "set", "k", "v"); got != "+OK\r\n" {
+		t.Fatalf("direct set: %q %v", got, err)
+	}
+
+	// 断开节点之间的连接
+	mu.Lock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	mu.Unlock()
+
+	var got string
+	for i := 0; i < 30; i++ {
+		if got, err = send("Direct", "get", "k"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if got != "$1\r\nv\r\n" {
+		t.Fatalf("direct get after reconnect: %q %v", got, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 2 {
+		t.Fatalf("expect the link to be reconnected, got %d connections", len(conns))
+	}
+}
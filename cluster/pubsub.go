@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"strconv"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/tool/logger"
+)
+
+/*
+集群模式下的发布订阅：
+
+1. SUBSCRIBE/UNSUBSCRIBE：在客户端连接的节点上订阅
+2. PUBLISH：并行在所有节点上发布（Direct publish：只在节点本地发布，不再转发，避免循环转发），回复所有节点上收到消息的客户端数量；
+   无法访问的节点忽略
+3. sharded pub/sub：channel 和 key 一样属于某个节点（哈希槽模式下为channel所在槽的负责节点）
+   - SSUBSCRIBE 的channel必须属于同一个节点（哈希槽模式下同一个槽），并且属于当前节点（哈希槽模式下也可以是负责节点的从节点），否则回复 -MOVED
+   - SPUBLISH 在channel所属的节点（哈希槽模式下包括从节点）上发布；重定向模式（cluster-redirect yes）下不属于当前节点时回复 -MOVED
+*/
+
+// 所有节点（哈希槽模式下包括从节点，不包括已下线的节点），按地址排序
+func (cluster *Cluster) allNodes() []string {
+	if cluster.mode == modeSlot {
+		var peers []string
+		for _, node := range cluster.slots.reachableNodes() {
+			peers = append(peers, node.addr)
+		}
+		return peers
+	}
+	return cluster.ringNodes()
+}
+
+// channel所属的节点（哈希槽模式下包括从节点）
+func (cluster *Cluster) channelNodes(channel string) ([]string, protocol.Reply) {
+	if cluster.mode != modeSlot {
+		return []string{cluster.pickPeer(channel)}, nil
+	}
+	owner := cluster.slots.nodeOf(hashslot.Slot(channel))
+	if owner == nil {
+		return nil, protocol.NewSimpleErrReply("CLUSTERDOWN Hash slot not served")
+	}
+	nodes := []string{owner.addr}
+	for _, replica := range cluster.slots.replicasOf(owner) {
+		if !cluster.slots.isFailed(replica) {
+			nodes = append(nodes, replica.addr)
+		}
+	}
+	return nodes, nil
+}
+
+// 在节点上发布消息，累加收到消息的客户端数量
+func (cluster *Cluster) publishTo(c abstract.Connection, peers []string, redisCommand [][]byte) int64 {
+	groups := make(map[string][]*scatterPart)
+	for _, peer := range peers {
+		groups[peer] = []*scatterPart{{cmdLine: redisCommand}}
+	}
+	cluster.scatter(c, groups)
+
+	var receivers int64
+	for peer, parts := range groups {
+		if intReply, ok := parts[0].reply.(*protocol.IntegerReply); ok {
+			receivers += intReply.Integer
+		} else {
+			logger.Warnf("cluster: %s to %s failed: %s", redisCommand[0], peer, parts[0].reply.ToBytes())
+		}
+	}
+	return receivers
+}
+
+// publish channel message
+func publishFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) != 3 {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	return protocol.NewIntegerReply(cluster.publishTo(c, cluster.allNodes(), redisCommand))
+}
+
+// ssubscribe channel [channel ...]
+func ssubscribeFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) < 2 {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	channels := make([]string, 0, len(redisCommand)-1)
+	for _, channel := range redisCommand[1:] {
+		channels = append(channels, string(channel))
+	}
+	if cluster.mode == modeSlot && !sameSlot(channels) {
+		return protocol.NewSimpleErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+	}
+	if cluster.mode != modeSlot && len(cluster.groupByKeys(channels)) > 1 {
+		return protocol.NewSimpleErrReply("CROSSSLOT Keys in request don't hash to the same node")
+	}
+
+	// 订阅只能在channel所属的节点上
+	nodes, errReply := cluster.channelNodes(channels[0])
+	if errReply != nil {
+		return errReply
+	}
+	if !containsPeer(nodes, cluster.self) {
+		return movedChannel(channels[0], nodes[0])
+	}
+	return cluster.engine.Exec(c, redisCommand)
+}
+
+func containsPeer(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+func movedChannel(channel string, owner string) protocol.Reply {
+	return protocol.NewSimpleErrReply("MOVED " + strconv.Itoa(hashslot.Slot(channel)) + " " + owner)
+}
+
+// spublish channel message
+func spublishFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) != 3 {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	channel := string(redisCommand[1])
+	nodes, errReply := cluster.channelNodes(channel)
+	if errReply != nil {
+		return errReply
+	}
+	// 重定向模式：和 Redis Cluster 相同，只能在channel所属的节点上发布
+	if cluster.redirectEnabled() && !containsPeer(nodes, cluster.self) {
+		return movedChannel(channel, nodes[0])
+	}
+	return protocol.NewIntegerReply(cluster.publishTo(c, nodes, redisCommand))
+}
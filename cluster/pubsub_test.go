@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+// 记录收到的消息
+type recordConn struct {
+	*connection.VirtualConnection
+	mu       sync.Mutex
+	received []string
+}
+
+func (r *recordConn) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = append(r.received, string(b))
+	return len(b), nil
+}
+
+func (r *recordConn) last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.received) == 0 {
+		return ""
+	}
+	return r.received[len(r.received)-1]
+}
+
+func TestPubSub(t *testing.T) {
+	peers := []string{"127.0.0.1:51379", "127.0.0.1:52379", "127.0.0.1:53379"}
+	conf.GlobalConfig.Peers = peers
+	for _, addr := range peers {
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&mockFactory{})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	exec := func(peer string, conn *recordConn, cmdLine ...string) string {
+		return string(cluster[peer].Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+	newConn := func() *recordConn {
+		return &recordConn{VirtualConnection: connection.NewVirtualConn()}
+	}
+
+	// PUBLISH 发送给所有节点上的订阅者
+	sub1, sub2, publisher := newConn(), newConn(), newConn()
+	exec(peers[1], sub1, "subscribe", "news")
+	exec(peers[2], sub2, "subscribe", "news")
+	if got := exec(peers[0], publisher, "publish", "news", "hello"); got != ":2\r\n" {
+		t.Fatalf("publish: expect :2, got %q", got)
+	}
+	message := "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n"
+	if sub1.last() != message || sub2.last() != message {
+		t.Fatalf("subscribers should receive %q, got %q %q", message, sub1.last(), sub2.last())
+	}
+
+	// sharded pub/sub：channel属于 peers[1]
+	var channel string
+	for i := 0; channel == ""; i++ {
+		if name := "channel" + strconv.Itoa(i); cluster[peers[0]].pickPeer(name) == peers[1] {
+			channel = name
+		}
+	}
+	ssub := newConn()
+	moved := "-MOVED " + strconv.Itoa(hashslot.Slot(channel)) + " " + peers[1] + "\r\n"
+	if got := exec(peers[0], ssub, "ssubscribe", channel); got != moved {
+		t.Fatalf("ssubscribe: expect %q, got %q", moved, got)
+	}
+	exec(peers[1], ssub, "ssubscribe", channel)
+	if ssub.SSubCount() != 1 || ssub.SubCount() != 0 {
+		t.Fatalf("expect 1 shard channel, got %d (%d channels)", ssub.SSubCount(), ssub.SubCount())
+	}
+	if got := exec(peers[2], publisher, "spublish", channel, "hi"); got != ":1\r\n" {
+		t.Fatalf("spublish: expect :1, got %q", got)
+	}
+	smessage := "*3\r\n$8\r\nsmessage\r\n$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n$2\r\nhi\r\n"
+	if ssub.last() != smessage {
+		t.Fatalf("expect %q, got %q", smessage, ssub.last())
+	}
+	// PUBLISH 不会发送给 SSUBSCRIBE 的订阅者
+	if got := exec(peers[0], publisher, "publish", channel, "hi"); got != ":0\r\n" {
+		t.Fatalf("publish: expect :0, got %q", got)
+	}
+
+	exec(peers[1], ssub, "sunsubscribe")
+	if got := exec(peers[0], publisher, "spublish", channel, "hi"); got != ":0\r\n" {
+		t.Fatalf("spublish after sunsubscribe: expect :0, got %q", got)
+	}
+}
@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"strconv"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+哈希槽模式下，keys的执行位置：
+
+1. 槽属于其他节点：-MOVED <slot> <ip:port>
+2. 槽正在从当前节点迁出，且key在当前节点不存在：-ASK <slot> <ip:port>，客户端先发送ASKING，再向目标节点发送本次命令
+3. 槽正在迁入当前节点：只有带ASKING标记的命令才在当前节点执行，否则 -MOVED 到槽的负责节点
+
+重定向模式（cluster-redirect yes）：直接回复 -MOVED/-ASK，由客户端重定向
+转发模式：由当前节点代替客户端重定向，MOVED 转发给负责的节点（Owner），ASK 转发给迁入的节点（Importing）
+*/
+
+// keys的执行位置
+const (
+	routeLocal = iota
+	routeMoved
+	routeAsk
+)
+
+func (cluster *Cluster) redirectEnabled() bool {
+	return cluster.redirect && cluster.mode == modeSlot
+}
+
+// 计算keys的执行位置（keys必须属于同一个槽）
+func (cluster *Cluster) locateSlot(c abstract.Connection, keys []string) (route int, slot int, node *clusterNode, errReply protocol.Reply) {
+	slot = hashslot.Slot(keys[0])
+	for _, key := range keys[1:] {
+		if hashslot.Slot(key) != slot {
+			return 0, 0, nil, protocol.NewSimpleErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	owner := cluster.slots.nodeOf(slot)
+	if owner == cluster.slots.myself {
+		target := cluster.slots.migratingTo(slot)
+		if target == nil {
+			return routeLocal, slot, owner, nil
+		}
+		// 迁出中：key都在当前节点（还没有迁走）时，在当前节点执行
+		missing := 0
+		for _, key := range keys {
+			if !cluster.existsLocal(c, key) {
+				missing++
+			}
+		}
+		if missing == 0 {
+			return routeLocal, slot, owner, nil
+		}
+		if missing < len(keys) {
+			// 部分key已经迁走
+			return 0, 0, nil, protocol.NewSimpleErrReply("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+		return routeAsk, slot, target, nil
+	}
+
+	if c.IsAsking() && cluster.slots.importingFrom(slot) != nil {
+		return routeLocal, slot, cluster.slots.myself, nil
+	}
+	if owner == nil {
+		return 0, 0, nil, protocol.NewSimpleErrReply("CLUSTERDOWN Hash slot not served")
+	}
+	if cluster.slots.isFailed(owner) {
+		return 0, 0, nil, protocol.NewSimpleErrReply("CLUSTERDOWN The cluster is down")
+	}
+	return routeMoved, slot, owner, nil
+}
+
+func redirectReply(route int, slot int, node *clusterNode) protocol.Reply {
+	prefix := "MOVED "
+	if route == routeAsk {
+		prefix = "ASK "
+	}
+	return protocol.NewSimpleErrReply(prefix + strconv.Itoa(slot) + " " + node.addr)
+}
+
+// 检查keys是否应该在当前节点执行，返回nil表示在当前节点执行，否则返回重定向（or 错误）回复
+func (cluster *Cluster) checkRedirect(c abstract.Connection, keys []string) protocol.Reply {
+	if len(keys) == 0 {
+		return nil
+	}
+	route, slot, node, errReply := cluster.locateSlot(c, keys)
+	if errReply != nil {
+		return errReply
+	}
+	if route == routeLocal {
+		return nil
+	}
+	return redirectReply(route, slot, node)
+}
+
+// 哈希槽模式下执行命令
+// followMoved：转发模式下是否转发给槽的负责节点（Owner转发过来的命令不再转发，避免各节点的槽分配表不一致时循环转发）
+func (cluster *Cluster) execSlotCommand(c abstract.Connection, redisCommand [][]byte, keys []string, followMoved bool) protocol.Reply {
+	if cluster.readFromReplica(c, redisCommand, keys) {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	route, slot, node, errReply := cluster.locateSlot(c, keys)
+	if errReply != nil {
+		return errReply
+	}
+	switch {
+	case route == routeLocal:
+		return cluster.engine.Exec(c, redisCommand)
+	case cluster.redirect:
+		return redirectReply(route, slot, node)
+	case route == routeAsk:
+		return cluster.Relay(node.addr, c, pushCmd(redisCommand, "Importing"))
+	case followMoved:
+		return cluster.Relay(node.addr, c, pushCmd(redisCommand, "Owner"))
+	}
+	return redirectReply(route, slot, node)
+}
+
+// key在当前节点是否存在
+func (cluster *Cluster) existsLocal(c abstract.Connection, key string) bool {
+	reply := cluster.engine.Exec(c, utils.ToCmdLine("exists", key))
+	intReply, ok := reply.(*protocol.IntegerReply)
+	return ok && intReply.Integer > 0
+}
+
+// 转发模式：其他节点认为当前节点负责该槽
+func ownerFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	redisCommand = popCmd(redisCommand)
+	return cluster.execSlotCommand(c, redisCommand, commandKeys(redisCommand), false)
+}
+
+// 转发模式：槽正在迁入当前节点，相当于 ASKING + 命令
+func importingFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	redisCommand = popCmd(redisCommand)
+	c.SetAsking(true)
+	return cluster.execSlotCommand(c, redisCommand, commandKeys(redisCommand), false)
+}
+
+// RESTORE-ASKING：MIGRATE 发送到目标节点的命令
+func restoreAskingFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) < 4 {
+		return protocol.NewArgNumErrReply("restore-asking")
+	}
+	if cluster.mode != modeSlot {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	c.SetAsking(true)
+	return cluster.execSlotCommand(c, redisCommand, []string{string(redisCommand[1])}, false)
+}
+
+// ASKING：下一条命令允许在迁入中的槽上执行
+func askingFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) != 1 {
+		return protocol.NewArgNumErrReply("asking")
+	}
+	c.SetAsking(true)
+	return protocol.NewOkReply()
+}
+
+// READONLY / READWRITE：是否允许在从节点上读取（见 failover.go）
+func readOnlyFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) != 1 {
+		return protocol.NewArgNumErrReply(string(redisCommand[0]))
+	}
+	c.SetReadOnly(true)
+	return protocol.NewOkReply()
+}
+
+func readWriteFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) != 1 {
+		return protocol.NewArgNumErrReply(string(redisCommand[0]))
+	}
+	c.SetReadOnly(false)
+	return protocol.NewOkReply()
+}
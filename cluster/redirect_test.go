@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+func TestRedirect(t *testing.T) {
+	conf.GlobalConfig.Peers = []string{"127.0.0.1:6379", "127.0.0.1:7379"}
+	conf.GlobalConfig.Self = "127.0.0.1:6379"
+	conf.GlobalConfig.ClusterMode = modeSlot
+	conf.GlobalConfig.ClusterRedirect = true
+	conf.GlobalConfig.ClusterConfigFile = ""
+	defer func() {
+		conf.GlobalConfig.ClusterMode = modeConsistentHash
+		conf.GlobalConfig.ClusterRedirect = false
+		conf.GlobalConfig.ClusterConfigFile = "nodes.conf"
+	}()
+	node := NewCluster()
+	defer node.Close()
+	conn := connection.NewVirtualConn()
+
+	// foo -> 12182，属于 127.0.0.1:7379
+	reply := node.Exec(conn, utils.ToCmdLine("set", "foo", "1"))
+	if string(reply.ToBytes()) != "-MOVED 12182 127.0.0.1:7379\r\n" {
+		t.Fatalf("expect MOVED, got %q", reply.ToBytes())
+	}
+	// bar -> 5061，属于当前节点
+	if reply := node.Exec(conn, utils.ToCmdLine("set", "bar", "1")); !protocol.IsOKReply(reply) {
+		t.Fatalf("expect OK, got %q", reply.ToBytes())
+	}
+	reply = node.Exec(conn, utils.ToCmdLine("mset", "bar", "1", "foo", "2"))
+	if string(reply.ToBytes()) != "-CROSSSLOT Keys in request don't hash to the same slot\r\n" {
+		t.Fatalf("expect CROSSSLOT, got %q", reply.ToBytes())
+	}
+
+	// 迁出中：已经存在的key在当前节点执行，不存在的key回复ASK
+	other := node.slots.nodeOf(12182)
+	node.slots.migrating[5061] = other
+	if reply := node.Exec(conn, utils.ToCmdLine("get", "bar")); string(reply.ToBytes()) != "$1\r\n1\r\n" {
+		t.Fatalf("expect local value, got %q", reply.ToBytes())
+	}
+	slot := strconv.Itoa(hashslot.Slot("{bar}x"))
+	reply = node.Exec(conn, utils.ToCmdLine("get", "{bar}x"))
+	if string(reply.ToBytes()) != "-ASK "+slot+" 127.0.0.1:7379\r\n" {
+		t.Fatalf("expect ASK, got %q", reply.ToBytes())
+	}
+
+	// 迁入中：只有ASKING之后的一条命令在当前节点执行
+	node.slots.importing[12182] = other
+	if reply := node.Exec(conn, utils.ToCmdLine("asking")); !protocol.IsOKReply(reply) {
+		t.Fatalf("asking failed: %q", reply.ToBytes())
+	}
+	if reply := node.Exec(conn, utils.ToCmdLine("set", "foo", "1")); !protocol.IsOKReply(reply) {
+		t.Fatalf("expect OK after ASKING, got %q", reply.ToBytes())
+	}
+	if reply := node.Exec(conn, utils.ToCmdLine("get", "foo")); !protocol.IsErrReply(reply) {
+		t.Fatalf("expect MOVED without ASKING, got %q", reply.ToBytes())
+	}
+}
@@ -0,0 +1,468 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/consistenthash"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+一致性hash模式下动态增删节点、修改权重（CLUSTER ADDPEER ip:port [weight] / DELPEER ip:port / SETWEIGHT ip:port weight）：
+
+1. 执行命令的节点计算新的节点列表（纪元+1），向新旧所有节点发送 CLUSTER SETPEERS <epoch> <ip:port=weight...>
+   节点更新一致性hash，保留原来的一致性hash，原来的所有节点标记为迁移中
+   有节点更新失败时撤销变更：向已经更新的节点发送原来的节点列表（纪元+1），还没有开始迁移key的变更可以被新的节点列表替换
+2. 所有节点都更新之后，再发送 CLUSTER REHOME <epoch>（失败时在后台重试）：节点在后台将不再属于自己的key迁移到新的节点（RESTORE-ASKING），
+   完成后向所有节点广播 CLUSTER REHOMED <epoch> <ip:port>
+3. key原来的节点迁移完成之前，命令发送给原来的节点执行（Rehome）：key还在原来的节点上时直接执行，已经迁走时转发给新的节点
+4. 所有节点都迁移完成后，删除原来的一致性hash
+
+迁移期间不经过原来节点的写入（例如 MSET），新节点上已经存在的key不会被覆盖（原来节点上的key直接删除）
+*/
+
+// 节点变更后，迁移失败时重试的间隔
+const rehomeRetryInterval = time.Second
+
+// 所有节点（迁移中包括原来的节点），按地址排序
+func (cluster *Cluster) ringNodes() []string {
+	cluster.ringMu.RLock()
+	defer cluster.ringMu.RUnlock()
+	nodes := cluster.consistHash.Nodes()
+	if cluster.oldHash != nil {
+		nodes = unionPeers(nodes, cluster.oldHash.Nodes())
+	}
+	return nodes
+}
+
+// 合并节点列表，按地址排序
+func unionPeers(lists ...[]string) []string {
+	contains := make(map[string]struct{})
+	var peers []string
+	for _, list := range lists {
+		for _, peer := range list {
+			if _, ok := contains[peer]; !ok {
+				contains[peer] = struct{}{}
+				peers = append(peers, peer)
+			}
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// 一致性hash模式下keys的执行位置：keys原来的节点还没有完成迁移时，返回原来的节点（rehome = true）
+func (cluster *Cluster) locateRing(keys []string) (peer string, rehome bool, errReply protocol.Reply) {
+	cluster.ringMu.RLock()
+	defer cluster.ringMu.RUnlock()
+	var source string
+	for i, key := range keys {
+		owner := cluster.consistHash.Get(key)
+		from := owner
+		if cluster.oldHash != nil {
+			if old := cluster.oldHash.Get(key); cluster.rehoming[old] {
+				from = old
+			}
+		}
+		if i == 0 {
+			peer, source = owner, from
+			continue
+		}
+		if owner != peer {
+			return "", false, protocol.NewSimpleErrReply("CROSSSLOT Keys in request don't hash to the same node")
+		}
+		if from != source {
+			return "", false, protocol.NewSimpleErrReply("TRYAGAIN Multiple keys request during rehoming of peers")
+		}
+	}
+	if source != peer {
+		return source, true, nil
+	}
+	return peer, false, nil
+}
+
+// Rehome：key原来的节点上执行命令，key已经迁走时转发给新的节点
+func rehomeFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	redisCommand = popCmd(redisCommand)
+	keys := commandKeys(redisCommand)
+	if len(keys) == 0 {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+
+	// 锁定keys，避免检查之后key被迁走
+	dbIndex := c.GetDBIndex()
+	cluster.engine.RWLocks(dbIndex, nil, keys)
+	missing := 0
+	for _, key := range keys {
+		if reply, ok := cluster.engine.ExecWithLock(dbIndex, utils.ToCmdLine("exists", key)).(*protocol.IntegerReply); !ok || reply.Integer == 0 {
+			missing++
+		}
+	}
+	if missing == 0 {
+		defer cluster.engine.RWUnLocks(dbIndex, nil, keys)
+		return cluster.engine.ExecWithLock(dbIndex, redisCommand)
+	}
+	cluster.engine.RWUnLocks(dbIndex, nil, keys)
+	if missing < len(keys) {
+		return protocol.NewSimpleErrReply("TRYAGAIN Multiple keys request during rehoming of peers")
+	}
+
+	peer := cluster.pickPeer(keys[0])
+	if peer == cluster.self {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	return cluster.Relay(peer, c, pushCmd(redisCommand, "Direct"))
+}
+
+// CLUSTER ADDPEER ip:port [weight] / DELPEER ip:port / SETWEIGHT ip:port weight
+func (cluster *Cluster) clusterChangePeer(subCommand string, args [][]byte) protocol.Reply {
+	if (subCommand == "addpeer" && len(args) != 1 && len(args) != 2) ||
+		(subCommand == "delpeer" && len(args) != 1) ||
+		(subCommand == "setweight" && len(args) != 2) {
+		return protocol.NewArgNumErrReply("cluster " + subCommand)
+	}
+	addr := string(args[0])
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return protocol.NewGenericErrReply("invalid address " + addr)
+	}
+	weight := 1
+	if len(args) == 2 {
+		var err error
+		if weight, err = strconv.Atoi(string(args[1])); err != nil || weight <= 0 {
+			return protocol.NewGenericErrReply("invalid weight " + string(args[1]))
+		}
+	}
+
+	cluster.ringMu.RLock()
+	if cluster.oldHash != nil {
+		cluster.ringMu.RUnlock()
+		return protocol.NewGenericErrReply("peers are rehoming, try again later")
+	}
+	nodes := cluster.consistHash.Nodes()
+	weights := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		weights[node] = cluster.consistHash.Weight(node)
+	}
+	epoch := cluster.ringEpoch + 1
+	cluster.ringMu.RUnlock()
+
+	previous := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		previous = append(previous, node+"="+strconv.Itoa(weights[node]))
+	}
+
+	_, exists := weights[addr]
+	switch {
+	case subCommand == "addpeer" && exists:
+		return protocol.NewGenericErrReply("peer " + addr + " already exists")
+	case subCommand != "addpeer" && !exists:
+		return protocol.NewGenericErrReply("unknown peer " + addr)
+	case subCommand == "delpeer" && len(nodes) == 1:
+		return protocol.NewGenericErrReply("can't remove the last peer")
+	case subCommand == "delpeer":
+		delete(weights, addr)
+	default:
+		weights[addr] = weight
+	}
+	peers := make([]string, 0, len(weights))
+	for _, node := range unionPeers(nodes, []string{addr}) {
+		if weight, ok := weights[node]; ok {
+			peers = append(peers, node+"="+strconv.Itoa(weight))
+		}
+	}
+
+	// 1.所有节点更新节点列表
+	epochStr := strconv.FormatInt(epoch, 10)
+	targets := unionPeers(nodes, []string{addr})
+	var updated, failed []string
+	for _, peer := range targets {
+		if _, err := cluster.callNode(peer, append([]string{"cluster", "setpeers", epochStr}, peers...)...); err != nil {
+			logger.Warn("cluster: set peers failed: " + err.Error())
+			failed = append(failed, peer)
+			continue
+		}
+		updated = append(updated, peer)
+	}
+	// 有节点没有更新：撤销变更（还没有开始迁移key），已经更新的节点恢复原来的节点列表
+	if len(failed) > 0 {
+		rollbackStr := strconv.FormatInt(epoch+1, 10)
+		for _, peer := range updated {
+			if _, err := cluster.callNode(peer, append([]string{"cluster", "setpeers", rollbackStr}, previous...)...); err != nil {
+				logger.Warn("cluster: rollback peers failed: " + err.Error())
+			}
+		}
+		return protocol.NewGenericErrReply("peers not updated: " + strings.Join(failed, ","))
+	}
+	// 2.开始迁移key
+	for _, peer := range targets {
+		if _, err := cluster.callNode(peer, "cluster", "rehome", epochStr); err != nil {
+			logger.Warn("cluster: rehome failed: " + err.Error())
+			go cluster.retryRehome(epoch, peer)
+		}
+	}
+	return protocol.NewOkReply()
+}
+
+// 通知节点开始迁移key失败时在后台重试，直到成功 or 节点列表再次变更
+func (cluster *Cluster) retryRehome(epoch int64, peer string) {
+	epochStr := strconv.FormatInt(epoch, 10)
+	for {
+		select {
+		case <-cluster.closed:
+			return
+		case <-time.After(rehomeRetryInterval):
+		}
+		cluster.ringMu.RLock()
+		current := cluster.ringEpoch
+		cluster.ringMu.RUnlock()
+		if current != epoch {
+			return
+		}
+		_, err := cluster.callNode(peer, "cluster", "rehome", epochStr)
+		if err == nil {
+			return
+		}
+		logger.Warn("cluster: retry rehome failed: " + err.Error())
+	}
+}
+
+// CLUSTER SETPEERS <epoch> <ip:port[=weight]...>：更新节点列表
+func (cluster *Cluster) clusterSetPeers(args [][]byte) protocol.Reply {
+	if len(args) < 2 {
+		return protocol.NewArgNumErrReply("cluster setpeers")
+	}
+	epoch, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return protocol.NewGenericErrReply("invalid epoch " + string(args[0]))
+	}
+	weights := make(map[string]int, len(args)-1)
+	for _, arg := range args[1:] {
+		peer, weight, err := parsePeerWeight(string(arg))
+		if err != nil {
+			return protocol.NewGenericErrReply(err.Error())
+		}
+		weights[peer] = weight
+	}
+
+	cluster.ringMu.Lock()
+	defer cluster.ringMu.Unlock()
+	if epoch <= cluster.ringEpoch {
+		return protocol.NewGenericErrReply(fmt.Sprintf("stale peers epoch %d, current epoch is %d", epoch, cluster.ringEpoch))
+	}
+	// 还没有开始迁移key的变更（例如有节点更新失败，撤销变更），在变更前的节点列表上重新计算
+	old := cluster.consistHash
+	if cluster.oldHash != nil {
+		if cluster.rehomeEpoch == cluster.ringEpoch {
+			return protocol.NewGenericErrReply("peers are rehoming, try again later")
+		}
+		old = cluster.oldHash
+	}
+
+	// 在副本上增删节点、修改权重
+	oldNodes := old.Nodes()
+	ring := old.Clone()
+	for _, node := range oldNodes {
+		weight, ok := weights[node]
+		if !ok {
+			ring.Remove(node)
+			continue
+		}
+		if weight > 0 && weight != ring.Weight(node) {
+			ring.AddWithWeight(node, weight)
+		}
+		delete(weights, node)
+	}
+	for peer, weight := range weights {
+		ring.AddWithWeight(peer, weight)
+	}
+
+	// 与变更前相同（撤销变更），不需要迁移key
+	if sameWeights(ring, old) {
+		cluster.consistHash, cluster.oldHash, cluster.rehoming, cluster.ringEpoch = old, nil, nil, epoch
+		logger.Info(fmt.Sprintf("cluster: peers restored to %v (epoch %d)", old.Nodes(), epoch))
+		return protocol.NewOkReply()
+	}
+
+	rehoming := make(map[string]bool, len(oldNodes))
+	for _, node := range oldNodes {
+		rehoming[node] = true
+	}
+	cluster.consistHash, cluster.oldHash, cluster.rehoming, cluster.ringEpoch = ring, old, rehoming, epoch
+	logger.Info(fmt.Sprintf("cluster: peers changed to %v (epoch %d)", ring.Nodes(), epoch))
+	return protocol.NewOkReply()
+}
+
+// 节点以及节点的权重是否相同
+func sameWeights(a, b *consistenthash.Map) bool {
+	nodes := a.Nodes()
+	if len(nodes) != len(b.Nodes()) {
+		return false
+	}
+	for _, node := range nodes {
+		if a.Weight(node) != b.Weight(node) {
+			return false
+		}
+	}
+	return true
+}
+
+// CLUSTER DISTRIBUTION：每个节点的权重、虚拟节点数量、预期分配到的key的比例
+func (cluster *Cluster) clusterDistribution() protocol.Reply {
+	cluster.ringMu.RLock()
+	defer cluster.ringMu.RUnlock()
+	shares := cluster.consistHash.Distribution()
+	result := protocol.NewMixReply()
+	for _, node := range cluster.consistHash.Nodes() {
+		item := protocol.NewMixReply()
+		item.Append(protocol.NewBulkReply([]byte("peer")), protocol.NewBulkReply([]byte(node)))
+		item.Append(protocol.NewBulkReply([]byte("weight")), protocol.NewIntegerReply(int64(cluster.consistHash.Weight(node))))
+		item.Append(protocol.NewBulkReply([]byte("virtual-nodes")), protocol.NewIntegerReply(int64(cluster.consistHash.VirtualNodes(node))))
+		item.Append(protocol.NewBulkReply([]byte("expected-share")), protocol.NewBulkReply([]byte(fmt.Sprintf("%.2f%%", shares[node]*100))))
+		result.Append(item)
+	}
+	return result
+}
+
+// CLUSTER REHOME <epoch>：在后台迁移不再属于当前节点的key
+func (cluster *Cluster) clusterRehome(args [][]byte) protocol.Reply {
+	if len(args) != 1 {
+		return protocol.NewArgNumErrReply("cluster rehome")
+	}
+	epoch, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return protocol.NewGenericErrReply("invalid epoch " + string(args[0]))
+	}
+	cluster.ringMu.Lock()
+	current, started := cluster.ringEpoch, cluster.rehomeEpoch == epoch
+	if epoch == current {
+		cluster.rehomeEpoch = epoch
+	}
+	cluster.ringMu.Unlock()
+	if epoch != current {
+		return protocol.NewGenericErrReply(fmt.Sprintf("peers epoch %d mismatch, current epoch is %d", epoch, current))
+	}
+	// 已经开始迁移（重试的 REHOME）
+	if started {
+		return protocol.NewOkReply()
+	}
+	go cluster.rehome(epoch, cluster.ringNodes())
+	return protocol.NewOkReply()
+}
+
+// CLUSTER REHOMED <epoch> <ip:port>：节点完成了key迁移
+func (cluster *Cluster) clusterRehomed(args [][]byte) protocol.Reply {
+	if len(args) != 2 {
+		return protocol.NewArgNumErrReply("cluster rehomed")
+	}
+	epoch, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return protocol.NewGenericErrReply("invalid epoch " + string(args[0]))
+	}
+	cluster.ringMu.Lock()
+	defer cluster.ringMu.Unlock()
+	if epoch != cluster.ringEpoch || cluster.oldHash == nil {
+		return protocol.NewOkReply()
+	}
+	delete(cluster.rehoming, string(args[1]))
+	if len(cluster.rehoming) == 0 {
+		cluster.oldHash, cluster.rehoming = nil, nil
+		logger.Info(fmt.Sprintf("cluster: all peers rehomed (epoch %d)", epoch))
+	}
+	return protocol.NewOkReply()
+}
+
+// 数据库中的key，以及key所属的节点
+type dbKey struct {
+	dbIndex int
+	key     string
+	peer    string
+}
+
+// 迁移不再属于当前节点的key，失败时重试；重新扫描直到没有不属于当前节点的key（迁移期间可能在当前节点上写入），完成后通知所有节点
+func (cluster *Cluster) rehome(epoch int64, notify []string) {
+	moved := 0
+	for {
+		keys := cluster.foreignKeys()
+		if len(keys) == 0 {
+			break
+		}
+		failed := 0
+		for _, k := range keys {
+			if err := cluster.rehomeKey(k.dbIndex, k.peer, k.key); err != nil {
+				logger.Warn(fmt.Sprintf("cluster: rehome key %s (db %d) to %s failed: %v", k.key, k.dbIndex, k.peer, err))
+				failed++
+				continue
+			}
+			moved++
+		}
+		if failed == 0 {
+			continue
+		}
+		select {
+		case <-cluster.closed:
+			return
+		case <-time.After(rehomeRetryInterval):
+		}
+	}
+	logger.Info(fmt.Sprintf("cluster: rehomed %d keys (epoch %d)", moved, epoch))
+	cluster.broadcastRehomed(epoch, cluster.self, notify)
+}
+
+// 所有数据库中不再属于当前节点的key
+func (cluster *Cluster) foreignKeys() []dbKey {
+	var keys []dbKey
+	for dbIndex := 0; dbIndex < conf.GlobalConfig.Databases; dbIndex++ {
+		cluster.engine.ForEach(dbIndex, func(key string, _ *payload.DataEntity, _ *time.Time) bool {
+			if peer := cluster.pickPeer(key); peer != cluster.self {
+				keys = append(keys, dbKey{dbIndex: dbIndex, key: key, peer: peer})
+			}
+			return true
+		})
+	}
+	return keys
+}
+
+// 迁移一个key：迁移过程中锁定key，新节点上已经存在的key不覆盖
+func (cluster *Cluster) rehomeKey(dbIndex int, peer string, key string) error {
+	keys := []string{key}
+	cluster.engine.RWLocks(dbIndex, nil, keys)
+	defer cluster.engine.RWUnLocks(dbIndex, nil, keys)
+
+	dump, ok := cluster.engine.ExecWithLock(dbIndex, utils.ToCmdLine("dump", key)).(*protocol.BulkReply)
+	if !ok {
+		return nil // key不存在
+	}
+	ttl := int64(0)
+	if pttl, ok := cluster.engine.ExecWithLock(dbIndex, utils.ToCmdLine("pttl", key)).(*protocol.IntegerReply); ok && pttl.Integer > 0 {
+		ttl = pttl.Integer
+	}
+	conn := connection.NewVirtualConn()
+	conn.SetDBIndex(dbIndex)
+	reply := cluster.Relay(peer, conn, utils.ToCmdLine("restore-asking", key, strconv.FormatInt(ttl, 10), string(dump.Arg)))
+	if protocol.IsErrReply(reply) && !strings.HasPrefix(string(reply.ToBytes()), "-BUSYKEY") {
+		return fmt.Errorf("%s", strings.TrimSpace(string(reply.ToBytes())))
+	}
+	cluster.engine.ExecWithLock(dbIndex, utils.ToCmdLine("del", key))
+	return nil
+}
+
+// 通知所有节点：addr完成了key迁移
+func (cluster *Cluster) broadcastRehomed(epoch int64, addr string, targets []string) {
+	epochStr := strconv.FormatInt(epoch, 10)
+	for _, peer := range targets {
+		if _, err := cluster.callNode(peer, "cluster", "rehomed", epochStr, addr); err != nil {
+			logger.Warn("cluster: notify rehomed failed: " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package cluster
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+// 等待所有节点完成key迁移
+func waitRehomed(t *testing.T, addrs []string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		done := true
+		for _, addr := range addrs {
+			node := cluster[addr]
+			node.ringMu.RLock()
+			done = done && node.oldHash == nil
+			node.ringMu.RUnlock()
+		}
+		if done {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("rehoming not finished")
+}
+
+func TestRehome(t *testing.T) {
+	// 两个节点组成集群，新节点只知道自己
+	peers := []string{"127.0.0.1:41379", "127.0.0.1:42379"}
+	newAddr := "127.0.0.1:43379"
+	addrs := append(peers, newAddr)
+	for _, addr := range addrs {
+		conf.GlobalConfig.Peers = peers
+		if addr == newAddr {
+			conf.GlobalConfig.Peers = nil
+		}
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&mockFactory{})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+	exec := func(node *Cluster, cmdLine ...string) string {
+		return string(node.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+	// 所有key都在所属的节点上，且任意节点都能读取
+	checkKeys := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			key := "key" + strconv.Itoa(i)
+			owner := cluster[first.pickPeer(key)]
+			if !owner.existsLocal(conn, key) {
+				t.Fatalf("%s not found on owner %s", key, owner.self)
+			}
+			for _, addr := range addrs {
+				if got := exec(cluster[addr], "get", key); got != "$"+strconv.Itoa(len(strconv.Itoa(i)))+"\r\n"+strconv.Itoa(i)+"\r\n" {
+					t.Fatalf("get %s from %s: %q", key, addr, got)
+				}
+			}
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		exec(first, "set", "key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// ADDPEER：所有节点更新节点列表，key迁移到新节点
+	if got := exec(first, "cluster", "addpeer", newAddr); got != "+OK\r\n" {
+		t.Fatalf("addpeer: %q", got)
+	}
+	waitRehomed(t, addrs)
+	if got := exec(first, "cluster", "addpeer", newAddr); got != "-ERR peer "+newAddr+" already exists\r\n" {
+		t.Fatalf("addpeer again: %q", got)
+	}
+	for _, addr := range addrs {
+		if nodes := cluster[addr].ringNodes(); len(nodes) != 3 {
+			t.Fatalf("%s: unexpected peers %v", addr, nodes)
+		}
+	}
+	moved := 0
+	for i := 0; i < 100; i++ {
+		if cluster[newAddr].existsLocal(conn, "key"+strconv.Itoa(i)) {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no keys moved to the new peer")
+	}
+	checkKeys(100)
+
+	// 更新节点列表之后、迁移完成之前：key在原来的节点上读写
+	var key string
+	for i := 0; key == ""; i++ {
+		if name := "key" + strconv.Itoa(i); first.pickPeer(name) == newAddr {
+			key = name
+		}
+	}
+	for _, addr := range addrs {
+		if got := exec(cluster[addr], "cluster", "setpeers", "2", peers[0], peers[1]); got != "+OK\r\n" {
+			t.Fatalf("setpeers: %q", got)
+		}
+	}
+	if got := exec(cluster[peers[1]], "set", key, "new"); got != "+OK\r\n" {
+		t.Fatalf("set during rehoming: %q", got)
+	}
+	if !cluster[newAddr].existsLocal(conn, key) || cluster[first.pickPeer(key)].existsLocal(conn, key) {
+		t.Fatalf("%s should stay on the old peer until rehomed", key)
+	}
+	if got := exec(first, "get", key); got != "$3\r\nnew\r\n" {
+		t.Fatalf("get during rehoming: %q", got)
+	}
+	whereis := first.pickPeer(key) + " rehoming from " + newAddr
+	if got := exec(first, "cluster", "whereis", key); got != "$"+strconv.Itoa(len(whereis))+"\r\n"+whereis+"\r\n" {
+		t.Fatalf("whereis during rehoming: %q", got)
+	}
+
+	// 迁移完成后，新节点上的key是最新的值
+	for _, addr := range addrs {
+		exec(cluster[addr], "cluster", "rehome", "2")
+	}
+	waitRehomed(t, addrs)
+	if cluster[newAddr].existsLocal(conn, key) {
+		t.Fatalf("%s should be moved away from the removed peer", key)
+	}
+	if got := exec(first, "get", key); got != "$3\r\nnew\r\n" {
+		t.Fatalf("get after rehomed: %q", got)
+	}
+	owner := first.pickPeer(key)
+	if got := exec(first, "cluster", "whereis", key); got != "$"+strconv.Itoa(len(owner))+"\r\n"+owner+"\r\n" {
+		t.Fatalf("whereis after rehomed: %q", got)
+	}
+	if got := exec(first, "dbsize"); got != ":100\r\n" {
+		t.Fatalf("dbsize: %q", got)
+	}
+}
+
+func TestPeerWeight(t *testing.T) {
+	conf.GlobalConfig.ClusterHashFunc = "murmur3"
+	conf.GlobalConfig.ClusterHashStrategy = "jump"
+	peers := []string{"127.0.0.1:44379", "127.0.0.1:45379"}
+	conf.GlobalConfig.ClusterPeerWeights = []string{peers[0] + "=3"}
+	defer func() {
+		conf.GlobalConfig.ClusterHashFunc = "crc32"
+		conf.GlobalConfig.ClusterHashStrategy = "ring"
+		conf.GlobalConfig.ClusterPeerWeights = nil
+	}()
+	conf.GlobalConfig.Peers = peers
+	for _, addr := range peers {
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&mockFactory{})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+	exec := func(cmdLine ...string) string {
+		return string(first.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+	distribution := func(weight0, weight1 int, share0, share1 string) string {
+		item := func(peer string, weight int, share string) string {
+			return "*8\r\n$4\r\npeer\r\n$15\r\n" + peer + "\r\n$6\r\nweight\r\n:" + strconv.Itoa(weight) +
+				"\r\n$13\r\nvirtual-nodes\r\n:" + strconv.Itoa(weight) + "\r\n$14\r\nexpected-share\r\n$" +
+				strconv.Itoa(len(share)) + "\r\n" + share + "\r\n"
+		}
+		return "*2\r\n" + item(peers[0], weight0, share0) + item(peers[1], weight1, share1)
+	}
+
+	if got := exec("cluster", "distribution"); got != distribution(3, 1, "75.00%", "25.00%") {
+		t.Fatalf("distribution: %q", got)
+	}
+	for i := 0; i < 100; i++ {
+		exec("set", "key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// 修改权重后，key迁移到新的节点
+	if got := exec("cluster", "setweight", peers[1], "0"); got != "-ERR invalid weight 0\r\n" {
+		t.Fatalf("setweight: %q", got)
+	}
+	if got := exec("cluster", "setweight", peers[1], "3"); got != "+OK\r\n" {
+		t.Fatalf("setweight: %q", got)
+	}
+	waitRehomed(t, peers)
+	if got := string(cluster[peers[1]].Exec(conn, utils.ToCmdLine("cluster", "distribution")).ToBytes()); got != distribution(3, 3, "50.00%", "50.00%") {
+		t.Fatalf("distribution: %q", got)
+	}
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		if !cluster[first.pickPeer(key)].existsLocal(conn, key) {
+			t.Fatalf("%s not found on owner", key)
+		}
+	}
+}
+
+// 第一次发送 RESTORE-ASKING 时执行 hook
+type restoreHookFactory struct {
+	mockFactory
+	once sync.Once
+	hook func()
+}
+
+func (f *restoreHookFactory) GetConn(addr string) (Client, error) {
+	return &restoreHookClient{fakeClient: fakeClient{cluster: getCluster(addr)}, factory: f}, nil
+}
+
+type restoreHookClient struct {
+	fakeClient
+	factory *restoreHookFactory
+}
+
+func (c *restoreHookClient) Send(command [][]byte) (protocol.Reply, error) {
+	if strings.EqualFold(string(command[0]), "restore-asking") {
+		c.factory.once.Do(c.factory.hook)
+	}
+	return c.fakeClient.Send(command)
+}
+
+func TestRehomeRescan(t *testing.T) {
+	peers := []string{"127.0.0.1:46379", "127.0.0.1:47379"}
+	newAddr := "127.0.0.1:48379"
+	addrs := append(peers, newAddr)
+	// 第一个节点迁移key时调用 hook
+	factory := &restoreHookFactory{}
+	for _, addr := range addrs {
+		conf.GlobalConfig.Peers = peers
+		if addr == newAddr {
+			conf.GlobalConfig.Peers = nil
+		}
+		conf.GlobalConfig.Self = addr
+		var node *Cluster
+		if addr == peers[0] {
+			node = newCluster(factory)
+		} else {
+			node = newCluster(&mockFactory{})
+		}
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+	for i := 0; i < 100; i++ {
+		first.Exec(conn, utils.ToCmdLine("set", "key"+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+
+	// 开始迁移之后，原来的节点上写入了新的key（另一个数据库，避免与正在迁移的key的锁冲突）
+	db1 := connection.NewVirtualConn()
+	db1.SetDBIndex(1)
+	var late string
+	factory.hook = func() {
+		for i := 0; late == ""; i++ {
+			if key := "late" + strconv.Itoa(i); first.pickPeer(key) == newAddr {
+				late = key
+			}
+		}
+		first.engine.Exec(db1, utils.ToCmdLine("set", late, "v"))
+	}
+
+	if got := string(first.Exec(conn, utils.ToCmdLine("cluster", "addpeer", newAddr)).ToBytes()); got != "+OK\r\n" {
+		t.Fatalf("addpeer: %q", got)
+	}
+	waitRehomed(t, addrs)
+	if late == "" {
+		t.Fatal("no keys rehomed from the first peer")
+	}
+	if first.existsLocal(db1, late) || !cluster[newAddr].existsLocal(db1, late) {
+		t.Fatalf("%s written during rehoming should be moved to the new peer", late)
+	}
+}
+
+// 发送给节点的 CLUSTER REHOME 前 n 次失败
+type rehomeFailFactory struct {
+	downFactory
+	peer  string
+	fails atomic.Int32
+}
+
+func (f *rehomeFailFactory) GetConn(addr string) (Client, error) {
+	if _, err := f.downFactory.GetConn(addr); err != nil {
+		return nil, err
+	}
+	return &rehomeFailClient{fakeClient: fakeClient{cluster: getCluster(addr)}, factory: f, addr: addr}, nil
+}
+
+type rehomeFailClient struct {
+	fakeClient
+	factory *rehomeFailFactory
+	addr    string
+}
+
+func (c *rehomeFailClient) Send(command [][]byte) (protocol.Reply, error) {
+	if c.addr == c.factory.peer && len(command) >= 2 && strings.EqualFold(string(command[1]), "rehome") && c.factory.fails.Add(-1) >= 0 {
+		return protocol.NewGenericErrReply("connection reset"), nil
+	}
+	return c.fakeClient.Send(command)
+}
+
+func TestChangePeerFailure(t *testing.T) {
+	peers := []string{"127.0.0.1:49379", "127.0.0.1:50379"}
+	newAddr := "127.0.0.1:51379"
+	addrs := append(peers, newAddr)
+	for _, addr := range addrs {
+		conf.GlobalConfig.Peers = peers
+		if addr == newAddr {
+			conf.GlobalConfig.Peers = nil
+		}
+		conf.GlobalConfig.Self = addr
+		var node *Cluster
+		if addr == peers[0] {
+			node = newCluster(&rehomeFailFactory{downFactory: downFactory{self: addr}, peer: peers[1]})
+		} else {
+			node = newCluster(&downFactory{self: addr})
+		}
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+	exec := func(node *Cluster, cmdLine ...string) string {
+		return string(node.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+	for i := 0; i < 50; i++ {
+		exec(first, "set", "key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// 新节点更新失败：已经更新的节点恢复原来的节点列表，key仍然可以读取
+	setDown(newAddr, true)
+	if got := exec(first, "cluster", "addpeer", newAddr); got != "-ERR peers not updated: "+newAddr+"\r\n" {
+		t.Fatalf("addpeer: %q", got)
+	}
+	setDown(newAddr, false)
+	for _, addr := range peers {
+		node := cluster[addr]
+		node.ringMu.RLock()
+		restored := node.oldHash == nil && node.ringEpoch == 2 && len(node.consistHash.Nodes()) == 2
+		node.ringMu.RUnlock()
+		if !restored {
+			t.Fatalf("%s: peers should be restored", addr)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		if got := exec(cluster[peers[1]], "get", key); got != "$"+strconv.Itoa(len(strconv.Itoa(i)))+"\r\n"+strconv.Itoa(i)+"\r\n" {
+			t.Fatalf("get %s after rollback: %q", key, got)
+		}
+	}
+
+	// CLUSTER REHOME 失败时在后台重试，迁移最终完成
+	factory := first.clientFactory.(*rehomeFailFactory)
+	factory.fails.Store(1)
+	if got := exec(first, "cluster", "addpeer", newAddr); got != "+OK\r\n" {
+		t.Fatalf("addpeer: %q", got)
+	}
+	waitRehomed(t, addrs)
+	if factory.fails.Load() >= 0 {
+		t.Fatal("rehome should be retried")
+	}
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		if !cluster[first.pickPeer(key)].existsLocal(conn, key) {
+			t.Fatalf("%s not found on owner", key)
+		}
+	}
+	if got := exec(first, "cluster", "delpeer", newAddr); got != "+OK\r\n" {
+		t.Fatalf("delpeer after rehomed: %q", got)
+	}
+	waitRehomed(t, addrs)
+}
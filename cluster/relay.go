@@ -11,21 +11,23 @@ func (cluster *Cluster) Relay(peer string, conn abstract.Connection, redisComman
 	// ******本地执行******
 	if cluster.self == peer {
 		//return cluster.engine.Exec(conn, redisCommand)
-		return cluster.Exec(conn, redisCommand)
+		return cluster.exec(conn, redisCommand)
 	}
 
 	// ******发送到远端执行******
 
-	client, err := cluster.clientFactory.GetConn(peer) // 从连接池中获取一个连接
+	client, err := cluster.clientFactory.GetConn(peer) // 获取与节点之间的连接
 	if err != nil {
 		logger.Error(err)
 		return protocol.NewGenericErrReply(err.Error())
 	}
 
 	defer func() {
-		cluster.clientFactory.ReturnConn(peer, client) // 归还连接
+		cluster.clientFactory.ReturnConn(peer, client)
 	}()
 
+	// 节点之间的连接是共享的，每条命令携带客户端选择的数据库
+	redisCommand = withDB(conn.GetDBIndex(), redisCommand)
 	logger.Debugf("命令:%q,转发至ip:%s", protocol.NewMultiBulkReply(redisCommand).ToBytes(), peer)
 	reply, err := client.Send(redisCommand) // 发送命令
 	if err != nil {
@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+一致性hash模式下的集群状态：
+
+CLUSTER NODES：每个节点一行
+<id> <ip:port> <flags> <link-state> weight=<权重> vnodes=<虚拟节点数量> share=<预期分配到的key的比例> ping=<延迟>us
+
+flags：myself（当前节点） peer（其他节点） rehoming（还没有完成key迁移） removed（已经删除，还没有完成key迁移）
+link-state：后台定时通过节点之间的连接发送 PING，命令使用最近一次探测的结果，connected or disconnected
+*/
+
+// 后台探测节点连通性的间隔
+const ringProbeInterval = time.Second
+
+// 节点的连通性
+type peerProbe struct {
+	ok  bool
+	rtt time.Duration
+}
+
+// 并发地向节点发送 PING（当前节点不需要）
+func (cluster *Cluster) probePeers(peers []string) map[string]peerProbe {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	result := make(map[string]peerProbe, len(peers))
+	for _, peer := range peers {
+		if peer == cluster.self {
+			mu.Lock() // 之前启动的协程可能正在写入
+			result[peer] = peerProbe{ok: true}
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			probe := peerProbe{}
+			start := time.Now()
+			if cli, err := cluster.clientFactory.GetConn(peer); err == nil {
+				reply, err := cli.Send(utils.ToCmdLine("ping"))
+				probe.ok = err == nil && !protocol.IsErrReply(reply)
+				probe.rtt = time.Since(start)
+				cluster.clientFactory.ReturnConn(peer, cli)
+			}
+			mu.Lock()
+			result[peer] = probe
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return result
+}
+
+// 定时探测节点的连通性
+func (cluster *Cluster) probeCron() {
+	ticker := time.NewTicker(ringProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			probes := cluster.probePeers(cluster.ringNodes())
+			cluster.probeMu.Lock()
+			cluster.probes = probes
+			cluster.probeMu.Unlock()
+		case <-cluster.closed:
+			return
+		}
+	}
+}
+
+// 节点最近一次探测的结果（还没有探测过的节点视为可达）
+func (cluster *Cluster) peerProbe(peer string) peerProbe {
+	cluster.probeMu.RLock()
+	defer cluster.probeMu.RUnlock()
+	if probe, ok := cluster.probes[peer]; ok {
+		return probe
+	}
+	return peerProbe{ok: true}
+}
+
+// CLUSTER NODES（一致性hash模式）
+func (cluster *Cluster) clusterRingNodes() protocol.Reply {
+	nodes := cluster.ringNodes()
+
+	cluster.ringMu.RLock()
+	shares := cluster.consistHash.Distribution()
+	lines := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		flags := []string{"peer"}
+		if node == cluster.self {
+			flags[0] = "myself"
+		}
+		if cluster.rehoming[node] {
+			flags = append(flags, "rehoming")
+		}
+		if cluster.consistHash.Weight(node) == 0 {
+			flags = append(flags, "removed")
+		}
+		probe := cluster.peerProbe(node)
+		linkState := "connected"
+		if !probe.ok {
+			linkState = "disconnected"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s %s weight=%d vnodes=%d share=%.2f%% ping=%dus",
+			nodeID(node), node, strings.Join(flags, ","), linkState,
+			cluster.consistHash.Weight(node), cluster.consistHash.VirtualNodes(node), shares[node]*100,
+			probe.rtt.Microseconds()))
+	}
+	cluster.ringMu.RUnlock()
+	return protocol.NewBulkReply([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+// CLUSTER WHEREIS：key所属的节点，key原来的节点还没有完成迁移时（命令仍然发送给原来的节点）同时返回原来的节点
+func (cluster *Cluster) whereis(key string) string {
+	if cluster.mode != modeConsistentHash {
+		return cluster.pickPeer(key)
+	}
+	source, rehome, _ := cluster.locateRing([]string{key})
+	owner := cluster.pickPeer(key)
+	if rehome {
+		return owner + " rehoming from " + source
+	}
+	return owner
+}
+
+// 一致性hash模式下 CLUSTER INFO 的状态：节点数量、不可达的节点数量、纪元、正在迁移key的节点数量
+func (cluster *Cluster) ringInfo() (nodes int, unreachable int, epoch int64, rehoming int) {
+	peers := cluster.ringNodes()
+	for _, peer := range peers {
+		if !cluster.peerProbe(peer).ok {
+			unreachable++
+		}
+	}
+	cluster.ringMu.RLock()
+	defer cluster.ringMu.RUnlock()
+	return len(peers), unreachable, cluster.ringEpoch, len(cluster.rehoming)
+}
+
+// 事务状态
+var txStatusNames = map[transactionStatus]string{
+	createdStatus:    "created",
+	preparedStatus:   "prepared",
+	committedStatus:  "committed",
+	rolledBackStatus: "rolledback",
+}
+
+// 事务的快照（事务正在 prepare/commit/rollback 时不等待事务锁，状态为 busy）
+type txSnapshot struct {
+	txId      string
+	status    string
+	dbIndex   int
+	keys      []string
+	startTime time.Time
+}
+
+func (cluster *Cluster) snapshotTransactions() []txSnapshot {
+	cluster.transactionLock.RLock()
+	txs := make([]*Transaction, 0, len(cluster.transactions))
+	for _, tx := range cluster.transactions {
+		txs = append(txs, tx)
+	}
+	cluster.transactionLock.RUnlock()
+
+	result := make([]txSnapshot, 0, len(txs))
+	for _, tx := range txs {
+		snapshot := txSnapshot{txId: tx.txId, status: "busy", dbIndex: tx.dbIndex, startTime: tx.startTime}
+		if tx.mu.TryLock() {
+			snapshot.status = txStatusNames[tx.status]
+			snapshot.keys = append(append(snapshot.keys, tx.writeKeys...), tx.readKeys...)
+			tx.mu.Unlock()
+		}
+		result = append(result, snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].startTime.Before(result[j].startTime)
+	})
+	return result
+}
+
+// 进行中（还没有提交 or 回滚）的事务数量
+func (cluster *Cluster) inFlightTransactions() int {
+	count := 0
+	for _, tx := range cluster.snapshotTransactions() {
+		if tx.status != "committed" && tx.status != "rolledback" {
+			count++
+		}
+	}
+	return count
+}
+
+// CLUSTER TRANSACTIONS：当前节点参与的TCC事务（提交 or 回滚后保留一段时间），按开始时间排序
+func (cluster *Cluster) clusterTransactions() protocol.Reply {
+	result := protocol.NewMixReply()
+	for _, tx := range cluster.snapshotTransactions() {
+		keys := make([][]byte, len(tx.keys))
+		for i, key := range tx.keys {
+			keys[i] = []byte(key)
+		}
+		item := protocol.NewMixReply()
+		item.Append(protocol.NewBulkReply([]byte("txid")), protocol.NewBulkReply([]byte(tx.txId)))
+		item.Append(protocol.NewBulkReply([]byte("status")), protocol.NewBulkReply([]byte(tx.status)))
+		item.Append(protocol.NewBulkReply([]byte("db")), protocol.NewIntegerReply(int64(tx.dbIndex)))
+		item.Append(protocol.NewBulkReply([]byte("keys")), protocol.NewMultiBulkReply(keys))
+		item.Append(protocol.NewBulkReply([]byte("age-ms")), protocol.NewIntegerReply(time.Since(tx.startTime).Milliseconds()))
+		result.Append(item)
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+func TestRingInfo(t *testing.T) {
+	peers := []string{"127.0.0.1:31379", "127.0.0.1:32379", "127.0.0.1:33379"}
+	conf.GlobalConfig.Peers = peers
+	for _, addr := range peers {
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&downFactory{self: addr})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+	exec := func(cmdLine ...string) string {
+		return string(first.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+
+	// WHEREIS：key所属的节点
+	for _, key := range []string{"a", "b", "{user}name"} {
+		peer := first.pickPeer(key)
+		if got := exec("cluster", "whereis", key); got != "$"+strconv.Itoa(len(peer))+"\r\n"+peer+"\r\n" {
+			t.Fatalf("whereis %s: expect %s, got %q", key, peer, got)
+		}
+	}
+
+	// NODES & INFO：后台探测的节点连通性
+	setDown(peers[2], true)
+	defer setDown(peers[2], false)
+	waitFor(t, "probe", func() bool {
+		return strings.Contains(exec("cluster", "nodes"), peers[2]+" peer disconnected")
+	})
+	lines := strings.Split(strings.TrimSpace(exec("cluster", "nodes")), "\n")
+	if len(lines) != 4 { // 第一行是 bulk 的长度
+		t.Fatalf("expect 3 nodes, got %q", lines)
+	}
+	for i, peer := range peers {
+		fields := strings.Fields(lines[i+1])
+		flags, linkState := "peer", "connected"
+		if i == 0 {
+			flags = "myself"
+		}
+		if i == 2 {
+			linkState = "disconnected"
+		}
+		if fields[0] != nodeID(peer) || fields[1] != peer || fields[2] != flags || fields[3] != linkState ||
+			fields[4] != "weight=1" || fields[5] != "vnodes=100" {
+			t.Fatalf("unexpected node %q", lines[i+1])
+		}
+	}
+	info := exec("cluster", "info")
+	for _, line := range []string{"cluster_state:fail", "cluster_known_nodes:3", "cluster_peers_unreachable:1", "cluster_transactions_in_flight:0"} {
+		if !strings.Contains(info, line+"\r\n") {
+			t.Fatalf("cluster info should contain %s: %q", line, info)
+		}
+	}
+	setDown(peers[2], false)
+	waitFor(t, "probe", func() bool {
+		return strings.Contains(exec("cluster", "info"), "cluster_state:ok\r\n")
+	})
+
+	// TRANSACTIONS：prepare 之后、commit/rollback 之前为进行中的事务
+	txId := first.newTxId()
+	if got := exec("Prepare", txId, "mset", "k", "v"); got != "+OK\r\n" {
+		t.Fatalf("prepare: %q", got)
+	}
+	prepared := "*1\r\n*10\r\n$4\r\ntxid\r\n$" + strconv.Itoa(len(txId)) + "\r\n" + txId + "\r\n$6\r\nstatus\r\n$8\r\nprepared\r\n$2\r\ndb\r\n:0\r\n$4\r\nkeys\r\n*1\r\n$1\r\nk\r\n$6\r\nage-ms\r\n:"
+	if got := exec("cluster", "transactions"); !strings.HasPrefix(got, prepared) {
+		t.Fatalf("transactions: %q", got)
+	}
+	if info := exec("cluster", "info"); !strings.Contains(info, "cluster_transactions_in_flight:1\r\n") {
+		t.Fatalf("cluster info: %q", info)
+	}
+	exec("Rollback", txId)
+	if info := exec("cluster", "info"); !strings.Contains(info, "cluster_transactions_in_flight:0\r\n") {
+		t.Fatalf("cluster info after rollback: %q", info)
+	}
+	if got := exec("cluster", "transactions"); !strings.Contains(got, "$10\r\nrolledback\r\n") {
+		t.Fatalf("transactions after rollback: %q", got)
+	}
+}
@@ -1,10 +1,13 @@
 package cluster
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/engine"
 	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
 )
 
 type clusterFunc func(cluster *Cluster, conn abstract.Connection, args [][]byte) protocol.Reply
@@ -18,26 +21,129 @@ func registerClusterRouter(cmd string, f clusterFunc) {
 func init() {
 
 	// 在集群节点上注册的命令
-	registerClusterRouter("Set", defultFunc)
-	registerClusterRouter("Get", defultFunc)
+	registerClusterRouter("Ping", localFunc)
+	registerClusterRouter("Auth", localFunc)
 	registerClusterRouter("MSet", mset)
+	registerClusterRouter("Restore-Asking", restoreAskingFunc)
+	registerClusterRouter("Migrate", migrateFunc)
+	registerClusterRouter("Cluster", execCluster)
+	registerClusterRouter("Asking", askingFunc)
+	registerClusterRouter("ReadOnly", readOnlyFunc)
+	registerClusterRouter("ReadWrite", readWriteFunc)
+
+	// 主从复制（从节点通过 REPLICAOF 同步主节点的数据）
+	registerClusterRouter("ReplConf", localFunc)
+	registerClusterRouter("PSync", localFunc)
+	registerClusterRouter("Sync", localFunc)
 
 	registerClusterRouter("Prepare", prepareFunc)
 	registerClusterRouter("Rollback", rollbackFunc)
 	registerClusterRouter("Commit", commitFunc)
+	registerClusterRouter("TxStatus", txStatusFunc)
+
+	// 事务（MULTI/EXEC/WATCH，见 multi.go）
+	registerClusterRouter("Multi", localFunc)
+	registerClusterRouter("Discard", localFunc)
+	registerClusterRouter("UnWatch", localFunc)
+	registerClusterRouter("Watch", watchFunc)
+	registerClusterRouter("WatchVersion", watchVersionFunc)
+	registerClusterRouter("Exec", execMultiFunc)
+
+	// 多key命令、全库命令（scatter-gather，见 scatter.go）
+	registerClusterRouter("MGet", mgetFunc)
+	registerClusterRouter("Del", sumKeysFunc)
+	registerClusterRouter("Unlink", sumKeysFunc)
+	registerClusterRouter("Exists", sumKeysFunc)
+	registerClusterRouter("Touch", sumKeysFunc)
+	registerClusterRouter("Keys", keysFunc)
+	registerClusterRouter("DBSize", dbSizeFunc)
+	registerClusterRouter("Scan", scanFunc)
+
+	// 发布订阅（见 pubsub.go）
+	registerClusterRouter("Subscribe", localFunc)
+	registerClusterRouter("Unsubscribe", localFunc)
+	registerClusterRouter("Publish", publishFunc)
+	registerClusterRouter("SSubscribe", ssubscribeFunc)
+	registerClusterRouter("SUnsubscribe", localFunc)
+	registerClusterRouter("SPublish", spublishFunc)
 
 	// 表示命令直接在存储引擎上执行命令
 	registerClusterRouter("Direct", directFunc)
+	// 哈希槽模式下转发的命令
+	registerClusterRouter("Owner", ownerFunc)
+	registerClusterRouter("Importing", importingFunc)
+	// 一致性hash模式下，key原来的节点还没有完成迁移
+	registerClusterRouter("Rehome", rehomeFunc)
+	// 在客户端选择的数据库上执行转发的命令
+	registerClusterRouter("WithDB", withDBFunc)
+	registerClusterRouter("Select", selectFunc)
+	// 节点认证（见 auth.go）
+	registerClusterRouter("ClusterAuth", clusterAuthFunc)
+
+	// 存储引擎中的其他命令：根据命令中的key（keyFunc）路由
+	for _, name := range engine.CommandNames() {
+		if _, ok := clusterRouter[name]; !ok {
+			registerClusterRouter(name, defultFunc)
+		}
+	}
 }
 
-func defultFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]byte) protocol.Reply {
-	key := string(redisCommand[1])
+// 单key命令转发至key所属的节点；多key命令的key必须属于同一个节点（哈希槽模式下同一个槽），否则回复 -CROSSSLOT
+func defultFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	keys := commandKeys(redisCommand)
+	if len(keys) == 0 {
+		// 没有key的命令（or 参数个数错误），在当前节点执行
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	if cluster.mode == modeSlot {
+		return cluster.execSlotCommand(c, redisCommand, keys, true)
+	}
 	// 计算key所属的节点
-	peer := cluster.consistHash.Get(key)
-	return cluster.Relay(peer, conn, pushCmd(redisCommand, "Direct")) // 将命令转发至节点，直接执行（不用再重复计算key所属节点）
+	peer, rehome, errReply := cluster.locateRing(keys)
+	if errReply != nil {
+		return errReply
+	}
+	if rehome {
+		return cluster.Relay(peer, c, pushCmd(redisCommand, "Rehome"))
+	}
+	return cluster.Relay(peer, c, pushCmd(redisCommand, "Direct")) // 将命令转发至节点，直接执行（不用再重复计算key所属节点）
+}
+
+// 在当前节点的存储引擎上执行命令
+func localFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	return cluster.engine.Exec(conn, redisCommand)
+}
+
+// SELECT：之后转发的命令都携带选择的数据库（cluster-single-db 只允许0号数据库，和Redis Cluster相同）
+func selectFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if conf.GlobalConfig.ClusterSingleDB && len(redisCommand) == 2 && string(redisCommand[1]) != "0" {
+		return protocol.NewGenericErrReply("SELECT is not allowed in cluster mode")
+	}
+	return cluster.engine.Exec(conn, redisCommand)
+}
+
+// WithDB <index> <command...>：临时切换连接的数据库执行命令（同一个连接上的命令是依次执行的）
+func withDBFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) < 3 {
+		return protocol.NewArgNumErrReply("withdb")
+	}
+	dbIndex, err := strconv.Atoi(string(redisCommand[1]))
+	if err != nil || dbIndex < 0 || dbIndex >= conf.GlobalConfig.Databases {
+		return protocol.NewGenericErrReply("db index out of range")
+	}
+	old := conn.GetDBIndex()
+	conn.SetDBIndex(dbIndex)
+	defer conn.SetDBIndex(old)
+	return cluster.exec(conn, redisCommand[2:])
 }
 
 // 直接在存储引擎上执行命令
 func directFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]byte) protocol.Reply {
 	return cluster.engine.Exec(conn, popCmd(redisCommand))
 }
+
+// 命令中的key（读key + 写key）
+func commandKeys(redisCommand [][]byte) []string {
+	readKeys, writeKeys := engine.GetRelatedKeys(redisCommand)
+	return append(readKeys, writeKeys...)
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+func TestRouter(t *testing.T) {
+	peers := []string{"127.0.0.1:16379", "127.0.0.1:17379", "127.0.0.1:18379"}
+	conf.GlobalConfig.Peers = peers
+	for _, addr := range peers {
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&mockFactory{})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+
+	// 找到属于其他节点的key
+	var key1, key2 string
+	for i := 0; key1 == "" || key2 == ""; i++ {
+		key := "key" + strconv.Itoa(i)
+		switch peer := first.pickPeer(key); {
+		case peer == peers[1] && key1 == "":
+			key1 = key
+		case peer == peers[2] && key2 == "":
+			key2 = key
+		}
+	}
+
+	tests := []struct {
+		cmdLine []string
+		expect  string
+	}{
+		{[]string{"zadd", key1, "1", "a", "2", "b"}, ":2\r\n"},
+		{[]string{"zcard", key1}, ":2\r\n"},
+		{[]string{"expire", key1, "100"}, ":1\r\n"},
+		{[]string{"persist", key1}, ":1\r\n"},
+		{[]string{"set", key2, "1"}, "+OK\r\n"},
+		{[]string{"exists", key1, key2}, ":2\r\n"},
+		{[]string{"del", key1}, ":1\r\n"},
+		{[]string{"exists", key1}, ":0\r\n"},
+		{[]string{"ttl"}, "-ERR wrong number of arguments for 'ttl' command\r\n"},
+	}
+	for _, tt := range tests {
+		reply := first.Exec(conn, utils.ToCmdLine(tt.cmdLine[0], tt.cmdLine[1:]...))
+		if string(reply.ToBytes()) != tt.expect {
+			t.Errorf("%v: expect %q, got %q", tt.cmdLine, tt.expect, reply.ToBytes())
+		}
+	}
+	// key只保存在所属的节点上
+	if reply := cluster[peers[2]].engine.Exec(conn, utils.ToCmdLine("get", key2)); string(reply.ToBytes()) != "$1\r\n1\r\n" {
+		t.Fatalf("key should be stored on %s, got %q", peers[2], reply.ToBytes())
+	}
+}
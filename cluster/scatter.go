@@ -0,0 +1,338 @@
+package cluster
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+)
+
+/*
+多key命令、全库命令（scatter-gather）：
+
+1. MGET/EXISTS/DEL/TOUCH/UNLINK key [key...]：按key所属的节点分组（哈希槽模式下按槽分组），并行在各节点上执行子命令，
+   MGET 按key的顺序合并结果，其他命令累加结果
+2. KEYS/DBSIZE：并行在所有节点（哈希槽模式下负责槽的节点）上执行，合并 or 累加结果
+3. SCAN：依次遍历各节点（按地址排序），游标 = 节点上的游标 * 节点数量 + 节点的索引
+任意一个节点执行失败时，回复错误（包含失败的节点地址）
+
+哈希槽的重定向模式（cluster-redirect yes）下和 Redis Cluster 相同：多key命令的key必须属于同一个槽，全库命令只在当前节点执行
+*/
+
+// 在节点上执行的子命令
+type scatterPart struct {
+	indexes []int // key在原命令中的位置
+	keys    []string
+	cmdLine CmdLine
+	reply   protocol.Reply
+	rehome  bool // 一致性hash模式下，key原来的节点还没有完成迁移
+}
+
+// 所有节点（哈希槽模式下负责槽的节点），按地址排序
+func (cluster *Cluster) allPeers() []string {
+	if cluster.mode == modeSlot {
+		var peers []string
+		for _, node := range cluster.slots.slotOwners() {
+			peers = append(peers, node.addr)
+		}
+		return peers
+	}
+	return cluster.ringNodes()
+}
+
+// 按key所属的节点分组：节点 -> 子命令（哈希槽模式下每个槽一条子命令，一致性hash模式下迁移中的key每个key一条子命令）
+func (cluster *Cluster) groupParts(name string, keys []string) (map[string][]*scatterPart, protocol.Reply) {
+	groups := make(map[string][]*scatterPart)
+	slotParts := make(map[int]*scatterPart)
+	for i, key := range keys {
+		var peer string
+		rehome := false
+		if cluster.mode == modeSlot {
+			peer = cluster.pickPeer(key)
+		} else {
+			peer, rehome, _ = cluster.locateRing([]string{key})
+		}
+		if peer == "" {
+			return nil, protocol.NewSimpleErrReply("CLUSTERDOWN Hash slot not served")
+		}
+		var part *scatterPart
+		if rehome {
+			part = &scatterPart{rehome: true}
+			groups[peer] = append(groups[peer], part)
+		} else if cluster.mode == modeSlot {
+			slot := hashslot.Slot(key)
+			if part = slotParts[slot]; part == nil {
+				part = &scatterPart{}
+				slotParts[slot] = part
+				groups[peer] = append(groups[peer], part)
+			}
+		} else {
+			if len(groups[peer]) == 0 || groups[peer][0].rehome {
+				groups[peer] = append([]*scatterPart{{}}, groups[peer]...)
+			}
+			part = groups[peer][0]
+		}
+		part.indexes = append(part.indexes, i)
+		part.keys = append(part.keys, key)
+	}
+	for _, parts := range groups {
+		for _, part := range parts {
+			part.cmdLine = make(CmdLine, 0, len(part.keys)+1)
+			part.cmdLine = append(part.cmdLine, []byte(name))
+			for _, key := range part.keys {
+				part.cmdLine = append(part.cmdLine, []byte(key))
+			}
+		}
+	}
+	return groups, nil
+}
+
+// 所有节点上执行同一条命令
+func (cluster *Cluster) broadcastParts(redisCommand [][]byte) map[string][]*scatterPart {
+	groups := make(map[string][]*scatterPart)
+	for _, peer := range cluster.allPeers() {
+		groups[peer] = []*scatterPart{{cmdLine: redisCommand}}
+	}
+	return groups
+}
+
+// 并行在各节点上执行子命令（同一个节点上的子命令依次执行），有节点失败时回复第一个失败的节点（按地址排序）的错误
+func (cluster *Cluster) scatter(c abstract.Connection, groups map[string][]*scatterPart) protocol.Reply {
+	peers := sortedPeers(groups)
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			conn := cluster.peerConn(c, peer)
+			for _, part := range groups[peer] {
+				if len(part.keys) > 0 && cluster.mode == modeSlot {
+					part.reply = cluster.execSlotCommand(conn, part.cmdLine, part.keys, true)
+				} else if part.rehome {
+					part.reply = cluster.Relay(peer, conn, pushCmd(part.cmdLine, "Rehome"))
+				} else {
+					part.reply = cluster.Relay(peer, conn, pushCmd(part.cmdLine, "Direct"))
+				}
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	for _, peer := range peers {
+		for _, part := range groups[peer] {
+			if protocol.IsErrReply(part.reply) {
+				return peerErrReply(peer, string(part.reply.ToBytes()))
+			}
+		}
+	}
+	return nil
+}
+
+func sortedPeers(groups map[string][]*scatterPart) []string {
+	peers := make([]string, 0, len(groups))
+	for peer := range groups {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// 子命令使用的连接：当前节点使用客户端的连接，其他节点使用虚拟连接（并行执行，不能共用客户端的连接）
+func (cluster *Cluster) peerConn(c abstract.Connection, peer string) abstract.Connection {
+	if peer == cluster.self {
+		return c
+	}
+	conn := connection.NewVirtualConn()
+	conn.SetDBIndex(c.GetDBIndex())
+	conn.SetReadOnly(c.IsReadOnly())
+	return conn
+}
+
+// 节点执行失败
+func peerErrReply(peer string, msg string) protocol.Reply {
+	msg = strings.TrimSuffix(strings.TrimPrefix(msg, "-"), "\r\n")
+	msg = strings.TrimPrefix(msg, "ERR ")
+	return protocol.NewGenericErrReply("peer " + peer + " failed: " + msg)
+}
+
+// 字符串数组（远程节点回复的空数组也解析为 MultiBulkReply）
+func bulkStrings(reply protocol.Reply) ([][]byte, bool) {
+	switch reply := reply.(type) {
+	case *protocol.MultiBulkReply:
+		return reply.RedisCommand, true
+	case *protocol.EmptyMultiBulkReply:
+		return nil, true
+	}
+	return nil, false
+}
+
+// 只有一个子命令时，不需要 scatter-gather
+func singlePart(groups map[string][]*scatterPart) bool {
+	if len(groups) != 1 {
+		return false
+	}
+	for _, parts := range groups {
+		return len(parts) == 1
+	}
+	return false
+}
+
+// mget key [key...]
+func mgetFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if cluster.redirectEnabled() || len(redisCommand) < 3 {
+		return defultFunc(cluster, c, redisCommand)
+	}
+	keys := commandKeys(redisCommand)
+	groups, errReply := cluster.groupParts("mget", keys)
+	if errReply != nil {
+		return errReply
+	}
+	if singlePart(groups) {
+		return defultFunc(cluster, c, redisCommand)
+	}
+	if errReply := cluster.scatter(c, groups); errReply != nil {
+		return errReply
+	}
+
+	// 按key的顺序合并结果
+	values := make([][]byte, len(keys))
+	for peer, parts := range groups {
+		for _, part := range parts {
+			args, ok := bulkStrings(part.reply)
+			if !ok || len(args) != len(part.keys) {
+				return peerErrReply(peer, "unexpected reply of mget")
+			}
+			for i, index := range part.indexes {
+				values[index] = args[i]
+			}
+		}
+	}
+	return protocol.NewMultiBulkReply(values)
+}
+
+// del/unlink/exists/touch key [key...]：累加各节点的结果
+func sumKeysFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if cluster.redirectEnabled() || len(redisCommand) < 3 {
+		return defultFunc(cluster, c, redisCommand)
+	}
+	name := strings.ToLower(string(redisCommand[0]))
+	groups, errReply := cluster.groupParts(name, commandKeys(redisCommand))
+	if errReply != nil {
+		return errReply
+	}
+	if singlePart(groups) {
+		return defultFunc(cluster, c, redisCommand)
+	}
+	if errReply := cluster.scatter(c, groups); errReply != nil {
+		return errReply
+	}
+	return sumReplies(groups, name)
+}
+
+// 累加各节点回复的数字
+func sumReplies(groups map[string][]*scatterPart, name string) protocol.Reply {
+	var sum int64
+	for peer, parts := range groups {
+		for _, part := range parts {
+			intReply, ok := part.reply.(*protocol.IntegerReply)
+			if !ok {
+				return peerErrReply(peer, "unexpected reply of "+name)
+			}
+			sum += intReply.Integer
+		}
+	}
+	return protocol.NewIntegerReply(sum)
+}
+
+// keys pattern
+func keysFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if cluster.redirectEnabled() || len(redisCommand) != 2 {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	groups := cluster.broadcastParts(redisCommand)
+	if errReply := cluster.scatter(c, groups); errReply != nil {
+		return errReply
+	}
+	// 按节点的顺序合并结果
+	keys := [][]byte{}
+	for _, peer := range sortedPeers(groups) {
+		part := groups[peer][0]
+		args, ok := bulkStrings(part.reply)
+		if !ok {
+			return peerErrReply(peer, "unexpected reply of keys")
+		}
+		keys = append(keys, args...)
+	}
+	return protocol.NewMultiBulkReply(keys)
+}
+
+// dbsize
+func dbSizeFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if cluster.redirectEnabled() || len(redisCommand) != 1 {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	groups := cluster.broadcastParts(redisCommand)
+	if errReply := cluster.scatter(c, groups); errReply != nil {
+		return errReply
+	}
+	return sumReplies(groups, "dbsize")
+}
+
+// scan cursor [MATCH pattern] [COUNT count]：依次遍历各节点
+func scanFunc(cluster *Cluster, c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if cluster.redirectEnabled() || len(redisCommand) < 2 {
+		return cluster.engine.Exec(c, redisCommand)
+	}
+	cursor, err := strconv.ParseUint(string(redisCommand[1]), 10, 64)
+	if err != nil {
+		return protocol.NewGenericErrReply("invalid cursor")
+	}
+	peers := cluster.allPeers()
+	if len(peers) == 0 {
+		return protocol.NewSimpleErrReply("CLUSTERDOWN Hash slot not served")
+	}
+
+	// 游标 = 节点上的游标 * 节点数量 + 节点的索引
+	n := uint64(len(peers))
+	index, peerCursor := cursor%n, cursor/n
+	peer := peers[index]
+	args := make([][]byte, len(redisCommand))
+	copy(args, redisCommand)
+	args[1] = []byte(strconv.FormatUint(peerCursor, 10))
+	reply := cluster.Relay(peer, cluster.peerConn(c, peer), pushCmd(args, "Direct"))
+	if protocol.IsErrReply(reply) {
+		return peerErrReply(peer, string(reply.ToBytes()))
+	}
+
+	// 回复：[cursor, [key...]]
+	mixReply, ok := reply.(*protocol.MixReply)
+	if !ok || len(mixReply.Replies()) != 2 {
+		return peerErrReply(peer, "unexpected reply of scan")
+	}
+	cursorReply, ok := mixReply.Replies()[0].(*protocol.BulkReply)
+	keys, ok2 := bulkStrings(mixReply.Replies()[1])
+	if !ok || !ok2 {
+		return peerErrReply(peer, "unexpected reply of scan")
+	}
+	next, err := strconv.ParseUint(string(cursorReply.Arg), 10, 64)
+	if err != nil {
+		return peerErrReply(peer, "unexpected reply of scan")
+	}
+	// 当前节点遍历完成，下一次遍历下一个节点
+	if next == 0 {
+		index++
+	}
+	cursor = 0
+	if index < n {
+		cursor = next*n + index
+	}
+
+	result := protocol.NewMixReply()
+	result.Append(protocol.NewBulkReply([]byte(strconv.FormatUint(cursor, 10))), protocol.NewMultiBulkReply(keys))
+	return result
+}
@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+func TestScatter(t *testing.T) {
+	peers := []string{"127.0.0.1:56379", "127.0.0.1:57379", "127.0.0.1:58379"}
+	conf.GlobalConfig.Peers = peers
+	for _, addr := range peers {
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&downFactory{self: addr})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first := cluster[peers[0]]
+	conn := connection.NewVirtualConn()
+	exec := func(cmdLine ...string) protocol.Reply {
+		return first.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...))
+	}
+	expect := func(want string, cmdLine ...string) {
+		t.Helper()
+		if got := string(exec(cmdLine...).ToBytes()); got != want {
+			t.Fatalf("%v: expect %q, got %q", cmdLine, want, got)
+		}
+	}
+
+	// key分布在所有节点上
+	var keys []string
+	owners := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		keys = append(keys, key)
+		owners[first.pickPeer(key)] = true
+		expect("+OK\r\n", "set", key, "v"+strconv.Itoa(i))
+	}
+	if len(owners) != len(peers) {
+		t.Fatalf("keys should be distributed to all peers, got %v", owners)
+	}
+
+	expect("*4\r\n$2\r\nv3\r\n$-1\r\n$2\r\nv0\r\n$3\r\nv15\r\n", "mget", "key3", "nokey", "key0", "key15")
+	expect(":3\r\n", "exists", "key1", "key2", "key2", "nokey")
+	expect(":2\r\n", "touch", "key1", "key7")
+	expect(":20\r\n", "dbsize")
+	expect(":2\r\n", "del", "key1", "key2", "nokey")
+	expect(":1\r\n", "unlink", "key3", "key1")
+	expect(":17\r\n", "dbsize")
+
+	reply, ok := exec("keys", "key1*").(*protocol.MultiBulkReply)
+	if !ok || len(reply.RedisCommand) != 10 {
+		t.Fatalf("keys: expect 10 keys, got %v", reply)
+	}
+
+	// SCAN 遍历所有节点
+	var scanned []string
+	cursor := "0"
+	for i := 0; ; i++ {
+		mixReply, ok := exec("scan", cursor, "count", "3").(*protocol.MixReply)
+		if !ok || i > 1000 {
+			t.Fatal("scan failed")
+		}
+		cursor = string(mixReply.Replies()[0].(*protocol.BulkReply).Arg)
+		for _, key := range mixReply.Replies()[1].(*protocol.MultiBulkReply).RedisCommand {
+			scanned = append(scanned, string(key))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(scanned)
+	var remain []string
+	for _, key := range keys {
+		if key != "key1" && key != "key2" && key != "key3" {
+			remain = append(remain, key)
+		}
+	}
+	sort.Strings(remain)
+	if len(scanned) != len(remain) {
+		t.Fatalf("scan: expect %v, got %v", remain, scanned)
+	}
+	for i := range remain {
+		if scanned[i] != remain[i] {
+			t.Fatalf("scan: expect %v, got %v", remain, scanned)
+		}
+	}
+
+	// 节点失败时，回复失败的节点
+	setDown(peers[2], true)
+	defer setDown(peers[2], false)
+	expect("-ERR peer "+peers[2]+" failed: connection refused\r\n", "dbsize")
+	expect("-ERR peer "+peers[2]+" failed: connection refused\r\n", append([]string{"mget"}, keys...)...)
+}
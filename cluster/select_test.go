@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+func TestSelect(t *testing.T) {
+	peers := []string{"127.0.0.1:63379", "127.0.0.1:64379"}
+	newAddr := "127.0.0.1:65379"
+	for _, addr := range append(peers, newAddr) {
+		conf.GlobalConfig.Peers = peers
+		if addr == newAddr {
+			conf.GlobalConfig.Peers = nil
+		}
+		conf.GlobalConfig.Self = addr
+		node := newCluster(&mockFactory{})
+		addCluster(addr, node)
+		defer node.Close()
+	}
+	first, second := cluster[peers[0]], cluster[peers[1]]
+	conn1, conn2 := connection.NewVirtualConn(), connection.NewVirtualConn()
+	exec := func(node *Cluster, conn *connection.VirtualConnection, cmdLine ...string) string {
+		return string(node.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)).ToBytes())
+	}
+
+	// 转发到其他节点的命令在客户端选择的数据库上执行
+	if got := exec(first, conn1, "select", "1"); got != "+OK\r\n" {
+		t.Fatalf("select: %q", got)
+	}
+	for i := 0; i < 20; i++ {
+		exec(first, conn1, "set", "key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	exec(second, conn2, "select", "1")
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		if got := exec(second, conn2, "get", key); got != "$"+strconv.Itoa(len(strconv.Itoa(i)))+"\r\n"+strconv.Itoa(i)+"\r\n" {
+			t.Fatalf("get %s in db 1: %q", key, got)
+		}
+	}
+	if got := exec(first, conn1, "dbsize"); got != ":20\r\n" {
+		t.Fatalf("dbsize in db 1: %q", got)
+	}
+	// TCC分布式事务也在选择的数据库上执行
+	if got := exec(first, conn1, "mset", "a", "1", "b", "2", "c", "3"); got != "+OK\r\n" {
+		t.Fatalf("mset: %q", got)
+	}
+	if got := exec(second, conn2, "mget", "a", "b", "c"); got != "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n" {
+		t.Fatalf("mget in db 1: %q", got)
+	}
+	exec(second, conn2, "select", "0")
+	if got := exec(second, conn2, "dbsize"); got != ":0\r\n" {
+		t.Fatalf("dbsize in db 0: %q", got)
+	}
+
+	// 增加节点后，所有数据库中的key都迁移到新节点
+	if got := exec(first, conn2, "cluster", "addpeer", newAddr); got != "+OK\r\n" {
+		t.Fatalf("addpeer: %q", got)
+	}
+	waitRehomed(t, append(peers, newAddr))
+	db1 := connection.NewVirtualConn()
+	db1.SetDBIndex(1)
+	moved := 0
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		if first.pickPeer(key) != newAddr {
+			continue
+		}
+		if !cluster[newAddr].existsLocal(db1, key) {
+			t.Fatalf("%s should be moved to db 1 of the new peer", key)
+		}
+		moved++
+	}
+	if moved == 0 {
+		t.Fatal("no keys moved to the new peer")
+	}
+	if got := exec(cluster[newAddr], conn1, "dbsize"); got != ":23\r\n" {
+		t.Fatalf("dbsize in db 1 after rehomed: %q", got)
+	}
+
+	// cluster-single-db：只允许使用0号数据库
+	conf.GlobalConfig.ClusterSingleDB = true
+	defer func() { conf.GlobalConfig.ClusterSingleDB = false }()
+	if got := exec(first, conn2, "select", "1"); got != "-ERR SELECT is not allowed in cluster mode\r\n" {
+		t.Fatalf("select with cluster-single-db: %q", got)
+	}
+	if got := exec(first, conn2, "select", "0"); got != "+OK\r\n" {
+		t.Fatalf("select 0 with cluster-single-db: %q", got)
+	}
+}
@@ -0,0 +1,263 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofish2020/easyredis/tool/hashslot"
+)
+
+/*
+哈希槽模式：16384个槽平均分配给所有节点（按地址排序后，每个节点负责一段连续的槽）
+
+所有节点使用相同的 peers 配置，计算出的槽分配表是一致的；没有配置 peers 的节点不负责任何槽（等待加入集群）
+
+之后节点之间通过 gossip 同步节点以及槽分配表（见 gossip.go）
+*/
+
+// 节点标记
+const (
+	nodeMyself    = 1 << iota
+	nodePFail     // 疑似下线：超过 cluster-node-timeout 没有收到PONG
+	nodeFail      // 下线：多数主节点认为疑似下线
+	nodeHandshake // 握手中：还没有收到过该节点的消息
+)
+
+type clusterNode struct {
+	// 节点id：sha1(addr)
+	id   string
+	addr string
+
+	// 以下字段由 slotTable.mu 保护
+	flags       int
+	configEpoch int64
+	createTime  time.Time
+	// 最近一次发送PING的时间 / 最早一次没有收到PONG的PING的时间（收到PONG后清零）
+	lastPing     time.Time
+	pingSent     time.Time
+	pongReceived time.Time
+	failTime     time.Time
+	// 其他主节点的下线报告：reporter id -> 报告时间
+	failReports map[string]time.Time
+	// 从节点：复制的主节点，以及复制偏移量
+	master     *clusterNode
+	replOffset int64
+	// 最近一次为该主节点的从节点投票的时间
+	votedTime time.Time
+
+	// 是否正在发送PING
+	pinging atomic.Bool
+}
+
+// 节点id：sha1(addr)
+func nodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+func newClusterNode(addr string) *clusterNode {
+	return &clusterNode{
+		id:          nodeID(addr),
+		addr:        addr,
+		createTime:  time.Now(),
+		failReports: make(map[string]time.Time),
+	}
+}
+
+func (node *clusterNode) hasFlag(flag int) bool {
+	return node.flags&flag != 0
+}
+
+// 槽分配表
+type slotTable struct {
+	mu sync.RWMutex
+
+	myself *clusterNode
+	// id -> *clusterNode
+	nodes map[string]*clusterNode
+	// slot -> 负责的节点
+	slots [hashslot.SlotCount]*clusterNode
+
+	// 迁移中的槽：slot -> 目标节点（当前节点迁出） / 源节点（当前节点迁入）
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+
+	// 集群的当前纪元，以及最近一次投票的纪元
+	currentEpoch  int64
+	lastVoteEpoch int64
+	// 从节点的故障转移状态（见 failover.go）
+	failover failoverState
+	// 被 CLUSTER FORGET 的节点：id -> 过期时间（过期之前不会通过 gossip 重新加入）
+	blacklist map[string]time.Time
+	// 是否需要保存 nodes.conf
+	dirty bool
+}
+
+// 槽区间 [start, end]
+type slotRange struct {
+	start int
+	end   int
+}
+
+// 槽平均分配给peers，self不在peers中时不负责任何槽
+func newSlotTable(self string, peers []string) *slotTable {
+	table := emptySlotTable()
+
+	addrs := make([]string, len(peers))
+	copy(addrs, peers)
+	sort.Strings(addrs)
+
+	for i, addr := range addrs {
+		node := newClusterNode(addr)
+		table.nodes[node.id] = node
+		if addr == self {
+			table.myself = node
+		}
+		// 平均分配：第i个节点负责 [i*N/n, (i+1)*N/n)
+		start := i * hashslot.SlotCount / len(addrs)
+		end := (i + 1) * hashslot.SlotCount / len(addrs)
+		for slot := start; slot < end; slot++ {
+			table.slots[slot] = node
+		}
+	}
+	if table.myself == nil {
+		table.myself = newClusterNode(self)
+		table.nodes[table.myself.id] = table.myself
+	}
+	table.myself.flags |= nodeMyself
+	return table
+}
+
+func emptySlotTable() *slotTable {
+	return &slotTable{
+		nodes:     make(map[string]*clusterNode),
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+		blacklist: make(map[string]time.Time),
+	}
+}
+
+// 槽所属的节点
+func (t *slotTable) nodeOf(slot int) *clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.slots[slot]
+}
+
+// 槽正在迁出的目标节点
+func (t *slotTable) migratingTo(slot int) *clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.migrating[slot]
+}
+
+// 槽正在迁入的源节点
+func (t *slotTable) importingFrom(slot int) *clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.importing[slot]
+}
+
+// 从节点复制的主节点（主节点返回nil）
+func (t *slotTable) masterOf(node *clusterNode) *clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return node.master
+}
+
+// 主节点的从节点（按地址排序）
+func (t *slotTable) replicasOf(master *clusterNode) []*clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var replicas []*clusterNode
+	for _, node := range t.sortedNodesLocked() {
+		if node.master == master {
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
+
+// 所有节点（按地址排序）
+func (t *slotTable) sortedNodes() []*clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.sortedNodesLocked()
+}
+
+func (t *slotTable) sortedNodesLocked() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(t.nodes))
+	for _, node := range t.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].addr < nodes[j].addr })
+	return nodes
+}
+
+// 可以访问的节点（不包括已下线、握手中的节点），按地址排序
+func (t *slotTable) reachableNodes() []*clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var nodes []*clusterNode
+	for _, node := range t.sortedNodesLocked() {
+		if node == t.myself || !node.hasFlag(nodeFail|nodeHandshake) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// 负责槽的节点（按地址排序）
+func (t *slotTable) slotOwners() []*clusterNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	contains := make(map[*clusterNode]struct{})
+	var owners []*clusterNode
+	for _, node := range t.slots {
+		if _, ok := contains[node]; node != nil && !ok {
+			contains[node] = struct{}{}
+			owners = append(owners, node)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].addr < owners[j].addr })
+	return owners
+}
+
+// 节点负责的槽区间
+func (t *slotTable) rangesOf(node *clusterNode) []slotRange {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.rangesOfLocked(node)
+}
+
+func (t *slotTable) rangesOfLocked(node *clusterNode) []slotRange {
+	var ranges []slotRange
+	for slot := 0; slot < hashslot.SlotCount; slot++ {
+		if t.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].end == slot-1 {
+			ranges[n-1].end = slot
+		} else {
+			ranges = append(ranges, slotRange{start: slot, end: slot})
+		}
+	}
+	return ranges
+}
+
+// 已分配的槽数量
+func (t *slotTable) assignedCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	count := 0
+	for _, node := range t.slots {
+		if node != nil {
+			count++
+		}
+	}
+	return count
+}
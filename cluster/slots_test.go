@@ -0,0 +1,41 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/gofish2020/easyredis/tool/hashslot"
+)
+
+func TestSlotTable(t *testing.T) {
+	peers := []string{"127.0.0.1:8379", "127.0.0.1:6379", "127.0.0.1:7379"}
+	table := newSlotTable("127.0.0.1:7379", peers)
+
+	if table.myself == nil || table.myself.addr != "127.0.0.1:7379" {
+		t.Fatalf("myself not found")
+	}
+	if count := table.assignedCount(); count != hashslot.SlotCount {
+		t.Fatalf("expect all slots assigned, got %d", count)
+	}
+
+	// 按地址排序后平均分配，每个节点一段连续的槽
+	nodes := table.sortedNodes()
+	next := 0
+	for _, node := range nodes {
+		ranges := table.rangesOf(node)
+		if len(ranges) != 1 || ranges[0].start != next {
+			t.Fatalf("unexpected ranges of %s: %v", node.addr, ranges)
+		}
+		next = ranges[0].end + 1
+	}
+	if nodes[0].addr != "127.0.0.1:6379" || table.nodeOf(0) != nodes[0] || table.nodeOf(hashslot.SlotCount-1) != nodes[2] {
+		t.Fatalf("unexpected slot owner")
+	}
+
+	// 其他节点计算出相同的分配表
+	other := newSlotTable("127.0.0.1:6379", peers)
+	for slot := 0; slot < hashslot.SlotCount; slot++ {
+		if other.nodeOf(slot).id != table.nodeOf(slot).id {
+			t.Fatalf("slot %d owner mismatch", slot)
+		}
+	}
+}
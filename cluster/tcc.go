@@ -1,41 +1,154 @@
 package cluster
 
 import (
+	"time"
+
 	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/connection"
 	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
 )
 
 // 回滚事务
 func rollbackTransaction(cluster *Cluster, c abstract.Connection, txId string, ipMap map[string][]string) {
+	if !cluster.txLog.decideRollback(txId) {
+		return // 已经记录了提交决定，不能回滚
+	}
 	argsGroup := [][]byte{[]byte(txId)}
-	// 向所有的ip发送回滚请求
+	// 向所有的ip发送回滚请求（没有收到的节点，超时后会向协调者查询）
 	for ip := range ipMap {
 		cluster.Relay(ip, c, pushCmd(argsGroup, "Rollback")) // Rollback txid
 	}
+	cluster.txLog.end(txId)
 }
 
 // 提交事务
-func commitTransaction(cluster *Cluster, c abstract.Connection, txId string, ipMap map[string][]string) ([]protocol.Reply, protocol.Reply) {
+func commitTransaction(cluster *Cluster, c abstract.Connection, txId string, ipMap map[string][]string) (map[string]protocol.Reply, protocol.Reply) {
+
+	// 先记录提交决定，再发送提交请求
+	peers := make([]string, 0, len(ipMap))
+	for ip := range ipMap {
+		peers = append(peers, ip)
+	}
+	ok, err := cluster.txLog.decideCommit(txId, peers)
+	if err != nil || !ok {
+		rollbackTransaction(cluster, c, txId, ipMap)
+		if err != nil {
+			return nil, protocol.NewGenericErrReply("write transaction log failed: " + err.Error())
+		}
+		return nil, protocol.NewGenericErrReply("transaction " + txId + " has been rolled back")
+	}
 
-	result := make([]protocol.Reply, len(ipMap))
+	result := make(map[string]protocol.Reply, len(ipMap))
 	var errReply protocol.Reply = nil
+	var failed []string
 	argsGroup := [][]byte{[]byte(txId)}
 	// 向所有的ip发送提交请求
 	for ip := range ipMap {
 		reply := cluster.Relay(ip, c, pushCmd(argsGroup, "Commit"))
 		if protocol.IsErrReply(reply) { // 说明提交的时候失败了
 			errReply = reply
-			break
+			failed = append(failed, ip)
+			continue
 		}
 		// 保存提交结果
-		result = append(result, reply)
+		result[ip] = reply
 	}
 
 	if errReply != nil {
-		rollbackTransaction(cluster, c, txId, ipMap)
-		result = nil
+		// 提交决定已经写入日志，不能再回滚：后台继续向失败的节点发送提交请求
+		go cluster.finishCommit(txId, failed)
+		return nil, errReply
+	}
+	cluster.txLog.end(txId)
+	return result, nil
+}
+
+// 协调者：有提交决定、没有结束的事务（提交失败 or 重启后恢复），重新发送提交请求，直到所有参与者都回复
+func (cluster *Cluster) finishCommit(txId string, peers []string) {
+	conn := connection.NewVirtualConn()
+	for {
+		done := true
+		for _, peer := range peers {
+			reply := cluster.Relay(peer, conn, utils.ToCmdLine("Commit", txId))
+			if protocol.IsErrReply(reply) {
+				done = false
+			}
+		}
+		if done {
+			cluster.txLog.end(txId)
+			logger.Infof("cluster: transaction %s committed", txId)
+			return
+		}
+		select {
+		case <-cluster.closed:
+			return
+		case <-time.After(maxPrepareTime):
+		}
+	}
+}
+
+// 参与者：超时没有收到 commit/rollback（or 重启后恢复的事务），向协调者查询事务的结果
+func (cluster *Cluster) resolveTransaction(tx *Transaction) {
+	tx.mu.Lock()
+	prepared := tx.status == preparedStatus
+	tx.mu.Unlock()
+	if !prepared {
+		return
+	}
+
+	decision := txDecisionRollback
+	if coordinator := txCoordinator(tx.txId); coordinator != "" {
+		reply := cluster.Relay(coordinator, connection.NewVirtualConn(), utils.ToCmdLine("TxStatus", tx.txId))
+		decision = txDecisionPending
+		if bulkReply, ok := reply.(*protocol.BulkReply); ok {
+			decision = string(bulkReply.Arg)
+		}
+	}
+
+	switch decision {
+	case txDecisionCommit:
+		tx.commit()
+	case txDecisionRollback:
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		if tx.status == preparedStatus {
+			tx.rollback()
+			cluster.transactionLock.Lock()
+			defer cluster.transactionLock.Unlock()
+			delete(cluster.transactions, tx.txId)
+		}
+	default:
+		// 协调者无法访问，继续锁定key等待
+		logger.Warnf("cluster: transaction %s is in doubt, coordinator %s is unreachable", tx.txId, txCoordinator(tx.txId))
+		select {
+		case <-cluster.closed:
+		default:
+			cluster.delay.Add(maxPrepareTime, genTxKey(tx.txId), func() {
+				cluster.resolveTransaction(tx)
+			})
+		}
+	}
+}
+
+// 参与者恢复：重新 prepare 没有结果的事务（锁定key），然后向协调者查询结果
+func (cluster *Cluster) recoverTransactions(prepared []*txRecord, decided []*txRecord) {
+	for _, record := range prepared {
+		conn := connection.NewVirtualConn()
+		conn.SetDBIndex(record.DBIndex)
+		tx := NewTransaction(record.TxID, record.Command, cluster, conn)
+		tx.recovered = true
+		tx.prepare()
+		cluster.transactionLock.Lock()
+		cluster.transactions[tx.txId] = tx
+		cluster.transactionLock.Unlock()
+		logger.Infof("cluster: transaction %s is in doubt, querying coordinator %s", tx.txId, txCoordinator(tx.txId))
+		go cluster.resolveTransaction(tx)
+	}
+	for _, record := range decided {
+		go cluster.finishCommit(record.TxID, record.Peers)
 	}
-	return result, errReply
 }
 
 func genTxKey(txId string) string {
@@ -44,6 +157,7 @@ func genTxKey(txId string) string {
 
 // ***********************Prepare/Commit/Rollback命令处理函数***********************
 // prepare txid mset key value [key value...]
+// prepare txid multi <watch-count> [key version ...] <command-count> [<argc> arg ...] ...（见 multi.go）
 func prepareFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]byte) protocol.Reply {
 
 	if len(redisCommand) < 3 {
@@ -62,24 +176,34 @@ func prepareFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]by
 
 	// prepare事务
 	err := tx.prepare()
+	if err == nil {
+		// 记录日志后才能回复OK
+		err = cluster.txLog.append(&txRecord{Type: txRecordPrepare, TxID: txId, DBIndex: tx.dbIndex, Command: tx.redisCommand})
+		if err != nil {
+			tx.mu.Lock()
+			tx.rollback()
+			tx.mu.Unlock()
+		}
+	}
 	if err != nil {
 		return protocol.NewGenericErrReply(err.Error())
 	}
 
-	// 3s后如果事务还没有提交，自动回滚（避免长时间锁定）
+	// 3s后如果事务还没有提交，向协调者查询事务的结果
 	cluster.delay.Add(maxPrepareTime, genTxKey(txId), func() {
-		tx.mu.Lock()
-		defer tx.mu.Unlock()
-		if tx.status == preparedStatus {
-			tx.rollback()
-			cluster.transactionLock.Lock()
-			defer cluster.transactionLock.Unlock()
-			delete(cluster.transactions, tx.txId)
-		}
+		cluster.resolveTransaction(tx)
 	})
 	return protocol.NewOkReply()
 }
 
+// TxStatus txid：协调者回复事务的结果（commit/rollback）
+func txStatusFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	if len(redisCommand) != 2 {
+		return protocol.NewArgNumErrReply("txstatus")
+	}
+	return protocol.NewBulkReply([]byte(cluster.txLog.status(string(redisCommand[1]))))
+}
+
 
 // rollback txid
 func rollbackFunc(cluster *Cluster, conn abstract.Connection, redisCommand [][]byte) protocol.Reply {
@@ -1,6 +1,8 @@
 package cluster
 
 import (
+	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,11 +14,36 @@ import (
 
 var cluster map[string]*Cluster = make(map[string]*Cluster)
 
+// 节点的定时任务通过模拟的连接访问其他节点，与测试中添加节点并发
+var clusterMu sync.RWMutex
+
+func addCluster(addr string, node *Cluster) {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+	cluster[addr] = node
+}
+
+func getCluster(addr string) *Cluster {
+	clusterMu.RLock()
+	defer clusterMu.RUnlock()
+	return cluster[addr]
+}
+
+func TestMain(m *testing.M) {
+	// 测试中的多个节点在同一个目录下，默认不记录分布式事务日志
+	conf.GlobalConfig.ClusterTxLogFile = ""
+	// 节点之间的连接需要认证
+	conf.GlobalConfig.ClusterSecret = "secret"
+	// 每个节点的每个db都会预先分配字典，测试中的节点较多，减少db的数量
+	conf.GlobalConfig.Databases = 4
+	os.Exit(m.Run())
+}
+
 type mockFactory struct {
 }
 
 func (f *mockFactory) GetConn(addr string) (Client, error) {
-	return &fakeClient{cluster: cluster[addr]}, nil
+	return &fakeClient{cluster: getCluster(addr)}, nil
 }
 
 func (f *mockFactory) ReturnConn(peer string, cli Client) error {
@@ -37,9 +64,8 @@ func TestTCC(t *testing.T) {
 
 	for _, v := range conf.GlobalConfig.Peers {
 		conf.GlobalConfig.Self = v
-		clusterX := NewCluster()
-		clusterX.clientFactory = &mockFactory{}
-		cluster[v] = clusterX
+		clusterX := newCluster(&mockFactory{})
+		addCluster(v, clusterX)
 	}
 
 	// 选中一个节点，作为协调者
@@ -7,6 +7,7 @@ import (
 	"github.com/gofish2020/easyredis/abstract"
 	"github.com/gofish2020/easyredis/engine"
 	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/logger"
 )
 
 /*
@@ -34,13 +35,19 @@ type Transaction struct {
 	conn         abstract.Connection // socket连接
 	dbIndex      int                 // 数据库索引
 
+	cmdLines  []CmdLine        // 需要执行的命令（MULTI/EXEC 事务包含多条命令）
+	watching  map[string]int64 // WATCH key的版本号（prepare 时检查）
+	multi     bool             // 是否为 MULTI/EXEC 事务（提交时回复每条命令的结果）
+	recovered bool             // 重启后恢复的事务（版本号没有持久化，不检查 WATCH key）
+
 	writeKeys  []string  // 写key
 	readKeys   []string  // 读key
 	keysLocked bool      // 是否对写key/读key已经上锁
 	undoLog    []CmdLine // 回滚日志
 
-	status transactionStatus // 事务状态
-	mu     *sync.Mutex       // 事务锁（操作事务对象的时候上锁）
+	status    transactionStatus // 事务状态
+	startTime time.Time         // 开始时间（CLUSTER TRANSACTIONS）
+	mu        *sync.Mutex       // 事务锁（操作事务对象的时候上锁）
 }
 
 func NewTransaction(txId string, cmdLine [][]byte, cluster *Cluster, c abstract.Connection) *Transaction {
@@ -51,6 +58,7 @@ func NewTransaction(txId string, cmdLine [][]byte, cluster *Cluster, c abstract.
 		conn:         c,
 		dbIndex:      c.GetDBIndex(),
 		status:       createdStatus,
+		startTime:    time.Now(),
 		mu:           &sync.Mutex{},
 	}
 }
@@ -60,14 +68,31 @@ func (tx *Transaction) prepare() error {
 	// 1.上锁
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
-	// 2.获取读写key
-	readKeys, writeKeys := engine.GetRelatedKeys(tx.redisCommand)
-	tx.readKeys = readKeys
-	tx.writeKeys = writeKeys
+	// 2.解析命令，获取读写key
+	cmdLines, watching, multi, err := parseTxCommand(tx.redisCommand)
+	if err != nil {
+		return err
+	}
+	tx.cmdLines, tx.watching, tx.multi = cmdLines, watching, multi
+	for _, cmdLine := range cmdLines {
+		readKeys, writeKeys := engine.GetRelatedKeys(cmdLine)
+		tx.readKeys = append(tx.readKeys, readKeys...)
+		tx.writeKeys = append(tx.writeKeys, writeKeys...)
+	}
+	for key := range watching {
+		tx.readKeys = append(tx.readKeys, key)
+	}
 	// 3. 锁定节点资源
 	tx.locks()
-	// 4.生成回滚日志
-	tx.undoLog = tx.cluster.engine.GetUndoLogs(tx.dbIndex, tx.redisCommand)
+	// 4.检查 WATCH key的版本号（回滚日志在提交时生成）
+	if !tx.recovered {
+		for key, version := range watching {
+			if tx.cluster.engine.GetVersion(tx.dbIndex, key) != version {
+				tx.unlocks()
+				return errWatchChanged
+			}
+		}
+	}
 	tx.status = preparedStatus
 	return nil
 }
@@ -76,6 +101,9 @@ func (tx *Transaction) rollback() error {
 	if tx.status == rolledBackStatus { // no need to rollback a rolled-back transaction
 		return nil
 	}
+	if err := tx.cluster.txLog.append(&txRecord{Type: txRecordRollback, TxID: tx.txId}); err != nil {
+		logger.Errorf("cluster: write transaction log failed: %v", err)
+	}
 	tx.locks()
 	for _, cmdLine := range tx.undoLog { // 执行回滚日志
 		tx.cluster.engine.ExecWithLock(tx.dbIndex, cmdLine)
@@ -91,12 +119,19 @@ func (tx *Transaction) commit() protocol.Reply {
 	if tx.status == committedStatus {
 		return protocol.NewIntegerReply(0)
 	}
+	if tx.status == rolledBackStatus {
+		return protocol.NewGenericErrReply("transaction " + tx.txId + " has been rolled back")
+	}
+	// 先记录日志，再提交
+	if err := tx.cluster.txLog.append(&txRecord{Type: txRecordCommit, TxID: tx.txId}); err != nil {
+		return protocol.NewGenericErrReply("write transaction log failed: " + err.Error())
+	}
 
 	tx.locks()
-	reply := tx.cluster.engine.ExecWithLock(tx.dbIndex, tx.redisCommand)
-	if protocol.IsErrReply(reply) {
+	results := tx.execCommands()
+	if !tx.multi && protocol.IsErrReply(results[0]) {
 		tx.rollback() // commit 失败，自动回滚
-		return reply
+		return results[0]
 	}
 	tx.status = committedStatus
 	tx.unlocks()
@@ -107,7 +142,30 @@ func (tx *Transaction) commit() protocol.Reply {
 		delete(tx.cluster.transactions, tx.txId)
 		tx.cluster.transactionLock.Unlock()
 	})
-	return reply
+	if tx.multi {
+		// MULTI/EXEC：回复每条命令的结果（命令执行出错不影响其他命令）
+		reply := protocol.NewMixReply()
+		reply.Append(results...)
+		return reply
+	}
+	return results[0]
+}
+
+// 依次执行命令（调用者已经锁定key）：执行前生成回滚日志，后执行的命令先回滚
+func (tx *Transaction) execCommands() []protocol.Reply {
+	results := make([]protocol.Reply, 0, len(tx.cmdLines))
+	for _, cmdLine := range tx.cmdLines {
+		undoLog := tx.cluster.engine.GetUndoLogs(tx.dbIndex, cmdLine)
+		reply := tx.cluster.engine.ExecWithLock(tx.dbIndex, cmdLine)
+		if !protocol.IsErrReply(reply) {
+			tx.undoLog = append(undoLog, tx.undoLog...)
+			// 写key变更版本号（WATCH）
+			_, writeKeys := engine.GetRelatedKeys(cmdLine)
+			tx.cluster.engine.AddVersion(tx.dbIndex, writeKeys...)
+		}
+		results = append(results, reply)
+	}
+	return results
 }
 
 func (tx *Transaction) locks() {
@@ -0,0 +1,261 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gofish2020/easyredis/tool/logger"
+)
+
+/*
+分布式事务（TCC）日志（cluster-tx-log-file）：节点宕机重启后，恢复未完成的事务
+
+参与者：
+1. prepare：锁定key、生成回滚日志后，先记录 prepare（事务id、数据库、命令），再回复OK
+2. commit/rollback：先记录结果，再执行
+3. 超过 maxPrepareTime 没有收到 commit/rollback，向协调者查询事务的结果（TxStatus txid）；
+   协调者无法访问时继续等待（不能自行回滚，否则可能和已经提交的节点不一致）
+
+协调者（事务id：<id>@<协调者地址>）：
+1. 所有参与者 prepare 成功后，先记录提交决定（decision commit），再发送 commit；commit 失败时改为回滚决定（decision rollback）
+2. 所有参与者都回复后，记录 end
+3. 没有提交决定的事务视为回滚（presumed abort）：回复参与者的查询后，不能再提交
+
+节点启动时加载日志：
+- 参与者：prepare 之后没有结果的事务，重新 prepare（锁定key），然后向协调者查询结果
+- 协调者：有提交决定、没有 end 的事务，重新向参与者发送 commit
+加载后重写日志（只保留未完成的事务）
+
+日志格式：每行一条json记录
+*/
+
+// 日志记录类型
+const (
+	txRecordPrepare  = "prepare"
+	txRecordCommit   = "commit"
+	txRecordRollback = "rollback"
+	txRecordDecision = "decision"
+	txRecordEnd      = "end"
+)
+
+// 事务的结果（TxStatus 的回复）
+const (
+	txDecisionCommit   = "commit"
+	txDecisionRollback = "rollback"
+	txDecisionPending  = "" // 协调者还没有决定
+)
+
+type txRecord struct {
+	Type     string   `json:"type"`
+	TxID     string   `json:"txid"`
+	DBIndex  int      `json:"db,omitempty"`
+	Command  [][]byte `json:"cmd,omitempty"`
+	Decision string   `json:"decision,omitempty"`
+	Peers    []string `json:"peers,omitempty"` // 协调者：参与者的地址
+}
+
+type txLog struct {
+	mu sync.Mutex
+	// 为空表示不记录日志
+	file *os.File
+	// 协调者：进行中的事务的决定
+	decisions map[string]string
+}
+
+// 事务的协调者
+func txCoordinator(txId string) string {
+	i := strings.LastIndexByte(txId, '@')
+	if i < 0 {
+		return ""
+	}
+	return txId[i+1:]
+}
+
+// 加载日志，返回未完成的事务（参与者：prepared，协调者：decided），然后重写日志
+func openTxLog(filename string) (l *txLog, prepared []*txRecord, decided []*txRecord, err error) {
+	l = &txLog{decisions: make(map[string]string)}
+	if filename == "" {
+		return l, nil, nil, nil
+	}
+
+	prepared, decided, err = loadTxLog(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, nil, err
+	}
+	for _, record := range decided {
+		l.decisions[record.TxID] = txDecisionCommit
+	}
+
+	// 重写日志：先写临时文件再重命名
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, nil, nil, err
+	}
+	tmpFile := filename + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	l.file = file
+	for _, record := range append(append([]*txRecord{}, prepared...), decided...) {
+		if err = l.write(record); err != nil {
+			file.Close()
+			return nil, nil, nil, err
+		}
+	}
+	if err = file.Sync(); err == nil {
+		err = os.Rename(tmpFile, filename)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+	return l, prepared, decided, nil
+}
+
+func loadTxLog(filename string) (prepared []*txRecord, decided []*txRecord, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	preparedMap := make(map[string]*txRecord)
+	decidedMap := make(map[string]*txRecord)
+	var order []*txRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 512*1024*1024)
+	for scanner.Scan() {
+		record := &txRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// 最后一条记录可能没有写完整
+			logger.Warnf("cluster: invalid transaction log record %q: %v", scanner.Text(), err)
+			continue
+		}
+		switch record.Type {
+		case txRecordPrepare:
+			preparedMap[record.TxID] = record
+			order = append(order, record)
+		case txRecordCommit, txRecordRollback:
+			delete(preparedMap, record.TxID)
+		case txRecordDecision: // 只记录提交决定
+			decidedMap[record.TxID] = record
+			order = append(order, record)
+		case txRecordEnd:
+			delete(decidedMap, record.TxID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, record := range order {
+		if record.Type == txRecordPrepare && preparedMap[record.TxID] == record {
+			prepared = append(prepared, record)
+		} else if record.Type == txRecordDecision && decidedMap[record.TxID] == record {
+			decided = append(decided, record)
+		}
+	}
+	return prepared, decided, nil
+}
+
+// 写入一条记录（调用者持有锁）
+func (l *txLog) write(record *txRecord) error {
+	if l.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// 写入一条记录并刷盘
+func (l *txLog) append(record *txRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.appendLocked(record)
+}
+
+func (l *txLog) appendLocked(record *txRecord) error {
+	if err := l.write(record); err != nil {
+		return err
+	}
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+// 协调者：开始事务
+func (l *txLog) begin(txId string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decisions[txId] = txDecisionPending
+}
+
+// 协调者：记录提交决定；事务已经视为回滚时（回复过参与者的查询）返回false
+func (l *txLog) decideCommit(txId string, peers []string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.decisions[txId] == txDecisionRollback {
+		return false, nil
+	}
+	err := l.appendLocked(&txRecord{Type: txRecordDecision, TxID: txId, Decision: txDecisionCommit, Peers: peers})
+	if err != nil {
+		return false, err
+	}
+	l.decisions[txId] = txDecisionCommit
+	return true, nil
+}
+
+// 协调者：回滚事务；已经记录了提交决定时返回false（只能继续提交）
+func (l *txLog) decideRollback(txId string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.decisions[txId] == txDecisionCommit {
+		return false
+	}
+	l.decisions[txId] = txDecisionRollback
+	return true
+}
+
+// 协调者：所有参与者都已经回复，事务结束
+func (l *txLog) end(txId string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.decisions[txId] == txDecisionCommit {
+		if err := l.appendLocked(&txRecord{Type: txRecordEnd, TxID: txId}); err != nil {
+			logger.Errorf("cluster: write transaction log failed: %v", err)
+		}
+	}
+	delete(l.decisions, txId)
+}
+
+// 协调者：事务的结果；还没有决定的事务视为回滚，之后不能再提交
+func (l *txLog) status(txId string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	decision, ok := l.decisions[txId]
+	if !ok {
+		return txDecisionRollback
+	}
+	if decision == txDecisionPending {
+		l.decisions[txId] = txDecisionRollback
+		return txDecisionRollback
+	}
+	return decision
+}
+
+func (l *txLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+func TestTxLogRecovery(t *testing.T) {
+	addr := "127.0.0.1:36379"
+	conf.GlobalConfig.Peers = []string{addr}
+	conf.GlobalConfig.Self = addr
+	conf.GlobalConfig.ClusterTxLogFile = filepath.Join(t.TempDir(), "cluster-tx.log")
+	defer func() {
+		conf.GlobalConfig.ClusterTxLogFile = ""
+	}()
+	conn := connection.NewVirtualConn()
+
+	// 当前节点既是协调者也是参与者：tx1 已经记录提交决定，tx2 没有决定，然后宕机
+	node := NewCluster()
+	tx1, tx2 := node.newTxId(), node.newTxId()
+	for _, cmdLine := range [][]string{
+		{"Prepare", tx1, "mset", "a", "1"},
+		{"Prepare", tx2, "mset", "b", "2"},
+	} {
+		if reply := node.Exec(conn, utils.ToCmdLine(cmdLine[0], cmdLine[1:]...)); string(reply.ToBytes()) != "+OK\r\n" {
+			t.Fatalf("prepare: %q", reply.ToBytes())
+		}
+	}
+	node.txLog.begin(tx1)
+	if ok, err := node.txLog.decideCommit(tx1, []string{addr}); !ok || err != nil {
+		t.Fatalf("decide commit failed: %v", err)
+	}
+	node.txLog.begin(tx2)
+	node.Close()
+
+	// 重启后恢复：tx1 提交，tx2 回滚（presumed abort）
+	node = NewCluster()
+	defer node.Close()
+	waitFor(t, "recovery", func() bool {
+		// 先复制事务列表：resolveTransaction 持有 tx.mu 时会获取 transactionLock
+		node.transactionLock.RLock()
+		txs := make([]*Transaction, 0, len(node.transactions))
+		for _, tx := range node.transactions {
+			txs = append(txs, tx)
+		}
+		node.transactionLock.RUnlock()
+		for _, tx := range txs {
+			tx.mu.Lock()
+			prepared := tx.status == preparedStatus
+			tx.mu.Unlock()
+			if prepared {
+				return false
+			}
+		}
+		node.txLog.mu.Lock()
+		defer node.txLog.mu.Unlock()
+		return len(node.txLog.decisions) == 0
+	})
+	if reply := node.Exec(conn, utils.ToCmdLine("get", "a")); string(reply.ToBytes()) != "$1\r\n1\r\n" {
+		t.Fatalf("tx1 should be committed, got %q", reply.ToBytes())
+	}
+	if reply := node.Exec(conn, utils.ToCmdLine("exists", "b")); string(reply.ToBytes()) != ":0\r\n" {
+		t.Fatalf("tx2 should be rolled back, got %q", reply.ToBytes())
+	}
+	// key已经解锁
+	if reply := node.Exec(conn, utils.ToCmdLine("set", "b", "3")); string(reply.ToBytes()) != "+OK\r\n" {
+		t.Fatalf("set: %q", reply.ToBytes())
+	}
+
+	// 日志已经重写，没有未完成的事务
+	prepared, decided, err := loadTxLog(conf.GlobalConfig.ClusterTxLogFile)
+	if err != nil || len(prepared) != 0 || len(decided) != 0 {
+		t.Fatalf("unexpected pending transactions: %d %d %v", len(prepared), len(decided), err)
+	}
+}
+
+func TestTxLogPresumedAbort(t *testing.T) {
+	l, _, _, err := openTxLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txId := "1@127.0.0.1:6379"
+	l.begin(txId)
+	// 回复参与者的查询后，不能再提交
+	if status := l.status(txId); status != txDecisionRollback {
+		t.Fatalf("expect rollback, got %s", status)
+	}
+	if ok, _ := l.decideCommit(txId, nil); ok {
+		t.Fatalf("should not commit after answering rollback")
+	}
+	if coordinator := txCoordinator(txId); coordinator != "127.0.0.1:6379" {
+		t.Fatalf("unexpected coordinator %s", coordinator)
+	}
+}
+
+// 记录提交决定后，不能再回滚：日志中没有回滚记录，重启后继续提交
+func TestTxLogNoRollbackAfterCommit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cluster-tx.log")
+	l, _, _, err := openTxLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txId := "1@127.0.0.1:6379"
+	l.begin(txId)
+	if ok, err := l.decideCommit(txId, []string{"127.0.0.1:7379"}); !ok || err != nil {
+		t.Fatalf("decide commit failed: %v", err)
+	}
+	if l.decideRollback(txId) {
+		t.Fatal("should not rollback after commit decision")
+	}
+	if status := l.status(txId); status != txDecisionCommit {
+		t.Fatalf("expect commit, got %s", status)
+	}
+	l.close()
+
+	prepared, decided, err := loadTxLog(filename)
+	if err != nil || len(prepared) != 0 || len(decided) != 1 || decided[0].Decision != txDecisionCommit {
+		t.Fatalf("unexpected transactions: %d %d %v", len(prepared), len(decided), err)
+	}
+}
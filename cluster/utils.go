@@ -1,17 +1,33 @@
 package cluster
 
-import "strconv"
+import (
+	"path/filepath"
+	"strconv"
+
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+)
 
 // 计算key应该存储的节点ip
 func (cluster *Cluster) groupByKeys(keys []string) map[string][]string {
 	var result = make(map[string][]string)
 	for _, key := range keys {
-		ip := cluster.consistHash.Get(key)
+		ip := cluster.pickPeer(key)
 		result[ip] = append(result[ip], key)
 	}
 	return result
 }
 
+// keys是否属于同一个槽
+func sameSlot(keys []string) bool {
+	for _, key := range keys[1:] {
+		if hashslot.Slot(key) != hashslot.Slot(keys[0]) {
+			return false
+		}
+	}
+	return true
+}
+
 // 替换命令名
 
 func replaceCmd(redisCommand [][]byte, newCmd string) [][]byte {
@@ -31,6 +47,18 @@ func pushCmd(redisCommand [][]byte, newCmd string) [][]byte {
 	return result
 }
 
+// 转发的命令携带客户端选择的数据库：WithDB <index> <command...>（0号数据库不需要）
+func withDB(dbIndex int, redisCommand [][]byte) [][]byte {
+	if dbIndex == 0 {
+		return redisCommand
+	}
+	result := make([][]byte, len(redisCommand)+2)
+	result[0] = []byte("WithDB")
+	result[1] = []byte(strconv.Itoa(dbIndex))
+	copy(result[2:], redisCommand)
+	return result
+}
+
 // 删除头部的命令
 func popCmd(redisCommand [][]byte) [][]byte {
 	result := make([][]byte, len(redisCommand)-1)
@@ -38,8 +66,16 @@ func popCmd(redisCommand [][]byte) [][]byte {
 	return result
 }
 
-// 生成事务id
+// 生成事务id：<id>@<协调者地址>（参与者通过事务id找到协调者，见 txlog.go）
 func (cluster *Cluster) newTxId() string {
 	id := cluster.snowflake.NextID()
-	return strconv.FormatInt(id, 10)
+	return strconv.FormatInt(id, 10) + "@" + cluster.self
+}
+
+// 数据文件的路径（相对路径在 Dir 目录下）
+func dataFilePath(filename string) string {
+	if filename == "" || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(conf.GlobalConfig.Dir, filename)
 }
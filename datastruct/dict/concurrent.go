@@ -230,6 +230,44 @@ func (c *ConcurrentDict) ForEach(consumer Consumer) {
 	}
 }
 
+// 遍历（调用方已经持有锁，例如 LockAll）
+func (c *ConcurrentDict) ForEachWithLock(consumer Consumer) {
+	if c == nil {
+		panic("dict is nil")
+	}
+	for _, sh := range c.shds {
+		for k, v := range sh.m {
+			if !consumer(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// shard的数量（SCAN 的游标为shard的索引）
+func (c *ConcurrentDict) ShardCount() int {
+	return len(c.shds)
+}
+
+// 遍历一个shard
+func (c *ConcurrentDict) ForEachInShard(index int, consumer Consumer) {
+	c.shds[index].forEach(consumer)
+}
+
+// 按照顺序，对所有的shard加【写锁】（例如：生成一致性快照，期间禁止写入）
+func (c *ConcurrentDict) LockAll() {
+	for _, sh := range c.shds {
+		sh.mu.Lock()
+	}
+}
+
+// 解锁所有的shard
+func (c *ConcurrentDict) UnLockAll() {
+	for _, sh := range c.shds {
+		sh.mu.Unlock()
+	}
+}
+
 // 加【读写锁】
 func (c *ConcurrentDict) RWLock(readKeys, writeKeys []string) {
 
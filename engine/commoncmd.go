@@ -29,6 +29,8 @@ func execSelect(c abstract.Connection, redisArgs [][]byte) protocol.Reply {
 
 // 异步方式重写aof
 func BGRewriteAOF(engine *Engine) protocol.Reply {
-	go engine.aof.Rewrite(newAuxiliaryEngine())
+	if err := engine.aof.BackgroundRewrite(); err != nil {
+		return protocol.NewGenericErrReply(err.Error())
+	}
 	return protocol.NewSimpleReply("Background append only file rewriting started")
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/gofish2020/easyredis/datastruct/dict"
 	"github.com/gofish2020/easyredis/engine/payload"
 	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
 	"github.com/gofish2020/easyredis/tool/logger"
 	"github.com/gofish2020/easyredis/tool/timewheel"
 )
@@ -34,6 +35,9 @@ type DB struct {
 	writeAof func(redisCommand [][]byte)
 
 	delay *timewheel.Delay
+
+	// 哈希槽索引（集群哈希槽模式下启用）
+	slotIndex *slotIndex
 }
 
 // 构造db对象
@@ -45,6 +49,9 @@ func newDB(delay *timewheel.Delay) *DB {
 		writeAof:   func(redisCommand [][]byte) {},
 		delay:      delay,
 	}
+	if conf.GlobalConfig.ClusterMode == "slot" {
+		db.slotIndex = newSlotIndex()
+	}
 	return db
 }
 
@@ -148,6 +155,20 @@ func (db *DB) execWithLock(cmdLine [][]byte) protocol.Reply {
 	return fun(db, cmdLine[1:])
 }
 
+// 遍历数据（调用方已经持有所有shard的锁）
+func (db *DB) forEachWithLock(cb func(key string, data *payload.DataEntity, expiration *time.Time) bool) {
+	db.dataDict.ForEachWithLock(func(key string, val interface{}) bool {
+		entity, _ := val.(*payload.DataEntity)
+		var expiration *time.Time
+		rawExpireTime, ok := db.ttlDict.Get(key)
+		if ok {
+			expireTime, _ := rawExpireTime.(time.Time)
+			expiration = &expireTime
+		}
+		return cb(key, entity, expiration)
+	})
+}
+
 // ********** Lock *********
 
 func (db *DB) RWLock(readKeys, writeKeys []string) {
@@ -201,7 +222,10 @@ func (db *DB) Persist(key string) {
 // 删除key(单个)
 func (db *DB) Remove(key string) {
 	db.ttlDict.Delete(key)
-	db.dataDict.DeleteWithLock(key)
+	_, deleted := db.dataDict.DeleteWithLock(key)
+	if deleted > 0 && db.slotIndex != nil {
+		db.slotIndex.remove(key)
+	}
 	// 从时间轮中删除任务
 	db.cancelDelay(key)
 }
@@ -279,6 +303,9 @@ func (db *DB) IsExpire(key string) bool {
 
 // ************** Version **************
 func (db *DB) GetVersion(key string) int64 {
+	if db.versionMap == nil {
+		return 0
+	}
 	val, ok := db.versionMap.Get(key)
 	if !ok {
 		return 0
@@ -287,6 +314,10 @@ func (db *DB) GetVersion(key string) int64 {
 }
 
 func (db *DB) addVersion(keys ...string) {
+	// newBasicDB 创建的db（aof重写使用）不记录版本号
+	if db.versionMap == nil {
+		return
+	}
 	for _, key := range keys {
 		db.versionMap.AddVersion(key, 1)
 	}
@@ -315,12 +346,20 @@ func (db *DB) GetEntity(key string) (*payload.DataEntity, bool) {
 
 // 保存数据到内存中 (插入 or 更新)
 func (db *DB) PutEntity(key string, entity *payload.DataEntity) int {
-	return db.dataDict.PutWithLock(key, entity)
+	result := db.dataDict.PutWithLock(key, entity)
+	if result > 0 && db.slotIndex != nil {
+		db.slotIndex.add(key)
+	}
+	return result
 }
 
 // 保存数据到内存中 (插入 )
 func (db *DB) PutIfAbsent(key string, entity *payload.DataEntity) int {
-	return db.dataDict.PutIfAbsentWithLock(key, entity)
+	result := db.dataDict.PutIfAbsentWithLock(key, entity)
+	if result > 0 && db.slotIndex != nil {
+		db.slotIndex.add(key)
+	}
+	return result
 }
 
 // 保存数据到内存中 (更新)
@@ -3,6 +3,7 @@ package engine
 import (
 	"fmt"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"github.com/gofish2020/easyredis/tool/conf"
 	"github.com/gofish2020/easyredis/tool/logger"
 	"github.com/gofish2020/easyredis/tool/timewheel"
+	"github.com/gofish2020/easyredis/utils"
 )
 
 // 存储引擎，负责数据的CRUD
@@ -29,12 +31,21 @@ type Engine struct {
 	// 订阅
 
 	hub *pubhub.Pubhub
+	// sharded pub/sub
+	shardHub *pubhub.Pubhub
+
+	// 主从复制
+	repl *replication
+
+	// 启动时间
+	startTime time.Time
 }
 
 func NewEngine() *Engine {
 
 	engine := &Engine{}
 
+	engine.startTime = time.Now()
 	engine.delay = timewheel.NewDelay()
 	// 多个dbSet
 	engine.dbSet = make([]*atomic.Value, conf.GlobalConfig.Databases)
@@ -50,29 +61,48 @@ func NewEngine() *Engine {
 	}
 
 	engine.hub = pubhub.NewPubsub()
+	engine.shardHub = pubhub.NewShardPubsub()
+	engine.repl = newReplication()
 	// 启用AOF日志
 	if conf.GlobalConfig.AppendOnly {
 		// 创建*AOF对象
-		aof, err := aof.NewAOF(conf.GlobalConfig.Dir+"/"+conf.GlobalConfig.AppendFilename, engine, true, conf.GlobalConfig.AppendFsync)
+		aof, err := aof.NewAOF(conf.GlobalConfig.Dir+"/"+conf.GlobalConfig.AppendDirName, conf.GlobalConfig.AppendFilename, engine, true, conf.GlobalConfig.AppendFsync, func() abstract.Engine {
+			return newAuxiliaryEngine()
+		})
 		if err != nil {
 			panic(err)
 		}
 		engine.aof = aof
-		// 设定每个db，使用aof写入日志
-		engine.aofBindEveryDB()
+	}
+	// 设定每个db，写命令传播到aof日志 & 从节点
+	for _, dbSet := range engine.dbSet {
+		engine.bindPropagate(dbSet.Load().(*DB))
+	}
+
+	// 主从复制
+	engine.repl.pingReplicaCron()
+	if conf.GlobalConfig.ReplicaOf != "" {
+		fields := strings.Fields(conf.GlobalConfig.ReplicaOf)
+		if len(fields) != 2 {
+			panic("invalid replicaof " + conf.GlobalConfig.ReplicaOf)
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil {
+			panic("invalid replicaof " + conf.GlobalConfig.ReplicaOf)
+		}
+		engine.replicaOf(fields[0], port)
 	}
 	return engine
 }
 
-func (e *Engine) aofBindEveryDB() {
-	for _, dbSet := range e.dbSet {
-		db := dbSet.Load().(*DB)
-		db.writeAof = func(redisCommand [][]byte) {
-			if conf.GlobalConfig.AppendOnly {
-				// 调用e.aof对象方法，保存命令
-				e.aof.SaveRedisCommand(db.index, aof.Command(redisCommand))
-			}
+// 写命令的传播点：aof日志 + 从节点
+func (e *Engine) bindPropagate(db *DB) {
+	db.writeAof = func(redisCommand [][]byte) {
+		if e.aof != nil {
+			// 调用e.aof对象方法，保存命令
+			e.aof.SaveRedisCommand(db.index, aof.Command(redisCommand))
 		}
+		e.repl.feed(db.index, redisCommand)
 	}
 }
 
@@ -106,6 +136,13 @@ func (e *Engine) Exec(c abstract.Connection, redisCommand [][]byte) (result prot
 		return protocol.NewGenericErrReply("Authentication required")
 	}
 
+	// 从节点只读（主节点传播的命令除外）
+	if e.repl.readOnly.Load() && isWriteCommand(commandName, redisCommand) {
+		if _, ok := c.(*masterClient); !ok {
+			return protocol.NewSimpleErrReply("READONLY You can't write against a read only replica.")
+		}
+	}
+
 	// 基础命令
 	switch commandName {
 	case "select": // 表示当前连接，要选中哪个db https://redis.io/commands/select/
@@ -118,12 +155,55 @@ func (e *Engine) Exec(c abstract.Connection, redisCommand [][]byte) (result prot
 			return protocol.NewGenericErrReply("AppendOnly is false, you can't rewrite aof file")
 		}
 		return BGRewriteAOF(e)
+	case "info": // https://redis.io/commands/info/
+		return execInfo(e, redisCommand[1:])
+	case "flushdb": // https://redis.io/commands/flushdb/
+		if len(redisCommand) != 1 {
+			return protocol.NewArgNumErrReply(commandName)
+		}
+		dbIndex := 0
+		if c != nil {
+			if c.IsTransaction() {
+				return protocol.NewGenericErrReply("cannot flushdb within multi")
+			}
+			dbIndex = c.GetDBIndex()
+		}
+		e.flushDB(dbIndex)
+		return protocol.NewOkReply()
+	case "flushall": // https://redis.io/commands/flushall/
+		if len(redisCommand) != 1 {
+			return protocol.NewArgNumErrReply(commandName)
+		}
+		if c != nil && c.IsTransaction() {
+			return protocol.NewGenericErrReply("cannot flushall within multi")
+		}
+		e.flushAll()
+		return protocol.NewOkReply()
+	case "replicaof", "slaveof": // https://redis.io/commands/replicaof/
+		return e.execReplicaOf(redisCommand[1:])
+	case "replconf":
+		return e.execReplConf(c, redisCommand[1:])
+	case "psync", "sync": // https://redis.io/commands/psync/
+		if (commandName == "psync" && len(redisCommand) != 3) || (commandName == "sync" && len(redisCommand) != 1) {
+			return protocol.NewArgNumErrReply(commandName)
+		}
+		return e.execPSync(c, redisCommand[1:])
+	case "wait": // https://redis.io/commands/wait/
+		return e.execWait(c, redisCommand[1:])
+	case "waitaof": // https://redis.io/commands/waitaof/
+		return e.execWaitAof(c, redisCommand[1:])
 	case "subscribe":
 		return e.hub.Subscribe(c, redisCommand[1:])
 	case "unsubscribe":
 		return e.hub.Unsubscribe(c, redisCommand[1:])
 	case "publish":
 		return e.hub.Publish(c, redisCommand[1:])
+	case "ssubscribe": // https://redis.io/commands/ssubscribe/
+		return e.shardHub.Subscribe(c, redisCommand[1:])
+	case "sunsubscribe":
+		return e.shardHub.Unsubscribe(c, redisCommand[1:])
+	case "spublish":
+		return e.shardHub.Publish(c, redisCommand[1:])
 	}
 
 	// redis 命令处理
@@ -137,7 +217,36 @@ func (e *Engine) Exec(c abstract.Connection, redisCommand [][]byte) (result prot
 }
 
 func (e *Engine) Close() {
-	e.aof.Close()
+	e.closeReplication()
+	if e.aof != nil {
+		e.aof.Close()
+	}
+}
+
+// 清空数据库（替换为新的空数据库）
+func (e *Engine) flushDB(index int) {
+	oldDB, errReply := e.selectDB(index)
+	if errReply != nil {
+		return
+	}
+	newDB := newDB(e.delay)
+	newDB.SetIndex(index)
+	e.bindPropagate(newDB)
+
+	// 加锁，等待正在执行的写命令结束
+	oldDB.dataDict.LockAll()
+	defer oldDB.dataDict.UnLockAll()
+	// 新数据库加锁后再替换：flushdb 写入aof之前，新数据库上的写命令不能执行（保证aof中的顺序）
+	newDB.dataDict.LockAll()
+	defer newDB.dataDict.UnLockAll()
+	e.dbSet[index].Store(newDB)
+	newDB.writeAof(utils.BuildCmdLine("flushdb"))
+}
+
+func (e *Engine) flushAll() {
+	for i := range e.dbSet {
+		e.flushDB(i)
+	}
 }
 
 func (e *Engine) RWLocks(dbIndex int, readKeys, writeKeys []string) {
@@ -177,6 +286,43 @@ func (e *Engine) ExecWithLock(dbIndex int, redisCommand [][]byte) protocol.Reply
 	return db.execWithLock(redisCommand)
 }
 
+// key的版本号（WATCH）
+func (e *Engine) GetVersion(dbIndex int, key string) int64 {
+	db, err := e.selectDB(dbIndex)
+	if err != nil {
+		logger.Error("GetVersion err:", err.Status)
+		return 0
+	}
+	return db.GetVersion(key)
+}
+
+// 变更key的版本号（ExecWithLock 执行写命令后调用）
+func (e *Engine) AddVersion(dbIndex int, keys ...string) {
+	db, err := e.selectDB(dbIndex)
+	if err != nil {
+		logger.Error("AddVersion err:", err.Status)
+		return
+	}
+	db.addVersion(keys...)
+}
+
+// 加载快照中的一条数据（AOF的rdb前缀），直接保存到数据库中
+func (e *Engine) LoadEntity(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error {
+	db, errReply := e.selectDB(dbIndex)
+	if errReply != nil {
+		return fmt.Errorf("load key %s: %s", key, errReply.Status)
+	}
+	keys := []string{key}
+	db.RWLock(nil, keys)
+	defer db.RWUnLock(nil, keys)
+	db.Remove(key)
+	db.PutEntity(key, entity)
+	if expiration != nil {
+		db.ExpireAt(key, *expiration)
+	}
+	return nil
+}
+
 // 遍历引擎的所有数据
 func (e *Engine) ForEach(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool) {
 
@@ -201,6 +347,7 @@ func (e *Engine) ForEach(dbIndex int, cb func(key string, data *payload.DataEnti
 func newAuxiliaryEngine() *Engine {
 	engine := &Engine{}
 	engine.delay = timewheel.NewDelay()
+	engine.repl = newReplication()
 	engine.dbSet = make([]*atomic.Value, conf.GlobalConfig.Databases)
 	for i := range engine.dbSet {
 
@@ -0,0 +1,22 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+)
+
+// 没有客户端连接（内部调用）时，flushdb 清空0号数据库
+func TestFlushDBWithoutConn(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+	c := connection.NewVirtualConn()
+	exec(e, c, "set", "key", "value")
+
+	if got := string(e.Exec(nil, cmdLine("flushdb")).ToBytes()); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := exec(e, c, "get", "key"); got != "$-1\r\n" {
+		t.Fatalf("db should be flushed, got %q", got)
+	}
+}
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+)
+
+/*
+INFO [section [section ...]] https://redis.io/commands/info/
+*/
+
+const easyredisVersion = "1.0.0"
+
+// 每个section的生成函数
+type infoFunc func(e *Engine) []string
+
+var infoSections = []struct {
+	name string
+	fun  infoFunc
+}{
+	{"server", serverInfo},
+	{"persistence", persistenceInfo},
+	{"replication", replicationInfo},
+	{"keyspace", keyspaceInfo},
+}
+
+func execInfo(e *Engine, args [][]byte) protocol.Reply {
+
+	// 需要输出的section（默认全部）
+	all := len(args) == 0
+	wanted := make(map[string]struct{})
+	for _, arg := range args {
+		section := strings.ToLower(string(arg))
+		if section == "all" || section == "default" || section == "everything" {
+			all = true
+		}
+		wanted[section] = struct{}{}
+	}
+
+	var builder strings.Builder
+	for _, section := range infoSections {
+		if _, ok := wanted[section.name]; !all && !ok {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		builder.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, line := range section.fun(e) {
+			builder.WriteString(line + "\r\n")
+		}
+	}
+	return protocol.NewBulkReply([]byte(builder.String()))
+}
+
+func serverInfo(e *Engine) []string {
+	uptime := time.Since(e.startTime)
+	return []string{
+		"easyredis_version:" + easyredisVersion,
+		"os:" + runtime.GOOS + " " + runtime.GOARCH,
+		"go_version:" + runtime.Version(),
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		"run_id:" + conf.GlobalConfig.RunID,
+		fmt.Sprintf("tcp_port:%d", conf.GlobalConfig.Port),
+		fmt.Sprintf("uptime_in_seconds:%d", int64(uptime.Seconds())),
+		fmt.Sprintf("uptime_in_days:%d", int64(uptime.Hours()/24)),
+	}
+}
+
+func persistenceInfo(e *Engine) []string {
+	if e.aof == nil {
+		return []string{"aof_enabled:0"}
+	}
+
+	stats := e.aof.Stats()
+	lastStatus := "ok"
+	if !stats.LastRewriteOK {
+		lastStatus = "err"
+	}
+	lastRewriteTime := int64(-1)
+	if stats.RewriteCount > 0 {
+		lastRewriteTime = int64(stats.LastRewriteTime.Seconds())
+	}
+	currentRewriteTime := int64(-1)
+	if stats.RewriteInProgress {
+		currentRewriteTime = int64(stats.CurrentRewriteTime.Seconds())
+	}
+	return []string{
+		"aof_enabled:1",
+		fmt.Sprintf("aof_rewrite_in_progress:%d", boolToInt(stats.RewriteInProgress)),
+		fmt.Sprintf("aof_rewrites:%d", stats.RewriteCount),
+		fmt.Sprintf("aof_last_rewrite_time_sec:%d", lastRewriteTime),
+		fmt.Sprintf("aof_current_rewrite_time_sec:%d", currentRewriteTime),
+		"aof_last_bgrewrite_status:" + lastStatus,
+		fmt.Sprintf("aof_current_size:%d", stats.CurrentSize),
+		fmt.Sprintf("aof_base_size:%d", stats.BaseSize),
+		fmt.Sprintf("aof_base_file_seq:%d", stats.CurrentBaseFileSeq),
+		fmt.Sprintf("aof_incr_file_seq:%d", stats.CurrentIncrFileSeq),
+		fmt.Sprintf("auto_aof_rewrite_percentage:%d", conf.GlobalConfig.AutoAofRewritePercentage),
+		"auto_aof_rewrite_min_size:" + conf.GlobalConfig.AutoAofRewriteMinSize,
+	}
+}
+
+func keyspaceInfo(e *Engine) []string {
+	var lines []string
+	for i := range e.dbSet {
+		db, _ := e.selectDB(i)
+		keys := db.dataDict.Count()
+		if keys == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=%d", i, keys, db.ttlDict.Count()))
+	}
+	return lines
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func replicationInfo(e *Engine) []string {
+	repl := e.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	lines := []string{"role:" + repl.role}
+	if repl.role == roleSlave && repl.link != nil {
+		link := repl.link
+		linkStatus := "down"
+		if link.getState() == linkStateConnected {
+			linkStatus = "up"
+		}
+		lastIO := int64(-1)
+		if lastIOTime := link.lastIOTime.Load(); lastIOTime > 0 {
+			lastIO = (time.Now().UnixMilli() - lastIOTime) / 1000
+		}
+		lines = append(lines,
+			"master_host:"+link.host,
+			fmt.Sprintf("master_port:%d", link.port),
+			"master_link_status:"+linkStatus,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", boolToInt(link.getState() == linkStateSync)),
+			fmt.Sprintf("slave_repl_offset:%d", repl.offset),
+			fmt.Sprintf("slave_priority:%d", conf.GlobalConfig.ReplicaPriority),
+			fmt.Sprintf("slave_read_only:%d", boolToInt(repl.readOnly.Load())),
+		)
+		return append(lines, replBacklogInfo(repl)...)
+	}
+
+	var slaves []string
+	for _, r := range repl.replicas {
+		state := r.getState()
+		if state != replicaStateSendBulk && state != replicaStateOnline {
+			continue
+		}
+		lag := int64(-1)
+		if ackTime := r.ackTime.Load(); ackTime > 0 {
+			lag = (time.Now().UnixMilli() - ackTime) / 1000
+		}
+		slaves = append(slaves, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d", len(slaves), r.ip, r.listeningPort, state, r.ackOffset.Load(), lag))
+	}
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(slaves)))
+	lines = append(lines, slaves...)
+	return append(lines, replBacklogInfo(repl)...)
+}
+
+// 复制id、偏移量以及积压缓冲区（调用方持有repl.mu）
+func replBacklogInfo(repl *replication) []string {
+	lines := []string{
+		"master_replid:" + repl.replID,
+		"master_replid2:" + repl.replID2,
+		fmt.Sprintf("master_repl_offset:%d", repl.offset),
+		fmt.Sprintf("second_repl_offset:%d", repl.secondReplOffset),
+	}
+	if repl.backlog == nil {
+		return append(lines,
+			"repl_backlog_active:0",
+			fmt.Sprintf("repl_backlog_size:%d", backlogSize()),
+			"repl_backlog_first_byte_offset:0",
+			"repl_backlog_histlen:0",
+		)
+	}
+	return append(lines,
+		"repl_backlog_active:1",
+		fmt.Sprintf("repl_backlog_size:%d", len(repl.backlog.buf)),
+		// 和redis一致，偏移量从1开始计数
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", repl.backlog.startOffset+1),
+		fmt.Sprintf("repl_backlog_histlen:%d", repl.backlog.histLen),
+	)
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/gofish2020/easyredis/aof"
+	"github.com/gofish2020/easyredis/rdb"
 	"github.com/gofish2020/easyredis/redis/protocol"
 	"github.com/gofish2020/easyredis/tool/wildcard"
 	"github.com/gofish2020/easyredis/utils"
@@ -284,6 +285,64 @@ func execKeys(db *DB, args [][]byte) protocol.Reply {
 	return protocol.NewMultiBulkReply(result)
 }
 
+// TOUCH key [key ...]：存在的key的数量（没有LRU，不需要更新访问时间）
+func execTouch(db *DB, args [][]byte) protocol.Reply {
+	return execExists(db, args)
+}
+
+func execDBSize(db *DB, args [][]byte) protocol.Reply {
+	return protocol.NewIntegerReply(int64(db.dataDict.Count()))
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+// 游标为shard的索引：每次遍历完整的shard，直到遍历的key的数量达到count，遍历完所有shard后游标为0
+func execScan(db *DB, args [][]byte) protocol.Reply {
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		return protocol.NewGenericErrReply("invalid cursor")
+	}
+	count := 10
+	var pattern *wildcard.Pattern
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return protocol.NewSyntaxErrReply()
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern, err = wildcard.CompilePattern(string(args[i+1]))
+			if err != nil {
+				return protocol.NewGenericErrReply("illegal wildcard")
+			}
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				return protocol.NewGenericErrReply("value is not an integer or out of range")
+			}
+		default:
+			return protocol.NewSyntaxErrReply()
+		}
+	}
+
+	result := [][]byte{}
+	scanned := 0
+	shardCount := db.dataDict.ShardCount()
+	for ; cursor < shardCount && scanned < count; cursor++ {
+		db.dataDict.ForEachInShard(cursor, func(key string, val interface{}) bool {
+			scanned++
+			if (pattern == nil || pattern.IsMatch(key)) && !db.IsExpire(key) {
+				result = append(result, []byte(key))
+			}
+			return true
+		})
+	}
+	if cursor >= shardCount {
+		cursor = 0
+	}
+	reply := protocol.NewMixReply()
+	reply.Append(protocol.NewBulkReply([]byte(strconv.Itoa(cursor))), protocol.NewMultiBulkReply(result))
+	return reply
+}
+
 func undoDel(db *DB, args [][]byte) []CmdLine {
 	keys := make([]string, len(args))
 	for i, v := range args {
@@ -299,9 +358,85 @@ func undoExpire(db *DB, args [][]byte) []CmdLine {
 	}
 }
 
+// 序列化key的value DUMP key
+func execDump(db *DB, args [][]byte) protocol.Reply {
+	entity, exists := db.GetEntity(string(args[0]))
+	if !exists {
+		return protocol.NewNullBulkReply()
+	}
+	data, err := rdb.DumpEntity(entity)
+	if err != nil {
+		return protocol.NewGenericErrReply(err.Error())
+	}
+	return protocol.NewBulkReply(data)
+}
+
+// 反序列化 RESTORE key ttl serialized-value [REPLACE] [ABSTTL]
+func execRestore(db *DB, args [][]byte) protocol.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.NewGenericErrReply("value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.NewGenericErrReply("Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	for _, arg := range args[3:] {
+		switch strings.ToLower(string(arg)) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		default:
+			return protocol.NewSyntaxErrReply()
+		}
+	}
+
+	_, exists := db.GetEntity(key)
+	if exists && !replace {
+		return protocol.NewSimpleErrReply("BUSYKEY Target key name already exists.")
+	}
+	entity, err := rdb.RestoreEntity(args[2])
+	if err != nil {
+		return protocol.NewGenericErrReply(err.Error())
+	}
+
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.UnixMilli(ttl)
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		// 已经过期
+		if !expireAt.After(time.Now()) {
+			if exists {
+				db.Remove(key)
+				db.writeAof(aof.Del([]byte(key)))
+			}
+			return protocol.NewOkReply()
+		}
+	}
+
+	db.Remove(key)
+	db.PutEntity(key, entity)
+	if exists {
+		db.writeAof(aof.Del([]byte(key)))
+	}
+	db.writeAof(aof.EntityToCmd(key, entity).RedisCommand)
+	if ttl > 0 {
+		db.ExpireAt(key, expireAt)
+		db.writeAof(aof.PExpireAtCmd(key, expireAt))
+	}
+	return protocol.NewOkReply()
+}
+
 func init() {
 	// 删除 DEL key [key ...]
 	registerCommand("Del", execDel, writeAllKey, -2, undoDel)
+	// 删除 UNLINK key [key ...]（和DEL相同）
+	registerCommand("Unlink", execDel, writeAllKey, -2, undoDel)
 	// 设置过期  EXPIRE key seconds [NX | XX | GT | LT]
 	registerCommand("Expire", execExpire, writeFirstKey, -3, undoExpire)
 	// 设定过期 ms PEXPIRE key milliseconds [NX | XX | GT | LT]
@@ -322,6 +457,18 @@ func init() {
 	registerCommand("PTTL", execPTTL, readFirstKey, 2, nil)
 	// 判断key是否存在 EXISTS key [key ...]
 	registerCommand("Exists", execExists, readAllKey, -2, nil)
+	// 序列化 DUMP key
+	registerCommand("Dump", execDump, readFirstKey, 2, nil)
+	// 反序列化 RESTORE key ttl serialized-value [REPLACE] [ABSTTL]
+	registerCommand("Restore", execRestore, writeFirstKey, -4, rollbackFirstKey)
+	// 集群迁移时使用（MIGRATE发送到目标节点），和RESTORE相同
+	registerCommand("Restore-Asking", execRestore, writeFirstKey, -4, rollbackFirstKey)
 	// 获取所有的key KEYS pattern
 	registerCommand("Keys", execKeys, noKey, 2, nil)
+	// 遍历key SCAN cursor [MATCH pattern] [COUNT count]
+	registerCommand("Scan", execScan, noKey, -2, nil)
+	// key的数量 DBSIZE
+	registerCommand("DBSize", execDBSize, noKey, 1, nil)
+	// TOUCH key [key ...]
+	registerCommand("Touch", execTouch, readAllKey, -2, nil)
 }
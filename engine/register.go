@@ -37,12 +37,22 @@ func registerCommand(name string, execFunc ExecFunc, keyFunc KeysFunc, argsNum i
 	commandCenter[name] = cmd
 }
 
+// 所有注册的命令名（集群模式下根据命令中的key路由）
+func CommandNames() []string {
+	names := make([]string, 0, len(commandCenter))
+	for name := range commandCenter {
+		names = append(names, name)
+	}
+	return names
+}
+
+// 命令中的 读key/写key（命令不存在 or 参数个数不正确时返回空）
 func GetRelatedKeys(redisCommand [][]byte) ([]string, []string) {
 
 	cmdName := strings.ToLower(string(redisCommand[0]))
 
 	cmd, ok := commandCenter[cmdName]
-	if !ok {
+	if !ok || !validateArity(cmd.argsNum, redisCommand) {
 		return nil, nil
 	}
 
@@ -0,0 +1,75 @@
+package engine
+
+/*
+复制积压缓冲区（环形缓冲）：保存最近传播给从节点的数据
+
+从节点断线重连后，如果需要的数据仍然在缓冲区中（PSYNC <replid> <offset>），只需要发送缓冲区中的数据（部分同步），不需要全量同步
+*/
+
+type replBacklog struct {
+	buf []byte
+	// 下一次写入的位置
+	idx int
+	// 有效数据的长度
+	histLen int
+	// 第一个有效字节的复制偏移量
+	startOffset int64
+}
+
+// offset：缓冲区第一个字节对应的复制偏移量
+func newReplBacklog(size int, offset int64) *replBacklog {
+	if size <= 0 {
+		size = 1
+	}
+	return &replBacklog{
+		buf:         make([]byte, size),
+		startOffset: offset,
+	}
+}
+
+// 结束位置的复制偏移量（不包括）
+func (b *replBacklog) endOffset() int64 {
+	return b.startOffset + int64(b.histLen)
+}
+
+func (b *replBacklog) write(data []byte) {
+	size := len(b.buf)
+	// 超过缓冲区大小，只需要保留最后的部分
+	if len(data) > size {
+		b.startOffset += int64(len(data) - size)
+		data = data[len(data)-size:]
+	}
+
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		data = data[n:]
+		b.idx = (b.idx + n) % size
+		b.histLen += n
+	}
+	// 覆盖了最早的数据
+	if b.histLen > size {
+		b.startOffset += int64(b.histLen - size)
+		b.histLen = size
+	}
+}
+
+// 读取 [offset, endOffset) 的数据（数据已经被覆盖 or 超出范围，返回false）
+func (b *replBacklog) readFrom(offset int64) ([]byte, bool) {
+	if offset < b.startOffset || offset > b.endOffset() {
+		return nil, false
+	}
+	n := int(b.endOffset() - offset)
+	result := make([]byte, 0, n)
+	// 第一个有效字节的位置
+	start := (b.idx - b.histLen + len(b.buf)) % len(b.buf)
+	pos := (start + int(offset-b.startOffset)) % len(b.buf)
+	for len(result) < n {
+		end := pos + n - len(result)
+		if end > len(b.buf) {
+			end = len(b.buf)
+		}
+		result = append(result, b.buf[pos:end]...)
+		pos = end % len(b.buf)
+	}
+	return result, true
+}
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestReplBacklog(t *testing.T) {
+	type read struct {
+		offset int64
+		data   string
+		ok     bool
+	}
+	tests := []struct {
+		name   string
+		size   int
+		offset int64 // 创建时的复制偏移量
+		writes []string
+		start  int64 // 第一个有效字节的复制偏移量
+		reads  []read
+	}{
+		{
+			name: "no wrap", size: 8, writes: []string{"abc"}, start: 0,
+			reads: []read{{0, "abc", true}, {2, "c", true}, {3, "", true}, {4, "", false}, {-1, "", false}},
+		},
+		{
+			name: "exactly full", size: 8, writes: []string{"abcd", "efgh"}, start: 0,
+			reads: []read{{0, "abcdefgh", true}, {7, "h", true}, {8, "", true}, {9, "", false}},
+		},
+		{
+			name: "wrap", size: 8, writes: []string{"abcdef", "ghij"}, start: 2,
+			reads: []read{
+				{2, "cdefghij", true}, // 缓冲区的开始
+				{5, "fghij", true},    // 跨越缓冲区的结尾
+				{8, "ij", true},       // 从缓冲区的开头读取
+				{10, "", true},        // 缓冲区的结束
+				{1, "", false},        // 已经被覆盖
+				{11, "", false},       // 超出范围
+			},
+		},
+		{
+			name: "larger than buffer", size: 8, writes: []string{"ab", "0123456789xyz"}, start: 7,
+			reads: []read{{7, "56789xyz", true}, {14, "z", true}, {15, "", true}, {6, "", false}, {0, "", false}},
+		},
+		{
+			name: "wrap many times", size: 3, writes: []string{"a", "b", "c", "d", "e", "f", "g"}, start: 4,
+			reads: []read{{4, "efg", true}, {6, "g", true}, {7, "", true}, {3, "", false}},
+		},
+		{
+			name: "initial offset", size: 8, offset: 100, writes: []string{"xyz", "0123456"}, start: 102,
+			reads: []read{{102, "z0123456", true}, {105, "23456", true}, {110, "", true}, {101, "", false}, {111, "", false}},
+		},
+	}
+	for _, tt := range tests {
+		b := newReplBacklog(tt.size, tt.offset)
+		for _, data := range tt.writes {
+			b.write([]byte(data))
+		}
+		if b.startOffset != tt.start {
+			t.Fatalf("%s: expect start offset %d, got %d", tt.name, tt.start, b.startOffset)
+		}
+		for _, r := range tt.reads {
+			data, ok := b.readFrom(r.offset)
+			if ok != r.ok || string(data) != r.data {
+				t.Fatalf("%s: read from %d expect %q %v, got %q %v", tt.name, r.offset, r.data, r.ok, data, ok)
+			}
+		}
+	}
+}
+
+// 随机写入，与完整的数据流比较
+func TestReplBacklogStream(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const size = 64
+	b := newReplBacklog(size, 1000)
+	var stream []byte
+	for i := 0; i < 200; i++ {
+		data := make([]byte, rnd.Intn(size*2))
+		rnd.Read(data)
+		b.write(data)
+		stream = append(stream, data...)
+
+		end := int64(1000 + len(stream))
+		if b.endOffset() != end || b.histLen > size {
+			t.Fatalf("unexpected backlog end %d (expect %d), histLen %d", b.endOffset(), end, b.histLen)
+		}
+		for offset := b.startOffset - 1; offset <= end+1; offset++ {
+			got, ok := b.readFrom(offset)
+			if offset < b.startOffset || offset > end {
+				if ok {
+					t.Fatalf("read from %d should fail, range [%d, %d]", offset, b.startOffset, end)
+				}
+				continue
+			}
+			if !ok || string(got) != string(stream[offset-1000:]) {
+				t.Fatalf("read from %d: unexpected data", offset)
+			}
+		}
+	}
+}
+
+// 从节点 PSYNC 发送已经收到的字节数+1，主节点从 psyncOffset-1 读取：正好是从节点缺少的数据
+func TestReplBacklogPsyncOffset(t *testing.T) {
+	masterOffset := int64(500) // 主节点创建积压缓冲区时已经传播的字节数
+	b := newReplBacklog(16, masterOffset)
+	b.write([]byte("0123456789"))
+
+	replicaOffset := masterOffset + 4 // 从节点收到了 "0123"
+	psyncOffset := replicaOffset + 1
+	data, ok := b.readFrom(psyncOffset - 1)
+	if !ok || string(data) != "456789" {
+		t.Fatalf("expect %q, got %q %v", "456789", data, ok)
+	}
+	// 从节点已经收到了所有数据
+	if data, ok := b.readFrom(masterOffset + 10); !ok || len(data) != 0 {
+		t.Fatalf("expect empty backlog, got %q %v", data, ok)
+	}
+	// 从节点的数据比主节点多
+	if _, ok := b.readFrom(masterOffset + 11); ok {
+		t.Fatal("offset beyond the master should fail")
+	}
+}
@@ -0,0 +1,482 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofish2020/easyredis/aof"
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/rdb"
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/parser"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+主从复制（从节点）：
+
+REPLICAOF host port 之后，后台协程连接主节点：
+1. [AUTH masterauth] -> REPLCONF listening-port <port> -> PSYNC <replid> <offset+1>
+2. 读取 +FULLRESYNC <replid> <offset>，以及快照 $<len>\r\n<rdb>，清空数据库，加载快照
+   or 读取 +CONTINUE [<replid>]，部分同步，直接从断开的位置继续
+3. 持续读取主节点传播的写命令并执行（同时更新复制偏移量，保存到积压缓冲区）
+4. 每秒发送 REPLCONF ACK <offset>，收到 REPLCONF GETACK 时立即发送
+
+连接断开后，每秒重连一次，直到 REPLICAOF NO ONE
+*/
+
+// 和主节点的连接状态
+const (
+	linkStateConnecting = "connecting" // 连接中
+	linkStateSync       = "sync"       // 全量同步中
+	linkStateConnected  = "connected"  // 同步命令中
+)
+
+const linkRetryInterval = 1 * time.Second
+
+// 主节点的连接（从节点执行主节点传播的命令，不受只读限制）
+type masterClient struct {
+	*connection.VirtualConnection
+}
+
+type masterLink struct {
+	host string
+	port int
+
+	state atomic.Value
+	// 最后一次收到主节点数据的时间
+	lastIOTime atomic.Int64
+
+	mu      sync.Mutex
+	conn    net.Conn
+	stopped chan struct{}
+
+	// 发送ACK（定时发送 & 回复GETACK）
+	writeMu sync.Mutex
+}
+
+func newMasterLink(host string, port int) *masterLink {
+	link := &masterLink{
+		host:    host,
+		port:    port,
+		stopped: make(chan struct{}),
+	}
+	link.state.Store(linkStateConnecting)
+	return link
+}
+
+func (link *masterLink) addr() string {
+	return net.JoinHostPort(link.host, strconv.Itoa(link.port))
+}
+
+func (link *masterLink) getState() string {
+	return link.state.Load().(string)
+}
+
+func (link *masterLink) isStopped() bool {
+	select {
+	case <-link.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// 记录当前的连接（已经停止，返回false）
+func (link *masterLink) setConn(conn net.Conn) bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.isStopped() {
+		return false
+	}
+	link.conn = conn
+	return true
+}
+
+// 停止同步，断开和主节点的连接
+func (link *masterLink) stop() {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.isStopped() {
+		return
+	}
+	close(link.stopped)
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+// REPLICAOF host port / REPLICAOF NO ONE
+func (e *Engine) execReplicaOf(args [][]byte) protocol.Reply {
+	if len(args) != 2 {
+		return protocol.NewArgNumErrReply("replicaof")
+	}
+	if strings.EqualFold(string(args[0]), "no") && strings.EqualFold(string(args[1]), "one") {
+		e.replicaOfNoOne()
+		return protocol.NewOkReply()
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return protocol.NewGenericErrReply("Invalid master port")
+	}
+	return e.replicaOf(string(args[0]), port)
+}
+
+// 成为host:port的从节点
+func (e *Engine) replicaOf(host string, port int) protocol.Reply {
+	repl := e.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	if repl.link != nil && repl.link.host == host && repl.link.port == port {
+		return protocol.NewSimpleReply("OK Already connected to specified master")
+	}
+	if repl.link != nil {
+		repl.link.stop()
+	}
+	// 断开自己的从节点（不支持链式复制）
+	repl.closeReplicas()
+	repl.role = roleSlave
+	repl.readOnly.Store(conf.GlobalConfig.ReplicaReadOnly)
+
+	link := newMasterLink(host, port)
+	repl.link = link
+	logger.Infof("connecting to master %s", link.addr())
+	go e.replicationLoop(link)
+	return protocol.NewOkReply()
+}
+
+// 停止同步，成为主节点（保留现有数据）
+func (e *Engine) replicaOfNoOne() {
+	repl := e.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	if repl.link == nil {
+		return
+	}
+	repl.link.stop()
+	repl.role = roleMaster
+	repl.readOnly.Store(false)
+	// 新的数据集标识，复制偏移量从已经同步的位置继续
+	// 保留原来的replid，其他从节点（原主节点的从节点）可以部分同步
+	repl.replID2 = repl.replID
+	repl.secondReplOffset = repl.offset + 1
+	repl.replID = utils.RandString(replIDLen)
+	repl.lastDBIndex = -1
+	repl.link = nil
+	logger.Info("master mode enabled")
+}
+
+// 集群模式下切换主从（CLUSTER REPLICATE / 故障转移）
+func (e *Engine) ReplicaOf(host string, port int) protocol.Reply {
+	return e.replicaOf(host, port)
+}
+
+func (e *Engine) ReplicaOfNoOne() {
+	e.replicaOfNoOne()
+}
+
+// 复制偏移量
+func (e *Engine) ReplOffset() int64 {
+	e.repl.mu.Lock()
+	defer e.repl.mu.Unlock()
+	return e.repl.offset
+}
+
+func (e *Engine) closeReplication() {
+	repl := e.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	select {
+	case <-repl.closed:
+		return
+	default:
+	}
+	close(repl.closed)
+	if repl.link != nil {
+		repl.link.stop()
+	}
+	repl.closeReplicas()
+}
+
+// 和主节点同步，连接断开后重连
+func (e *Engine) replicationLoop(link *masterLink) {
+	for {
+		err := e.syncWithMaster(link)
+		if link.isStopped() {
+			return
+		}
+		logger.Warnf("master %s link err: %v, reconnecting...", link.addr(), err)
+		link.state.Store(linkStateConnecting)
+
+		select {
+		case <-time.After(linkRetryInterval):
+		case <-link.stopped:
+			return
+		}
+	}
+}
+
+// 一次完整的同步过程：握手 -> 全量同步 or 部分同步 -> 持续接收写命令
+func (e *Engine) syncWithMaster(link *masterLink) error {
+	timeout := time.Duration(conf.GlobalConfig.ReplTimeout) * time.Second
+
+	conn, err := net.DialTimeout("tcp", link.addr(), timeout)
+	if err != nil {
+		return err
+	}
+	if !link.setConn(conn) {
+		conn.Close()
+		return nil
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// 发送命令，并读取一行回复
+	sendCommand := func(args ...string) (string, error) {
+		cmd := make([][]byte, 0, len(args))
+		for _, arg := range args {
+			cmd = append(cmd, []byte(arg))
+		}
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write(protocol.NewMultiBulkReply(cmd).ToBytes()); err != nil {
+			return "", err
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSuffix(line, utils.CRLF)
+		if strings.HasPrefix(line, "-") {
+			return "", fmt.Errorf("%s reply %s", args[0], line[1:])
+		}
+		return line, nil
+	}
+
+	//1.握手
+	if conf.GlobalConfig.MasterAuth != "" {
+		if _, err := sendCommand("auth", conf.GlobalConfig.MasterAuth); err != nil {
+			return err
+		}
+	}
+	if _, err := sendCommand("replconf", "listening-port", strconv.Itoa(conf.GlobalConfig.Port)); err != nil {
+		return err
+	}
+	repl := e.repl
+	repl.mu.Lock()
+	replID, psyncOffset := repl.replID, repl.offset+1
+	repl.mu.Unlock()
+	line, err := sendCommand("psync", replID, strconv.FormatInt(psyncOffset, 10))
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		//2.全量同步 +FULLRESYNC <replid> <offset>
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.New("unexpected psync reply " + line)
+		}
+		link.state.Store(linkStateSync)
+		if err := e.readSnapshot(link, conn, reader, timeout); err != nil {
+			return err
+		}
+		repl.mu.Lock()
+		repl.replID = fields[1]
+		repl.replID2 = ""
+		repl.secondReplOffset = -1
+		repl.offset = offset
+		repl.backlog = newReplBacklog(backlogSize(), offset)
+		// 之前的刷盘位置属于原来的数据集
+		repl.fsyncedReplOffset = -1
+		repl.pendingAofOffset, repl.pendingReplOffset = 0, -1
+		repl.mu.Unlock()
+		logger.Infof("master %s full sync finished, replid %s offset %d", link.addr(), fields[1], offset)
+	case len(fields) > 0 && len(fields) <= 2 && fields[0] == "+CONTINUE":
+		//2.部分同步 +CONTINUE [<replid>]
+		repl.mu.Lock()
+		// 主节点的replid发生变化（从节点提升为主节点），记录原来的replid
+		if len(fields) == 2 && fields[1] != repl.replID {
+			repl.replID2 = repl.replID
+			repl.secondReplOffset = repl.offset + 1
+			repl.replID = fields[1]
+		}
+		repl.mu.Unlock()
+		logger.Infof("master %s partial resynchronization succeeded, continue from offset %d", link.addr(), psyncOffset)
+	default:
+		return errors.New("unexpected psync reply " + line)
+	}
+	link.state.Store(linkStateConnected)
+
+	// 定时发送ACK，直到连接断开
+	done := make(chan struct{})
+	defer close(done)
+	go e.replAckLoop(link, conn, done)
+
+	//3.持续接收写命令
+	return e.streamFromMaster(link, conn, reader, timeout)
+}
+
+// 每秒向主节点发送一次 REPLCONF ACK <offset>
+func (e *Engine) replAckLoop(link *masterLink, conn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if err := e.sendAck(link, conn); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// REPLCONF ACK <offset> [FACK <aofoffset>]（开启aof时，上报已经刷盘的复制偏移量）
+func (e *Engine) sendAck(link *masterLink, conn net.Conn) error {
+	args := [][]byte{[]byte("ack")}
+	e.repl.mu.Lock()
+	args = append(args, []byte(strconv.FormatInt(e.repl.offset, 10)))
+	if e.aof != nil {
+		args = append(args, []byte("fack"), []byte(strconv.FormatInt(e.fsyncedReplOffset(), 10)))
+	}
+	e.repl.mu.Unlock()
+
+	link.writeMu.Lock()
+	defer link.writeMu.Unlock()
+	_, err := conn.Write(protocol.NewMultiBulkReply(utils.BuildCmdLine("replconf", args...)).ToBytes())
+	return err
+}
+
+// 已经写入aof并刷盘的复制偏移量（调用方持有repl.mu）
+// 记录一个等待刷盘的位置（aof偏移量，复制偏移量），aof刷盘到该位置后，对应的复制偏移量即为已经刷盘
+func (e *Engine) fsyncedReplOffset() int64 {
+	repl := e.repl
+	if e.aof.FsyncedOffset() >= repl.pendingAofOffset {
+		repl.fsyncedReplOffset = repl.pendingReplOffset
+		// 命令先写入aof，再增加复制偏移量，所以aof偏移量一定包括了复制偏移量之前的命令
+		repl.pendingAofOffset, repl.pendingReplOffset = e.aof.Offset(), repl.offset
+		if e.aof.FsyncedOffset() >= repl.pendingAofOffset {
+			repl.fsyncedReplOffset = repl.pendingReplOffset
+		}
+	}
+	return repl.fsyncedReplOffset
+}
+
+// 读取快照 $<len>\r\n<rdb>，清空数据库后加载
+func (e *Engine) readSnapshot(link *masterLink, conn net.Conn, reader *bufio.Reader, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	header = strings.TrimSuffix(header, utils.CRLF)
+	if !strings.HasPrefix(header, "$") {
+		return errors.New("unexpected snapshot header " + header)
+	}
+	size, err := strconv.Atoi(header[1:])
+	if err != nil || size < 0 {
+		return errors.New("unexpected snapshot header " + header)
+	}
+
+	data := make([]byte, size)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return err
+	}
+	link.lastIOTime.Store(time.Now().UnixMilli())
+
+	// 清空数据库（同时会写入aof），然后加载快照
+	e.flushAll()
+	client := e.repl.masterClient
+	defer client.SetDBIndex(0)
+	return rdb.NewDecoder(bufio.NewReader(bytes.NewReader(data))).Load(func(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error {
+		// 已过期的数据，不用加载
+		if expiration != nil && expiration.Before(time.Now()) {
+			return nil
+		}
+		cmd := aof.EntityToCmd(key, entity)
+		if cmd == nil {
+			return nil
+		}
+		client.SetDBIndex(dbIndex)
+		ret := e.Exec(client, cmd.RedisCommand)
+		if protocol.IsErrReply(ret) {
+			logger.Error("load snapshot err ", string(ret.ToBytes()))
+			return nil
+		}
+		if expiration != nil {
+			e.Exec(client, aof.PExpireAtCmd(key, *expiration))
+		}
+		return nil
+	})
+}
+
+// 执行主节点传播的写命令，直到连接断开
+func (e *Engine) streamFromMaster(link *masterLink, conn net.Conn, reader *bufio.Reader, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	ch := parser.ParseStream(reader)
+	for payload := range ch {
+		if payload.Err != nil {
+			return payload.Err
+		}
+		reply, ok := payload.Reply.(*protocol.MultiBulkReply)
+		if !ok || len(reply.RedisCommand) == 0 {
+			continue
+		}
+		// 主节点定时发送PING，收到数据说明主节点存活
+		conn.SetDeadline(time.Now().Add(timeout))
+		link.lastIOTime.Store(time.Now().UnixMilli())
+
+		data := reply.ToBytes()
+		// REPLCONF GETACK：立即发送ACK（同样计入复制偏移量）
+		if isGetAck(reply.RedisCommand) {
+			e.repl.feedFromMaster(data)
+			if err := e.sendAck(link, conn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ret := e.Exec(e.repl.masterClient, reply.RedisCommand)
+		if protocol.IsErrReply(ret) {
+			logger.Error("exec master command err ", string(ret.ToBytes()))
+		}
+		e.repl.feedFromMaster(data)
+	}
+	return io.EOF
+}
+
+func isGetAck(redisCommand [][]byte) bool {
+	return len(redisCommand) >= 2 && strings.EqualFold(string(redisCommand[0]), "replconf") && strings.EqualFold(string(redisCommand[1]), "getack")
+}
+
+// 是否为写命令（从节点只读时拒绝）
+func isWriteCommand(commandName string, redisCommand [][]byte) bool {
+	switch commandName {
+	case "flushdb", "flushall":
+		return true
+	}
+	cmd, ok := commandCenter[commandName]
+	if !ok || !validateArity(cmd.argsNum, redisCommand) {
+		return false
+	}
+	_, writeKeys := cmd.keyFunc(redisCommand[1:])
+	return len(writeKeys) > 0
+}
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+同步确认：
+
+WAIT numreplicas timeout：等待至少numreplicas个从节点，确认收到当前复制偏移量之前的数据（REPLCONF ACK）
+WAITAOF numlocal numreplicas timeout：等待本地aof刷盘（numlocal 0 or 1），以及至少numreplicas个从节点确认写入aof并刷盘（REPLCONF ACK ... FACK）
+
+timeout 单位毫秒，0表示一直等待；超时后返回当前确认的个数
+*/
+
+// 通知等待ACK的客户端（调用方持有repl.mu）
+func (repl *replication) notifyAck() {
+	if repl.ackNotify != nil {
+		close(repl.ackNotify)
+		repl.ackNotify = nil
+	}
+}
+
+// 等待至少num个从节点满足acked，返回满足的从节点个数
+func (repl *replication) waitForReplicas(num int, deadline time.Time, acked func(r *replica) bool) int {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	getAck := false
+	for {
+		repl.mu.Lock()
+		count := repl.countReplicasLocked(acked)
+		if count >= num {
+			repl.mu.Unlock()
+			return count
+		}
+		if repl.ackNotify == nil {
+			repl.ackNotify = make(chan struct{})
+		}
+		notify := repl.ackNotify
+		repl.mu.Unlock()
+
+		// 要求从节点立即发送ACK（不用等待定时发送）
+		if !getAck {
+			getAck = true
+			repl.feed(-1, utils.BuildCmdLine("replconf", []byte("getack"), []byte("*")))
+		}
+
+		select {
+		case <-notify:
+		case <-timeout:
+			return repl.countReplicas(acked)
+		case <-repl.closed:
+			return repl.countReplicas(acked)
+		}
+	}
+}
+
+func (repl *replication) countReplicas(acked func(r *replica) bool) int {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	return repl.countReplicasLocked(acked)
+}
+
+func (repl *replication) countReplicasLocked(acked func(r *replica) bool) int {
+	count := 0
+	for _, r := range repl.replicas {
+		if r.getState() == replicaStateOnline && acked(r) {
+			count++
+		}
+	}
+	return count
+}
+
+// 解析超时时间（毫秒），0表示一直等待
+func parseWaitTimeout(arg []byte) (time.Time, protocol.Reply) {
+	timeout, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return time.Time{}, protocol.NewGenericErrReply("timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return time.Time{}, protocol.NewGenericErrReply("timeout is negative")
+	}
+	if timeout == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(time.Duration(timeout) * time.Millisecond), nil
+}
+
+// WAIT numreplicas timeout
+func (e *Engine) execWait(c abstract.Connection, args [][]byte) protocol.Reply {
+	if len(args) != 2 {
+		return protocol.NewArgNumErrReply("wait")
+	}
+	if c != nil && c.IsTransaction() {
+		return protocol.NewGenericErrReply("cannot wait within multi")
+	}
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return protocol.NewGenericErrReply("value is not an integer or out of range")
+	}
+	deadline, errReply := parseWaitTimeout(args[1])
+	if errReply != nil {
+		return errReply
+	}
+
+	repl := e.repl
+	repl.mu.Lock()
+	role, offset := repl.role, repl.offset
+	repl.mu.Unlock()
+	if role != roleMaster {
+		return protocol.NewGenericErrReply("WAIT cannot be used with replica instances")
+	}
+
+	count := repl.waitForReplicas(numReplicas, deadline, func(r *replica) bool {
+		return r.ackOffset.Load() >= offset
+	})
+	return protocol.NewIntegerReply(int64(count))
+}
+
+// WAITAOF numlocal numreplicas timeout
+func (e *Engine) execWaitAof(c abstract.Connection, args [][]byte) protocol.Reply {
+	if len(args) != 3 {
+		return protocol.NewArgNumErrReply("waitaof")
+	}
+	if c != nil && c.IsTransaction() {
+		return protocol.NewGenericErrReply("cannot waitaof within multi")
+	}
+	numLocal, err := strconv.Atoi(string(args[0]))
+	if err != nil || numLocal < 0 {
+		return protocol.NewGenericErrReply("value is out of range, must be positive")
+	}
+	if numLocal > 1 {
+		return protocol.NewGenericErrReply("WAITAOF numlocal must be 0 or 1")
+	}
+	numReplicas, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return protocol.NewGenericErrReply("value is not an integer or out of range")
+	}
+	deadline, errReply := parseWaitTimeout(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	if numLocal > 0 && e.aof == nil {
+		return protocol.NewGenericErrReply("WAITAOF cannot be used when numlocal is set but appendonly is disabled")
+	}
+
+	repl := e.repl
+	repl.mu.Lock()
+	role, offset := repl.role, repl.offset
+	repl.mu.Unlock()
+	if role != roleMaster {
+		return protocol.NewGenericErrReply("WAITAOF cannot be used with replica instances")
+	}
+
+	// 本地aof刷盘
+	var localOffset int64
+	if e.aof != nil {
+		localOffset = e.aof.Offset()
+		if numLocal > 0 {
+			e.aof.WaitFsync(localOffset, deadline)
+		}
+	}
+	// 从节点aof刷盘
+	count := repl.waitForReplicas(numReplicas, deadline, func(r *replica) bool {
+		return r.ackAofOffset.Load() >= offset
+	})
+
+	reply := protocol.NewMixReply()
+	local := int64(0)
+	if e.aof != nil && e.aof.FsyncedOffset() >= localOffset {
+		local = 1
+	}
+	reply.Append(protocol.NewIntegerReply(local), protocol.NewIntegerReply(int64(count)))
+	return reply
+}
@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofish2020/easyredis/aof"
+	"github.com/gofish2020/easyredis/redis/connection"
+)
+
+// 内存中的从节点连接：丢弃主节点发送的数据，收到 REPLCONF GETACK 时通知
+type fakeReplica struct {
+	*connection.VirtualConnection
+	getAck chan struct{}
+}
+
+func newFakeReplica() *fakeReplica {
+	return &fakeReplica{VirtualConnection: connection.NewVirtualConn(), getAck: make(chan struct{}, 16)}
+}
+
+func (r *fakeReplica) Write(b []byte) (int, error) {
+	if bytes.Contains(bytes.ToLower(b), []byte("getack")) {
+		select {
+		case r.getAck <- struct{}{}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (r *fakeReplica) RemoteAddr() string {
+	return "127.0.0.1:50000"
+}
+
+// 全量同步，等待从节点上线
+func attachReplica(t *testing.T, e *Engine) *fakeReplica {
+	t.Helper()
+	r := newFakeReplica()
+	if reply := string(e.Exec(r, cmdLine("replconf", "listening-port", "6380")).ToBytes()); reply != "+OK\r\n" {
+		t.Fatalf("unexpected replconf reply %q", reply)
+	}
+	e.Exec(r, cmdLine("psync", "?", "-1"))
+	deadline := time.Now().Add(3 * time.Second)
+	for e.repl.countReplicas(func(*replica) bool { return true }) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("replica not online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return r
+}
+
+func ack(e *Engine, r *fakeReplica, offset int64, aofOffset int64) {
+	e.Exec(r, cmdLine("replconf", "ack", strconv.FormatInt(offset, 10), "fack", strconv.FormatInt(aofOffset, 10)))
+}
+
+func waitGetAck(t *testing.T, r *fakeReplica) {
+	t.Helper()
+	select {
+	case <-r.getAck:
+	case <-time.After(3 * time.Second):
+		t.Fatal("replica should receive REPLCONF GETACK")
+	}
+}
+
+func TestWaitArgs(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+	c := connection.NewVirtualConn()
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"wait", "1"}, "-ERR wrong number of arguments for 'wait' command\r\n"},
+		{[]string{"wait", "x", "0"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"wait", "1", "x"}, "-ERR timeout is not an integer or out of range\r\n"},
+		{[]string{"wait", "1", "-1"}, "-ERR timeout is negative\r\n"},
+		{[]string{"wait", "0", "0"}, ":0\r\n"},
+		{[]string{"waitaof", "0", "0"}, "-ERR wrong number of arguments for 'waitaof' command\r\n"},
+		{[]string{"waitaof", "x", "0", "0"}, "-ERR value is out of range, must be positive\r\n"},
+		{[]string{"waitaof", "-1", "0", "0"}, "-ERR value is out of range, must be positive\r\n"},
+		{[]string{"waitaof", "2", "0", "0"}, "-ERR WAITAOF numlocal must be 0 or 1\r\n"},
+		{[]string{"waitaof", "0", "x", "0"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"waitaof", "0", "0", "-1"}, "-ERR timeout is negative\r\n"},
+		// appendonly no
+		{[]string{"waitaof", "1", "0", "0"}, "-ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled\r\n"},
+		{[]string{"waitaof", "0", "0", "0"}, "*2\r\n:0\r\n:0\r\n"},
+	}
+	for _, tt := range tests {
+		if got := exec(e, c, tt.args...); got != tt.expected {
+			t.Fatalf("%v: expect %q, got %q", tt.args, tt.expected, got)
+		}
+	}
+
+	// 事务中不能等待
+	exec(e, c, "multi")
+	if got := exec(e, c, "wait", "0", "0"); got != "-ERR cannot wait within multi\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	exec(e, c, "discard")
+
+	// 从节点不能等待
+	exec(e, c, "replicaof", "127.0.0.1", closedPort(t))
+	if got := exec(e, c, "wait", "0", "0"); got != "-ERR WAIT cannot be used with replica instances\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := exec(e, c, "waitaof", "0", "0", "0"); got != "-ERR WAITAOF cannot be used with replica instances\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestWaitAck(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+	c := connection.NewVirtualConn()
+	r1 := attachReplica(t, e)
+	r2 := attachReplica(t, e)
+
+	exec(e, c, "set", "key", "value")
+	offset := e.ReplOffset()
+
+	// 等待时发送 GETACK，从节点回复ACK后唤醒
+	result := make(chan string, 1)
+	go func() { result <- exec(e, c, "wait", "1", "0") }()
+	waitGetAck(t, r1)
+	waitGetAck(t, r2)
+	select {
+	case got := <-result:
+		t.Fatalf("wait should block until ack, got %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// ACK的偏移量不够，继续等待
+	ack(e, r1, offset-1, -1)
+	select {
+	case got := <-result:
+		t.Fatalf("wait should block until ack, got %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// 从节点确认收到了所有数据（包括GETACK）
+	ack(e, r1, e.ReplOffset(), -1)
+	select {
+	case got := <-result:
+		if got != ":1\r\n" {
+			t.Fatalf("expect 1 replica, got %q", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait should return after ack")
+	}
+
+	// 不需要等待：直接返回已经确认的从节点个数
+	if got := exec(e, c, "wait", "0", "0"); got != ":1\r\n" {
+		t.Fatalf("expect 1 replica, got %q", got)
+	}
+
+	// 超时，返回已经确认的从节点个数
+	start := time.Now()
+	if got := exec(e, c, "wait", "2", "100"); got != ":1\r\n" {
+		t.Fatalf("expect 1 replica after timeout, got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("wait returned before timeout: %v", elapsed)
+	}
+	ack(e, r1, e.ReplOffset(), -1)
+	ack(e, r2, e.ReplOffset(), -1)
+	if got := exec(e, c, "wait", "2", "100"); got != ":2\r\n" {
+		t.Fatalf("expect 2 replicas, got %q", got)
+	}
+
+	// 新的写命令之后，之前的ACK不再满足
+	exec(e, c, "set", "key", "new")
+	if got := exec(e, c, "wait", "1", "50"); got != ":0\r\n" {
+		t.Fatalf("expect 0 replicas, got %q", got)
+	}
+}
+
+func TestWaitAofAck(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+	c := connection.NewVirtualConn()
+	r := attachReplica(t, e)
+	exec(e, c, "set", "key", "value")
+
+	// 从节点收到了数据，但是没有刷盘（未开启aof时为-1）
+	result := make(chan string, 1)
+	go func() { result <- exec(e, c, "waitaof", "0", "1", "0") }()
+	waitGetAck(t, r)
+	ack(e, r, e.ReplOffset(), -1)
+	select {
+	case got := <-result:
+		t.Fatalf("waitaof should block until aof ack, got %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ack(e, r, e.ReplOffset(), e.ReplOffset())
+	select {
+	case got := <-result:
+		if got != "*2\r\n:0\r\n:1\r\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("waitaof should return after ack")
+	}
+}
+
+// 开启aof：numlocal 等待本地刷盘
+func TestWaitAofLocal(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+	var err error
+	e.aof, err = aof.NewAOF(t.TempDir(), "appendonly.aof", e, false, aof.FsyncEverySec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connection.NewVirtualConn()
+
+	exec(e, c, "set", "key", "value")
+	if got := exec(e, c, "waitaof", "1", "0", "3000"); got != "*2\r\n:1\r\n:0\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
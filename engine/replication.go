@@ -0,0 +1,476 @@
+package engine
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/rdb"
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+主从复制（主节点）：
+
+1. 从节点发送 REPLCONF listening-port <port>，然后发送 PSYNC ? -1
+2. 主节点对所有数据库加锁（期间禁止写入），生成快照，并记录此时的复制偏移量
+3. 回复 +FULLRESYNC <replid> <offset>\r\n，然后发送快照 $<len>\r\n<rdb>
+4. 之后的写命令（和aof是同一个传播点 db.writeAof），按照顺序发送给从节点，同时保存到复制积压缓冲区中
+5. 从节点每秒发送 REPLCONF ACK <offset>，上报已经处理的复制偏移量
+
+部分同步：从节点断线重连后，发送 PSYNC <replid> <offset+1>，如果replid一致（or 为提升前的主节点replid2），
+并且需要的数据仍然在积压缓冲区中，回复 +CONTINUE <replid>，然后只发送缓冲区中的数据
+*/
+
+const (
+	roleMaster = "master"
+	roleSlave  = "slave"
+)
+
+// 从节点状态
+const (
+	replicaStateHandshake = "handshake" // 握手中（REPLCONF）
+	replicaStateSendBulk  = "send_bulk" // 发送快照中
+	replicaStateOnline    = "online"    // 同步命令中
+	replicaStateClosed    = "closed"    // 已断开
+)
+
+const (
+	replIDLen = 40
+	// 从节点的发送缓冲上限（超过后断开，避免内存无限增长）
+	replicaOutputLimit = 256 * 1024 * 1024
+	defaultBacklogSize = 1024 * 1024
+)
+
+type replication struct {
+	mu sync.Mutex
+
+	role string
+	// 复制id（主节点的数据集标识；从节点为主节点的replid）
+	replID string
+	// 提升为主节点之前的复制id，以及有效的偏移量（用于提升后，其他从节点的部分同步）
+	replID2          string
+	secondReplOffset int64
+	// 复制偏移量（已经传播 or 已经从主节点接收的字节数）
+	offset int64
+	// 复制积压缓冲区（第一个从节点连接时创建）
+	backlog *replBacklog
+	// 最后传播的数据库索引
+	lastDBIndex int
+	// 从节点（key为从节点的连接）
+	replicas map[abstract.Connection]*replica
+
+	// 作为从节点时，和主节点的连接
+	link *masterLink
+	// 执行主节点传播的命令（重连后继续使用，保留选中的数据库）
+	masterClient *masterClient
+	// 从节点：已经写入aof并刷盘的复制偏移量（FACK），以及等待刷盘的位置
+	fsyncedReplOffset int64
+	pendingAofOffset  int64
+	pendingReplOffset int64
+
+	// 收到从节点ACK后关闭，通知 WAIT/WAITAOF 的客户端
+	ackNotify chan struct{}
+	// 从节点只读（避免每条命令都加锁）
+	readOnly atomic.Bool
+
+	closed chan struct{}
+}
+
+func newReplication() *replication {
+	return &replication{
+		role:              roleMaster,
+		replID:            utils.RandString(replIDLen),
+		secondReplOffset:  -1,
+		fsyncedReplOffset: -1,
+		lastDBIndex:       -1,
+		replicas:          make(map[abstract.Connection]*replica),
+		masterClient:      &masterClient{connection.NewVirtualConn()},
+		closed:            make(chan struct{}),
+	}
+}
+
+// 复制积压缓冲区的大小
+func backlogSize() int {
+	size, err := conf.ParseSize(conf.GlobalConfig.ReplBacklogSize)
+	if err != nil || size <= 0 {
+		return defaultBacklogSize
+	}
+	return int(size)
+}
+
+// 从节点（主节点视角）
+type replica struct {
+	conn abstract.Connection
+	// 从节点的ip和端口
+	ip            string
+	listeningPort int
+	state         atomic.Value
+	// 从节点上报的复制偏移量，以及上报的时间
+	ackOffset atomic.Int64
+	ackTime   atomic.Int64
+	// 从节点上报的已经刷盘的复制偏移量（从节点未开启aof时为-1）
+	ackAofOffset atomic.Int64
+
+	// 等待发送的数据
+	mu          sync.Mutex
+	pending     [][]byte
+	pendingSize int
+	notify      chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newReplica(c abstract.Connection) *replica {
+	r := &replica{
+		conn:   c,
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	r.state.Store(replicaStateHandshake)
+	r.ackAofOffset.Store(-1)
+	if remote, ok := c.(interface{ RemoteAddr() string }); ok {
+		r.ip, _, _ = net.SplitHostPort(remote.RemoteAddr())
+	}
+	return r
+}
+
+func (r *replica) getState() string {
+	return r.state.Load().(string)
+}
+
+// 保存到发送缓冲中（缓冲超过上限，返回false）
+func (r *replica) send(data []byte) bool {
+	r.mu.Lock()
+	r.pending = append(r.pending, data)
+	r.pendingSize += len(data)
+	size := r.pendingSize
+	r.mu.Unlock()
+
+	if size > replicaOutputLimit {
+		return false
+	}
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (r *replica) close() {
+	r.closeOnce.Do(func() {
+		r.state.Store(replicaStateClosed)
+		close(r.closed)
+	})
+}
+
+// 先发送全量同步的数据，然后持续发送缓冲中的命令
+func (r *replica) writeLoop(fullSync []byte) {
+	if _, err := r.conn.Write(fullSync); err != nil {
+		logger.Warn("replica full sync err:", err)
+		r.close()
+		return
+	}
+	r.state.CompareAndSwap(replicaStateSendBulk, replicaStateOnline)
+
+	for {
+		select {
+		case <-r.notify:
+		case <-r.closed:
+			return
+		}
+
+		r.mu.Lock()
+		pending := r.pending
+		r.pending = nil
+		r.pendingSize = 0
+		r.mu.Unlock()
+
+		for _, data := range pending {
+			// 连接已经关闭（连接对象会被复用，不能再写入）
+			if r.conn.IsClosed() || r.getState() == replicaStateClosed {
+				return
+			}
+			if _, err := r.conn.Write(data); err != nil {
+				logger.Warn("replica write err:", err)
+				r.close()
+				return
+			}
+		}
+	}
+}
+
+// 将写命令传播给从节点（调用方持有key的锁，保证和快照的顺序一致）
+func (repl *replication) feed(dbIndex int, redisCommand [][]byte) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	// 积压缓冲区创建之后，即使没有从节点，也需要保存（从节点重连后部分同步）
+	if repl.role != roleMaster || (repl.backlog == nil && !repl.hasReplicas()) {
+		return
+	}
+
+	var data []byte
+	// dbIndex < 0 表示和数据库无关的命令（例如：PING）
+	if dbIndex >= 0 && dbIndex != repl.lastDBIndex {
+		data = append(data, protocol.NewMultiBulkReply(utils.BuildCmdLine("select", []byte(strconv.Itoa(dbIndex)))).ToBytes()...)
+		repl.lastDBIndex = dbIndex
+	}
+	data = append(data, protocol.NewMultiBulkReply(redisCommand).ToBytes()...)
+	repl.offset += int64(len(data))
+	if repl.backlog != nil {
+		repl.backlog.write(data)
+	}
+
+	for c, r := range repl.replicas {
+		state := r.getState()
+		if state != replicaStateSendBulk && state != replicaStateOnline {
+			continue
+		}
+		if !r.send(data) {
+			logger.Warnf("replica %s:%d output buffer overcome the limit, closing", r.ip, r.listeningPort)
+			r.close()
+			delete(repl.replicas, c)
+		}
+	}
+}
+
+// 从节点：保存主节点传播的数据（原样保存到积压缓冲区中，提升为主节点后，其他从节点可以部分同步）
+func (repl *replication) feedFromMaster(data []byte) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.backlog == nil {
+		repl.backlog = newReplBacklog(backlogSize(), repl.offset)
+	}
+	repl.offset += int64(len(data))
+	repl.backlog.write(data)
+}
+
+// 是否存在需要同步的从节点
+func (repl *replication) hasReplicas() bool {
+	for _, r := range repl.replicas {
+		state := r.getState()
+		if state == replicaStateSendBulk || state == replicaStateOnline {
+			return true
+		}
+	}
+	return false
+}
+
+// 定时向从节点发送PING（从节点通过PING判断主节点是否存活）
+func (repl *replication) pingReplicaCron() {
+	period := conf.GlobalConfig.ReplPingReplicaPeriod
+	if period <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				repl.feed(-1, utils.BuildCmdLine("ping"))
+			case <-repl.closed:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// 断开所有的从节点
+func (repl *replication) closeReplicas() {
+	for c, r := range repl.replicas {
+		r.close()
+		delete(repl.replicas, c)
+	}
+}
+
+// REPLCONF <option> <value> [<option> <value> ...]
+func (e *Engine) execReplConf(c abstract.Connection, args [][]byte) protocol.Reply {
+	if len(args)%2 != 0 {
+		return protocol.NewSyntaxErrReply()
+	}
+
+	repl := e.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	// REPLCONF ACK <offset> [FACK <aofoffset>]：从节点上报复制偏移量（不需要回复）
+	if len(args) > 0 && strings.EqualFold(string(args[0]), "ack") {
+		r, ok := repl.replicas[c]
+		if !ok {
+			return protocol.NewNoReply()
+		}
+		if offset, err := strconv.ParseInt(string(args[1]), 10, 64); err == nil {
+			r.ackOffset.Store(offset)
+			r.ackTime.Store(time.Now().UnixMilli())
+		}
+		if len(args) == 4 && strings.EqualFold(string(args[2]), "fack") {
+			if aofOffset, err := strconv.ParseInt(string(args[3]), 10, 64); err == nil {
+				r.ackAofOffset.Store(aofOffset)
+			}
+		}
+		repl.notifyAck()
+		return protocol.NewNoReply()
+	}
+
+	r, ok := repl.replicas[c]
+	if !ok {
+		r = newReplica(c)
+		repl.replicas[c] = r
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(string(args[i])) {
+		case "listening-port":
+			port, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return protocol.NewGenericErrReply("value is not an integer or out of range")
+			}
+			r.listeningPort = port
+		case "capa":
+		default:
+			return protocol.NewGenericErrReply("Unrecognized REPLCONF option: " + string(args[i]))
+		}
+	}
+	return protocol.NewOkReply()
+}
+
+// PSYNC <replid> <offset> / SYNC
+func (e *Engine) execPSync(c abstract.Connection, args [][]byte) protocol.Reply {
+	repl := e.repl
+	repl.mu.Lock()
+	role := repl.role
+	repl.mu.Unlock()
+	if role != roleMaster {
+		return protocol.NewGenericErrReply("Can't SYNC while not a master, chained replication is not supported")
+	}
+
+	// 部分同步
+	if len(args) == 2 && repl.tryPartialResync(c, string(args[0]), string(args[1])) {
+		return protocol.NewNoReply()
+	}
+
+	// 生成快照，并在快照的同时，记录复制偏移量 & 注册从节点（之后的写命令，都会保存到从节点的发送缓冲中）
+	var (
+		r      *replica
+		replID string
+		offset int64
+	)
+	var buf bytes.Buffer
+	err := e.snapshot(&buf, func() {
+		repl.mu.Lock()
+		defer repl.mu.Unlock()
+
+		var ok bool
+		r, ok = repl.replicas[c]
+		if !ok {
+			r = newReplica(c)
+			repl.replicas[c] = r
+		}
+		r.state.Store(replicaStateSendBulk)
+		// 从节点加载快照后，从0号数据库开始，下一条命令需要写入select
+		repl.lastDBIndex = -1
+		replID, offset = repl.replID, repl.offset
+		if repl.backlog == nil {
+			repl.backlog = newReplBacklog(backlogSize(), repl.offset)
+		}
+	})
+	if err != nil {
+		return protocol.NewGenericErrReply(err.Error())
+	}
+	logger.Infof("replica %s:%d asks for synchronization, full resync with replid %s offset %d", r.ip, r.listeningPort, replID, offset)
+
+	// PSYNC: +FULLRESYNC <replid> <offset>\r\n$<len>\r\n<rdb>
+	// SYNC: $<len>\r\n<rdb>
+	var fullSync []byte
+	if len(args) > 0 {
+		fullSync = []byte("+FULLRESYNC " + replID + " " + strconv.FormatInt(offset, 10) + utils.CRLF)
+	}
+	fullSync = append(fullSync, []byte("$"+strconv.Itoa(buf.Len())+utils.CRLF)...)
+	fullSync = append(fullSync, buf.Bytes()...)
+	go r.writeLoop(fullSync)
+
+	// 回复由writeLoop发送
+	return protocol.NewNoReply()
+}
+
+// 部分同步：replid一致，并且 [offset-1, 当前偏移量) 的数据仍然在积压缓冲区中
+func (repl *replication) tryPartialResync(c abstract.Connection, replID string, offsetStr string) bool {
+	psyncOffset, err := strconv.ParseInt(offsetStr, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+
+	if replID != repl.replID && (replID != repl.replID2 || psyncOffset > repl.secondReplOffset) {
+		return false
+	}
+	if repl.backlog == nil {
+		return false
+	}
+	// psyncOffset 为从节点需要的下一个字节
+	data, ok := repl.backlog.readFrom(psyncOffset - 1)
+	if !ok {
+		return false
+	}
+
+	r, ok := repl.replicas[c]
+	if !ok {
+		r = newReplica(c)
+		repl.replicas[c] = r
+	}
+	r.state.Store(replicaStateSendBulk)
+	r.ackOffset.Store(psyncOffset - 1)
+	logger.Infof("replica %s:%d partial resynchronization accepted, sending %d bytes of backlog starting from offset %d", r.ip, r.listeningPort, len(data), psyncOffset)
+
+	// +CONTINUE <replid>\r\n<backlog>
+	go r.writeLoop(append([]byte("+CONTINUE "+repl.replID+utils.CRLF), data...))
+	return true
+}
+
+// 生成一致性快照：对所有数据库加锁（期间禁止写入），fn同样在持有锁的期间执行
+func (e *Engine) snapshot(buf *bytes.Buffer, fn func()) error {
+	dbs := make([]*DB, len(e.dbSet))
+	for i := range e.dbSet {
+		dbs[i] = e.dbSet[i].Load().(*DB)
+		dbs[i].dataDict.LockAll()
+	}
+	defer func() {
+		for _, db := range dbs {
+			db.dataDict.UnLockAll()
+		}
+	}()
+
+	err := rdb.Dump(buf, len(dbs), func(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool) {
+		dbs[dbIndex].forEachWithLock(cb)
+	})
+	if err != nil {
+		return err
+	}
+	fn()
+	return nil
+}
+
+// 客户端连接关闭，如果是从节点，停止同步
+func (e *Engine) AfterClientClose(c abstract.Connection) {
+	repl := e.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if r, ok := repl.replicas[c]; ok {
+		logger.Infof("replica %s:%d connection lost", r.ip, r.listeningPort)
+		r.close()
+		delete(repl.replicas, c)
+	}
+}
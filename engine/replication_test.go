@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/connection"
+	"github.com/gofish2020/easyredis/tool/conf"
+)
+
+func cmdLine(args ...string) [][]byte {
+	result := make([][]byte, len(args))
+	for i, arg := range args {
+		result[i] = []byte(arg)
+	}
+	return result
+}
+
+func exec(e *Engine, c *connection.VirtualConnection, args ...string) string {
+	return string(e.Exec(c, cmdLine(args...)).ToBytes())
+}
+
+// 没有监听的端口（连接主节点一直失败，从节点停留在 connecting 状态）
+func closedPort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return strconv.Itoa(port)
+}
+
+func replicationField(e *Engine, c *connection.VirtualConnection, field string) string {
+	for _, line := range strings.Split(exec(e, c, "info", "replication"), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	return ""
+}
+
+func TestReplicaOfArgs(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+	c := connection.NewVirtualConn()
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"replicaof"}, "-ERR wrong number of arguments for 'replicaof' command\r\n"},
+		{[]string{"replicaof", "127.0.0.1"}, "-ERR wrong number of arguments for 'replicaof' command\r\n"},
+		{[]string{"replicaof", "127.0.0.1", "6379", "x"}, "-ERR wrong number of arguments for 'replicaof' command\r\n"},
+		{[]string{"replicaof", "127.0.0.1", "abc"}, "-ERR Invalid master port\r\n"},
+		{[]string{"replicaof", "127.0.0.1", "0"}, "-ERR Invalid master port\r\n"},
+		{[]string{"replicaof", "127.0.0.1", "65536"}, "-ERR Invalid master port\r\n"},
+		{[]string{"slaveof", "127.0.0.1", "-1"}, "-ERR Invalid master port\r\n"},
+		// 已经是主节点
+		{[]string{"replicaof", "NO", "ONE"}, "+OK\r\n"},
+		{[]string{"slaveof", "no", "one"}, "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		if got := exec(e, c, tt.args...); got != tt.expected {
+			t.Fatalf("%v: expect %q, got %q", tt.args, tt.expected, got)
+		}
+	}
+	if role := replicationField(e, c, "role"); role != roleMaster {
+		t.Fatalf("invalid arguments should not change role, got %s", role)
+	}
+}
+
+func TestReplicaOfState(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+	c := connection.NewVirtualConn()
+	replID := replicationField(e, c, "master_replid")
+
+	port := closedPort(t)
+	if reply := exec(e, c, "replicaof", "127.0.0.1", port); reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	fields := map[string]string{
+		"role":               roleSlave,
+		"master_host":        "127.0.0.1",
+		"master_port":        port,
+		"master_link_status": "down",
+		"slave_read_only":    "1",
+	}
+	for field, expected := range fields {
+		if got := replicationField(e, c, field); got != expected {
+			t.Fatalf("%s: expect %s, got %s", field, expected, got)
+		}
+	}
+	if reply := exec(e, c, "replicaof", "127.0.0.1", port); reply != "+OK Already connected to specified master\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	// 切换到另一个主节点
+	port2 := closedPort(t)
+	if reply := exec(e, c, "slaveof", "127.0.0.1", port2); reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if got := replicationField(e, c, "master_port"); got != port2 {
+		t.Fatalf("expect master port %s, got %s", port2, got)
+	}
+
+	// 重新成为主节点：新的replid，原来的replid保存为replid2
+	if reply := exec(e, c, "replicaof", "no", "one"); reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if role := replicationField(e, c, "role"); role != roleMaster {
+		t.Fatalf("expect master, got %s", role)
+	}
+	if got := replicationField(e, c, "master_host"); got != "" {
+		t.Fatalf("master should not report master_host, got %s", got)
+	}
+	if newID := replicationField(e, c, "master_replid"); newID == replID || replicationField(e, c, "master_replid2") != replID {
+		t.Fatalf("unexpected replid %s, replid2 %s", newID, replicationField(e, c, "master_replid2"))
+	}
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+	defer func(readOnly bool) { conf.GlobalConfig.ReplicaReadOnly = readOnly }(conf.GlobalConfig.ReplicaReadOnly)
+	conf.GlobalConfig.ReplicaReadOnly = true
+
+	e := NewEngine()
+	defer e.Close()
+	c := connection.NewVirtualConn()
+	exec(e, c, "set", "key", "value")
+	exec(e, c, "replicaof", "127.0.0.1", closedPort(t))
+
+	const readOnlyErr = "-READONLY You can't write against a read only replica.\r\n"
+	for _, args := range [][]string{
+		{"set", "key", "new"},
+		{"del", "key"},
+		{"zadd", "zset", "1", "a"},
+		{"mset", "a", "1", "b", "2"},
+		{"expire", "key", "100"},
+		{"flushdb"},
+		{"flushall"},
+	} {
+		if got := exec(e, c, args...); got != readOnlyErr {
+			t.Fatalf("%v: expect READONLY, got %q", args, got)
+		}
+	}
+	// 读命令不受影响
+	if got := exec(e, c, "get", "key"); got != "$5\r\nvalue\r\n" {
+		t.Fatalf("unexpected get reply %q", got)
+	}
+	// 主节点传播的命令不受只读限制
+	master := &masterClient{VirtualConnection: connection.NewVirtualConn()}
+	if got := string(e.Exec(master, cmdLine("set", "key", "from-master")).ToBytes()); got != "+OK\r\n" {
+		t.Fatalf("master write should succeed, got %q", got)
+	}
+	if got := exec(e, c, "get", "key"); got != "$11\r\nfrom-master\r\n" {
+		t.Fatalf("unexpected get reply %q", got)
+	}
+
+	// 成为主节点后可以写入
+	exec(e, c, "replicaof", "no", "one")
+	if got := exec(e, c, "set", "key", "new"); got != "+OK\r\n" {
+		t.Fatalf("master should accept writes, got %q", got)
+	}
+
+	// replica-read-only no
+	conf.GlobalConfig.ReplicaReadOnly = false
+	exec(e, c, "replicaof", "127.0.0.1", closedPort(t))
+	if got := exec(e, c, "set", "key", "replica"); got != "+OK\r\n" {
+		t.Fatalf("writable replica should accept writes, got %q", got)
+	}
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/tool/hashslot"
+)
+
+/*
+哈希槽索引：slot -> keys
+
+集群哈希槽模式下（cluster-mode slot）启用，CLUSTER COUNTKEYSINSLOT/GETKEYSINSLOT 以及槽迁移不需要遍历整个数据库
+*/
+
+type slotKeys struct {
+	mu   sync.RWMutex
+	keys map[string]struct{}
+}
+
+type slotIndex struct {
+	slots [hashslot.SlotCount]slotKeys
+}
+
+func newSlotIndex() *slotIndex {
+	return &slotIndex{}
+}
+
+func (idx *slotIndex) add(key string) {
+	sk := &idx.slots[hashslot.Slot(key)]
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	if sk.keys == nil {
+		sk.keys = make(map[string]struct{})
+	}
+	sk.keys[key] = struct{}{}
+}
+
+func (idx *slotIndex) remove(key string) {
+	sk := &idx.slots[hashslot.Slot(key)]
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	delete(sk.keys, key)
+}
+
+// 槽内的key（limit < 0 表示不限制数量），跳过已过期的key
+func (idx *slotIndex) keysInSlot(slot int, limit int, expired func(key string) bool) []string {
+	sk := &idx.slots[slot]
+	sk.mu.RLock()
+	defer sk.mu.RUnlock()
+	var keys []string
+	for key := range sk.keys {
+		if limit >= 0 && len(keys) >= limit {
+			break
+		}
+		if !expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// 槽内key的数量（包括还没有删除的过期key）
+func (idx *slotIndex) count(slot int) int {
+	sk := &idx.slots[slot]
+	sk.mu.RLock()
+	defer sk.mu.RUnlock()
+	return len(sk.keys)
+}
+
+// 当前数据库中，槽内的key（limit < 0 表示不限制数量）
+func (e *Engine) KeysInSlot(dbIndex int, slot int, limit int) []string {
+	db, errReply := e.selectDB(dbIndex)
+	if errReply != nil || limit == 0 {
+		return nil
+	}
+	now := time.Now()
+	expired := func(key string) bool {
+		raw, ok := db.ttlDict.Get(key)
+		return ok && raw.(time.Time).Before(now)
+	}
+	if db.slotIndex != nil {
+		return db.slotIndex.keysInSlot(slot, limit, expired)
+	}
+
+	// 没有启用索引，遍历数据库
+	var keys []string
+	e.ForEach(dbIndex, func(key string, data *payload.DataEntity, expiration *time.Time) bool {
+		if hashslot.Slot(key) == slot && !expired(key) {
+			keys = append(keys, key)
+		}
+		return limit < 0 || len(keys) < limit
+	})
+	return keys
+}
+
+// 当前数据库中，槽内key的数量
+func (e *Engine) CountKeysInSlot(dbIndex int, slot int) int {
+	db, errReply := e.selectDB(dbIndex)
+	if errReply != nil {
+		return 0
+	}
+	if db.slotIndex != nil {
+		return db.slotIndex.count(slot)
+	}
+	return len(e.KeysInSlot(dbIndex, slot, -1))
+}
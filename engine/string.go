@@ -148,6 +148,17 @@ func cmdSet(db *DB, args [][]byte) protocol.Reply {
 	return protocol.NewNullBulkReply()
 }
 
+// https://redis.io/commands/mget/     key [key ...]
+func cmdMGet(db *DB, args [][]byte) protocol.Reply {
+	result := make([][]byte, len(args))
+	for i, key := range args {
+		// key不存在 or 不是字符串，回复nil
+		bytes, _ := db.getStringObject(string(key))
+		result[i] = bytes
+	}
+	return protocol.NewMultiBulkReply(result)
+}
+
 func cmdMSet(db *DB, args [][]byte) protocol.Reply {
 	size := len(args) / 2
 	// 提取出key value
@@ -176,4 +187,6 @@ func init() {
 	registerCommand("Set", cmdSet, writeFirstKey, -3, rollbackFirstKey)
 	// 设置多个值
 	registerCommand("MSet", cmdMSet, writeMultiKey, -3, undoMSet)
+	// 获取多个值
+	registerCommand("MGet", cmdMGet, readAllKey, -2, nil)
 }
@@ -25,6 +25,10 @@ func checkPasswd(c abstract.Connection) bool {
 	if conf.GlobalConfig.RequirePass == "" {
 		return true
 	}
+	// 通过认证的集群节点不需要密码
+	if c.IsClusterPeer() {
+		return true
+	}
 	// 密码是否一致
 	return c.GetPassword() == conf.GlobalConfig.RequirePass
 }
@@ -38,7 +38,7 @@ func writeMultiKey(args [][]byte) ([]string, []string) {
 
 	size := len(args) / 2
 
-	writeKeys := make([]string, size)
+	writeKeys := make([]string, 0, size)
 
 	for i := 0; i < size; i++ {
 		writeKeys = append(writeKeys, string(args[2*i]))
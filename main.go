@@ -14,6 +14,15 @@ import (
 )
 
 func main() {
+	// 子命令：检测 & 修复aof文件
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" {
+		os.Exit(checkAof(os.Args[2:]))
+	}
+	// 子命令：哨兵模式
+	if len(os.Args) > 1 && os.Args[1] == "sentinel" {
+		os.Exit(runSentinel(os.Args[2:]))
+	}
+
 	//1. 打印logo
 	println(utils.Logo())
 
@@ -65,13 +74,7 @@ func initConfig() {
 		conf.LoadConfig(configFileName)
 	} else {
 		// 默认的配置
-		conf.GlobalConfig = &conf.RedisConfig{
-			Bind:           "0.0.0.0",
-			Port:           6379,
-			AppendOnly:     false,
-			AppendFilename: "",
-			RunID:          utils.RandString(40),
-		}
+		conf.GlobalConfig.Bind = "0.0.0.0"
 	}
 	//logger.Debugf("%#v", conf.GlobalConfig)
 }
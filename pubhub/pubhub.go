@@ -21,6 +21,11 @@ const (
 	_subscribe   = "subscribe"
 	_unsubscribe = "unsubscribe"
 	_message     = "message"
+
+	// sharded pub/sub
+	_ssubscribe   = "ssubscribe"
+	_sunsubscribe = "sunsubscribe"
+	_smessage     = "smessage"
 )
 
 // https://redis.io/docs/interact/pubsub/
@@ -33,17 +38,17 @@ func channelMsg(action, chanName string, count int) []byte {
 		":" + strconv.Itoa(count) + utils.CRLF)
 }
 
-func noChannelMsg() []byte {
+func noChannelMsg(action string) []byte {
 	return []byte("*3" + utils.CRLF +
-		"$" + strconv.Itoa(len(_unsubscribe)) + utils.CRLF + _unsubscribe + utils.CRLF +
+		"$" + strconv.Itoa(len(action)) + utils.CRLF + action + utils.CRLF +
 		"$-1" + utils.CRLF +
 		":0" + utils.CRLF)
 }
 
-func publisMsg(channel string, msg string) []byte {
+func publisMsg(action string, channel string, msg string) []byte {
 
 	return []byte("*3" + utils.CRLF +
-		"$" + strconv.Itoa(len(_message)) + utils.CRLF + _message + utils.CRLF +
+		"$" + strconv.Itoa(len(action)) + utils.CRLF + action + utils.CRLF +
 		"$" + strconv.Itoa(len(channel)) + utils.CRLF + channel + utils.CRLF +
 		"$" + strconv.Itoa(len(msg)) + utils.CRLF + msg + utils.CRLF)
 }
@@ -57,6 +62,9 @@ type Pubhub struct {
 	//locker sync.RWMutex
 
 	locker *locker.Locker // 自定义一个分布锁
+
+	// sharded pub/sub（SSUBSCRIBE/SUNSUBSCRIBE/SPUBLISH）：客户端单独记录订阅的channel，消息类型为 ssubscribe/sunsubscribe/smessage
+	shard bool
 }
 
 func NewPubsub() *Pubhub {
@@ -67,11 +75,56 @@ func NewPubsub() *Pubhub {
 	return pubsub
 }
 
+func NewShardPubsub() *Pubhub {
+	pubsub := NewPubsub()
+	pubsub.shard = true
+	return pubsub
+}
+
+// 消息类型
+func (p *Pubhub) actions() (subscribe, unsubscribe, message string) {
+	if p.shard {
+		return _ssubscribe, _sunsubscribe, _smessage
+	}
+	return _subscribe, _unsubscribe, _message
+}
+
+func (p *Pubhub) subscribe(c abstract.Connection, channel string) {
+	if p.shard {
+		c.SSubscribe(channel)
+	} else {
+		c.Subscribe(channel)
+	}
+}
+
+func (p *Pubhub) unsubscribe(c abstract.Connection, channel string) {
+	if p.shard {
+		c.SUnsubscribe(channel)
+	} else {
+		c.Unsubscribe(channel)
+	}
+}
+
+func (p *Pubhub) subCount(c abstract.Connection) int {
+	if p.shard {
+		return c.SSubCount()
+	}
+	return c.SubCount()
+}
+
+func (p *Pubhub) channels(c abstract.Connection) []string {
+	if p.shard {
+		return c.GetShardChannels()
+	}
+	return c.GetChannels()
+}
+
 // SUBSCRIBE channel [channel ...]
 func (p *Pubhub) Subscribe(c abstract.Connection, args [][]byte) protocol.Reply {
 
+	subscribe, _, _ := p.actions()
 	if len(args) < 1 {
-		return protocol.NewArgNumErrReply("subscribe")
+		return protocol.NewArgNumErrReply(subscribe)
 	}
 
 	// 通道名
@@ -86,7 +139,7 @@ func (p *Pubhub) Subscribe(c abstract.Connection, args [][]byte) protocol.Reply
 	for _, arg := range args {
 		chanName := string(arg)
 		// 记录当前客户端连接订阅的通道
-		c.Subscribe(chanName)
+		p.subscribe(c, chanName)
 
 		// 双向链表，记录通道下的客户端连接
 		var l *list.LinkedList
@@ -108,7 +161,7 @@ func (p *Pubhub) Subscribe(c abstract.Connection, args [][]byte) protocol.Reply
 		}
 
 		// 回复客户端消息
-		_, err := c.Write(channelMsg(_subscribe, chanName, c.SubCount()))
+		_, err := c.Write(channelMsg(subscribe, chanName, p.subCount(c)))
 		if err != nil {
 			logger.Warn(err)
 		}
@@ -121,9 +174,10 @@ func (p *Pubhub) Subscribe(c abstract.Connection, args [][]byte) protocol.Reply
 // unsubscribes itself from all the channels using the UNSUBSCRIBE command without additional arguments
 func (p *Pubhub) Unsubscribe(c abstract.Connection, args [][]byte) protocol.Reply {
 
+	_, unsubscribe, _ := p.actions()
 	var channels []string
 	if len(args) < 1 { // 取消全部
-		channels = c.GetChannels()
+		channels = p.channels(c)
 	} else { // 取消指定channel
 		channels = make([]string, len(args))
 		for i, v := range args {
@@ -136,12 +190,12 @@ func (p *Pubhub) Unsubscribe(c abstract.Connection, args [][]byte) protocol.Repl
 
 	// 说明已经没有订阅的通道
 	if len(channels) == 0 {
-		c.Write(noChannelMsg())
+		c.Write(noChannelMsg(unsubscribe))
 	}
 	for _, channel := range channels {
 
 		// 从客户端中删除当前通道
-		c.Unsubscribe(channel)
+		p.unsubscribe(c, channel)
 		// 获取链表
 		raw, ok := p.dataDict.Get(channel)
 		if ok {
@@ -156,7 +210,7 @@ func (p *Pubhub) Unsubscribe(c abstract.Connection, args [][]byte) protocol.Repl
 				p.dataDict.Delete(channel)
 			}
 		}
-		c.Write(channelMsg(_unsubscribe, channel, c.SubCount()))
+		c.Write(channelMsg(unsubscribe, channel, p.subCount(c)))
 	}
 
 	return protocol.NewNoReply()
@@ -164,7 +218,11 @@ func (p *Pubhub) Unsubscribe(c abstract.Connection, args [][]byte) protocol.Repl
 
 func (p *Pubhub) Publish(self abstract.Connection, args [][]byte) protocol.Reply {
 
+	_, _, message := p.actions()
 	if len(args) != 2 {
+		if p.shard {
+			return protocol.NewArgNumErrReply("spublish")
+		}
 		return protocol.NewArgNumErrReply("publish")
 	}
 
@@ -194,7 +252,7 @@ func (p *Pubhub) Publish(self abstract.Connection, args [][]byte) protocol.Reply
 				return true
 			}
 			// 发送数据
-			conn.Write(publisMsg(channelName, string(args[1])))
+			conn.Write(publisMsg(message, channelName, string(args[1])))
 			sendSuccess++
 			return true
 		})
@@ -0,0 +1,177 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"time"
+
+	"github.com/gofish2020/easyredis/datastruct/sortedset"
+	"github.com/gofish2020/easyredis/engine/payload"
+)
+
+var ErrChecksum = errors.New("rdb checksum mismatch")
+
+type Decoder struct {
+	// 注意：这里直接使用外部的reader，快照读取完成后，reader的游标正好位于快照的结尾（混合持久化，后面紧跟着aof命令）
+	r   *bufio.Reader
+	crc hash.Hash64
+	buf [8]byte
+	// 字符串的最大长度（0表示不限制），避免非法数据导致分配过大的内存
+	maxLen uint64
+}
+
+func NewDecoder(r *bufio.Reader) *Decoder {
+	return &Decoder{
+		r:   r,
+		crc: crc64.New(crcTable),
+	}
+}
+
+// 实现 io.ByteReader，用于读取 uvarint
+func (dec *Decoder) ReadByte() (byte, error) {
+	b, err := dec.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	dec.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (dec *Decoder) readFull(data []byte) error {
+	if _, err := io.ReadFull(dec.r, data); err != nil {
+		return err
+	}
+	dec.crc.Write(data)
+	return nil
+}
+
+func (dec *Decoder) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(dec)
+}
+
+func (dec *Decoder) readString() ([]byte, error) {
+	size, err := dec.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if dec.maxLen > 0 && size > dec.maxLen {
+		return nil, fmt.Errorf("rdb string length %d out of range", size)
+	}
+	data := make([]byte, size)
+	if err := dec.readFull(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (dec *Decoder) readUint64() (uint64, error) {
+	if err := dec.readFull(dec.buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(dec.buf[:]), nil
+}
+
+func (dec *Decoder) readHeader() error {
+	header := make([]byte, len(magic)+len(version))
+	if err := dec.readFull(header); err != nil {
+		return err
+	}
+	if string(header[:len(magic)]) != magic {
+		return errors.New("invalid rdb header")
+	}
+	if string(header[len(magic):]) != version {
+		return fmt.Errorf("unsupported rdb version %s", header[len(magic):])
+	}
+	return nil
+}
+
+func (dec *Decoder) readValue(valueType byte) (*payload.DataEntity, error) {
+	switch valueType {
+	case typeString:
+		val, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		return &payload.DataEntity{RedisObject: val}, nil
+	case typeZSet:
+		size, err := dec.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		zset := sortedset.NewSortedSet()
+		for i := uint64(0); i < size; i++ {
+			member, err := dec.readString()
+			if err != nil {
+				return nil, err
+			}
+			bits, err := dec.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			zset.Add(string(member), math.Float64frombits(bits))
+		}
+		return &payload.DataEntity{RedisObject: zset}, nil
+	}
+	return nil, fmt.Errorf("unknown rdb value type %d", valueType)
+}
+
+// 解析快照，每解析出一条数据，调用一次cb
+func (dec *Decoder) Load(cb EntryFunc) error {
+	if err := dec.readHeader(); err != nil {
+		return err
+	}
+
+	dbIndex := 0
+	var expiration *time.Time
+	for {
+		op, err := dec.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opEOF:
+			// 校验和不参与计算
+			sum := dec.crc.Sum64()
+			if _, err := io.ReadFull(dec.r, dec.buf[:]); err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint64(dec.buf[:]) != sum {
+				return ErrChecksum
+			}
+			return nil
+		case opSelectDB:
+			index, err := dec.readUvarint()
+			if err != nil {
+				return err
+			}
+			dbIndex = int(index)
+		case opExpireMs:
+			ms, err := dec.readUint64()
+			if err != nil {
+				return err
+			}
+			expireAt := time.UnixMilli(int64(ms))
+			expiration = &expireAt
+		default:
+			key, err := dec.readString()
+			if err != nil {
+				return err
+			}
+			entity, err := dec.readValue(op)
+			if err != nil {
+				return err
+			}
+			if err := cb(dbIndex, string(key), entity, expiration); err != nil {
+				return err
+			}
+			expiration = nil
+		}
+	}
+}
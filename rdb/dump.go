@@ -0,0 +1,52 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/gofish2020/easyredis/engine/payload"
+)
+
+/*
+DUMP / RESTORE 的序列化格式：只包含一条数据（不含key和过期时间）的快照
+
+	EASYRDB0001 type "" value 0xFF crc64
+*/
+
+var ErrInvalidPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// 序列化一个value
+func DumpEntity(entity *payload.DataEntity) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.WriteHeader(); err != nil {
+		return nil, err
+	}
+	if err := enc.WriteEntry("", entity, nil); err != nil {
+		return nil, err
+	}
+	if err := enc.WriteEnd(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 反序列化 DumpEntity 的结果
+func RestoreEntity(data []byte) (*payload.DataEntity, error) {
+	var result *payload.DataEntity
+	dec := NewDecoder(bufio.NewReader(bytes.NewReader(data)))
+	dec.maxLen = uint64(len(data))
+	err := dec.Load(func(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error {
+		if result != nil {
+			return ErrInvalidPayload
+		}
+		result = entity
+		return nil
+	})
+	if err != nil || result == nil {
+		return nil, ErrInvalidPayload
+	}
+	return result, nil
+}
@@ -0,0 +1,164 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"time"
+
+	"github.com/gofish2020/easyredis/datastruct/sortedset"
+	"github.com/gofish2020/easyredis/engine/payload"
+)
+
+type Encoder struct {
+	w   *bufio.Writer
+	crc hash.Hash64
+	buf [binary.MaxVarintLen64]byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:   bufio.NewWriter(w),
+		crc: crc64.New(crcTable),
+	}
+}
+
+// 将数据写入文件，同时计算校验和
+func (enc *Encoder) write(data []byte) error {
+	enc.crc.Write(data)
+	_, err := enc.w.Write(data)
+	return err
+}
+
+func (enc *Encoder) writeByte(b byte) error {
+	return enc.write([]byte{b})
+}
+
+func (enc *Encoder) writeUvarint(x uint64) error {
+	n := binary.PutUvarint(enc.buf[:], x)
+	return enc.write(enc.buf[:n])
+}
+
+func (enc *Encoder) writeString(s []byte) error {
+	if err := enc.writeUvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	return enc.write(s)
+}
+
+func (enc *Encoder) writeUint64(x uint64) error {
+	binary.LittleEndian.PutUint64(enc.buf[:8], x)
+	return enc.write(enc.buf[:8])
+}
+
+// 文件头
+func (enc *Encoder) WriteHeader() error {
+	return enc.write([]byte(magic + version))
+}
+
+// 选中数据库
+func (enc *Encoder) WriteDBIndex(dbIndex int) error {
+	if err := enc.writeByte(opSelectDB); err != nil {
+		return err
+	}
+	return enc.writeUvarint(uint64(dbIndex))
+}
+
+// 写入一条数据（不支持的数据类型直接跳过）
+func (enc *Encoder) WriteEntry(key string, entity *payload.DataEntity, expiration *time.Time) error {
+	if entity == nil {
+		return nil
+	}
+
+	var valueType byte
+	switch entity.RedisObject.(type) {
+	case []byte:
+		valueType = typeString
+	case *sortedset.SortedSet:
+		valueType = typeZSet
+	default:
+		return nil
+	}
+
+	// 过期时间
+	if expiration != nil {
+		if err := enc.writeByte(opExpireMs); err != nil {
+			return err
+		}
+		if err := enc.writeUint64(uint64(expiration.UnixMilli())); err != nil {
+			return err
+		}
+	}
+
+	if err := enc.writeByte(valueType); err != nil {
+		return err
+	}
+	if err := enc.writeString([]byte(key)); err != nil {
+		return err
+	}
+
+	switch val := entity.RedisObject.(type) {
+	case []byte:
+		return enc.writeString(val)
+	case *sortedset.SortedSet:
+		size := val.Len()
+		if err := enc.writeUvarint(uint64(size)); err != nil {
+			return err
+		}
+		var err error
+		val.ForEachByRank(0, size, false, func(pair *sortedset.Pair) bool {
+			if err = enc.writeString([]byte(pair.Member)); err != nil {
+				return false
+			}
+			if err = enc.writeUint64(math.Float64bits(pair.Score)); err != nil {
+				return false
+			}
+			return true
+		})
+		return err
+	}
+	return nil
+}
+
+// 结束标识 + 校验和，并刷新缓冲
+func (enc *Encoder) WriteEnd() error {
+	if err := enc.writeByte(opEOF); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(enc.buf[:8], enc.crc.Sum64())
+	if _, err := enc.w.Write(enc.buf[:8]); err != nil {
+		return err
+	}
+	return enc.w.Flush()
+}
+
+// 将 dbNum 个数据库的数据，以快照格式写入w
+func Dump(w io.Writer, dbNum int, forEach ForEachFunc) error {
+	enc := NewEncoder(w)
+	if err := enc.WriteHeader(); err != nil {
+		return err
+	}
+
+	for i := 0; i < dbNum; i++ {
+		var err error
+		selected := false
+		forEach(i, func(key string, data *payload.DataEntity, expiration *time.Time) bool {
+			// 空数据库不写 select
+			if !selected {
+				if err = enc.WriteDBIndex(i); err != nil {
+					return false
+				}
+				selected = true
+			}
+			err = enc.WriteEntry(key, data, expiration)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return enc.WriteEnd()
+}
@@ -0,0 +1,55 @@
+package rdb
+
+import (
+	"bufio"
+	"hash/crc64"
+	"time"
+
+	"github.com/gofish2020/easyredis/engine/payload"
+)
+
+/*
+二进制快照（简化版RDB格式）：
+
+	EASYRDB0001                       文件头：魔数 + 版本号
+	[0xFE dbIndex]                    选中数据库
+	[0xFC expireAt(ms,8字节)] type key value   数据（过期时间可选）
+	...
+	0xFF crc64(8字节)                  结束标识 + 校验和
+
+用于aof重写时的混合持久化（快照 + 增量命令）
+*/
+
+const (
+	magic   = "EASYRDB"
+	version = "0001"
+)
+
+const (
+	opSelectDB byte = 0xFE
+	opExpireMs byte = 0xFC
+	opEOF      byte = 0xFF
+)
+
+// 数据类型
+const (
+	typeString byte = 0
+	typeZSet   byte = 3
+)
+
+var crcTable = crc64.MakeTable(crc64.ISO)
+
+// 遍历数据库的函数（和 abstract.Engine 的 ForEach 签名一致）
+type ForEachFunc func(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool)
+
+// 解析出一条数据的回调
+type EntryFunc func(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error
+
+// 判断reader的头部是否为二进制快照
+func HasPreamble(reader *bufio.Reader) bool {
+	header, err := reader.Peek(len(magic))
+	if err != nil {
+		return false
+	}
+	return string(header) == magic
+}
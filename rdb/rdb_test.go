@@ -0,0 +1,95 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gofish2020/easyredis/datastruct/sortedset"
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpAndLoad(t *testing.T) {
+
+	zset := sortedset.NewSortedSet()
+	zset.Add("a", 1.5)
+	zset.Add("b", -2)
+
+	expireAt := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	dbs := map[int]map[string]*payload.DataEntity{
+		0: {"str": {RedisObject: []byte("value")}},
+		3: {"zset": {RedisObject: zset}},
+	}
+
+	var buf bytes.Buffer
+	err := Dump(&buf, 16, func(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool) {
+		for key, entity := range dbs[dbIndex] {
+			if dbIndex == 3 {
+				cb(key, entity, &expireAt)
+			} else {
+				cb(key, entity, nil)
+			}
+		}
+	})
+	assert.Nil(t, err)
+
+	// 快照后面追加其他数据，验证读取快照后游标的位置
+	buf.WriteString("*1\r\n$4\r\nPING\r\n")
+
+	reader := bufio.NewReader(&buf)
+	assert.True(t, HasPreamble(reader))
+
+	loaded := make(map[string]int)
+	err = NewDecoder(reader).Load(func(dbIndex int, key string, entity *payload.DataEntity, expiration *time.Time) error {
+		loaded[key] = dbIndex
+		switch key {
+		case "str":
+			assert.Nil(t, expiration)
+			assert.Equal(t, []byte("value"), entity.RedisObject)
+		case "zset":
+			assert.Equal(t, expireAt, *expiration)
+			set := entity.RedisObject.(*sortedset.SortedSet)
+			assert.Equal(t, int64(2), set.Len())
+			pair, _ := set.Get("b")
+			assert.Equal(t, float64(-2), pair.Score)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"str": 0, "zset": 3}, loaded)
+
+	rest, _ := reader.ReadString(0)
+	assert.Equal(t, "*1\r\n$4\r\nPING\r\n", rest)
+}
+
+func TestChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	err := Dump(&buf, 1, func(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool) {
+		cb("key", &payload.DataEntity{RedisObject: []byte("value")}, nil)
+	})
+	assert.Nil(t, err)
+
+	data := buf.Bytes()
+	data[len(data)-10] ^= 0xFF // 篡改数据
+
+	err = NewDecoder(bufio.NewReader(bytes.NewReader(data))).Load(func(int, string, *payload.DataEntity, *time.Time) error { return nil })
+	assert.NotNil(t, err)
+}
+
+func TestDumpEntity(t *testing.T) {
+	zset := sortedset.NewSortedSet()
+	zset.Add("a", 1.5)
+
+	data, err := DumpEntity(&payload.DataEntity{RedisObject: zset})
+	assert.Nil(t, err)
+	entity, err := RestoreEntity(data)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), entity.RedisObject.(*sortedset.SortedSet).Len())
+
+	// 篡改数据，校验和不匹配
+	data[len(data)-9] ^= 0xFF
+	_, err = RestoreEntity(data)
+	assert.Equal(t, ErrInvalidPayload, err)
+}
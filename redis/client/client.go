@@ -17,6 +17,7 @@ import (
 const (
 	maxChanSize = 1 << 10
 	maxWait     = 3 * time.Second
+	maxBatch    = 64 // 一次写入的最大请求数量
 
 	heartBeatInterval = 1 * time.Second
 )
@@ -27,6 +28,9 @@ const (
 	connClosed
 )
 
+// 等待结果超时
+var ErrTimeout = errors.New("time out")
+
 type request struct {
 	command [][]byte       // redis命令
 	err     error          // 处理出错
@@ -48,7 +52,7 @@ type RedisClient struct {
 	connStatus atomic.Int32
 
 	// heartbeat
-	ticker time.Ticker
+	ticker *time.Ticker
 
 	// buffer cache
 	waitSend   chan *request
@@ -56,6 +60,20 @@ type RedisClient struct {
 
 	// 有请求正在处理中...
 	working sync.WaitGroup
+
+	// 保证关闭waitSend之后，不会再写入（重连失败时，会在接收协程中关闭）
+	closeMu sync.RWMutex
+	// 发送协程已退出
+	sendDone chan struct{}
+	// 发送协程写入连接 & 保存到waitResult时持有，重连时持有该锁替换连接
+	sendMu sync.Mutex
+
+	// 连接建立后（包括重连）执行的初始化，例如节点之间的认证
+	onConnect func(Sender) error
+}
+
+type Sender interface {
+	Send(command [][]byte) (protocol.Reply, error)
 }
 
 // 创建redis客户端socket
@@ -69,27 +87,34 @@ func NewRedisClient(addr string) (*RedisClient, error) {
 	rc.conn = conn
 	rc.waitSend = make(chan *request, maxChanSize)
 	rc.waitResult = make(chan *request, maxChanSize)
+	rc.sendDone = make(chan struct{})
 	rc.addr = addr
 	rc.connStatus.Store(connCreated)
 	return &rc, nil
 }
 
+// 设置连接建立后（包括重连）执行的初始化，需要在 Start 之前设置
+func (rc *RedisClient) SetOnConnect(fn func(Sender) error) {
+	rc.onConnect = fn
+}
+
 // 启动
 func (rc *RedisClient) Start() error {
-	rc.ticker = *time.NewTicker(heartBeatInterval)
+	rc.ticker = time.NewTicker(heartBeatInterval)
 	// 将waitSend缓冲区进行发送
 	go rc.execSend()
 	// 获取服务端结果
-	go rc.execReceive()
+	go rc.execReceive(parser.ParseStream(rc.conn))
 	// 定时发送心跳
 	//go rc.execHeardBeat()
 	rc.connStatus.Store(connRunning) // 启动状态
+	if rc.onConnect != nil {
+		return rc.onConnect(rc)
+	}
 	return nil
 }
 
-func (rc *RedisClient) execReceive() {
-
-	ch := parser.ParseStream(rc.conn)
+func (rc *RedisClient) execReceive(ch <-chan *parser.Payload) {
 
 	for payload := range ch {
 
@@ -115,10 +140,11 @@ func (rc *RedisClient) reconnect() {
 	rc.conn.Close()
 
 	var conn net.Conn
+	var ch <-chan *parser.Payload
 	// 重连（重试3次）
 	for i := 0; i < 3; i++ {
 		var err error
-		conn, err = net.Dial("tcp", rc.addr)
+		conn, ch, err = rc.dial()
 		if err != nil {
 			logger.Error("reconnect error: " + err.Error())
 			time.Sleep(time.Second)
@@ -127,26 +153,105 @@ func (rc *RedisClient) reconnect() {
 			break
 		}
 	}
-	// 服务端连不上，说明服务可能挂了（or 网络问题 and so on...)
-	if conn == nil {
-		rc.Stop()
-		return
+
+	// 等待发送协程暂停（发送协程可能阻塞在 waitResult 上，所以一边等待一边清理）
+	locked := make(chan struct{})
+	go func() {
+		rc.sendMu.Lock()
+		close(locked)
+	}()
+	results := rc.waitResult
+	for waiting := true; waiting; {
+		select {
+		case <-locked:
+			waiting = false
+		case req, ok := <-results:
+			if !ok { // 已关闭
+				results = nil
+				continue
+			}
+			rc.resetReq(req)
+		}
+	}
+	// 清理 waitResult(因为连接重置，老的请求的数据结果在老连接上,老连接已经关了，新连接上肯定是没有结果的)
+	for drained := false; !drained; {
+		select {
+		case req := <-rc.waitResult:
+			rc.resetReq(req)
+		default:
+			drained = true
+		}
 	}
 
-	// 这里关闭没问题，因为rc.conn.Close已经关闭，函数Send中保存的请求因为发送不成功，不会写入到waitResult
-	close(rc.waitResult)
-	// 清理 waitResult(因为连接重置，新连接上只能处理新请求，老的请求的数据结果在老连接上,老连接已经关了，新连接上肯定是没有结果的)
-	for req := range rc.waitResult {
-		req.err = errors.New("connect reset")
-		req.wait.Done()
+	// 服务端连不上，说明服务可能挂了（or 网络问题 and so on...)；or 已经关闭
+	if conn == nil || rc.connStatus.Load() == connClosed {
+		rc.sendMu.Unlock()
+		if conn != nil {
+			conn.Close()
+			go drainPayload(ch)
+		}
+		rc.Stop()
+		return
 	}
 
 	// 新连接（新气象）
-	rc.waitResult = make(chan *request, maxWait)
 	rc.conn = conn
+	rc.sendMu.Unlock()
 
 	// 重新启动接收协程
-	go rc.execReceive()
+	go rc.execReceive(ch)
+}
+
+// 建立连接，并执行初始化
+func (rc *RedisClient) dial() (net.Conn, <-chan *parser.Payload, error) {
+	conn, err := net.Dial("tcp", rc.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := parser.ParseStream(conn)
+	if rc.onConnect != nil {
+		if err := rc.onConnect(&connSender{conn: conn, ch: ch}); err != nil {
+			conn.Close()
+			go drainPayload(ch)
+			return nil, nil, err
+		}
+	}
+	return conn, ch, nil
+}
+
+func (rc *RedisClient) resetReq(req *request) {
+	if req == nil { // waitResult 已关闭
+		return
+	}
+	req.err = errors.New("connect reset")
+	req.wait.Done()
+}
+
+func drainPayload(ch <-chan *parser.Payload) {
+	for range ch {
+	}
+}
+
+// 直接在连接上同步地发送请求（重连后执行初始化时，还没有切换到新连接）
+type connSender struct {
+	conn net.Conn
+	ch   <-chan *parser.Payload
+}
+
+func (s *connSender) Send(command [][]byte) (protocol.Reply, error) {
+	s.conn.SetDeadline(time.Now().Add(maxWait))
+	defer s.conn.SetDeadline(time.Time{})
+	if _, err := s.conn.Write(protocol.NewMultiBulkReply(command).ToBytes()); err != nil {
+		return nil, err
+	}
+	payload, ok := <-s.ch
+	if !ok {
+		return nil, errors.New("connection closed")
+	}
+	if payload.Err != nil {
+		return nil, payload.Err
+	}
+	return payload.Reply, nil
 }
 
 func (rc *RedisClient) handleResult(reply protocol.Reply) {
@@ -159,23 +264,51 @@ func (rc *RedisClient) handleResult(reply protocol.Reply) {
 	req.wait.Done() // 通知已经获取到结果
 }
 
-// 将waitSend缓冲区进行发送
+// 将waitSend缓冲区进行发送：缓冲区中已有的请求合并后一次写入（pipeline）
 func (rc *RedisClient) execSend() {
+	defer close(rc.sendDone)
+	batch := make([]*request, 0, maxBatch)
 	for req := range rc.waitSend {
-		rc.sendReq(req)
+		batch = append(batch[:0], req)
+	more:
+		for len(batch) < maxBatch {
+			select {
+			case req, ok := <-rc.waitSend:
+				if !ok {
+					break more
+				}
+				batch = append(batch, req)
+			default:
+				break more
+			}
+		}
+		rc.sendReq(batch)
 	}
 }
 
-func (rc *RedisClient) sendReq(req *request) {
-	// 无效请求
-	if req == nil || len(req.command) == 0 {
+func (rc *RedisClient) sendReq(batch []*request) {
+	var buf []byte
+	reqs := make([]*request, 0, len(batch))
+	for _, req := range batch {
+		// 无效请求
+		if req == nil || len(req.command) == 0 {
+			continue
+		}
+		buf = append(buf, req.Bytes()...)
+		reqs = append(reqs, req)
+	}
+	if len(reqs) == 0 {
 		return
 	}
 
+	// 重连时等待发送协程暂停，保证 waitResult 中的请求都在同一个连接上
+	rc.sendMu.Lock()
+	defer rc.sendMu.Unlock()
+
 	var err error
 	// 网络请求（重试3次）
 	for i := 0; i < 3; i++ {
-		_, err = rc.conn.Write(req.Bytes())
+		_, err = rc.conn.Write(buf)
 		// 发送成功 or 发送错误（除了超时错误和deadline错误）跳出
 		if err == nil ||
 			(!strings.Contains(err.Error(), "timeout") && // only retry timeout
@@ -184,11 +317,13 @@ func (rc *RedisClient) sendReq(req *request) {
 		}
 	}
 
-	if err == nil { // 发送成功，异步等待结果
-		rc.waitResult <- req
-	} else { // 发送失败，请求直接失败
-		req.err = err
-		req.wait.Done()
+	for _, req := range reqs {
+		if err == nil { // 发送成功，异步等待结果
+			rc.waitResult <- req
+		} else { // 发送失败，请求直接失败
+			req.err = err
+			req.wait.Done()
+		}
 	}
 }
 
@@ -202,9 +337,16 @@ func (rc *RedisClient) execHeardBeat() {
 
 // 将redis命令保存到 waitSend 中
 func (rc *RedisClient) Send(command [][]byte) (protocol.Reply, error) {
+	return rc.SendWithTimeout(command, maxWait)
+}
+
+// 发送redis命令，超过timeout没有收到结果时返回 ErrTimeout（多个协程可以并发调用，请求在同一个连接上依次发送）
+func (rc *RedisClient) SendWithTimeout(command [][]byte, timeout time.Duration) (protocol.Reply, error) {
 
+	rc.closeMu.RLock()
 	// 已关闭
 	if rc.connStatus.Load() == connClosed {
+		rc.closeMu.RUnlock()
 		return nil, errors.New("client closed")
 	}
 
@@ -221,10 +363,11 @@ func (rc *RedisClient) Send(command [][]byte) (protocol.Reply, error) {
 
 	// 将数据保存到缓冲中
 	rc.waitSend <- req
+	rc.closeMu.RUnlock()
 
 	// 等待处理结束
-	if req.wait.WaitWithTimeOut(maxWait) {
-		return nil, errors.New("time out")
+	if req.wait.WaitWithTimeOut(timeout) {
+		return nil, ErrTimeout
 	}
 	// 出错
 	if req.err != nil {
@@ -235,15 +378,29 @@ func (rc *RedisClient) Send(command [][]byte) (protocol.Reply, error) {
 	return req.reply, nil
 }
 
+// 客户端是否已关闭（重连失败时会自动关闭）
+func (rc *RedisClient) IsClosed() bool {
+	return rc.connStatus.Load() == connClosed
+}
+
 func (rc *RedisClient) Stop() {
-	// 设置已关闭
-	rc.connStatus.Store(connClosed)
+	// 设置已关闭（重连失败时已经关闭）
+	rc.closeMu.Lock()
+	if rc.connStatus.Swap(connClosed) == connClosed {
+		rc.closeMu.Unlock()
+		return
+	}
 	rc.ticker.Stop()
 
 	// 保证发送协程停止
 	close(rc.waitSend)
+	rc.closeMu.Unlock()
 	// 说明等待网络请求结果的request客户端不阻塞了（也就是剩下的req不需要等待了，可以关闭网络连接）
 	rc.working.Wait()
+	// 超时返回的请求可能还在发送中，等待发送协程退出后再关闭 waitResult
+	<-rc.sendDone
+	rc.sendMu.Lock()
 	rc.conn.Close()
+	rc.sendMu.Unlock()
 	close(rc.waitResult)
 }
@@ -2,9 +2,15 @@ package client
 
 import (
 	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gofish2020/easyredis/redis/parser"
+	"github.com/gofish2020/easyredis/redis/protocol"
 	"github.com/gofish2020/easyredis/tool/logger"
 )
 
@@ -38,3 +44,105 @@ func TestReconnect(t *testing.T) {
 		t.Error("reconnect error")
 	}
 }
+
+// 本地服务端：每个命令回复 +PONG，可以主动断开所有连接
+type pongServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func newPongServer(t *testing.T) *pongServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &pongServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go func() {
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					conn.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *pongServer) kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func TestReconnectPipeline(t *testing.T) {
+	server := newPongServer(t)
+	defer server.listener.Close()
+
+	client, err := NewRedisClient(server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var connected atomic.Int32
+	client.SetOnConnect(func(s Sender) error {
+		reply, err := s.Send([][]byte{[]byte("PING")})
+		if err != nil {
+			return err
+		}
+		if string(reply.ToBytes()) != "+PONG\r\n" {
+			return errors.New("unexpected reply")
+		}
+		connected.Add(1)
+		return nil
+	})
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	// 请求并发地在连接上发送时断开连接：进行中的请求失败，不会 panic
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				client.SendWithTimeout([][]byte{[]byte("PING")}, time.Second)
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		server.kill()
+	}
+	wg.Wait()
+
+	// 重连后执行了初始化，新连接上的请求正常
+	var reply protocol.Reply
+	for i := 0; i < 50; i++ {
+		if reply, err = client.Send([][]byte{[]byte("PING")}); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || string(reply.ToBytes()) != "+PONG\r\n" {
+		t.Fatalf("send after reconnect: %v %v", reply, err)
+	}
+	if connected.Load() < 2 {
+		t.Fatalf("onConnect should run on reconnect, ran %d times", connected.Load())
+	}
+}
@@ -41,8 +41,9 @@ type KeepConnection struct {
 
 	// 记录当前连接，订阅的channel
 
-	mu   sync.Mutex
-	subs map[string]struct{}
+	mu    sync.Mutex
+	subs  map[string]struct{}
+	ssubs map[string]struct{} // SSUBSCRIBE 订阅的channel
 
 	closed atomic.Bool
 
@@ -51,6 +52,14 @@ type KeepConnection struct {
 	queue    [][][]byte
 	watchKey map[string]int64
 	txErrors []error
+
+	// 集群：ASKING（只对下一条命令有效） & READONLY
+	asking   bool
+	readOnly bool
+
+	// 集群：通过节点认证（CLUSTERAUTH）的连接 & 认证过程中的随机数
+	clusterPeer      bool
+	clusterChallenge string
 }
 
 // 本质就是构建 *KeepConnection对象，存储c net.Conn 以及相关信息
@@ -73,6 +82,10 @@ func NewKeepConnection(c net.Conn) *KeepConnection {
 	conn.queue = nil
 	conn.txErrors = nil
 	conn.watchKey = nil
+	conn.asking = false
+	conn.readOnly = false
+	conn.clusterPeer = false
+	conn.clusterChallenge = ""
 	return conn
 }
 
@@ -164,6 +177,37 @@ func (k *KeepConnection) GetChannels() []string {
 	return result
 }
 
+func (k *KeepConnection) SSubscribe(channel string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.ssubs == nil {
+		k.ssubs = map[string]struct{}{}
+	}
+	k.ssubs[channel] = struct{}{}
+}
+
+func (k *KeepConnection) SUnsubscribe(channel string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.ssubs, channel)
+}
+
+func (k *KeepConnection) SSubCount() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.ssubs)
+}
+
+func (k *KeepConnection) GetShardChannels() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var result []string
+	for channel := range k.ssubs {
+		result = append(result, channel)
+	}
+	return result
+}
+
 func (k *KeepConnection) IsTransaction() bool {
 	return k.trx.Load()
 }
@@ -203,3 +247,35 @@ func (k *KeepConnection) GetTxErrors() []error {
 func (k *KeepConnection) AddTxError(err error) {
 	k.txErrors = append(k.txErrors, err)
 }
+
+func (k *KeepConnection) SetAsking(val bool) {
+	k.asking = val
+}
+
+func (k *KeepConnection) IsAsking() bool {
+	return k.asking
+}
+
+func (k *KeepConnection) SetReadOnly(val bool) {
+	k.readOnly = val
+}
+
+func (k *KeepConnection) IsReadOnly() bool {
+	return k.readOnly
+}
+
+func (k *KeepConnection) SetClusterPeer(val bool) {
+	k.clusterPeer = val
+}
+
+func (k *KeepConnection) IsClusterPeer() bool {
+	return k.clusterPeer
+}
+
+func (k *KeepConnection) SetClusterChallenge(challenge string) {
+	k.clusterChallenge = challenge
+}
+
+func (k *KeepConnection) GetClusterChallenge() string {
+	return k.clusterChallenge
+}
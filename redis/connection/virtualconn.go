@@ -23,3 +23,8 @@ func (v *VirtualConnection) GetDBIndex() int {
 func (v *VirtualConnection) GetPassword() string {
 	return conf.GlobalConfig.RequirePass
 }
+
+// 内部创建的连接，视为已认证的节点
+func (v *VirtualConnection) IsClusterPeer() bool {
+	return true
+}
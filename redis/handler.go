@@ -33,7 +33,8 @@ type RedisHandler struct {
 func NewRedisHandler() *RedisHandler {
 
 	var abEngine abstract.Engine
-	if len(conf.GlobalConfig.Peers) > 0 {
+	// 哈希槽模式下，没有配置peers的节点也以集群方式启动（等待 CLUSTER REBALANCE 加入集群）
+	if len(conf.GlobalConfig.Peers) > 0 || conf.GlobalConfig.ClusterMode == "slot" {
 		// 分布式
 		logger.Debug("启动集群版")
 		abEngine = cluster.NewCluster()
@@ -42,6 +43,11 @@ func NewRedisHandler() *RedisHandler {
 		logger.Debug("启动单机版")
 		abEngine = engine.NewEngine()
 	}
+	return NewRedisHandlerWithEngine(abEngine)
+}
+
+// 使用指定的引擎处理命令（例如：哨兵）
+func NewRedisHandlerWithEngine(abEngine abstract.Engine) *RedisHandler {
 	return &RedisHandler{
 		engine: abEngine,
 	}
@@ -62,6 +68,7 @@ func (h *RedisHandler) Handle(ctx context.Context, conn net.Conn) {
 			if payload.Err == io.EOF || payload.Err == io.ErrUnexpectedEOF || strings.Contains(payload.Err.Error(), "use of closed network connection") {
 				h.activeConn.Delete(keepConn)
 				logger.Warn("client closed:" + keepConn.RemoteAddr())
+				h.engine.AfterClientClose(keepConn)
 				keepConn.Close()
 				return
 			}
@@ -72,6 +79,7 @@ func (h *RedisHandler) Handle(ctx context.Context, conn net.Conn) {
 			if err != nil {
 				h.activeConn.Delete(keepConn)
 				logger.Warn("client closed:" + keepConn.RemoteAddr() + " err info: " + err.Error())
+				h.engine.AfterClientClose(keepConn)
 				keepConn.Close()
 				return
 			}
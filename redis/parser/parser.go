@@ -77,6 +77,17 @@ func parse(r io.Reader, out chan<- *Payload) {
 				Reply: protocol.NewSimpleErrReply(string(line[1:])),
 			}
 
+			// : 整数（回复）
+		case ':':
+			integer, err := strconv.ParseInt(string(line[1:]), 10, 64)
+			if err != nil {
+				protocolError(out, "illegal integer "+string(line))
+				continue
+			}
+			out <- &Payload{
+				Reply: protocol.NewIntegerReply(integer),
+			}
+
 			// $ 二进制安全，字符串
 		case '$':
 			err = parseBulkString(line, reader, out)
@@ -128,59 +139,130 @@ hello\r\n
 $5\r\n
 world\r\n
 
+请求中的数组只包含字符串（MultiBulkReply）；回复中的数组还可能包含 整数、状态、错误、嵌套数组（MixReply）
 */
 
 func parseArrays(header []byte, reader *bufio.Reader, out chan<- *Payload) error {
 	// 解析 *2 , bodyNum 表示后序有多少个数据等待解析
 
 	bodyNum, err := strconv.ParseInt(string(header[1:]), 10, 64)
-	if err != nil || bodyNum < 0 {
+	if err != nil || bodyNum < -1 {
 		protocolError(out, "illegal array header"+string(header[1:]))
 		return nil
 	}
 
+	reply, err := readArray(bodyNum, reader)
+	if err != nil {
+		if protoErr, ok := err.(protocolErr); ok {
+			protocolError(out, string(protoErr))
+			return nil
+		}
+		return err
+	}
+	out <- &Payload{
+		Err:   nil,
+		Reply: reply,
+	}
+	return nil
+}
+
+// 数组格式错误
+type protocolErr string
+
+func (e protocolErr) Error() string {
+	return string(e)
+}
+
+// 读取数组中的 bodyNum 个元素（-1 表示 Null array）
+func readArray(bodyNum int64, reader *bufio.Reader) (protocol.Reply, error) {
+	if bodyNum == -1 {
+		return protocol.NewNullBulkReply(), nil
+	}
+
 	// lines最终保存的解析出来的结果
 	lines := make([][]byte, 0, bodyNum)
+	// 包含非字符串元素时，保存到 mixReply 中
+	var mixReply *protocol.MixReply
 	// 解析后序数据
 	for i := int64(0); i < bodyNum; i++ {
 		// 继续读取一行
-		var line []byte
-		line, err = reader.ReadBytes('\n')
+		line, err := reader.ReadBytes('\n')
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// 解析 $5\r\n
 		length := len(line)
-		if length < 4 || line[length-2] != '\r' || line[0] != '$' {
-			protocolError(out, "illegal bulk string header "+string(line))
-			return nil
+		if length < 3 || line[length-2] != '\r' {
+			return nil, protocolErr("illegal bulk string header " + string(line))
 		}
-		// 得到数字 $5中的数字5
-		dataLen, err := strconv.ParseInt(string(line[1:length-2]), 10, 64)
-		if err != nil || dataLen < -1 {
-			protocolError(out, "illegal bulk string length "+string(line))
-			return nil
-		} else if dataLen == -1 { // 这里的-1 表示 Null elements in arrays
-			lines = append(lines, nil)
-		} else {
-			// 基于数字5 读取 5+2 长度的数据，这里的2表示\r\n
-			body := make([]byte, dataLen+2)
-			// 注意：这里直接读取指定长度的字节
-			_, err := io.ReadFull(reader, body)
+
+		var elem protocol.Reply
+		switch line[0] {
+		case '$':
+			// 得到数字 $5中的数字5
+			dataLen, err := strconv.ParseInt(string(line[1:length-2]), 10, 64)
+			if err != nil || dataLen < -1 {
+				return nil, protocolErr("illegal bulk string length " + string(line))
+			} else if dataLen == -1 { // 这里的-1 表示 Null elements in arrays
+				lines = append(lines, nil)
+				elem = protocol.NewNullBulkReply()
+			} else {
+				// 基于数字5 读取 5+2 长度的数据，这里的2表示\r\n
+				body := make([]byte, dataLen+2)
+				// 注意：这里直接读取指定长度的字节
+				_, err := io.ReadFull(reader, body)
+				if err != nil {
+					return nil, err
+				}
+				// 所以最终读取到的是 hello\r\n，去掉\r\n 保存到 lines中
+				lines = append(lines, body[:len(body)-2])
+				elem = protocol.NewBulkReply(body[:len(body)-2])
+			}
+			if mixReply != nil {
+				mixReply.Append(elem)
+			}
+			continue
+		case ':':
+			integer, err := strconv.ParseInt(string(line[1:length-2]), 10, 64)
 			if err != nil {
-				return err
+				return nil, protocolErr("illegal integer " + string(line))
+			}
+			elem = protocol.NewIntegerReply(integer)
+		case '+':
+			elem = protocol.NewSimpleReply(string(line[1 : length-2]))
+		case '-':
+			elem = protocol.NewSimpleErrReply(string(line[1 : length-2]))
+		case '*':
+			num, err := strconv.ParseInt(string(line[1:length-2]), 10, 64)
+			if err != nil || num < -1 {
+				return nil, protocolErr("illegal array header " + string(line))
+			}
+			if elem, err = readArray(num, reader); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, protocolErr("illegal bulk string header " + string(line))
+		}
+
+		// 第一个非字符串元素：之前的字符串元素转移到 mixReply 中
+		if mixReply == nil {
+			mixReply = protocol.NewMixReply()
+			for _, arg := range lines {
+				if arg == nil {
+					mixReply.Append(protocol.NewNullBulkReply())
+				} else {
+					mixReply.Append(protocol.NewBulkReply(arg))
+				}
 			}
-			// 所以最终读取到的是 hello\r\n，去掉\r\n 保存到 lines中
-			lines = append(lines, body[:len(body)-2])
 		}
+		mixReply.Append(elem)
 	}
 
-	out <- &Payload{
-		Err:   nil,
-		Reply: protocol.NewMultiBulkReply(lines),
+	if mixReply != nil {
+		return mixReply, nil
 	}
-	return nil
+	return protocol.NewMultiBulkReply(lines), nil
 }
 
 func protocolError(out chan<- *Payload, msg string) {
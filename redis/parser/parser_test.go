@@ -0,0 +1,37 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gofish2020/easyredis/redis/protocol"
+)
+
+func TestParseReplies(t *testing.T) {
+	data := "*2\r\n$3\r\nget\r\n$1\r\na\r\n" + // 请求
+		":-2\r\n" +
+		"*3\r\n:1\r\n$-1\r\n*2\r\n+OK\r\n-ERR no\r\n" + // 嵌套数组
+		"*-1\r\n"
+	var replies []protocol.Reply
+	for payload := range ParseStream(bytes.NewReader([]byte(data))) {
+		if payload.Err != nil {
+			break
+		}
+		replies = append(replies, payload.Reply)
+	}
+	if len(replies) != 4 {
+		t.Fatalf("expect 4 replies, got %d", len(replies))
+	}
+	if _, ok := replies[0].(*protocol.MultiBulkReply); !ok {
+		t.Fatalf("request should be parsed as multi bulk")
+	}
+	if integer, ok := replies[1].(*protocol.IntegerReply); !ok || integer.Integer != -2 {
+		t.Fatalf("expect integer reply, got %q", replies[1].ToBytes())
+	}
+	if got := string(replies[2].ToBytes()); got != "*3\r\n:1\r\n$-1\r\n*2\r\n+OK\r\n-ERR no\r\n" {
+		t.Fatalf("unexpected nested array %q", got)
+	}
+	if got := string(replies[3].ToBytes()); got != "$-1\r\n" {
+		t.Fatalf("unexpected null array %q", got)
+	}
+}
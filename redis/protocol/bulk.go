@@ -114,3 +114,7 @@ func (m *MixReply) ToBytes() []byte {
 func (m *MixReply) Append(replies ...Reply) {
 	m.replies = append(m.replies, replies...)
 }
+
+func (m *MixReply) Replies() []Reply {
+	return m.replies
+}
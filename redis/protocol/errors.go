@@ -14,7 +14,7 @@ func NewSimpleErrReply(status string) *SimpleErrReply {
 }
 
 func (s *SimpleErrReply) ToBytes() []byte {
-	return []byte("-" + s.Status)
+	return []byte("-" + s.Status + utils.CRLF)
 }
 
 // 一般错误  -ERR xxxxx
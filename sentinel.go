@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gofish2020/easyredis/redis"
+	"github.com/gofish2020/easyredis/sentinel"
+	"github.com/gofish2020/easyredis/tcpserver"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+哨兵模式（监控主从节点，自动故障转移）：
+
+	easyredis sentinel -conf sentinel.conf
+*/
+
+func runSentinel(args []string) int {
+	flagSet := flag.NewFlagSet("sentinel", flag.ExitOnError)
+	configFileName := flagSet.String("conf", "", "Usage: -conf=./sentinel.conf")
+	flagSet.Parse(args)
+
+	if *configFileName == "" {
+		*configFileName = utils.ExecDir() + "/sentinel.conf"
+	}
+	if !utils.FileExists(*configFileName) {
+		fmt.Fprintln(os.Stderr, "sentinel config file not found: "+*configFileName)
+		return 1
+	}
+	conf.LoadConfig(*configFileName)
+
+	println(utils.Logo())
+	initLogger()
+	logger.Info("start easyredis sentinel")
+
+	s, err := sentinel.NewSentinel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	tcp := tcpserver.NewTCPServer(tcpserver.TCPConfig{
+		Addr: fmt.Sprintf("%s:%d", conf.GlobalConfig.Bind, conf.GlobalConfig.Port),
+	}, redis.NewRedisHandlerWithEngine(s))
+	if err := tcp.Start(); err != nil {
+		logger.Errorf("%+v", err)
+		s.Close()
+		return 1
+	}
+	tcp.Close()
+	return 0
+}
@@ -0,0 +1,257 @@
+package sentinel
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+/*
+SENTINEL 子命令：
+
+get-master-addr-by-name <name>：当前主节点的地址
+master <name> / masters：主节点的状态
+replicas <name> / slaves <name>：从节点的状态
+sentinels <name>：其他哨兵的状态
+failover <name>：强制故障转移（不需要其他哨兵同意）
+
+哨兵之间使用：
+is-master-down-by-addr <ip> <port> <current_epoch> <runid|*>：询问主节点是否下线，runid不为*时请求投票
+hello <ip:port> <runid> <current_epoch> <name> <master_ip> <master_port> <config_epoch>：同步纪元 & 主节点地址
+
+为了兼容 redis/client 的解析，回复中的数组元素都是字符串
+*/
+
+func (s *Sentinel) execSentinel(args [][]byte) protocol.Reply {
+	subCommand := strings.ToLower(string(args[0]))
+	args = args[1:]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch subCommand {
+	case "get-master-addr-by-name":
+		if len(args) != 1 {
+			return protocol.NewArgNumErrReply("sentinel " + subCommand)
+		}
+		if string(args[0]) != s.name {
+			return protocol.NewNullBulkReply()
+		}
+		return protocol.NewMultiBulkReply(utils.ToCmdLine(s.master.host(), strconv.Itoa(s.master.port())))
+	case "master", "masters":
+		if subCommand == "master" && (len(args) != 1 || string(args[0]) != s.name) {
+			return protocol.NewGenericErrReply("No such master with that name")
+		}
+		reply := s.instanceReply(s.master)
+		if subCommand == "masters" {
+			result := protocol.NewMixReply()
+			result.Append(reply)
+			return result
+		}
+		return reply
+	case "replicas", "slaves", "sentinels":
+		if len(args) != 1 || string(args[0]) != s.name {
+			return protocol.NewGenericErrReply("No such master with that name")
+		}
+		instances := s.replicas
+		if subCommand == "sentinels" {
+			instances = s.sentinels
+		}
+		result := protocol.NewMixReply()
+		for _, inst := range instances {
+			result.Append(s.instanceReply(inst))
+		}
+		if len(instances) == 0 {
+			return protocol.NewEmptyMultiBulkReply()
+		}
+		return result
+	case "failover":
+		if len(args) != 1 || string(args[0]) != s.name {
+			return protocol.NewGenericErrReply("No such master with that name")
+		}
+		if s.failoverState != failoverNone {
+			return protocol.NewSimpleErrReply("INPROG Failover already in progress")
+		}
+		if s.selectReplica() == nil {
+			return protocol.NewSimpleErrReply("NOGOODSLAVE No suitable replica to promote")
+		}
+		s.failoverForced = true
+		return protocol.NewOkReply()
+	case "is-master-down-by-addr":
+		if len(args) != 4 {
+			return protocol.NewArgNumErrReply("sentinel " + subCommand)
+		}
+		epoch, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return protocol.NewGenericErrReply("value is not an integer or out of range")
+		}
+		down := "0"
+		if net.JoinHostPort(string(args[0]), string(args[1])) == s.master.addr && s.master.sdown {
+			down = "1"
+		}
+		leader, leaderEpoch := "*", int64(0)
+		if runID := string(args[3]); runID != "*" {
+			leader, leaderEpoch = s.vote(runID, epoch)
+		}
+		return protocol.NewMultiBulkReply(utils.ToCmdLine(down, leader, strconv.FormatInt(leaderEpoch, 10)))
+	case "hello":
+		if len(args) != 7 {
+			return protocol.NewArgNumErrReply("sentinel " + subCommand)
+		}
+		return s.handleHello(args)
+	}
+	return protocol.NewGenericErrReply("unknown sentinel subcommand '" + subCommand + "'")
+}
+
+// 实例的状态（字段名 字段值 ...）
+func (s *Sentinel) instanceReply(inst *instance) protocol.Reply {
+	flags := []string{inst.kind}
+	if inst.sdown {
+		flags = append(flags, "s_down")
+	}
+	if inst == s.master && s.odown {
+		flags = append(flags, "o_down")
+	}
+	if inst == s.master && s.failoverState != failoverNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	if inst == s.promoted {
+		flags = append(flags, "promoted")
+	}
+	lastOkPing := int64(-1)
+	if !inst.lastOkPing.IsZero() {
+		lastOkPing = time.Since(inst.lastOkPing).Milliseconds()
+	}
+
+	fields := []string{
+		"name", inst.addr,
+		"ip", inst.host(),
+		"port", strconv.Itoa(inst.port()),
+		"runid", inst.runID,
+		"flags", strings.Join(flags, ","),
+		"last-ok-ping-reply", strconv.FormatInt(lastOkPing, 10),
+	}
+	switch inst.kind {
+	case kindMaster:
+		fields[1] = s.name
+		fields = append(fields,
+			"role-reported", inst.role,
+			"config-epoch", strconv.FormatInt(s.configEpoch, 10),
+			"num-slaves", strconv.Itoa(len(s.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(s.sentinels)),
+			"quorum", strconv.Itoa(s.quorum),
+			"down-after-milliseconds", strconv.FormatInt(s.downAfter.Milliseconds(), 10),
+			"failover-timeout", strconv.FormatInt(s.failoverTimeout.Milliseconds(), 10),
+		)
+	case kindReplica:
+		linkStatus := "err"
+		if inst.masterLinkUp {
+			linkStatus = "ok"
+		}
+		fields = append(fields,
+			"role-reported", inst.role,
+			"master-host", inst.masterHost,
+			"master-port", strconv.Itoa(inst.masterPort),
+			"master-link-status", linkStatus,
+			"slave-priority", strconv.Itoa(inst.priority),
+			"slave-repl-offset", strconv.FormatInt(inst.replOffset, 10),
+		)
+	case kindSentinel:
+		fields = append(fields,
+			"leader", inst.leader,
+			"leader-epoch", strconv.FormatInt(inst.leaderEpoch, 10),
+		)
+	}
+	return protocol.NewMultiBulkReply(utils.ToCmdLine(fields[0], fields[1:]...))
+}
+
+// 询问其他哨兵：主节点是否下线（等待选举结果时，同时请求投票）
+func (s *Sentinel) askMasterState(peer *instance) {
+	s.mu.Lock()
+	runID := "*"
+	if s.failoverState == failoverWaitStart {
+		runID = s.runID
+	}
+	cmdLine := utils.ToCmdLine("sentinel", "is-master-down-by-addr", s.master.host(), strconv.Itoa(s.master.port()),
+		strconv.FormatInt(s.currentEpoch, 10), runID)
+	s.mu.Unlock()
+
+	reply, err := peer.send(cmdLine)
+	if err != nil {
+		logger.Debugf("ask sentinel %s err: %v", peer.addr, err)
+		return
+	}
+	result, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(result.RedisCommand) != 3 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer.masterDown = string(result.RedisCommand[0]) == "1"
+	peer.downReplyTime = time.Now()
+	if leader := string(result.RedisCommand[1]); leader != "*" {
+		leaderEpoch, _ := strconv.ParseInt(string(result.RedisCommand[2]), 10, 64)
+		if leaderEpoch > peer.leaderEpoch || peer.leader != leader {
+			logger.Infof("sentinel %s voted for %s %d", peer.addr, leader, leaderEpoch)
+		}
+		peer.leader = leader
+		peer.leaderEpoch = leaderEpoch
+	}
+}
+
+// 发送hello：自身的地址 & 纪元，以及主节点的地址 & 配置纪元
+func (s *Sentinel) sendHello(peer *instance) {
+	s.mu.Lock()
+	cmdLine := utils.ToCmdLine("sentinel", "hello", s.addr, s.runID, strconv.FormatInt(s.currentEpoch, 10),
+		s.name, s.master.host(), strconv.Itoa(s.master.port()), strconv.FormatInt(s.configEpoch, 10))
+	s.mu.Unlock()
+
+	if _, err := peer.send(cmdLine); err != nil {
+		logger.Debugf("hello sentinel %s err: %v", peer.addr, err)
+	}
+}
+
+// 收到hello：发现新的哨兵，更新纪元；配置纪元更大时，切换主节点（调用方持有s.mu）
+func (s *Sentinel) handleHello(args [][]byte) protocol.Reply {
+	addr, runID := string(args[0]), string(args[1])
+	currentEpoch, err1 := strconv.ParseInt(string(args[2]), 10, 64)
+	configEpoch, err2 := strconv.ParseInt(string(args[6]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return protocol.NewGenericErrReply("value is not an integer or out of range")
+	}
+
+	if addr != s.addr {
+		peer, ok := s.sentinels[addr]
+		if !ok {
+			peer = newInstance(kindSentinel, addr, "")
+			s.sentinels[addr] = peer
+			logger.Infof("+sentinel %s %s @ %s %s", addr, runID, s.name, s.master.addr)
+		}
+		peer.runID = runID
+	}
+	if currentEpoch > s.currentEpoch {
+		s.currentEpoch = currentEpoch
+		logger.Infof("+new-epoch %d", currentEpoch)
+	}
+
+	masterAddr := net.JoinHostPort(string(args[4]), string(args[5]))
+	if string(args[3]) == s.name && configEpoch > s.configEpoch {
+		s.configEpoch = configEpoch
+		if masterAddr != s.master.addr {
+			// 其他哨兵已经完成故障转移
+			if s.failoverState != failoverNone {
+				logger.Warnf("-failover-abort master %s %s, config updated by sentinel %s", s.name, s.master.addr, addr)
+				s.failoverState = failoverNone
+				s.promoted = nil
+			}
+			s.switchMaster(masterAddr)
+		}
+	}
+	return protocol.NewOkReply()
+}
@@ -0,0 +1,353 @@
+package sentinel
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/logger"
+	"github.com/gofish2020/easyredis/utils"
+)
+
+// 主观下线：超过 down-after-milliseconds 没有正常回复PING
+func (s *Sentinel) checkSubjectivelyDown(inst *instance, now time.Time) {
+	lastOk := inst.lastOkPing
+	if lastOk.IsZero() {
+		lastOk = inst.createdTime
+	}
+	down := now.Sub(lastOk) > s.downAfter
+	if down && !inst.sdown {
+		inst.sdown = true
+		inst.sdownSince = now
+		logger.Warnf("+sdown %s %s", inst.kind, inst.addr)
+	} else if !down && inst.sdown {
+		inst.sdown = false
+		logger.Infof("-sdown %s %s", inst.kind, inst.addr)
+	}
+}
+
+// 客观下线：包括自己在内，有quorum个哨兵认为主节点下线
+func (s *Sentinel) checkObjectivelyDown(now time.Time) {
+	odown := false
+	if s.master.sdown {
+		count := 1
+		for _, peer := range s.sentinels {
+			if peer.masterDown && now.Sub(peer.downReplyTime) < downReplyTTL {
+				count++
+			}
+		}
+		odown = count >= s.quorum
+	}
+	if odown && !s.odown {
+		s.odown = true
+		s.odownSince = now
+		logger.Warnf("+odown master %s %s #quorum %d", s.name, s.master.addr, s.quorum)
+	} else if !odown && s.odown {
+		s.odown = false
+		logger.Infof("-odown master %s %s", s.name, s.master.addr)
+	}
+}
+
+// 获取INFO，更新实例的角色 & 复制信息，从主节点的INFO中发现从节点
+func (s *Sentinel) refreshInfo(inst *instance) {
+	reply, err := inst.send([][]byte{[]byte("info")})
+	if err != nil {
+		logger.Debugf("info %s %s err: %v", inst.kind, inst.addr, err)
+		return
+	}
+	bulk, ok := reply.(*protocol.BulkReply)
+	if !ok {
+		return
+	}
+	fields := parseInfo(string(bulk.Arg))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.updateRole(inst, fields, now)
+
+	// 主节点的从节点列表
+	if inst == s.master && inst.role == kindMaster {
+		for _, addr := range parseReplicaAddrs(fields) {
+			if _, ok := s.replicas[addr]; !ok && addr != s.master.addr {
+				s.replicas[addr] = newInstance(kindReplica, addr, s.authPass)
+				logger.Infof("+slave %s %s @ %s %s", kindReplica, addr, s.name, s.master.addr)
+			}
+		}
+	}
+
+	if inst.kind == kindReplica {
+		s.fixReplicaConfig(inst, now)
+	}
+}
+
+func (s *Sentinel) updateRole(inst *instance, fields map[string]string, now time.Time) {
+	role := fields["role"]
+	masterHost := fields["master_host"]
+	masterPort, _ := strconv.Atoi(fields["master_port"])
+	if inst.role != role || inst.masterHost != masterHost || inst.masterPort != masterPort {
+		if inst.role != "" {
+			logger.Infof("%s %s role changed: %s -> %s %s", inst.kind, inst.addr, inst.role, role, net.JoinHostPort(masterHost, fields["master_port"]))
+		}
+		inst.roleChangedAt = now
+	}
+	inst.runID = fields["run_id"]
+	inst.role = role
+	inst.masterHost = masterHost
+	inst.masterPort = masterPort
+	inst.masterLinkUp = fields["master_link_status"] == "up"
+	inst.replOffset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	inst.priority = defaultPriority
+	if priority, err := strconv.Atoi(fields["slave_priority"]); err == nil {
+		inst.priority = priority
+	}
+	inst.infoRefresh = now
+}
+
+// 修正从节点的配置：从节点的角色为主节点（例如：恢复后的原主节点），or 复制的不是当前的主节点
+// 角色刚刚发生变化时，可能是其他哨兵的故障转移（还没有收到hello），等待一段时间再修正
+func (s *Sentinel) fixReplicaConfig(inst *instance, now time.Time) {
+	if s.failoverState != failoverNone || s.master.sdown || inst.sdown {
+		return
+	}
+	if inst.role == kindReplica && net.JoinHostPort(inst.masterHost, strconv.Itoa(inst.masterPort)) == s.master.addr {
+		return
+	}
+	if now.Sub(inst.roleChangedAt) < 4*helloPeriod || now.Sub(inst.lastReconf) < 4*helloPeriod {
+		return
+	}
+	inst.lastReconf = now
+	if inst.role == kindMaster {
+		logger.Infof("+convert-to-slave %s %s @ %s %s", inst.kind, inst.addr, s.name, s.master.addr)
+	} else {
+		logger.Infof("+fix-slave-config %s %s @ %s %s", inst.kind, inst.addr, s.name, s.master.addr)
+	}
+	masterHost, masterPort := s.master.host(), strconv.Itoa(s.master.port())
+	go func() {
+		if _, err := inst.send(utils.ToCmdLine("replicaof", masterHost, masterPort)); err != nil {
+			logger.Warnf("replicaof %s %s to %s err: %v", masterHost, masterPort, inst.addr, err)
+		}
+	}()
+}
+
+// 投票：每个纪元只投票一次（先到先得），返回投票的结果
+func (s *Sentinel) vote(runID string, epoch int64) (string, int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		logger.Infof("+new-epoch %d", epoch)
+	}
+	if s.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		s.leader = runID
+		s.leaderEpoch = epoch
+		logger.Infof("+vote-for-leader %s %d", runID, epoch)
+		// 投票给其他哨兵，一段时间内不发起故障转移
+		if runID != s.runID {
+			s.failoverStartTime = time.Now().Add(time.Duration(rand.Intn(maxDesync)) * time.Millisecond)
+		}
+	}
+	return s.leader, s.leaderEpoch
+}
+
+// 统计纪元epoch的投票结果，返回得票最多的哨兵，以及票数
+func (s *Sentinel) electedLeader(epoch int64) (string, int) {
+	votes := make(map[string]int)
+	if s.leaderEpoch == epoch && s.leader != "" {
+		votes[s.leader]++
+	}
+	for _, peer := range s.sentinels {
+		if peer.leaderEpoch == epoch && peer.leader != "" && peer.leader != "*" {
+			votes[peer.leader]++
+		}
+	}
+	winner, most := "", 0
+	for runID, count := range votes {
+		if count > most || (count == most && runID < winner) {
+			winner, most = runID, count
+		}
+	}
+	return winner, most
+}
+
+func (s *Sentinel) failoverStateMachine(now time.Time) {
+	switch s.failoverState {
+	case failoverNone:
+		// 上次故障转移开始后的 2*failover-timeout 内，不再发起
+		if !s.failoverForced && (!s.odown || now.Sub(s.failoverStartTime) < 2*s.failoverTimeout) {
+			return
+		}
+		s.currentEpoch++
+		s.failoverEpoch = s.currentEpoch
+		s.failoverStartTime = now.Add(time.Duration(rand.Intn(maxDesync)) * time.Millisecond)
+		logger.Infof("+new-epoch %d", s.currentEpoch)
+		logger.Infof("+try-failover master %s %s", s.name, s.master.addr)
+		if s.failoverForced {
+			// 强制故障转移，不需要选举
+			s.failoverForced = false
+			s.startFailover()
+			return
+		}
+		s.failoverState = failoverWaitStart
+		s.vote(s.runID, s.failoverEpoch)
+		// 立即请求其他哨兵投票
+		for _, peer := range s.sentinels {
+			peer.lastAskSent = now
+			s.async(&peer.asking, peer, s.askMasterState)
+		}
+	case failoverWaitStart:
+		winner, votes := s.electedLeader(s.failoverEpoch)
+		// 需要多数哨兵的投票，并且不少于quorum
+		required := (len(s.sentinels)+1)/2 + 1
+		if required < s.quorum {
+			required = s.quorum
+		}
+		if winner == s.runID && votes >= required {
+			logger.Infof("+elected-leader master %s %s epoch %d votes %d", s.name, s.master.addr, s.failoverEpoch, votes)
+			s.startFailover()
+			return
+		}
+		electionTimeout := s.failoverTimeout
+		if electionTimeout > electionLimit {
+			electionTimeout = electionLimit
+		}
+		if now.Sub(s.failoverStartTime) > electionTimeout {
+			logger.Warnf("-failover-abort-not-elected master %s %s epoch %d", s.name, s.master.addr, s.failoverEpoch)
+			s.failoverState = failoverNone
+		}
+	}
+}
+
+// 选择最优的从节点，开始故障转移
+func (s *Sentinel) startFailover() {
+	promoted := s.selectReplica()
+	if promoted == nil {
+		logger.Warnf("-failover-abort-no-good-slave master %s %s", s.name, s.master.addr)
+		s.failoverState = failoverNone
+		return
+	}
+	logger.Infof("+selected-slave %s %s @ %s %s", promoted.kind, promoted.addr, s.name, s.master.addr)
+	s.failoverState = failoverInProgress
+	s.promoted = promoted
+	go s.failover(s.failoverEpoch, promoted)
+}
+
+// 最优的从节点：没有下线，INFO及时更新，优先级不为0；优先级最小，复制偏移量最大（相同时，runid较小）
+func (s *Sentinel) selectReplica() *instance {
+	now := time.Now()
+	var candidates []*instance
+	for _, inst := range s.replicas {
+		if inst.sdown || inst.role != kindReplica || inst.priority == 0 || now.Sub(inst.infoRefresh) > 5*infoPeriod {
+			continue
+		}
+		candidates = append(candidates, inst)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority < candidates[j].priority
+		}
+		if candidates[i].replOffset != candidates[j].replOffset {
+			return candidates[i].replOffset > candidates[j].replOffset
+		}
+		return candidates[i].runID < candidates[j].runID
+	})
+	return candidates[0]
+}
+
+// 领头哨兵执行故障转移：提升从节点 -> 等待成为主节点 -> 切换主节点 -> 其他从节点复制新的主节点
+func (s *Sentinel) failover(epoch int64, promoted *instance) {
+	abort := func(reason string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		logger.Warnf("-failover-abort-%s master %s %s epoch %d", reason, s.name, s.master.addr, epoch)
+		if s.failoverEpoch == epoch && s.failoverState == failoverInProgress {
+			s.failoverState = failoverNone
+			s.promoted = nil
+		}
+	}
+
+	//1.提升为主节点
+	logger.Infof("+failover-state-send-slaveof-noone %s %s", promoted.kind, promoted.addr)
+	if _, err := promoted.send(utils.ToCmdLine("replicaof", "no", "one")); err != nil {
+		logger.Warnf("replicaof no one to %s err: %v", promoted.addr, err)
+		abort("slaveof-noone-failed")
+		return
+	}
+
+	//2.等待角色变为主节点
+	deadline := time.Now().Add(s.failoverTimeout)
+	for {
+		reply, err := promoted.send([][]byte{[]byte("info"), []byte("replication")})
+		if bulk, ok := reply.(*protocol.BulkReply); ok && err == nil && parseInfo(string(bulk.Arg))["role"] == kindMaster {
+			break
+		}
+		if time.Now().After(deadline) {
+			abort("timeout")
+			return
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-s.closed:
+			return
+		}
+	}
+	logger.Infof("+promoted-slave %s %s", promoted.kind, promoted.addr)
+
+	//3.切换主节点
+	s.mu.Lock()
+	if s.failoverEpoch != epoch || s.failoverState != failoverInProgress {
+		// 收到其他哨兵更新的配置，放弃本次故障转移
+		s.mu.Unlock()
+		return
+	}
+	s.configEpoch = epoch
+	s.switchMaster(promoted.addr)
+	s.failoverState = failoverNone
+	s.promoted = nil
+	masterHost, masterPort := promoted.host(), strconv.Itoa(promoted.port())
+	replicas := make([]*instance, 0, len(s.replicas))
+	for _, inst := range s.replicas {
+		replicas = append(replicas, inst)
+		inst.lastReconf = time.Now()
+	}
+	// 立即通知其他哨兵
+	for _, peer := range s.sentinels {
+		peer.lastHelloSent = time.Now()
+		s.async(&peer.greeting, peer, s.sendHello)
+	}
+	s.mu.Unlock()
+
+	//4.其他从节点复制新的主节点（原主节点恢复后，在INFO中发现并修正）
+	for _, inst := range replicas {
+		if _, err := inst.send(utils.ToCmdLine("replicaof", masterHost, masterPort)); err != nil {
+			logger.Warnf("-slave-reconf %s %s err: %v", inst.kind, inst.addr, err)
+			continue
+		}
+		logger.Infof("+slave-reconf-sent %s %s", inst.kind, inst.addr)
+	}
+	logger.Infof("+failover-end master %s %s", s.name, masterHost+":"+masterPort)
+}
+
+// 切换主节点地址：原主节点 & 其他从节点，都作为新主节点的从节点（调用方持有s.mu）
+func (s *Sentinel) switchMaster(addr string) {
+	oldMaster := s.master
+	logger.Infof("+switch-master %s %s %s", s.name, oldMaster.addr, addr)
+
+	newMaster, ok := s.replicas[addr]
+	if ok {
+		delete(s.replicas, addr)
+	} else {
+		newMaster = newInstance(kindMaster, addr, s.authPass)
+	}
+	newMaster.kind = kindMaster
+	newMaster.sdown = false
+
+	oldMaster.kind = kindReplica
+	s.replicas[oldMaster.addr] = oldMaster
+	s.master = newMaster
+	s.odown = false
+}
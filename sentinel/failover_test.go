@@ -0,0 +1,372 @@
+package sentinel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 不启动定时任务的哨兵：节点地址都不可连接（127.0.0.1:1）
+func newTestSentinel(quorum int, peers int) *Sentinel {
+	s := &Sentinel{
+		runID:           "self",
+		addr:            "127.0.0.1:26379",
+		name:            "mymaster",
+		quorum:          quorum,
+		downAfter:       time.Second,
+		failoverTimeout: 3 * time.Second,
+		replicas:        make(map[string]*instance),
+		sentinels:       make(map[string]*instance),
+		failoverState:   failoverNone,
+		closed:          make(chan struct{}),
+	}
+	s.master = newInstance(kindMaster, "127.0.0.1:1", "")
+	for i := 0; i < peers; i++ {
+		peer := newInstance(kindSentinel, fmt.Sprintf("127.0.0.2:%d", 26380+i), "")
+		peer.runID = fmt.Sprintf("peer%d", i)
+		// 不发送请求（询问 / hello）
+		peer.asking.Store(true)
+		peer.greeting.Store(true)
+		s.sentinels[peer.addr] = peer
+	}
+	return s
+}
+
+func addReplica(s *Sentinel, addr string, runID string, priority int, offset int64) *instance {
+	inst := newInstance(kindReplica, addr, "")
+	inst.runID = runID
+	inst.role = kindReplica
+	inst.priority = priority
+	inst.replOffset = offset
+	inst.infoRefresh = time.Now()
+	s.replicas[addr] = inst
+	return inst
+}
+
+func TestSubjectivelyDown(t *testing.T) {
+	s := newTestSentinel(1, 0)
+	now := time.Now()
+
+	// 从未回复PING：从创建时开始计算
+	s.master.createdTime = now
+	s.checkSubjectivelyDown(s.master, now.Add(500*time.Millisecond))
+	if s.master.sdown {
+		t.Fatal("master should not be sdown before down-after-milliseconds")
+	}
+	s.checkSubjectivelyDown(s.master, now.Add(1500*time.Millisecond))
+	if !s.master.sdown {
+		t.Fatal("master should be sdown after down-after-milliseconds")
+	}
+
+	// 恢复
+	s.master.lastOkPing = now.Add(1400 * time.Millisecond)
+	s.checkSubjectivelyDown(s.master, now.Add(1500*time.Millisecond))
+	if s.master.sdown {
+		t.Fatal("master should recover after ping reply")
+	}
+}
+
+func TestObjectivelyDown(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		quorum int
+		sdown  bool
+		votes  []time.Time // 认为主节点下线的哨兵的回复时间
+		odown  bool
+	}{
+		{name: "quorum 1", quorum: 1, sdown: true, odown: true},
+		{name: "not sdown", quorum: 1, sdown: false, votes: []time.Time{now}, odown: false},
+		{name: "quorum 2 self only", quorum: 2, sdown: true, odown: false},
+		{name: "quorum 2", quorum: 2, sdown: true, votes: []time.Time{now}, odown: true},
+		{name: "quorum 3", quorum: 3, sdown: true, votes: []time.Time{now}, odown: false},
+		{name: "expired reply", quorum: 2, sdown: true, votes: []time.Time{now.Add(-downReplyTTL - time.Second)}, odown: false},
+	}
+	for _, tt := range tests {
+		s := newTestSentinel(tt.quorum, 3)
+		s.master.sdown = tt.sdown
+		i := 0
+		for _, peer := range s.sentinels {
+			if i < len(tt.votes) {
+				peer.masterDown = true
+				peer.downReplyTime = tt.votes[i]
+			}
+			i++
+		}
+		s.checkObjectivelyDown(now)
+		if s.odown != tt.odown {
+			t.Fatalf("%s: expect odown %v", tt.name, tt.odown)
+		}
+	}
+
+	// 主节点恢复后，不再客观下线
+	s := newTestSentinel(1, 0)
+	s.master.sdown = true
+	s.checkObjectivelyDown(now)
+	s.master.sdown = false
+	s.checkObjectivelyDown(now)
+	if s.odown {
+		t.Fatal("odown should be cleared")
+	}
+}
+
+// 每个纪元只投票一次（先到先得）
+func TestVote(t *testing.T) {
+	s := newTestSentinel(2, 2)
+	steps := []struct {
+		runID  string
+		epoch  int64
+		leader string
+		lepoch int64
+	}{
+		{"peer0", 1, "peer0", 1},
+		{"peer1", 1, "peer0", 1}, // 已经投票
+		{"self", 1, "peer0", 1},
+		{"peer1", 2, "peer1", 2}, // 新的纪元
+		{"peer0", 1, "peer1", 2}, // 过期的纪元
+	}
+	for i, step := range steps {
+		leader, epoch := s.vote(step.runID, step.epoch)
+		if leader != step.leader || epoch != step.lepoch {
+			t.Fatalf("step %d: expect %s %d, got %s %d", i, step.leader, step.lepoch, leader, epoch)
+		}
+	}
+	if s.currentEpoch != 2 {
+		t.Fatalf("expect current epoch 2, got %d", s.currentEpoch)
+	}
+	// 投票给其他哨兵后，一段时间内不发起故障转移
+	if !s.failoverStartTime.After(time.Now().Add(-time.Second)) {
+		t.Fatal("failover start time should be updated after voting for another sentinel")
+	}
+
+	// 通过命令投票
+	reply := string(s.Exec(nil, [][]byte{[]byte("sentinel"), []byte("is-master-down-by-addr"), []byte("127.0.0.1"), []byte("1"), []byte("3"), []byte("peer0")}).ToBytes())
+	if reply != "*3\r\n$1\r\n0\r\n$5\r\npeer0\r\n$1\r\n3\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	reply = string(s.Exec(nil, [][]byte{[]byte("sentinel"), []byte("is-master-down-by-addr"), []byte("127.0.0.1"), []byte("1"), []byte("3"), []byte("peer1")}).ToBytes())
+	if reply != "*3\r\n$1\r\n0\r\n$5\r\npeer0\r\n$1\r\n3\r\n" {
+		t.Fatalf("should vote only once per epoch, got %q", reply)
+	}
+}
+
+func TestElectedLeader(t *testing.T) {
+	s := newTestSentinel(2, 4)
+	s.vote("self", 5)
+	votes := map[string]struct {
+		leader string
+		epoch  int64
+	}{
+		"peer0": {"self", 5},
+		"peer1": {"peer1", 5},
+		"peer2": {"self", 4}, // 其他纪元的投票
+		"peer3": {"*", 5},    // 没有投票
+	}
+	for _, peer := range s.sentinels {
+		vote := votes[peer.runID]
+		peer.leader, peer.leaderEpoch = vote.leader, vote.epoch
+	}
+	if winner, count := s.electedLeader(5); winner != "self" || count != 2 {
+		t.Fatalf("expect self 2, got %s %d", winner, count)
+	}
+	// 票数相同时，runid较小的胜出
+	for _, peer := range s.sentinels {
+		if peer.runID == "peer0" {
+			peer.leader = "peer1"
+		}
+	}
+	if winner, count := s.electedLeader(5); winner != "peer1" || count != 2 {
+		t.Fatalf("expect peer1 2, got %s %d", winner, count)
+	}
+	if winner, count := s.electedLeader(6); winner != "" || count != 0 {
+		t.Fatalf("expect no votes, got %s %d", winner, count)
+	}
+}
+
+func TestSelectReplica(t *testing.T) {
+	type replica struct {
+		runID    string
+		priority int
+		offset   int64
+	}
+	tests := []struct {
+		name     string
+		replicas []replica
+		selected string
+	}{
+		{"no replicas", nil, ""},
+		{"priority", []replica{{"a", 100, 100}, {"b", 10, 50}, {"c", 50, 200}}, "b"},
+		{"offset", []replica{{"a", 100, 100}, {"b", 100, 300}, {"c", 100, 200}}, "b"},
+		{"runid", []replica{{"c", 100, 100}, {"a", 100, 100}, {"b", 100, 100}}, "a"},
+		{"priority 0", []replica{{"a", 0, 300}, {"b", 100, 100}}, "b"},
+		{"all priority 0", []replica{{"a", 0, 300}}, ""},
+	}
+	for _, tt := range tests {
+		s := newTestSentinel(1, 0)
+		for i, r := range tt.replicas {
+			addReplica(s, fmt.Sprintf("127.0.0.1:%d", 6380+i), r.runID, r.priority, r.offset)
+		}
+		selected := ""
+		if inst := s.selectReplica(); inst != nil {
+			selected = inst.runID
+		}
+		if selected != tt.selected {
+			t.Fatalf("%s: expect %q, got %q", tt.name, tt.selected, selected)
+		}
+	}
+
+	// 下线、角色不是从节点、INFO过期的从节点不能选择
+	s := newTestSentinel(1, 0)
+	addReplica(s, "127.0.0.1:6380", "a", 100, 100).sdown = true
+	addReplica(s, "127.0.0.1:6381", "b", 100, 100).role = kindMaster
+	addReplica(s, "127.0.0.1:6382", "c", 100, 100).infoRefresh = time.Now().Add(-6 * infoPeriod)
+	if inst := s.selectReplica(); inst != nil {
+		t.Fatalf("expect no replica, got %s", inst.runID)
+	}
+	addReplica(s, "127.0.0.1:6383", "d", 100, 0)
+	if inst := s.selectReplica(); inst == nil || inst.runID != "d" {
+		t.Fatal("expect replica d")
+	}
+}
+
+func TestUpdatePriority(t *testing.T) {
+	s := newTestSentinel(1, 0)
+	inst := addReplica(s, "127.0.0.1:6380", "a", 100, 0)
+	s.updateRole(inst, parseInfo("role:slave\r\nslave_priority:0\r\nslave_repl_offset:10\r\n"), time.Now())
+	if inst.priority != 0 || inst.replOffset != 10 {
+		t.Fatalf("unexpected priority %d offset %d", inst.priority, inst.replOffset)
+	}
+	s.updateRole(inst, parseInfo("role:slave\r\n"), time.Now())
+	if inst.priority != defaultPriority {
+		t.Fatalf("expect default priority, got %d", inst.priority)
+	}
+}
+
+func TestFailoverStateMachine(t *testing.T) {
+	// 5个哨兵：需要3票（多数），quorum 2
+	s := newTestSentinel(2, 4)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+
+	// 没有客观下线
+	s.failoverStateMachine(now)
+	if s.failoverState != failoverNone || s.currentEpoch != 0 {
+		t.Fatalf("unexpected state %s epoch %d", s.failoverState, s.currentEpoch)
+	}
+
+	// 客观下线：新的纪元，投票给自己，等待选举结果
+	s.odown = true
+	s.failoverStateMachine(now)
+	if s.failoverState != failoverWaitStart || s.failoverEpoch != 1 || s.leader != "self" || s.leaderEpoch != 1 {
+		t.Fatalf("unexpected state %s epoch %d leader %s %d", s.failoverState, s.failoverEpoch, s.leader, s.leaderEpoch)
+	}
+	// 2票：没有达到多数
+	peers := make([]*instance, 0, len(s.sentinels))
+	for _, peer := range s.sentinels {
+		peers = append(peers, peer)
+	}
+	peers[0].leader, peers[0].leaderEpoch = "self", 1
+	peers[1].leader, peers[1].leaderEpoch = "peer1", 1
+	s.failoverStateMachine(now)
+	if s.failoverState != failoverWaitStart {
+		t.Fatalf("2 votes should not be elected, state %s", s.failoverState)
+	}
+	// 选举超时
+	s.failoverStateMachine(s.failoverStartTime.Add(s.failoverTimeout + time.Millisecond))
+	if s.failoverState != failoverNone {
+		t.Fatalf("election should time out, state %s", s.failoverState)
+	}
+	// 上次故障转移开始后的 2*failover-timeout 内不再发起
+	s.failoverStateMachine(s.failoverStartTime.Add(time.Second))
+	if s.failoverState != failoverNone || s.currentEpoch != 1 {
+		t.Fatalf("failover should not restart, state %s epoch %d", s.failoverState, s.currentEpoch)
+	}
+
+	// 新的纪元，3票当选，但是没有可用的从节点
+	now = s.failoverStartTime.Add(2*s.failoverTimeout + time.Millisecond)
+	s.failoverStateMachine(now)
+	if s.failoverState != failoverWaitStart || s.failoverEpoch != 2 {
+		t.Fatalf("unexpected state %s epoch %d", s.failoverState, s.failoverEpoch)
+	}
+	for _, peer := range peers[:2] {
+		peer.leader, peer.leaderEpoch = "self", 2
+	}
+	s.failoverStateMachine(now)
+	if s.failoverState != failoverNone || s.promoted != nil {
+		t.Fatalf("failover without replicas should abort, state %s", s.failoverState)
+	}
+
+	// 有可用的从节点：开始故障转移，提升从节点失败（无法连接）后放弃
+	replica := addReplica(s, "127.0.0.1:1", "r1", 100, 10)
+	now = s.failoverStartTime.Add(2*s.failoverTimeout + time.Millisecond)
+	s.failoverStateMachine(now)
+	for _, peer := range peers[:2] {
+		peer.leader, peer.leaderEpoch = "self", 3
+	}
+	s.failoverStateMachine(now)
+	if s.failoverState != failoverInProgress || s.promoted != replica || s.failoverEpoch != 3 {
+		t.Fatalf("failover should start, state %s", s.failoverState)
+	}
+	s.mu.Unlock()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		s.mu.Lock()
+		state := s.failoverState
+		s.mu.Unlock()
+		if state == failoverNone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failover should abort when the replica is unreachable")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.mu.Lock()
+	if s.promoted != nil || s.master.addr != "127.0.0.1:1" || s.configEpoch != 0 {
+		t.Fatal("aborted failover should not switch master")
+	}
+}
+
+// quorum 大于多数时，需要quorum票
+func TestFailoverQuorum(t *testing.T) {
+	s := newTestSentinel(3, 2)
+	s.odown = true
+	now := time.Now()
+	s.failoverStateMachine(now)
+	for _, peer := range s.sentinels {
+		peer.leader, peer.leaderEpoch = "self", 1
+		break
+	}
+	// 3个哨兵，2票是多数，但是小于quorum
+	s.failoverStateMachine(now)
+	if s.failoverState != failoverWaitStart {
+		t.Fatalf("votes below quorum should not be elected, state %s", s.failoverState)
+	}
+}
+
+// 强制故障转移（SENTINEL failover）：不需要选举
+func TestForcedFailover(t *testing.T) {
+	s := newTestSentinel(2, 2)
+	reply := string(s.Exec(nil, [][]byte{[]byte("sentinel"), []byte("failover"), []byte("mymaster")}).ToBytes())
+	if reply != "-NOGOODSLAVE No suitable replica to promote\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	// 从节点不可连接：提升失败后放弃，不影响后续的故障转移
+	addReplica(s, "127.0.0.1:1", "r1", 100, 10)
+	reply = string(s.Exec(nil, [][]byte{[]byte("sentinel"), []byte("failover"), []byte("mymaster")}).ToBytes())
+	if reply != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	s.mu.Lock()
+	s.failoverStateMachine(time.Now())
+	state, epoch := s.failoverState, s.failoverEpoch
+	s.mu.Unlock()
+	if state != failoverInProgress || epoch != 1 {
+		t.Fatalf("forced failover should start without election, state %s epoch %d", state, epoch)
+	}
+	reply = string(s.Exec(nil, [][]byte{[]byte("sentinel"), []byte("failover"), []byte("mymaster")}).ToBytes())
+	if reply != "-INPROG Failover already in progress\r\n" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+}
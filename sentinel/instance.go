@@ -0,0 +1,198 @@
+package sentinel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofish2020/easyredis/redis/client"
+	"github.com/gofish2020/easyredis/redis/protocol"
+)
+
+// 实例类型
+const (
+	kindMaster   = "master"
+	kindReplica  = "slave"
+	kindSentinel = "sentinel"
+)
+
+// INFO中没有slave_priority时，使用默认的优先级
+const defaultPriority = 100
+
+// 被监控的实例（主节点 / 从节点 / 其他哨兵），除了客户端以外的字段由 Sentinel.mu 保护
+type instance struct {
+	kind string
+	addr string
+	// 实例的runid（INFO or hello中获取）
+	runID string
+
+	createdTime time.Time
+	// 最后一次正常回复PING的时间
+	lastOkPing   time.Time
+	lastPingSent time.Time
+	// 主观下线
+	sdown      bool
+	sdownSince time.Time
+
+	// INFO（主节点 & 从节点）
+	lastInfoSent time.Time
+	infoRefresh  time.Time
+	role         string
+	masterHost   string
+	masterPort   int
+	masterLinkUp bool
+	replOffset   int64
+	// 从节点的优先级（replica-priority，越小越优先，0表示不能提升为主节点）
+	priority int
+	// 角色（or 从节点的主节点）发生变化的时间
+	roleChangedAt time.Time
+	// 最后一次发送REPLICAOF（修正从节点配置）的时间
+	lastReconf time.Time
+
+	// 其他哨兵：对主节点下线的判断，以及投票结果
+	masterDown    bool
+	downReplyTime time.Time
+	leader        string
+	leaderEpoch   int64
+	lastHelloSent time.Time
+	lastAskSent   time.Time
+
+	// 正在执行的请求（同一类请求，同时只有一个）
+	pinging  atomic.Bool
+	infoing  atomic.Bool
+	asking   atomic.Bool
+	greeting atomic.Bool
+
+	// 连接
+	clientMu sync.Mutex
+	client   *client.RedisClient
+	password string
+}
+
+func newInstance(kind string, addr string, password string) *instance {
+	return &instance{
+		kind:        kind,
+		addr:        addr,
+		password:    password,
+		createdTime: time.Now(),
+		priority:    defaultPriority,
+	}
+}
+
+func (inst *instance) host() string {
+	host, _, _ := net.SplitHostPort(inst.addr)
+	return host
+}
+
+func (inst *instance) port() int {
+	_, port, _ := net.SplitHostPort(inst.addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// 获取连接（断开后重新创建）
+func (inst *instance) getClient() (*client.RedisClient, error) {
+	inst.clientMu.Lock()
+	defer inst.clientMu.Unlock()
+	if inst.client != nil {
+		return inst.client, nil
+	}
+
+	c, err := client.NewRedisClient(inst.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.Start()
+	if inst.password != "" {
+		reply, err := c.Send([][]byte{[]byte("auth"), []byte(inst.password)})
+		if err == nil && protocol.IsErrReply(reply) {
+			err = errors.New(string(reply.ToBytes()))
+		}
+		if err != nil {
+			c.Stop()
+			return nil, err
+		}
+	}
+	inst.client = c
+	return c, nil
+}
+
+// 关闭连接（下次请求时重新创建）
+func (inst *instance) closeClient(c *client.RedisClient) {
+	inst.clientMu.Lock()
+	defer inst.clientMu.Unlock()
+	if c != nil && inst.client == c {
+		inst.client = nil
+		go c.Stop()
+	}
+}
+
+// 发送命令，错误回复也作为error返回
+func (inst *instance) send(cmdLine [][]byte) (protocol.Reply, error) {
+	c, err := inst.getClient()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.Send(cmdLine)
+	if err != nil {
+		inst.closeClient(c)
+		return nil, err
+	}
+	if protocol.IsErrReply(reply) {
+		return reply, errors.New(strings.TrimSpace(string(reply.ToBytes())))
+	}
+	return reply, nil
+}
+
+func (inst *instance) close() {
+	inst.clientMu.Lock()
+	c := inst.client
+	inst.client = nil
+	inst.clientMu.Unlock()
+	if c != nil {
+		go c.Stop()
+	}
+}
+
+// 解析INFO的结果：key -> value
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx <= 0 {
+			continue
+		}
+		fields[line[:idx]] = line[idx+1:]
+	}
+	return fields
+}
+
+// 解析主节点INFO中的从节点地址 slave0:ip=127.0.0.1,port=6380,state=online,...
+func parseReplicaAddrs(fields map[string]string) []string {
+	var addrs []string
+	for i := 0; ; i++ {
+		value, ok := fields["slave"+strconv.Itoa(i)]
+		if !ok {
+			return addrs
+		}
+		var ip, port string
+		for _, kv := range strings.Split(value, ",") {
+			if strings.HasPrefix(kv, "ip=") {
+				ip = strings.TrimPrefix(kv, "ip=")
+			} else if strings.HasPrefix(kv, "port=") {
+				port = strings.TrimPrefix(kv, "port=")
+			}
+		}
+		if ip != "" && port != "" && port != "0" {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+}
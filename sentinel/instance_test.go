@@ -0,0 +1,21 @@
+package sentinel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInfo(t *testing.T) {
+	info := "# Replication\r\nrole:master\r\nconnected_slaves:2\r\n" +
+		"slave0:ip=127.0.0.1,port=6380,state=online,offset=10,lag=0\r\n" +
+		"slave1:ip=127.0.0.1,port=6381,state=online,offset=10,lag=1\r\n" +
+		"master_repl_offset:10\r\n"
+	fields := parseInfo(info)
+	if fields["role"] != "master" || fields["master_repl_offset"] != "10" {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	addrs := parseReplicaAddrs(fields)
+	if !reflect.DeepEqual(addrs, []string{"127.0.0.1:6380", "127.0.0.1:6381"}) {
+		t.Fatalf("unexpected replicas %v", addrs)
+	}
+}
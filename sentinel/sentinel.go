@@ -0,0 +1,285 @@
+package sentinel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofish2020/easyredis/abstract"
+	"github.com/gofish2020/easyredis/engine/payload"
+	"github.com/gofish2020/easyredis/redis/protocol"
+	"github.com/gofish2020/easyredis/tool/conf"
+	"github.com/gofish2020/easyredis/tool/logger"
+)
+
+/*
+哨兵模式：监控一个主节点及其从节点，主节点故障时自动故障转移
+
+1. 每秒向主节点、从节点、其他哨兵发送PING，超过 down-after-milliseconds 没有正常回复，认为主观下线（SDOWN）
+2. 每10秒（主节点下线 or 故障转移中为每秒）向主节点、从节点发送INFO，从主节点的INFO中发现从节点
+3. 主节点主观下线后，每秒询问其他哨兵（SENTINEL is-master-down-by-addr），包括自己在内有quorum个哨兵认为下线，则为客观下线（ODOWN）
+4. 客观下线后，开始故障转移：当前纪元+1，投票给自己，并请求其他哨兵投票（每个纪元只投票一次，先到先得）；
+   获得多数（且不少于quorum）投票的哨兵成为领头哨兵
+5. 领头哨兵选择最优的从节点（复制偏移量最大），发送 REPLICAOF NO ONE 提升为主节点，其他从节点（包括恢复后的原主节点）REPLICAOF 新的主节点
+6. 哨兵之间每2秒发送一次 SENTINEL hello，同步纪元以及主节点的地址（配置纪元较大的为准）
+
+客户端通过 SENTINEL get-master-addr-by-name <name> 获取当前主节点的地址
+*/
+
+const (
+	cronInterval  = 100 * time.Millisecond
+	pingPeriod    = 1 * time.Second
+	infoPeriod    = 10 * time.Second
+	helloPeriod   = 2 * time.Second
+	askPeriod     = 1 * time.Second
+	downReplyTTL  = 5 * askPeriod
+	maxDesync     = 1000 // 故障转移开始时间的随机延迟（毫秒），避免多个哨兵同时发起选举
+	electionLimit = 10 * time.Second
+)
+
+// 故障转移状态
+const (
+	failoverNone       = "none"
+	failoverWaitStart  = "wait_start"  // 等待选举结果
+	failoverInProgress = "in_progress" // 领头哨兵执行故障转移
+)
+
+type Sentinel struct {
+	mu sync.Mutex
+
+	runID string
+	// 自身地址（其他哨兵通过hello获取）
+	addr string
+	// 当前纪元
+	currentEpoch int64
+	// 投票结果（每个纪元只投票一次）
+	leader      string
+	leaderEpoch int64
+
+	// 监控的主节点
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	authPass        string
+	master          *instance
+	// 主节点地址对应的配置纪元（故障转移后更新）
+	configEpoch int64
+	replicas    map[string]*instance
+	odown       bool
+	odownSince  time.Time
+
+	// 故障转移
+	failoverState     string
+	failoverEpoch     int64
+	failoverStartTime time.Time
+	promoted          *instance
+	// 强制故障转移（SENTINEL failover，不需要其他哨兵同意）
+	failoverForced bool
+
+	// 其他哨兵 addr -> *instance
+	sentinels map[string]*instance
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewSentinel() (*Sentinel, error) {
+	cfg := conf.GlobalConfig
+	// mymaster 127.0.0.1 6379 2
+	fields := strings.Fields(cfg.SentinelMonitor)
+	if len(fields) != 4 {
+		return nil, errors.New("invalid sentinel-monitor " + cfg.SentinelMonitor + ", expect: <name> <host> <port> <quorum>")
+	}
+	port, err := strconv.Atoi(fields[2])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New("invalid sentinel-monitor port " + fields[2])
+	}
+	quorum, err := strconv.Atoi(fields[3])
+	if err != nil || quorum <= 0 {
+		return nil, errors.New("invalid sentinel-monitor quorum " + fields[3])
+	}
+
+	host := cfg.Bind
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	s := &Sentinel{
+		runID:           cfg.RunID,
+		addr:            net.JoinHostPort(host, strconv.Itoa(cfg.Port)),
+		name:            fields[0],
+		quorum:          quorum,
+		downAfter:       time.Duration(cfg.SentinelDownAfterMilliseconds) * time.Millisecond,
+		failoverTimeout: time.Duration(cfg.SentinelFailoverTimeout) * time.Millisecond,
+		authPass:        cfg.SentinelAuthPass,
+		replicas:        make(map[string]*instance),
+		sentinels:       make(map[string]*instance),
+		failoverState:   failoverNone,
+		closed:          make(chan struct{}),
+	}
+	s.master = newInstance(kindMaster, net.JoinHostPort(fields[1], fields[2]), s.authPass)
+	for _, peer := range cfg.SentinelPeers {
+		peer = strings.TrimSpace(peer)
+		if peer != "" && peer != s.addr {
+			s.sentinels[peer] = newInstance(kindSentinel, peer, "")
+		}
+	}
+	logger.Infof("+monitor master %s %s quorum %d", s.name, s.master.addr, s.quorum)
+
+	go s.cron()
+	return s, nil
+}
+
+func (s *Sentinel) cron() {
+	ticker := time.NewTicker(cronInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.timer()
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// 定时任务：发送PING/INFO/hello，检测下线，推进故障转移
+func (s *Sentinel) timer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	// 主节点下线 or 故障转移中，每秒获取一次INFO
+	period := infoPeriod
+	if s.master.sdown || s.failoverState != failoverNone {
+		period = time.Second
+	}
+
+	for _, inst := range s.allInstances() {
+		s.checkSubjectivelyDown(inst, now)
+		if now.Sub(inst.lastPingSent) >= pingPeriod {
+			inst.lastPingSent = now
+			s.async(&inst.pinging, inst, s.ping)
+		}
+		if inst.kind != kindSentinel && now.Sub(inst.lastInfoSent) >= period {
+			inst.lastInfoSent = now
+			s.async(&inst.infoing, inst, s.refreshInfo)
+		}
+	}
+
+	for _, peer := range s.sentinels {
+		if now.Sub(peer.lastHelloSent) >= helloPeriod {
+			peer.lastHelloSent = now
+			s.async(&peer.greeting, peer, s.sendHello)
+		}
+		// 主节点主观下线后，询问其他哨兵
+		if s.master.sdown && now.Sub(peer.lastAskSent) >= askPeriod {
+			peer.lastAskSent = now
+			s.async(&peer.asking, peer, s.askMasterState)
+		}
+	}
+
+	s.checkObjectivelyDown(now)
+	s.failoverStateMachine(now)
+}
+
+// 主节点 + 从节点 + 其他哨兵
+func (s *Sentinel) allInstances() []*instance {
+	result := make([]*instance, 0, 1+len(s.replicas)+len(s.sentinels))
+	result = append(result, s.master)
+	for _, inst := range s.replicas {
+		result = append(result, inst)
+	}
+	for _, inst := range s.sentinels {
+		result = append(result, inst)
+	}
+	return result
+}
+
+// 异步执行请求（同一类请求，同时只有一个）
+func (s *Sentinel) async(flag *atomic.Bool, inst *instance, fn func(inst *instance)) {
+	if !flag.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer flag.Store(false)
+		fn(inst)
+	}()
+}
+
+func (s *Sentinel) ping(inst *instance) {
+	_, err := inst.send([][]byte{[]byte("ping")})
+	if err != nil {
+		logger.Debugf("ping %s %s err: %v", inst.kind, inst.addr, err)
+		return
+	}
+	s.mu.Lock()
+	inst.lastOkPing = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *Sentinel) Exec(c abstract.Connection, redisCommand [][]byte) protocol.Reply {
+	commandName := strings.ToLower(string(redisCommand[0]))
+	switch commandName {
+	case "ping":
+		return protocol.NewPONGReply()
+	case "info":
+		return s.execInfo()
+	case "sentinel":
+		if len(redisCommand) < 2 {
+			return protocol.NewArgNumErrReply(commandName)
+		}
+		return s.execSentinel(redisCommand[1:])
+	}
+	return protocol.NewGenericErrReply("unknown command '" + commandName + "'")
+}
+
+// INFO：哨兵的状态
+func (s *Sentinel) execInfo() protocol.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lines := []string{
+		"# Server",
+		"run_id:" + s.runID,
+		fmt.Sprintf("tcp_port:%d", conf.GlobalConfig.Port),
+		"",
+		"# Sentinel",
+		"sentinel_masters:1",
+		fmt.Sprintf("sentinel_current_epoch:%d", s.currentEpoch),
+		fmt.Sprintf("master0:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			s.name, s.masterStatus(), s.master.addr, len(s.replicas), len(s.sentinels)+1),
+	}
+	return protocol.NewBulkReply([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
+
+func (s *Sentinel) masterStatus() string {
+	switch {
+	case s.odown:
+		return "odown"
+	case s.master.sdown:
+		return "sdown"
+	}
+	return "ok"
+}
+
+func (s *Sentinel) ForEach(dbIndex int, cb func(key string, data *payload.DataEntity, expiration *time.Time) bool) {
+}
+
+func (s *Sentinel) AfterClientClose(c abstract.Connection) {
+}
+
+func (s *Sentinel) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, inst := range s.allInstances() {
+			inst.close()
+		}
+	})
+}
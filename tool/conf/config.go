@@ -13,6 +13,8 @@ import (
 
 const runidMaxLen = 40
 const defaultDatabasesNum = 16
+const defaultAppendFilename = "appendonly.aof"
+const defaultAppendDirName = "appendonlydir"
 
 /*
 purpose:读取conf配置文件
@@ -31,27 +33,102 @@ type RedisConfig struct {
 	// aof 相关
 	AppendOnly     bool   `conf:"appendonly"`     // 是否启用aof
 	AppendFilename string `conf:"appendfilename"` // aof文件名
+	AppendDirName  string `conf:"appenddirname"`  // aof目录名（在 Dir 目录下）
 	AppendFsync    string `conf:"appendfsync"`    // aof刷盘间隔
+	// aof重写时，是否以二进制快照作为文件头部（混合持久化）
+	AofUseRdbPreamble bool `conf:"aof-use-rdb-preamble"`
+	// 自动重写：aof文件大小相比上次重写后的增长百分比（0表示关闭自动重写）
+	AutoAofRewritePercentage int `conf:"auto-aof-rewrite-percentage"`
+	// 自动重写：aof文件的最小大小，例如：64mb
+	AutoAofRewriteMinSize string `conf:"auto-aof-rewrite-min-size"`
+	// 启动加载时，如果aof文件尾部不完整，是否截断后继续启动（否则启动失败）
+	AofLoadTruncated bool `conf:"aof-load-truncated"`
+	// 写入命令时，是否在aof中记录时间戳注释（用于按时间点恢复）
+	AofTimestampEnabled bool `conf:"aof-timestamp-enabled"`
 
 	// 服务器密码
 	RequirePass string `conf:"requirepass,omitempty"`
 
+	// 主从复制
+	ReplicaOf             string `conf:"replicaof"`                // 主节点地址，例如：127.0.0.1 6379
+	MasterAuth            string `conf:"masterauth"`               // 主节点密码
+	ReplicaReadOnly       bool   `conf:"replica-read-only"`        // 从节点只读
+	ReplicaPriority       int    `conf:"replica-priority"`         // 故障转移时的优先级（越小越优先，0表示不会被提升为主节点）
+	ReplTimeout           int    `conf:"repl-timeout"`             // 复制超时时间（秒）
+	ReplPingReplicaPeriod int    `conf:"repl-ping-replica-period"` // 主节点向从节点发送PING的间隔（秒）
+	ReplBacklogSize       string `conf:"repl-backlog-size"`        // 复制积压缓冲区大小，例如：1mb
+
+	// 哨兵
+	SentinelMonitor               string   `conf:"sentinel-monitor"`                 // 监控的主节点，例如：mymaster 127.0.0.1 6379 2（名称 地址 端口 quorum）
+	SentinelDownAfterMilliseconds int      `conf:"sentinel-down-after-milliseconds"` // 超过该时间没有正常回复，认为主观下线（毫秒）
+	SentinelFailoverTimeout       int      `conf:"sentinel-failover-timeout"`        // 故障转移超时时间（毫秒）
+	SentinelAuthPass              string   `conf:"sentinel-auth-pass"`               // 主从节点的密码
+	SentinelPeers                 []string `conf:"sentinel-peers"`                   // 其他哨兵的地址，例如：127.0.0.1:26380,127.0.0.1:26381
+
 	// 集群
-	Peers []string `conf:"peers"`
-	Self  string   `conf:"self"`
+	Peers           []string `conf:"peers"`
+	Self            string   `conf:"self"`
+	ClusterMode     string   `conf:"cluster-mode"`     // key的分配方式：consistent-hash（一致性hash） or slot（哈希槽，兼容Redis Cluster客户端）
+	ClusterRedirect bool     `conf:"cluster-redirect"` // 哈希槽模式下，key不属于当前节点时回复 -MOVED/-ASK（由客户端重定向），而不是转发
+
+	ClusterConfigFile  string `conf:"cluster-config-file"`  // 哈希槽模式下，保存集群节点、槽分配、纪元的文件（在 Dir 目录下），为空表示不保存
+	ClusterNodeTimeout int    `conf:"cluster-node-timeout"` // 超过该时间没有收到节点的PONG，认为疑似下线（毫秒）
+	ClusterTxLogFile   string `conf:"cluster-tx-log-file"`  // 分布式事务日志（在 Dir 目录下），为空表示不记录
+
+	ClusterPeerConns    int `conf:"cluster-peer-conns"`    // 与每个节点建立的连接数量（多个请求并发地在同一个连接上发送）
+	ClusterRelayTimeout int `conf:"cluster-relay-timeout"` // 转发到其他节点的请求等待结果的超时时间（毫秒）
+
+	ClusterHashFunc     string   `conf:"cluster-hash-func"`     // 一致性hash模式下的hash函数：crc32 fnv murmur3 xxhash（所有节点必须相同）
+	ClusterHashStrategy string   `conf:"cluster-hash-strategy"` // 一致性hash模式下的分配方式：ring（哈希环） or jump（Jump Consistent Hash）
+	ClusterPeerWeights  []string `conf:"cluster-peer-weights"`  // 节点的权重，例如：127.0.0.1:6379=2,127.0.0.1:6380=1（默认为1）
+
+	ClusterSecret   string `conf:"cluster-secret"`    // 节点之间相互认证的密钥（所有节点必须相同，没有配置时使用 requirepass）
+	ClusterSingleDB bool   `conf:"cluster-single-db"` // 集群模式下只允许使用0号数据库（和Redis Cluster相同），否则转发的命令携带客户端选择的数据库
 }
 
 // 全局配置
 var GlobalConfig *RedisConfig
 
 func init() {
-	GlobalConfig = &RedisConfig{
+	GlobalConfig = defaultConfig()
+	GlobalConfig.Dir = "."
+	GlobalConfig.RunID = utils.RandString(runidMaxLen)
+}
+
+// 默认配置（配置文件中没有配置的项，使用默认值）
+func defaultConfig() *RedisConfig {
+	return &RedisConfig{
 		Bind:       "127.0.0.1",
 		Port:       6379,
 		AppendOnly: false,
-		Dir:        ".",
-		RunID:      utils.RandString(runidMaxLen),
 		Databases:  defaultDatabasesNum,
+
+		AppendFilename: defaultAppendFilename,
+		AppendDirName:  defaultAppendDirName,
+
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    "64mb",
+		AofLoadTruncated:         true,
+
+		ReplicaReadOnly:       true,
+		ReplicaPriority:       100,
+		ReplTimeout:           60,
+		ReplPingReplicaPeriod: 10,
+		ReplBacklogSize:       "1mb",
+
+		SentinelDownAfterMilliseconds: 30000,
+		SentinelFailoverTimeout:       180000,
+
+		ClusterMode:        "consistent-hash",
+		ClusterConfigFile:  "nodes.conf",
+		ClusterNodeTimeout: 15000,
+		ClusterTxLogFile:   "cluster-tx.log",
+
+		ClusterPeerConns:    4,
+		ClusterRelayTimeout: 3000,
+
+		ClusterHashFunc:     "crc32",
+		ClusterHashStrategy: "ring",
 	}
 }
 
@@ -77,13 +154,21 @@ func LoadConfig(configFile string) error {
 		GlobalConfig.Databases = defaultDatabasesNum
 	}
 
+	if GlobalConfig.AppendFilename == "" {
+		GlobalConfig.AppendFilename = defaultAppendFilename
+	}
+
+	if GlobalConfig.AppendDirName == "" {
+		GlobalConfig.AppendDirName = defaultAppendDirName
+	}
+
 	utils.MakeDir(GlobalConfig.Dir)
 	return nil
 }
 
 func parse(r io.Reader) *RedisConfig {
 
-	newRedisConfig := &RedisConfig{}
+	newRedisConfig := defaultConfig()
 
 	//1.按行扫描文件
 	lineMap := make(map[string]string)
@@ -161,3 +246,29 @@ func TmpDir() string {
 	utils.MakeDir(dir)
 	return dir
 }
+
+// 解析内存大小，例如：1k => 1000 1kb => 1024 1m => 1000000 1mb => 1024*1024
+func ParseSize(size string) (int64, error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	mul := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSuffix(size, unit.suffix)
+			mul = unit.mul
+			break
+		}
+	}
+	num, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return num * mul, nil
+}
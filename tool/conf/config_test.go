@@ -25,4 +25,25 @@ func TestLoad(t *testing.T) {
 
 }
 
-
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"1024": 1024,
+		"1k":   1000,
+		"1kb":  1024,
+		"64mb": 64 * 1024 * 1024,
+		"1GB":  1024 * 1024 * 1024,
+	}
+	for input, expected := range cases {
+		size, err := ParseSize(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != expected {
+			t.Fatalf("ParseSize(%s) = %d, expected %d", input, size, expected)
+		}
+	}
+
+	if _, err := ParseSize("1xb"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -9,11 +9,22 @@ import (
 
 type HashFunc func(data []byte) uint32
 
+/*
+两种分配方式：
+
+1. 哈希环（默认）：每个节点生成 replicas * weight 个虚拟节点，key属于顺时针方向第一个虚拟节点
+2. Jump Consistent Hash：节点按地址排序，每个节点占 weight 个桶，不需要虚拟节点；
+   增删排在最后的节点时只迁移 1/n 的key，增删中间的节点时迁移的key更多
+*/
+
 type Map struct {
 	hashFunc  HashFunc       // 计算hash函数
-	replicas  int            // 每个节点的虚拟节点数量
+	replicas  int            // 每个节点（权重为1）的虚拟节点数量
+	jump      bool           // 使用 Jump Consistent Hash
+	weights   map[string]int // 真实节点 -> 权重
 	hashValue []int          // hash值
 	hashMap   map[int]string // hash值映射的真实节点
+	buckets   []string       // Jump Consistent Hash 的桶
 }
 
 /*
@@ -24,6 +35,7 @@ func New(replicas int, fn HashFunc) *Map {
 	m := &Map{
 		replicas: replicas,
 		hashFunc: fn,
+		weights:  make(map[string]int),
 		hashMap:  make(map[int]string),
 	}
 	if m.hashFunc == nil {
@@ -32,26 +44,151 @@ func New(replicas int, fn HashFunc) *Map {
 	return m
 }
 
+// 使用 Jump Consistent Hash 分配key
+func NewJump(fn HashFunc) *Map {
+	m := New(0, fn)
+	m.jump = true
+	return m
+}
+
 func (m *Map) IsEmpty() bool {
+	if m.jump {
+		return len(m.buckets) == 0
+	}
 	return len(m.hashValue) == 0
 }
 
-// 添加 节点
+// 添加 节点（权重为1）
 func (m *Map) Add(ipAddrs ...string) {
 	for _, ipAddr := range ipAddrs {
-		if ipAddr == "" {
+		m.AddWithWeight(ipAddr, 1)
+	}
+}
+
+// 添加 节点，权重越大分配的key越多（已经存在的节点更新权重）
+func (m *Map) AddWithWeight(ipAddr string, weight int) {
+	if ipAddr == "" {
+		return
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	if _, ok := m.weights[ipAddr]; ok {
+		m.Remove(ipAddr)
+	}
+	m.weights[ipAddr] = weight
+	if m.jump {
+		m.rebuildBuckets()
+		return
+	}
+	// 每个ipAddr 生成 m.replicas * weight 个哈希值副本
+	for i := 0; i < m.replicas*weight; i++ {
+		hash := int(m.hashFunc([]byte(strconv.Itoa(i) + ipAddr)))
+		// 记录hash值
+		m.hashValue = append(m.hashValue, hash)
+		// 映射hash为同一个ipAddr
+		m.hashMap[hash] = ipAddr
+	}
+	sort.Ints(m.hashValue)
+}
+
+// 节点按地址排序，每个节点占 weight 个桶
+func (m *Map) rebuildBuckets() {
+	m.buckets = m.buckets[:0]
+	for _, ipAddr := range m.Nodes() {
+		for i := 0; i < m.weights[ipAddr]; i++ {
+			m.buckets = append(m.buckets, ipAddr)
+		}
+	}
+}
+
+// 删除 节点
+func (m *Map) Remove(ipAddrs ...string) {
+	removed := make(map[string]struct{}, len(ipAddrs))
+	for _, ipAddr := range ipAddrs {
+		removed[ipAddr] = struct{}{}
+		delete(m.weights, ipAddr)
+	}
+	if m.jump {
+		m.rebuildBuckets()
+		return
+	}
+	hashValue := m.hashValue[:0]
+	for _, hash := range m.hashValue {
+		if _, ok := removed[m.hashMap[hash]]; ok {
+			delete(m.hashMap, hash)
 			continue
 		}
-		// 每个ipAddr 生成 m.replicas个哈希值副本
-		for i := 0; i < m.replicas; i++ {
-			hash := int(m.hashFunc([]byte(strconv.Itoa(i) + ipAddr)))
-			// 记录hash值
-			m.hashValue = append(m.hashValue, hash)
-			// 映射hash为同一个ipAddr
-			m.hashMap[hash] = ipAddr
+		hashValue = append(hashValue, hash)
+	}
+	m.hashValue = hashValue
+}
+
+// 复制（节点变更时，在副本上修改，不影响正在使用的Map）
+func (m *Map) Clone() *Map {
+	c := &Map{
+		replicas:  m.replicas,
+		hashFunc:  m.hashFunc,
+		jump:      m.jump,
+		weights:   make(map[string]int, len(m.weights)),
+		hashValue: make([]int, len(m.hashValue)),
+		hashMap:   make(map[int]string, len(m.hashMap)),
+		buckets:   make([]string, len(m.buckets)),
+	}
+	for ipAddr, weight := range m.weights {
+		c.weights[ipAddr] = weight
+	}
+	copy(c.hashValue, m.hashValue)
+	for hash, ipAddr := range m.hashMap {
+		c.hashMap[hash] = ipAddr
+	}
+	copy(c.buckets, m.buckets)
+	return c
+}
+
+// 所有的真实节点（按地址排序）
+func (m *Map) Nodes() []string {
+	nodes := make([]string, 0, len(m.weights))
+	for ipAddr := range m.weights {
+		nodes = append(nodes, ipAddr)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// 节点的权重（节点不存在时返回0）
+func (m *Map) Weight(ipAddr string) int {
+	return m.weights[ipAddr]
+}
+
+// 节点的虚拟节点数量（Jump Consistent Hash 为桶的数量）
+func (m *Map) VirtualNodes(ipAddr string) int {
+	if m.jump {
+		return m.weights[ipAddr]
+	}
+	return m.replicas * m.weights[ipAddr]
+}
+
+// 每个节点预期分配到的key的比例（哈希环：节点的虚拟节点负责的hash区间长度之和 / hash空间）
+func (m *Map) Distribution() map[string]float64 {
+	shares := make(map[string]float64, len(m.weights))
+	if m.jump {
+		for ipAddr := range m.weights {
+			shares[ipAddr] = float64(m.weights[ipAddr]) / float64(len(m.buckets))
 		}
+		return shares
 	}
-	sort.Ints(m.hashValue)
+	if len(m.hashValue) == 0 {
+		return shares
+	}
+	const space = float64(1 << 32)
+	// hash值 (前一个hash值, hash] 属于该虚拟节点，第一个虚拟节点还负责最后一个hash值之后的区间
+	prev := float64(m.hashValue[len(m.hashValue)-1]) - space
+	for _, hash := range m.hashValue {
+		shares[m.hashMap[hash]] += (float64(hash) - prev) / space
+		prev = float64(hash)
+	}
+	return shares
 }
 
 // support hash tag  example :{key}
@@ -74,6 +211,9 @@ func (m *Map) Get(key string) string {
 	}
 
 	partitionKey := getPartitionKey(key)
+	if m.jump {
+		return m.buckets[jumpHash(uint64(m.hashFunc([]byte(partitionKey))), len(m.buckets))]
+	}
 	hash := int(m.hashFunc([]byte(partitionKey)))
 
 	// 查找 m.keys中第一个大于or等于hash值的元素索引
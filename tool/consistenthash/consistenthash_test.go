@@ -1,6 +1,8 @@
 package consistenthash
 
 import (
+	"math"
+	"strconv"
 	"testing"
 
 	"github.com/gofish2020/easyredis/utils"
@@ -24,3 +26,91 @@ func TestConsistentHash(t *testing.T) {
 	}
 
 }
+
+func TestRemove(t *testing.T) {
+	hashMap := New(100, nil)
+	hashMap.Add("127.0.0.1:7379", "127.0.0.1:8379", "127.0.0.1:6379")
+
+	removed := hashMap.Clone()
+	removed.Remove("127.0.0.1:8379")
+	if nodes := removed.Nodes(); len(nodes) != 2 || nodes[0] != "127.0.0.1:6379" || nodes[1] != "127.0.0.1:7379" {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+	// 只有被删除节点上的key改变节点
+	for i := 0; i < 1000; i++ {
+		key := utils.RandString(10)
+		before, after := hashMap.Get(key), removed.Get(key)
+		if after == "127.0.0.1:8379" || (before != "127.0.0.1:8379" && before != after) {
+			t.Fatalf("key %s: %s -> %s", key, before, after)
+		}
+	}
+	if len(hashMap.Nodes()) != 3 {
+		t.Fatal("clone should not change the original map")
+	}
+}
+
+func TestHashFunc(t *testing.T) {
+	cases := []struct {
+		fn   HashFunc
+		data string
+		want uint32
+	}{
+		{Murmur3, "", 0},
+		{Murmur3, "hello", 0x248bfa47},
+		{Murmur3, "The quick brown fox jumps over the lazy dog", 0x2e4ff723},
+		{XXHash, "", 0x02cc5d05},
+		{XXHash, "abc", 0x32d153ff},
+		{XXHash, "Nobody inspects the spammish repetition", 0xe2293b2f},
+		{FNV1a, "a", 0xe40c292c},
+	}
+	for i, c := range cases {
+		if got := c.fn([]byte(c.data)); got != c.want {
+			t.Errorf("case %d: %q expect %#x, got %#x", i, c.data, c.want, got)
+		}
+	}
+	for _, name := range HashFuncNames() {
+		if _, ok := HashFuncByName(name); !ok {
+			t.Fatalf("hash func %s not found", name)
+		}
+	}
+}
+
+func TestWeight(t *testing.T) {
+	for _, hashMap := range []*Map{New(100, Murmur3), NewJump(XXHash)} {
+		hashMap.AddWithWeight("127.0.0.1:6379", 1)
+		hashMap.AddWithWeight("127.0.0.1:7379", 3)
+
+		// 预期比例之和为1，权重为3的节点分配到更多的key
+		shares := hashMap.Distribution()
+		if sum := shares["127.0.0.1:6379"] + shares["127.0.0.1:7379"]; math.Abs(sum-1) > 1e-9 {
+			t.Fatalf("shares sum %f", sum)
+		}
+		counts := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			counts[hashMap.Get(strconv.Itoa(i))]++
+		}
+		heavy := float64(counts["127.0.0.1:7379"]) / 10000
+		if heavy < 0.65 || heavy > 0.85 || math.Abs(heavy-shares["127.0.0.1:7379"]) > 0.05 {
+			t.Fatalf("unexpected distribution %v, expect %v", counts, shares)
+		}
+		if hashMap.Weight("127.0.0.1:7379") != 3 {
+			t.Fatalf("unexpected weight %d", hashMap.Weight("127.0.0.1:7379"))
+		}
+	}
+}
+
+func TestJump(t *testing.T) {
+	hashMap := NewJump(nil)
+	hashMap.Add("127.0.0.1:6379", "127.0.0.1:7379")
+	added := hashMap.Clone()
+	added.Add("127.0.0.1:8379")
+
+	// 添加排在最后的节点：只有分配给新节点的key改变节点
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		before, after := hashMap.Get(key), added.Get(key)
+		if before != after && after != "127.0.0.1:8379" {
+			t.Fatalf("key %s: %s -> %s", key, before, after)
+		}
+	}
+}
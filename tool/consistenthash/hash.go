@@ -0,0 +1,144 @@
+package consistenthash
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+)
+
+// 可选的hash函数（集群中所有节点必须使用相同的hash函数）
+var hashFuncs = map[string]HashFunc{
+	"crc32":   crc32.ChecksumIEEE,
+	"fnv":     FNV1a,
+	"murmur3": Murmur3,
+	"xxhash":  XXHash,
+}
+
+// 按名称获取hash函数
+func HashFuncByName(name string) (HashFunc, bool) {
+	fn, ok := hashFuncs[name]
+	return fn, ok
+}
+
+// 所有hash函数的名称
+func HashFuncNames() []string {
+	names := make([]string, 0, len(hashFuncs))
+	for name := range hashFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FNV-1a 32位
+func FNV1a(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
+
+// MurmurHash3 x86 32位（seed = 0）
+func Murmur3(data []byte) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	var h uint32
+	n := len(data)
+	for ; len(data) >= 4; data = data[4:] {
+		k := binary.LittleEndian.Uint32(data)
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch len(data) {
+	case 3:
+		k ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// xxHash 32位（seed = 0）
+func XXHash(data []byte) uint32 {
+	const (
+		p1 uint32 = 2654435761
+		p2 uint32 = 2246822519
+		p3 uint32 = 3266489917
+		p4 uint32 = 668265263
+		p5 uint32 = 374761393
+	)
+	round := func(acc uint32, input uint32) uint32 {
+		acc += input * p2
+		acc = bits.RotateLeft32(acc, 13)
+		return acc * p1
+	}
+
+	n := len(data)
+	var h uint32
+	if n >= 16 {
+		v1, v2, v3, v4 := p1, p2, uint32(0), uint32(0)
+		v1 += p2
+		v4 -= p1
+		for ; len(data) >= 16; data = data[16:] {
+			v1 = round(v1, binary.LittleEndian.Uint32(data[0:]))
+			v2 = round(v2, binary.LittleEndian.Uint32(data[4:]))
+			v3 = round(v3, binary.LittleEndian.Uint32(data[8:]))
+			v4 = round(v4, binary.LittleEndian.Uint32(data[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = p5
+	}
+	h += uint32(n)
+
+	for ; len(data) >= 4; data = data[4:] {
+		h += binary.LittleEndian.Uint32(data) * p3
+		h = bits.RotateLeft32(h, 17) * p4
+	}
+	for _, b := range data {
+		h += uint32(b) * p5
+		h = bits.RotateLeft32(h, 11) * p1
+	}
+
+	h ^= h >> 15
+	h *= p2
+	h ^= h >> 13
+	h *= p3
+	h ^= h >> 16
+	return h
+}
+
+// Jump Consistent Hash（Lamping & Veach）：key映射到 [0, buckets) 中的一个桶
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,59 @@
+package hashslot
+
+/*
+Redis Cluster 的哈希槽：slot = CRC16(key) % 16384
+
+如果key中包含 {hashtag}，只对 {} 中的内容计算（用于把多个key分配到同一个槽）
+*/
+
+// 槽的数量
+const SlotCount = 16384
+
+// CRC16/XMODEM（多项式 0x1021，初始值 0）
+var crc16Table [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func Crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// 提取 {hashtag}：第一个 { 与其后第一个 } 之间的内容不为空时才生效
+func HashTag(key string) string {
+	for beg := 0; beg < len(key); beg++ {
+		if key[beg] != '{' {
+			continue
+		}
+		for end := beg + 1; end < len(key); end++ {
+			if key[end] == '}' {
+				if end == beg+1 {
+					return key
+				}
+				return key[beg+1 : end]
+			}
+		}
+		return key
+	}
+	return key
+}
+
+// key所属的槽
+func Slot(key string) int {
+	return int(Crc16([]byte(HashTag(key)))) & (SlotCount - 1)
+}
@@ -0,0 +1,34 @@
+package hashslot
+
+import "testing"
+
+func TestCrc16(t *testing.T) {
+	if crc := Crc16([]byte("123456789")); crc != 0x31C3 {
+		t.Fatalf("crc16 expect 0x31C3, got %#x", crc)
+	}
+}
+
+func TestSlot(t *testing.T) {
+	cases := map[string]int{
+		"foo":         12182,
+		"bar":         5061,
+		"hello":       866,
+		"{user1000}a": Slot("user1000"),
+		"a{user1000}": Slot("user1000"),
+		"foo{}{bar}":  Slot("foo{}{bar}"),
+		"foo{{bar}}":  Slot("{bar"),
+		"foo{bar}{z}": Slot("bar"),
+	}
+	for key, slot := range cases {
+		if got := Slot(key); got != slot {
+			t.Errorf("slot of %q expect %d, got %d", key, slot, got)
+		}
+	}
+
+	if HashTag("foo{}{bar}") != "foo{}{bar}" {
+		t.Errorf("empty hashtag should use the whole key")
+	}
+	if HashTag("foo{bar") != "foo{bar" {
+		t.Errorf("unclosed hashtag should use the whole key")
+	}
+}
@@ -94,6 +94,14 @@ func (p *Pool) Put(x any) {
 
 }
 
+// 丢弃对象（对象已经不可用，例如连接已关闭），不再放回对象池
+func (p *Pool) Discard(x any) {
+	p.mu.Lock()
+	p.activeCount--
+	p.mu.Unlock()
+	p.freeObject(x)
+}
+
 func (p *Pool) Get() (any, error) {
 	p.mu.Lock()
 	if p.closed {
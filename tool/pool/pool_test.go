@@ -169,3 +169,29 @@ func TestPool_CreateErr(t *testing.T) {
 	}
 
 }
+
+func TestDiscard(t *testing.T) {
+	freed := 0
+	pool := NewPool(func() (interface{}, error) {
+		return &mockConn{open: true}, nil
+	}, func(x interface{}) {
+		freed++
+	}, Config{MaxIdles: 1, MaxActive: 1})
+
+	x, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Discard(x)
+	if freed != 1 {
+		t.Fatalf("discarded object should be freed")
+	}
+	// 丢弃之后可以重新创建
+	y, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y == x {
+		t.Fatalf("discarded object should not be reused")
+	}
+}
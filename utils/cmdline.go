@@ -9,3 +9,12 @@ func BuildCmdLine(commandName string, args ...[]byte) [][]byte {
 	return result
 
 }
+
+func ToCmdLine(commandName string, args ...string) [][]byte {
+	result := make([][]byte, len(args)+1)
+	result[0] = []byte(commandName)
+	for i, s := range args {
+		result[i+1] = []byte(s)
+	}
+	return result
+}